@@ -0,0 +1,82 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package buildinfo reports the version, commit and channel of the extension binary.
+//
+// These values can be injected at link time, e.g.
+//
+//	go build -ldflags "-X elastic/apm-lambda-extension/buildinfo.version=1.1.0 -X elastic/apm-lambda-extension/buildinfo.commit=$(git rev-parse HEAD) -X elastic/apm-lambda-extension/buildinfo.channel=release"
+//
+// Otherwise, the version and commit are read from the build information embedded by the Go toolchain,
+// so that locally built binaries still report accurate values, and locally built binaries belong to the
+// snapshot channel.
+package buildinfo
+
+import (
+	"runtime/debug"
+	"strings"
+)
+
+// defaultVersion is the version of the extension reported when none could be found in the build information.
+const defaultVersion = "1.1.0"
+
+// Build channels, deciding which experimental features are enabled by default.
+const (
+	ReleaseChannel  = "release"
+	SnapshotChannel = "snapshot"
+)
+
+// version, commit and channel are set at link time.
+var (
+	version string
+	commit  string
+	channel string
+)
+
+// Version returns the version of the extension.
+func Version() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v := strings.TrimPrefix(info.Main.Version, "v"); v != "" && v != "(devel)" {
+			return v
+		}
+	}
+	return defaultVersion
+}
+
+// Commit returns the VCS revision the extension was built from, or "unknown".
+func Commit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if revision := vcsRevision(info); revision != "" {
+			return revision
+		}
+	}
+	return "unknown"
+}
+
+// Channel returns the channel the extension was built for, ReleaseChannel or SnapshotChannel.
+func Channel() string {
+	if channel == ReleaseChannel {
+		return ReleaseChannel
+	}
+	return SnapshotChannel
+}
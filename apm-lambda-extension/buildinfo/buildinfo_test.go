@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package buildinfo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersion(t *testing.T) {
+	// Test binaries are not stamped with a module version
+	assert.Equal(t, defaultVersion, Version())
+
+	setLinkerValues(t, "1.2.3", "")
+	assert.Equal(t, "1.2.3", Version())
+}
+
+func TestCommit(t *testing.T) {
+	assert.NotEmpty(t, Commit())
+
+	setLinkerValues(t, "", "0123456789abcdef")
+	assert.Equal(t, "0123456789abcdef", Commit())
+}
+
+func TestChannel(t *testing.T) {
+	assert.Equal(t, SnapshotChannel, Channel())
+
+	originalChannel := channel
+	t.Cleanup(func() { channel = originalChannel })
+	channel = ReleaseChannel
+	assert.Equal(t, ReleaseChannel, Channel())
+	channel = "nightly"
+	assert.Equal(t, SnapshotChannel, Channel())
+}
+
+func setLinkerValues(t *testing.T, v string, c string) {
+	originalVersion, originalCommit := version, commit
+	version, commit = v, c
+	t.Cleanup(func() {
+		version, commit = originalVersion, originalCommit
+	})
+}
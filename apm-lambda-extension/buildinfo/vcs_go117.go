@@ -15,8 +15,14 @@
 // specific language governing permissions and limitations
 // under the License.
 
-package extension
+//go:build !go1.18
+// +build !go1.18
 
-const (
-	Version = "1.1.0"
-)
+package buildinfo
+
+import "runtime/debug"
+
+// vcsRevision always returns an empty string, as VCS stamping requires Go 1.18.
+func vcsRevision(_ *debug.BuildInfo) string {
+	return ""
+}
@@ -0,0 +1,151 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package datagen produces intake v2 ndjson payloads of a configurable
+// shape, for use in benchmarks and load tests.
+package datagen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Config describes the shape of a generated batch.
+type Config struct {
+	// Transactions is the number of transactions in the batch.
+	Transactions int
+	// SpansPerTransaction is the number of spans attached to each transaction.
+	SpansPerTransaction int
+	// LabelCardinality is the number of distinct values used for the
+	// labels attached to each event. Zero disables labels.
+	LabelCardinality int
+	// PaddingBytes is the size of an opaque string added to each event
+	// context, used to inflate the payload towards a target size.
+	PaddingBytes int
+	// Seed initializes the random source, so that batches are reproducible.
+	Seed int64
+}
+
+// DefaultConfig returns a batch shape roughly equivalent to a small
+// function invocation traced by an APM agent.
+func DefaultConfig() Config {
+	return Config{
+		Transactions:        5,
+		SpansPerTransaction: 3,
+		LabelCardinality:    10,
+		Seed:                1,
+	}
+}
+
+// Metadata returns the metadata line used as the first line of every batch.
+func Metadata() []byte {
+	return []byte(`{"metadata":{"service":{"name":"datagen-service","version":"1.0.0","environment":"test","agent":{"name":"elastic-node","version":"3.36.0"},"language":{"name":"javascript","version":"16"},"runtime":{"name":"node","version":"16.15.0"},"framework":{"name":"AWS Lambda","version":""},"node":{"configured_name":"datagen-node"}},"process":{"pid":1,"title":"node","argv":["node","index.js"]},"system":{"architecture":"x64","hostname":"169.254.1.1","platform":"linux"},"cloud":{"provider":"aws","region":"us-east-1","service":{"name":"lambda"},"account":{"id":"123456789012"}}}}`)
+}
+
+// Batch generates an ndjson batch made of a metadata line followed by
+// transactions and their spans, as sent by an agent to the intake v2 endpoint.
+func Batch(cfg Config) []byte {
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	padding := strings.Repeat("x", cfg.PaddingBytes)
+
+	var buf bytes.Buffer
+	buf.Write(Metadata())
+	buf.WriteByte('\n')
+
+	timestamp := int64(1656000000000000)
+	for i := 0; i < cfg.Transactions; i++ {
+		traceID := randomHex(rng, 16)
+		transactionID := randomHex(rng, 8)
+		duration := 10 + rng.Float64()*990
+
+		transaction := map[string]interface{}{
+			"id":         transactionID,
+			"trace_id":   traceID,
+			"name":       fmt.Sprintf("GET /api/items/%d", i),
+			"type":       "request",
+			"duration":   duration,
+			"timestamp":  timestamp,
+			"outcome":    "success",
+			"result":     "HTTP 2xx",
+			"sampled":    true,
+			"span_count": map[string]int{"started": cfg.SpansPerTransaction},
+			"faas": map[string]interface{}{
+				"coldstart": i == 0,
+				"execution": randomHex(rng, 16),
+				"trigger":   map[string]string{"type": "http"},
+			},
+			"context": eventContext(rng, cfg, padding),
+		}
+		writeEvent(&buf, "transaction", transaction)
+
+		for j := 0; j < cfg.SpansPerTransaction; j++ {
+			span := map[string]interface{}{
+				"id":             randomHex(rng, 8),
+				"transaction_id": transactionID,
+				"trace_id":       traceID,
+				"parent_id":      transactionID,
+				"name":           fmt.Sprintf("SELECT FROM items_%d", j),
+				"type":           "db",
+				"subtype":        "postgresql",
+				"action":         "query",
+				"duration":       rng.Float64() * duration / float64(cfg.SpansPerTransaction),
+				"timestamp":      timestamp + int64(j)*1000,
+				"outcome":        "success",
+				"context":        eventContext(rng, cfg, padding),
+			}
+			writeEvent(&buf, "span", span)
+		}
+		timestamp += int64(duration * 1000)
+	}
+	return buf.Bytes()
+}
+
+// Size returns the number of events (metadata excluded) of a batch
+// generated from cfg.
+func (cfg Config) Size() int {
+	return cfg.Transactions * (1 + cfg.SpansPerTransaction)
+}
+
+func eventContext(rng *rand.Rand, cfg Config, padding string) map[string]interface{} {
+	context := map[string]interface{}{}
+	if cfg.LabelCardinality > 0 {
+		context["tags"] = map[string]string{
+			"tenant": fmt.Sprintf("tenant-%d", rng.Intn(cfg.LabelCardinality)),
+			"region": fmt.Sprintf("region-%d", rng.Intn(cfg.LabelCardinality)),
+		}
+	}
+	if padding != "" {
+		context["custom"] = map[string]string{"padding": padding}
+	}
+	return context
+}
+
+func writeEvent(buf *bytes.Buffer, eventType string, event map[string]interface{}) {
+	// Marshalling a map of plain values cannot fail.
+	data, _ := json.Marshal(map[string]interface{}{eventType: event})
+	buf.Write(data)
+	buf.WriteByte('\n')
+}
+
+func randomHex(rng *rand.Rand, n int) string {
+	b := make([]byte, n)
+	rng.Read(b)
+	return fmt.Sprintf("%x", b)
+}
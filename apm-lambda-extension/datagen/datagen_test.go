@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package datagen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchShape(t *testing.T) {
+	cfg := Config{Transactions: 4, SpansPerTransaction: 2, LabelCardinality: 3, Seed: 42}
+	batch := Batch(cfg)
+
+	var counts = map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(batch))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		require.Len(t, event, 1)
+		for eventType := range event {
+			counts[eventType]++
+		}
+	}
+	require.NoError(t, scanner.Err())
+
+	assert.Equal(t, map[string]int{"metadata": 1, "transaction": 4, "span": 8}, counts)
+	assert.Equal(t, 12, cfg.Size())
+	assert.True(t, bytes.HasPrefix(batch, Metadata()))
+}
+
+func TestBatchDeterministic(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, Batch(cfg), Batch(cfg))
+
+	cfg2 := cfg
+	cfg2.Seed++
+	assert.NotEqual(t, Batch(cfg), Batch(cfg2))
+}
+
+func TestBatchPadding(t *testing.T) {
+	cfg := Config{Transactions: 1, Seed: 1}
+	small := Batch(cfg)
+	cfg.PaddingBytes = 1000
+	large := Batch(cfg)
+	assert.GreaterOrEqual(t, len(large)-len(small), 1000)
+}
@@ -0,0 +1,118 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// adaptiveWeight is the weight of the latest observation in the moving averages of the adaptive send strategy.
+const adaptiveWeight = 0.3
+
+// defaultAdaptiveMaxDelay is the default maximum delay of the agent data deferred by the adaptive send strategy.
+const defaultAdaptiveMaxDelay = time.Minute
+
+// AdaptiveSendStrategy decides, at the end of each invocation, whether the agent data is flushed synchronously
+// or deferred to the next invocation, when ELASTIC_APM_SEND_STRATEGY is set to adaptive.
+//
+// Deferring the agent data adds no billed duration, as it is sent while the next invocation runs, but delays
+// it until the next invocation. The data is therefore deferred when the next invocation is expected within the
+// maximum delay, from the average interval between the invocations, and flushed otherwise. The data is also
+// deferred when a flush is not expected to complete before the deadline of the invocation, from the average
+// latency of the requests to the APM server.
+type AdaptiveSendStrategy struct {
+	maxDelay time.Duration
+	// invocations is the number of invocations observed, and lastInvocation the start of the last one
+	invocations    int
+	lastInvocation time.Time
+	interval       time.Duration
+	// requests and requestLatencyUs are the cumulative request counters at the last decision
+	requests         int64
+	requestLatencyUs int64
+	latency          time.Duration
+	// deferredSince is the end of the first invocation whose data was deferred and is still buffered
+	deferredSince time.Time
+}
+
+// NewAdaptiveSendStrategy returns the adaptive send strategy, which bounds the delay of the deferred agent
+// data to ELASTIC_APM_ADAPTIVE_MAX_DELAY.
+func NewAdaptiveSendStrategy(config *extensionConfig) *AdaptiveSendStrategy {
+	return &AdaptiveSendStrategy{maxDelay: config.adaptiveMaxDelay}
+}
+
+// Decide returns the send strategy applied at the end of the invocation described by event, at now.
+func (strategy *AdaptiveSendStrategy) Decide(transport *ApmServerTransport, event *NextEventResponse, now time.Time) SendStrategy {
+	if event == nil || event.EventType != Invoke {
+		return Background
+	}
+	strategy.observe(transport, event)
+
+	buffered := transport.BufferedDataCount()
+	if buffered == 0 {
+		strategy.deferredSince = time.Time{}
+		return Background
+	}
+	if strategy.deferredSince.IsZero() {
+		strategy.deferredSince = now
+	}
+	expectedInterval := strategy.interval
+	if strategy.invocations < 2 {
+		// Without history, the next invocation may never come
+		expectedInterval = strategy.maxDelay
+	}
+	if expectedInterval < strategy.maxDelay && now.Sub(strategy.deferredSince) < strategy.maxDelay {
+		Log.Debugf("Adaptive send strategy: deferring %d agent data payloads, next invocation expected in %s", buffered, expectedInterval)
+		return Background
+	}
+	flushDuration := strategy.latency * time.Duration(buffered)
+	if remaining := time.UnixMilli(event.DeadlineMs).Sub(now); flushDuration >= remaining {
+		Log.Debugf("Adaptive send strategy: deferring %d agent data payloads, flushing them would take %s out of %s left", buffered, flushDuration, remaining)
+		return Background
+	}
+	Log.Debugf("Adaptive send strategy: flushing %d agent data payloads", buffered)
+	strategy.deferredSince = time.Time{}
+	return SyncFlush
+}
+
+// observe updates the averages of the interval between the invocations and of the latency of the requests to
+// the APM server with the invocation described by event.
+func (strategy *AdaptiveSendStrategy) observe(transport *ApmServerTransport, event *NextEventResponse) {
+	if strategy.invocations > 0 {
+		strategy.interval = movingAverage(strategy.interval, event.Timestamp.Sub(strategy.lastInvocation), strategy.invocations == 1)
+	}
+	strategy.invocations++
+	strategy.lastInvocation = event.Timestamp
+
+	requests := atomic.LoadInt64(&transport.metrics.requests)
+	requestLatencyUs := atomic.LoadInt64(&transport.metrics.requestLatencyUs)
+	if requests > strategy.requests {
+		latency := time.Duration((requestLatencyUs-strategy.requestLatencyUs)/(requests-strategy.requests)) * time.Microsecond
+		strategy.latency = movingAverage(strategy.latency, latency, strategy.requests == 0)
+	}
+	strategy.requests, strategy.requestLatencyUs = requests, requestLatencyUs
+}
+
+// movingAverage returns the exponentially weighted moving average updated with value, which is the first
+// observation if first is set.
+func movingAverage(average, value time.Duration, first bool) time.Duration {
+	if first {
+		return value
+	}
+	return average + time.Duration(adaptiveWeight*float64(value-average))
+}
@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adaptiveInvocation(start time.Time) *NextEventResponse {
+	return &NextEventResponse{EventType: Invoke, Timestamp: start, DeadlineMs: start.Add(3 * time.Second).UnixMilli()}
+}
+
+func TestAdaptiveSendStrategy(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	strategy := NewAdaptiveSendStrategy(&extensionConfig{adaptiveMaxDelay: time.Minute})
+	start := time.Now()
+
+	// Without history, the next invocation may never come
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	assert.Equal(t, SyncFlush, strategy.Decide(transport, adaptiveInvocation(start), start.Add(time.Second)))
+
+	// Frequent invocations
+	start = start.Add(10 * time.Second)
+	assert.Equal(t, Background, strategy.Decide(transport, adaptiveInvocation(start), start.Add(time.Second)))
+	assert.Equal(t, 10*time.Second, strategy.interval)
+
+	// Data deferred for too long is flushed
+	start = start.Add(10 * time.Second)
+	assert.Equal(t, Background, strategy.Decide(transport, adaptiveInvocation(start), start.Add(time.Second)))
+	start = start.Add(time.Minute)
+	assert.Equal(t, SyncFlush, strategy.Decide(transport, adaptiveInvocation(start), start.Add(time.Second)))
+	assert.Equal(t, 10*time.Second+time.Duration(0.3*float64(50*time.Second)), strategy.interval)
+
+	// Nothing to send
+	<-transport.dataChannel
+	start = start.Add(time.Second)
+	assert.Equal(t, Background, strategy.Decide(transport, adaptiveInvocation(start), start.Add(time.Second)))
+	assert.True(t, strategy.deferredSince.IsZero())
+}
+
+func TestAdaptiveSendStrategySlowRequests(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	strategy := NewAdaptiveSendStrategy(&extensionConfig{adaptiveMaxDelay: time.Second})
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	transport.EnqueueAPMData(AgentData{Data: []byte("bar")})
+	transport.metrics.recordRequest(time.Second, 3)
+	start := time.Now()
+
+	// Flushing 2 payloads would take 2s, out of the 2s left
+	assert.Equal(t, Background, strategy.Decide(transport, adaptiveInvocation(start), start.Add(time.Second)))
+	assert.Equal(t, time.Second, strategy.latency)
+
+	transport.metrics.recordRequest(0, 3)
+	start = start.Add(time.Minute)
+	assert.Equal(t, SyncFlush, strategy.Decide(transport, adaptiveInvocation(start), start.Add(time.Second)))
+	assert.Equal(t, 700*time.Millisecond, strategy.latency)
+}
+
+func TestAdaptiveSendStrategyShutdown(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	strategy := NewAdaptiveSendStrategy(&extensionConfig{adaptiveMaxDelay: time.Minute})
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	assert.Equal(t, Background, strategy.Decide(transport, nil, time.Now()))
+	assert.Equal(t, Background, strategy.Decide(transport, &NextEventResponse{EventType: Shutdown}, time.Now()))
+}
+
+func TestProcessEnvAdaptiveSendStrategy(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("ELASTIC_APM_SEND_STRATEGY", "Adaptive")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, Adaptive, config.SendStrategy)
+	assert.Equal(t, time.Minute, config.adaptiveMaxDelay)
+
+	t.Setenv("ELASTIC_APM_ADAPTIVE_MAX_DELAY", "30s")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 30*time.Second, config.adaptiveMaxDelay)
+
+	t.Setenv("ELASTIC_APM_ADAPTIVE_MAX_DELAY", "-1s")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, time.Minute, config.adaptiveMaxDelay)
+}
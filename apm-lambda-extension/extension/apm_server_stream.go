@@ -0,0 +1,204 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// shouldStream reports whether agent data should be streamed to the APM server rather than buffered.
+//
+// Agent data is buffered, even in stream mode:
+//   - until the metadata of the execution environment is extracted from a payload, as it is needed to
+//     report the platform metrics;
+//   - while the APM server is unreachable or throttles the extension, so that it can be sent, or persisted,
+//     once the grace period is over;
+//   - when the agent data must be read in full before it is sent: to validate it before the agent is
+//     answered, to sanitize, rate limit, truncate or strip its events, to hold it for tail sampling or an
+//     atomic flush, to add metadata labels, or to write it to a Kinesis or Firehose stream.
+func (transport *ApmServerTransport) shouldStream() bool {
+	return transport.config.dataForwarderMode == StreamMode &&
+		!transport.config.validateIntake &&
+		transport.sanitizer == nil &&
+		transport.tailSampler == nil &&
+		transport.rateLimiter == nil &&
+		transport.recordOutput == nil &&
+		transport.truncator == nil &&
+		transport.atomicFlush == nil &&
+		!transport.legacyCompat.active() &&
+		!transport.enrichment.hasLabels() &&
+		!transport.backingOff() &&
+		atomic.LoadInt32(&transport.metadataExtracted) == 1
+}
+
+// StreamToApmServer forwards the agent data read from body to the APM server as it is received, instead
+// of reading the whole payload in memory first, on behalf of the agent identified by agentUserAgent.
+// Uncompressed data is compressed on the fly.
+//
+// Streamed data cannot be replayed: it is lost, and counted as a delivery failure, if the request fails.
+// If the APM server rejected events, and ELASTIC_APM_LAMBDA_RELAY_INTAKE_ERRORS is set, an
+// *intakeRejectedError holding its response is returned.
+func (transport *ApmServerTransport) StreamToApmServer(ctx context.Context, body io.Reader, contentEncoding string, agentUserAgent string) error {
+	err := transport.streamToApmServer(ctx, body, contentEncoding, agentUserAgent)
+	if err != nil {
+		transport.debug.recordError(err)
+	}
+	return err
+}
+
+func (transport *ApmServerTransport) streamToApmServer(ctx context.Context, body io.Reader, contentEncoding string, agentUserAgent string) error {
+	if transport.currentStatus() == Failing {
+		atomic.AddInt64(&transport.deliveryFailures, 1)
+		return errors.New("transport status is unhealthy")
+	}
+
+	// Filtered agent data is decompressed to be filtered, and compressed again like uncompressed agent data
+	encoding := contentEncoding
+	if encoding == "" || transport.filter != nil {
+		encoding = transport.compression.contentEncoding(math.MaxInt32)
+	}
+
+	if err := transport.requests.acquire(ctx); err != nil {
+		atomic.AddInt64(&transport.deliveryFailures, 1)
+		return fmt.Errorf("failed to stream to APM server: %v", err)
+	}
+	defer transport.requests.release()
+
+	pr, pw := io.Pipe()
+	copyDone := make(chan error, 1)
+	go func() {
+		err := copyAgentData(pw, body, contentEncoding, transport.compression, transport.filter)
+		pw.CloseWithError(err)
+		copyDone <- err
+	}()
+
+	transport.endpoints.probePrimary(transport.client)
+	endpoint := transport.endpoints.active()
+	req, err := http.NewRequest("POST", endpoint.url+"intake/v2/events", pr)
+	var resp *http.Response
+	var respBody []byte
+	if err == nil {
+		if encoding != "" {
+			req.Header.Add("Content-Encoding", encoding)
+		}
+		req.Header.Add("Content-Type", "application/x-ndjson")
+		req.Header.Set("User-Agent", forwardedUserAgent(agentUserAgent))
+		endpoint.credentials.setAuthorization(req)
+		Log.Debug("Streaming agent data to APM server")
+		resp, err = transport.client.Do(req)
+		if err == nil {
+			defer resp.Body.Close()
+			respBody, err = transport.readStreamResponse(resp, endpoint)
+		}
+	}
+	// Unblock the copy if the request ended before the whole body was sent, and wait for it to return,
+	// as the agent request body must not be read once its handler has returned.
+	pr.Close()
+	copyErr := <-copyDone
+
+	if copyErr != nil && !errors.Is(copyErr, io.ErrClosedPipe) {
+		atomic.AddInt64(&transport.deliveryFailures, 1)
+		return fmt.Errorf("failed to read the agent data to stream: %v", copyErr)
+	}
+	if err != nil {
+		atomic.AddInt64(&transport.deliveryFailures, 1)
+		// The streamed data cannot be sent again, but the next data is sent to the fallback APM server,
+		// if any, rather than after a grace period
+		if !transport.endpoints.failOver() {
+			transport.SetApmServerTransportState(ctx, Failing)
+		}
+		return fmt.Errorf("failed to stream to APM server: %v", err)
+	}
+	return transport.handleStreamResponse(ctx, resp, respBody)
+}
+
+// readStreamResponse reads the response of the APM server to streamed agent data.
+func (transport *ApmServerTransport) readStreamResponse(resp *http.Response, endpoint *apmServerEndpoint) ([]byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response body after streaming to the APM server")
+	}
+	if resp.StatusCode == http.StatusUnauthorized && endpoint.credentials.refresh() {
+		// The streamed data cannot be sent again, but the next requests use the refreshed credentials
+		Log.Warn("APM server rejected the credentials of streamed agent data, credentials refreshed")
+	}
+	Log.Debugf("APM server response body: %v", string(body))
+	Log.Debugf("APM server response status code: %v", resp.StatusCode)
+	return body, nil
+}
+
+// handleStreamResponse handles the response of the APM server to streamed agent data like postToApmServer
+// does, except that the streamed data cannot be sent again: the extension backs off when the APM server
+// throttles it or fails, and the agent data refused with a client error is counted as quarantined. When the
+// APM server rejected events, and ELASTIC_APM_LAMBDA_RELAY_INTAKE_ERRORS is set, an *intakeRejectedError
+// holding its response, and wrapping the error if any, is returned to be relayed to the agent.
+func (transport *ApmServerTransport) handleStreamResponse(ctx context.Context, resp *http.Response, respBody []byte) error {
+	var rejected *intakeRejectedError
+	if transport.config.relayIntakeErrors && resp.StatusCode >= http.StatusBadRequest {
+		rejected = &intakeRejectedError{statusCode: resp.StatusCode, body: respBody}
+	}
+	if retryAfter, ok := throttledResponse(resp, transport.clock.Now()); ok {
+		transport.throttle(ctx, retryAfter)
+		var response intakeResponse
+		if json.Unmarshal(respBody, &response) != nil || response.Accepted == 0 {
+			atomic.AddInt64(&transport.deliveryFailures, 1)
+		}
+		return rejected.wrap(fmt.Errorf("%w for %s", errThrottled, retryAfter))
+	}
+	if isServerError(resp.StatusCode, respBody) {
+		atomic.AddInt64(&transport.deliveryFailures, 1)
+		if !transport.endpoints.failOver() {
+			transport.SetApmServerTransportState(ctx, Failing)
+		}
+		return rejected.wrap(fmt.Errorf("failed to stream to APM server: status %d: %s", resp.StatusCode, truncateForLog(respBody)))
+	}
+	transport.SetApmServerTransportState(ctx, Healthy)
+	Log.Debug("Transport status set to healthy")
+	if isClientError(resp.StatusCode, respBody) {
+		return rejected.wrap(transport.quarantine(resp.StatusCode, respBody, AgentData{}))
+	}
+	if rejected != nil {
+		return rejected
+	}
+	return nil
+}
+
+// copyAgentData copies the agent data from body to w, compressing it if it is not already compressed.
+// When filter is set, the agent data is decompressed, filtered and compressed again.
+func copyAgentData(w io.Writer, body io.Reader, contentEncoding string, compression compressionConfig, filter *eventFilter) error {
+	if filter != nil {
+		reader, err := uncompressedReader(body, contentEncoding)
+		if err != nil {
+			return err
+		}
+		return compression.compressStream(w, filter.reader(reader))
+	}
+	if contentEncoding != "" {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	return compression.compressStream(w, body)
+}
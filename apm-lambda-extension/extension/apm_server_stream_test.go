@@ -0,0 +1,284 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamToApmServerNotCompressed(t *testing.T) {
+	s := "A long time ago in a galaxy far, far away..."
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(gr)
+		require.NoError(t, err)
+		assert.Equal(t, s, string(data))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	require.NoError(t, transport.StreamToApmServer(context.Background(), strings.NewReader(s), "", ""))
+	assert.Equal(t, Healthy, transport.currentStatus())
+}
+
+func TestStreamToApmServerCompressed(t *testing.T) {
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, err := gw.Write([]byte("A long time ago in a galaxy far, far away..."))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		data, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, compressed.Bytes(), data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	require.NoError(t, transport.StreamToApmServer(context.Background(), bytes.NewReader(compressed.Bytes()), "gzip", ""))
+}
+
+// TestStreamToApmServerForwardsWhileReceiving checks that the APM server receives the agent data before
+// the agent finished sending it.
+func TestStreamToApmServerForwardsWhileReceiving(t *testing.T) {
+	firstChunk := make(chan string, 1)
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, len("first\n"))
+		if _, err := io.ReadFull(r.Body, buf); err == nil {
+			firstChunk <- string(buf)
+		}
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	agentBody, agentWriter := io.Pipe()
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	streamed := make(chan error, 1)
+	go func() {
+		streamed <- transport.StreamToApmServer(context.Background(), agentBody, "identity", "")
+	}()
+
+	_, err := agentWriter.Write([]byte("first\n"))
+	require.NoError(t, err)
+	select {
+	case chunk := <-firstChunk:
+		assert.Equal(t, "first\n", chunk)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The APM server did not receive the data sent so far")
+	}
+	_, err = agentWriter.Write([]byte("second\n"))
+	require.NoError(t, err)
+	require.NoError(t, agentWriter.Close())
+	require.NoError(t, <-streamed)
+}
+
+func TestStreamToApmServerDown(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	// Ensure that the grace period is not 0, to avoid a race between reaching the pending status and the assertion
+	transport.reconnectionCount = 0
+	assert.Error(t, transport.StreamToApmServer(context.Background(), strings.NewReader("data"), "", ""))
+	assert.Equal(t, Failing, transport.currentStatus())
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+}
+
+func TestStreamToApmServerServerError(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	transport.reconnectionCount = 0
+	err := transport.StreamToApmServer(context.Background(), strings.NewReader("data"), "", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 503")
+	assert.Equal(t, Failing, transport.currentStatus())
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+}
+
+func TestStreamToApmServerThrottled(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer apmServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	transport.clock = newManualClock()
+	err := transport.StreamToApmServer(ctx, strings.NewReader("data"), "", "")
+	assert.ErrorIs(t, err, errThrottled)
+	assert.Equal(t, Throttled, transport.currentStatus())
+	assert.False(t, transport.shouldStream())
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+}
+
+func TestStreamToApmServerClientError(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":"forbidden request: endpoint is disabled"}`))
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	err := transport.StreamToApmServer(context.Background(), strings.NewReader("data"), "", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 403")
+	// The APM server is reachable
+	assert.Equal(t, Healthy, transport.currentStatus())
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+	assert.Equal(t, int64(1), transport.metrics.clientErrors)
+}
+
+func TestHandleIntakeV2EventsStreamMode(t *testing.T) {
+	var received int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:      apmServer.URL + "/",
+		dataForwarderMode: StreamMode,
+	})
+	handler := handleIntakeV2Events(context.Background(), transport)
+	body := `{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"transaction":{"id":"0102030405060708"}}` + "\n"
+
+	// The payloads are buffered until the metadata is extracted
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(body)))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, 1, transport.BufferedDataCount())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&received))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	forwarded := make(chan error, 1)
+	metadataContainer := MetadataContainer{}
+	go func() {
+		forwarded <- transport.ForwardApmData(ctx, &metadataContainer)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&received) == 1 }, 5*time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, <-forwarded)
+	assert.True(t, metadataContainer.Known())
+
+	// The next payloads are streamed
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(body)))
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&received))
+}
+
+func TestHandleIntakeV2EventsRelayIntakeErrors(t *testing.T) {
+	rejection := `{"accepted":1,"errors":[{"message":"failed to validate transaction: missing required property 'trace_id'","document":"{\"transaction\":{}}"}]}`
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(rejection))
+	}))
+	defer apmServer.Close()
+
+	body := `{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"transaction":{}}` + "\n"
+	for _, relay := range []bool{false, true} {
+		transport := InitApmServerTransport(&extensionConfig{
+			apmServerUrl:      apmServer.URL + "/",
+			dataForwarderMode: StreamMode,
+			relayIntakeErrors: relay,
+		})
+		transport.metadataExtracted = 1
+		handler := handleIntakeV2Events(context.Background(), transport)
+
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(body)))
+		if relay {
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+			assert.Equal(t, rejection, recorder.Body.String())
+		} else {
+			assert.Equal(t, http.StatusAccepted, recorder.Code)
+		}
+		// The APM server is reachable, even if it rejected events
+		assert.Equal(t, Healthy, transport.currentStatus())
+	}
+}
+
+func TestHandleIntakeV2EventsRelayThrottling(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error":"queue is full"}`))
+	}))
+	defer apmServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:      apmServer.URL + "/",
+		dataForwarderMode: StreamMode,
+		relayIntakeErrors: true,
+	})
+	transport.clock = newManualClock()
+	transport.metadataExtracted = 1
+	handler := handleIntakeV2Events(ctx, transport)
+
+	recorder := httptest.NewRecorder()
+	body := `{"metadata":{"service":{"name":"foo"}}}` + "\n"
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(body)))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, `{"error":"queue is full"}`, recorder.Body.String())
+	assert.Equal(t, Throttled, transport.currentStatus())
+}
+
+func TestProcessEnvRelayIntakeErrors(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	assert.False(t, ProcessEnv(new(mockSecretManager)).relayIntakeErrors)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_RELAY_INTAKE_ERRORS", "true")
+	assert.True(t, ProcessEnv(new(mockSecretManager)).relayIntakeErrors)
+}
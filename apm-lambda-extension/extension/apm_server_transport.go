@@ -19,8 +19,8 @@ package extension
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -28,32 +28,87 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"elastic/apm-lambda-extension/buildinfo"
+	"elastic/apm-lambda-extension/failpoint"
 )
 
+// userAgent identifies the extension in the requests sent to the APM server.
+var userAgent = fmt.Sprintf("apm-lambda-extension/%s", buildinfo.Version())
+
 // Constants for the state of the transport used in
 // the backoff implementation.
 type ApmServerTransportStatusType string
 
 const (
-	Failing ApmServerTransportStatusType = "Failing"
-	Pending ApmServerTransportStatusType = "Pending"
-	Healthy ApmServerTransportStatusType = "Healthy"
+	Failing   ApmServerTransportStatusType = "Failing"
+	Throttled ApmServerTransportStatusType = "Throttled"
+	Pending   ApmServerTransportStatusType = "Pending"
+	Healthy   ApmServerTransportStatusType = "Healthy"
 )
 
 // A struct to track the state and status of sending
 // to the APM server. Used in the backoff implementation.
 type ApmServerTransport struct {
 	sync.Mutex
-	bufferPool        sync.Pool
-	config            *extensionConfig
-	AgentDoneSignal   chan struct{}
-	dataChannel       chan AgentData
-	client            *http.Client
-	status            ApmServerTransportStatusType
-	reconnectionCount int
-	gracePeriodTimer  *time.Timer
+	bufferPool         sync.Pool
+	config             *extensionConfig
+	AgentDoneSignal    chan struct{}
+	agentDoneMutex     sync.Mutex
+	expectedFlushes    int
+	receivedFlushes    int
+	dataChannel        chan AgentData
+	priorityChannel    chan AgentData
+	client             *http.Client
+	dnsCache           *dnsCache
+	status             ApmServerTransportStatusType
+	statusMutex        sync.RWMutex
+	reconnectionCount  int
+	clock              clock
+	backoff            backoffConfig
+	compression        compressionConfig
+	spillBuffer        *SpillBuffer
+	checkpointed       int32
+	checkpointMutex    sync.Mutex
+	credentials        *credentials
+	endpoints          *apmServerEndpoints
+	debug              debugState
+	deliveryFailures   int64
+	droppedPayloads    int64
+	rejectedPayloads   int64
+	rejectedEvents     int64
+	retriedEvents      int64
+	retriedRequests    int64
+	reportedDrops      bufferDrops
+	flushListeners     []FlushListener
+	metadataExtracted  int32
+	agentDataSeen      int32
+	enrichment         *metadataEnrichment
+	centralConfig      *centralConfig
+	certExpiry         *certExpiryMonitor
+	configDrift        *configDrift
+	platformTxs        *platformTransactions
+	legacyCompat       *legacyServerCompat
+	xrayLinks          *xrayLinks
+	invocations        *invocationPayloads
+	requests           *requestLimiter
+	sanitizer          *fieldSanitizer
+	filter             *eventFilter
+	tailSampler        *tailSampler
+	metricsFile        *metricsFile
+	rateLimiter        *rateLimiter
+	recordOutput       *RecordOutput
+	truncator          *eventTruncator
+	deadLetters        *DeadLetterQueue
+	atomicFlush        *atomicFlush
+	gracePeriodEnd     int64
+	invocationDeadline int64
+	metrics            selfMetrics
 }
 
 func InitApmServerTransport(config *extensionConfig) *ApmServerTransport {
@@ -61,14 +116,49 @@ func InitApmServerTransport(config *extensionConfig) *ApmServerTransport {
 	transport.bufferPool = sync.Pool{New: func() interface{} {
 		return &bytes.Buffer{}
 	}}
-	transport.dataChannel = make(chan AgentData, 100)
-	transport.client = &http.Client{
-		Timeout:   time.Duration(config.DataForwarderTimeoutSeconds) * time.Second,
-		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	dataBufferSize := config.dataBufferSize
+	if dataBufferSize <= 0 {
+		dataBufferSize = defaultDataBufferSize
 	}
+	transport.dataChannel = make(chan AgentData, dataBufferSize)
+	transport.priorityChannel = make(chan AgentData, priorityBufferSize)
+	transport.client = newApmServerHTTPClient(config)
+	transport.dnsCache = newDNSCache(config)
+	transport.dnsCache.wrap(transport.client)
+	transport.requests = newRequestLimiter(config.maxInFlightRequests)
 	transport.config = config
-	transport.status = Healthy
+	transport.backoff = config.backoff
+	if transport.backoff == (backoffConfig{}) {
+		transport.backoff = defaultBackoffConfig
+	}
+	transport.compression = config.compression
+	if transport.compression == (compressionConfig{}) {
+		transport.compression = defaultCompressionConfig
+	}
+	spillBuffer, err := NewSpillBuffer(config.spillDir, config.spillBufferMaxBytes)
+	if err != nil {
+		Log.Warnf("Could not create the spill buffer, undelivered data will be dropped: %v", err)
+	}
+	transport.spillBuffer = spillBuffer
+	transport.credentials = newCredentials(config)
+	transport.endpoints = newApmServerEndpoints(config, transport.credentials)
+	transport.enrichment = newMetadataEnrichment(config)
+	transport.centralConfig = newCentralConfig(config)
+	transport.certExpiry = newCertExpiryMonitor(config.certExpiryWarning)
+	transport.xrayLinks = &xrayLinks{enabled: config.xrayLinks}
+	transport.sanitizer = newFieldSanitizer(config)
+	transport.filter = newEventFilter(config)
+	transport.tailSampler = newTailSampler(config)
+	transport.metricsFile = newMetricsFile(config)
+	transport.rateLimiter = newRateLimiter(config)
+	transport.truncator = newEventTruncator(config)
+	transport.atomicFlush = newAtomicFlush(config)
+	transport.platformTxs = newPlatformTransactions(config)
+	transport.legacyCompat = newLegacyServerCompat(config)
+	transport.clock = systemClock{}
+	transport.setStatus(Healthy)
 	transport.reconnectionCount = -1
+	transport.RefreshDNSCache()
 	return &transport
 }
 
@@ -76,23 +166,39 @@ func InitApmServerTransport(config *extensionConfig) *ApmServerTransport {
 // Stop checking for, and sending agent data when the function invocation
 // has completed, signaled via a channel.
 func (transport *ApmServerTransport) ForwardApmData(ctx context.Context, metadataContainer *MetadataContainer) error {
-	if transport.status == Failing {
+	if transport.backingOff() {
 		return nil
 	}
+	if len(transport.atomicFlush.pending()) > 0 {
+		// The agent data of the previous invocations which was not flushed is sent as a whole
+		transport.flushHeldData(ctx)
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			Log.Debug("Invocation context cancelled, not processing any more agent data")
 			return nil
+		case agentData := <-transport.priorityChannel:
+			if err := transport.PostToApmServer(ctx, agentData); err != nil {
+				return fmt.Errorf("error sending error document to APM server, skipping: %v", err)
+			}
 		case agentData := <-transport.dataChannel:
-			if metadataContainer.Metadata == nil {
+			if !metadataContainer.Known() {
 				metadata, err := ProcessMetadata(agentData)
 				if err != nil {
 					Log.Errorf("Error extracting metadata from agent payload %v", err)
 				}
-				metadataContainer.Metadata = metadata
+				metadataContainer.Set(metadata)
+				if metadata != nil {
+					atomic.StoreInt32(&transport.metadataExtracted, 1)
+				}
 			}
-			if err := transport.PostToApmServer(ctx, agentData); err != nil {
+			if transport.atomicFlush.hold(agentData) {
+				Log.Debug("Holding agent data for the atomic flush")
+				continue
+			}
+			batchMaxWait := time.Duration(transport.config.batchMaxWaitMs) * time.Millisecond
+			if _, err := transport.postBatches(ctx, agentData, batchMaxWait); err != nil {
 				return fmt.Errorf("error sending to APM server, skipping: %v", err)
 			}
 		}
@@ -100,21 +206,46 @@ func (transport *ApmServerTransport) ForwardApmData(ctx context.Context, metadat
 }
 
 // FlushAPMData reads all the apm data in the apm data channel and sends it to the APM server.
-func (transport *ApmServerTransport) FlushAPMData(ctx context.Context) {
-	if transport.status == Failing {
-		Log.Debug("Flush skipped - Transport failing")
+// The registered flush listeners are notified of the start and end of the flush, along with
+// the invocation described by info.
+func (transport *ApmServerTransport) FlushAPMData(ctx context.Context, info FlushInfo) {
+	if transport.backingOff() {
+		Log.Debugf("Flush skipped - Transport %s", strings.ToLower(string(transport.currentStatus())))
+		return
+	}
+	if err := failpoint.Inject(failpoint.Flush); err != nil {
+		Log.Errorf("Flush failed, the agent data stays buffered: %v", err)
 		return
 	}
 	Log.Debug("Flush started - Checking for agent data")
+	transport.notifyFlushStart(ctx, info)
+	result := transport.sendPriorityData(ctx)
+	if transport.atomicFlush != nil {
+		heldResult := transport.flushHeldData(ctx)
+		result.Sent += heldResult.Sent
+		result.Failed += heldResult.Failed
+		Log.Debug("Flush ended - Atomic flush of the agent data")
+		transport.notifyFlushEnd(ctx, info, result)
+		return
+	}
 	for {
+		if transport.currentStatus() == Throttled {
+			Log.Debug("Flush ended - Transport throttled, the agent data stays buffered")
+			transport.notifyFlushEnd(ctx, info, result)
+			return
+		}
 		select {
 		case agentData := <-transport.dataChannel:
 			Log.Debug("Flush in progress - Processing agent data")
-			if err := transport.PostToApmServer(ctx, agentData); err != nil {
+			batchResult, err := transport.postBatches(ctx, agentData, 0)
+			if err != nil {
 				Log.Errorf("Error sending to APM server, skipping: %v", err)
 			}
+			result.Sent += batchResult.Sent
+			result.Failed += batchResult.Failed
 		default:
 			Log.Debug("Flush ended - No agent data on buffer")
+			transport.notifyFlushEnd(ctx, info, result)
 			return
 		}
 	}
@@ -126,72 +257,290 @@ func (transport *ApmServerTransport) FlushAPMData(ctx context.Context) {
 // It sets the APM transport status to failing upon errors, as part of the backoff
 // strategy.
 func (transport *ApmServerTransport) PostToApmServer(ctx context.Context, agentData AgentData) error {
-	// todo: can this be a streaming or streaming style call that keeps the
-	//       connection open across invocations?
-	if transport.status == Failing {
-		return errors.New("transport status is unhealthy")
+	err := transport.postToApmServer(ctx, agentData)
+	if err != nil {
+		transport.debug.recordError(err)
+	} else {
+		transport.refreshCheckpoint()
 	}
+	return err
+}
 
-	endpointURI := "intake/v2/events"
-	encoding := agentData.ContentEncoding
+func (transport *ApmServerTransport) postToApmServer(ctx context.Context, agentData AgentData) error {
+	if transport.currentStatus() == Throttled {
+		return &deliveryError{err: errThrottled, retained: transport.EnqueueAPMData(agentData)}
+	}
+	if transport.currentStatus() == Failing {
+		return &deliveryError{err: errors.New("transport status is unhealthy"), retained: transport.handleDeliveryFailure(agentData)}
+	}
 
-	var r io.Reader
-	if agentData.ContentEncoding != "" {
-		r = bytes.NewReader(agentData.Data)
-	} else {
-		encoding = "gzip"
+	encoding := agentData.ContentEncoding
+	body := agentData.Data
+	if transport.filter != nil {
+		if filtered, changed, err := transport.filterAgentData(agentData); err != nil {
+			Log.Debugf("Could not filter the agent data: %v", err)
+		} else if changed {
+			encoding = ""
+			body = filtered
+		}
+	}
+	if transport.rateLimiter != nil {
+		if limited, changed, hasEvents, err := transport.rateLimitAgentData(AgentData{Data: body, ContentEncoding: encoding}); err != nil {
+			Log.Debugf("Could not rate limit the agent data: %v", err)
+		} else if !hasEvents {
+			return nil
+		} else if changed {
+			encoding = ""
+			body = limited
+		}
+	}
+	if transport.enrichment.active() {
+		if enriched, changed, err := transport.enrichAgentData(AgentData{Data: body, ContentEncoding: encoding}); err != nil {
+			Log.Debugf("Could not enrich the agent data metadata: %v", err)
+		} else if changed {
+			encoding = ""
+			body = enriched
+		}
+	}
+	if transport.invocations != nil {
+		if enriched, changed, err := transport.addInvocationPayloads(AgentData{Data: body, ContentEncoding: encoding}); err != nil {
+			Log.Debugf("Could not add the invocation payloads to the agent data: %v", err)
+		} else if changed {
+			encoding = ""
+			body = enriched
+		}
+	}
+	if transport.sanitizer != nil {
+		if sanitized, changed, err := transport.sanitizeAgentData(AgentData{Data: body, ContentEncoding: encoding}); err != nil {
+			Log.Debugf("Could not sanitize the agent data: %v", err)
+		} else if changed {
+			encoding = ""
+			body = sanitized
+		}
+	}
+	if transport.truncator != nil {
+		if truncated, changed, err := transport.truncateAgentData(AgentData{Data: body, ContentEncoding: encoding}); err != nil {
+			Log.Debugf("Could not truncate the oversized events of the agent data: %v", err)
+		} else if changed {
+			encoding = ""
+			body = truncated
+		}
+	}
+	if transport.legacyCompat.active() {
+		if stripped, changed, err := transport.stripLegacyFields(AgentData{Data: body, ContentEncoding: encoding}); err != nil {
+			Log.Debugf("Could not strip the fields unsupported by the APM server from the agent data: %v", err)
+		} else if changed {
+			encoding = ""
+			body = stripped
+		}
+	}
+	if encoding == "" {
 		buf := transport.bufferPool.Get().(*bytes.Buffer)
 		defer func() {
 			buf.Reset()
 			transport.bufferPool.Put(buf)
 		}()
-		gw, err := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+		compressed, compressedEncoding, err := transport.compression.compress(buf, body)
 		if err != nil {
-			return err
-		}
-		if _, err := gw.Write(agentData.Data); err != nil {
-			Log.Errorf("Failed to compress data: %v", err)
-		}
-		if err := gw.Close(); err != nil {
-			Log.Errorf("Failed write compressed data to buffer: %v", err)
+			Log.Errorf("Failed to compress data, sending it uncompressed: %v", err)
+		} else {
+			body, encoding = compressed, compressedEncoding
 		}
-		r = buf
 	}
 
-	req, err := http.NewRequest("POST", transport.config.apmServerUrl+endpointURI, r)
+	if err := transport.requests.acquire(ctx); err != nil {
+		return &deliveryError{err: fmt.Errorf("failed to post to APM server: %v", err), retained: transport.handleDeliveryFailure(agentData)}
+	}
+	defer transport.requests.release()
+
+	if transport.recordOutput != nil {
+		return transport.writeRecord(ctx, agentData, body, encoding)
+	}
+
+	transport.endpoints.probePrimary(transport.client)
+	endpoint := transport.endpoints.active()
+	req, err := newIntakeRequest(endpoint, body, encoding, agentData.agentUserAgent)
 	if err != nil {
 		return fmt.Errorf("failed to create a new request when posting to APM server: %v", err)
 	}
-	req.Header.Add("Content-Encoding", encoding)
-	req.Header.Add("Content-Type", "application/x-ndjson")
-	if transport.config.apmServerApiKey != "" {
-		req.Header.Add("Authorization", "ApiKey "+transport.config.apmServerApiKey)
-	} else if transport.config.apmServerSecretToken != "" {
-		req.Header.Add("Authorization", "Bearer "+transport.config.apmServerSecretToken)
-	}
 
 	Log.Debug("Sending data chunk to APM server")
-	resp, err := transport.client.Do(req)
+	start := time.Now()
+	var resp *http.Response
+	if err = failpoint.Inject(failpoint.Post); err == nil {
+		resp, err = transport.client.Do(req)
+	}
+	if err != nil && isConnectionResetError(err) {
+		// The connection was closed by the server or a proxy before a response was received, which
+		// commonly happens with pooled connections. Retry once before entering backoff.
+		Log.Debugf("Connection reset while posting to APM server, retrying once: %v", err)
+		if retryReq, retryErr := replayRequest(req); retryErr == nil {
+			resp, err = transport.client.Do(retryReq)
+		}
+	}
+	if err != nil && transport.endpoints.failOver() {
+		// Send the data to the fallback APM server right away, rather than after a grace period
+		endpoint = transport.endpoints.active()
+		if fallbackReq, fallbackErr := newIntakeRequest(endpoint, body, encoding, agentData.agentUserAgent); fallbackErr == nil {
+			req = fallbackReq
+			resp, err = transport.client.Do(req)
+		}
+	}
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && endpoint.credentials.refresh() {
+		// The secret may have been rotated in Secrets Manager since the credentials were fetched
+		Log.Info("APM server rejected the credentials, retrying with the refreshed credentials")
+		if retryReq, retryErr := replayRequest(req); retryErr == nil {
+			resp.Body.Close()
+			endpoint.credentials.setAuthorization(retryReq)
+			resp, err = transport.client.Do(retryReq)
+		}
+	}
+	// Transient failures are retried within the invocation, rather than waiting for the grace period to end
+	resp, err = transport.retryTransientFailures(ctx, req, resp, err)
 	if err != nil {
+		transport.metrics.recordRequest(time.Since(start), 0)
+		retained := transport.handleDeliveryFailure(agentData)
 		transport.SetApmServerTransportState(ctx, Failing)
-		return fmt.Errorf("failed to post to APM server: %v", err)
+		return &deliveryError{err: fmt.Errorf("failed to post to APM server: %v", err), retained: retained}
 	}
 
+	transport.certExpiry.observe(resp.TLS, time.Now())
+
 	//Read the response body
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	transport.metrics.recordRequest(time.Since(start), len(body))
 	if err != nil {
+		retained := transport.handleDeliveryFailure(agentData)
 		transport.SetApmServerTransportState(ctx, Failing)
-		return fmt.Errorf("failed to read the response body after posting to the APM server")
+		return &deliveryError{err: fmt.Errorf("failed to read the response body after posting to the APM server"), retained: retained}
+	}
+
+	if retryAfter, ok := throttledResponse(resp, transport.clock.Now()); ok {
+		transport.throttle(ctx, retryAfter)
+		var response intakeResponse
+		if json.Unmarshal(respBody, &response) != nil || response.Accepted == 0 {
+			// The agent data stays buffered until the APM server accepts data again
+			return &deliveryError{err: fmt.Errorf("%w for %s", errThrottled, retryAfter), retained: transport.EnqueueAPMData(agentData)}
+		}
+		transport.recordIntakeResponse(resp.StatusCode, respBody, AgentData{Data: body, ContentEncoding: encoding, retried: agentData.retried, agentUserAgent: agentData.agentUserAgent})
+		return fmt.Errorf("%w for %s", errThrottled, retryAfter)
+	}
+	if isServerError(resp.StatusCode, respBody) {
+		retained := transport.handleDeliveryFailure(agentData)
+		transport.SetApmServerTransportState(ctx, Failing)
+		return &deliveryError{err: fmt.Errorf("failed to post to APM server: status %d: %s", resp.StatusCode, truncateForLog(respBody)), retained: retained}
 	}
 
 	transport.SetApmServerTransportState(ctx, Healthy)
+	if resp.StatusCode < http.StatusMultipleChoices {
+		transport.debug.recordSent()
+	}
 	Log.Debug("Transport status set to healthy")
-	Log.Debugf("APM server response body: %v", string(body))
+	Log.Debugf("APM server response body: %v", string(respBody))
 	Log.Debugf("APM server response status code: %v", resp.StatusCode)
+	if isClientError(resp.StatusCode, respBody) {
+		return transport.quarantine(resp.StatusCode, respBody, agentData)
+	}
+	if !agentData.receivedAt.IsZero() {
+		transport.metrics.deliveryLatency.observe(time.Since(agentData.receivedAt))
+	}
+	transport.recordIntakeResponse(resp.StatusCode, respBody, AgentData{Data: body, ContentEncoding: encoding, retried: agentData.retried, agentUserAgent: agentData.agentUserAgent})
 	return nil
 }
 
+// newIntakeRequest returns a request sending body, encoded with encoding, to the intake endpoint of the
+// APM server, on behalf of the agent identified by agentUserAgent. The body is a bytes.Reader, which allows
+// http.NewRequest to set GetBody so that the request can be replayed.
+func newIntakeRequest(endpoint *apmServerEndpoint, body []byte, encoding string, agentUserAgent string) (*http.Request, error) {
+	req, err := http.NewRequest("POST", endpoint.url+"intake/v2/events", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if encoding != "" {
+		req.Header.Add("Content-Encoding", encoding)
+	}
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", forwardedUserAgent(agentUserAgent))
+	endpoint.credentials.setAuthorization(req)
+	return req, nil
+}
+
+// forwardedUserAgent returns the User-Agent of the requests forwarding the data of the agent identified by
+// agentUserAgent. It identifies the extension, followed by the agent, so that the payloads rejected by the
+// APM server can be attributed to the agent that sent them.
+func forwardedUserAgent(agentUserAgent string) string {
+	if agentUserAgent == "" {
+		return userAgent
+	}
+	return userAgent + " " + agentUserAgent
+}
+
+// handleDeliveryFailure records that agentData could not be delivered, and persists it to the spill
+// buffer, if any, so that it is not lost. Agent data which cannot be persisted is sent to the dead-letter
+// queue, if any. It reports whether agentData was persisted or sent to the dead-letter queue.
+func (transport *ApmServerTransport) handleDeliveryFailure(agentData AgentData) bool {
+	atomic.AddInt64(&transport.deliveryFailures, 1)
+	if transport.spillBuffer != nil {
+		err := transport.spillBuffer.Spill(agentData)
+		if err == nil {
+			Log.Debug("Undelivered agent data persisted to the spill buffer")
+			return true
+		}
+		if transport.deadLetters == nil {
+			Log.Warnf("Could not persist undelivered agent data, dropping it: %v", err)
+			return false
+		}
+		Log.Warnf("Could not persist undelivered agent data, sending it to the dead-letter queue: %v", err)
+	}
+	return transport.sendToDeadLetterQueue(agentData)
+}
+
+// ReplaySpilledData queues the agent data persisted after earlier delivery failures, provided that the
+// transport is healthy. Data is replayed as long as there is room in the agent data channel.
+func (transport *ApmServerTransport) ReplaySpilledData() {
+	if transport.spillBuffer == nil || transport.currentStatus() != Healthy {
+		return
+	}
+	replayed, err := transport.spillBuffer.Replay(func(agentData AgentData) bool {
+		select {
+		case transport.dataChannel <- agentData:
+			return true
+		default:
+			return false
+		}
+	})
+	if err != nil {
+		Log.Warnf("Error replaying spilled agent data: %v", err)
+	}
+	if replayed > 0 {
+		Log.Infof("Replayed %d agent data payloads from the spill buffer", replayed)
+	}
+}
+
+// isConnectionResetError reports whether err denotes a connection closed by the peer, as opposed to
+// e.g. a timeout or a DNS failure, for which retrying right away is unlikely to succeed.
+func isConnectionResetError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// replayRequest returns a copy of req with a fresh body, obtained from GetBody.
+func replayRequest(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retryReq := req.Clone(req.Context())
+	retryReq.Body = body
+	return retryReq, nil
+}
+
 // SetApmServerTransportState takes a state of the APM server transport and updates
 // the current state of the transport. For a change to a failing state, the grace period
 // is calculated and a go routine is started that waits for that period to complete
@@ -203,26 +552,36 @@ func (transport *ApmServerTransport) SetApmServerTransportState(ctx context.Cont
 	switch status {
 	case Healthy:
 		transport.Lock()
-		transport.status = status
-		Log.Debugf("APM server Transport status set to %s", transport.status)
+		if transport.currentStatus() != status {
+			transport.debug.recordTransition(status)
+			atomic.AddInt64(&transport.metrics.stateChanges, 1)
+		}
+		transport.setStatus(status)
+		Log.Debugf("APM server Transport status set to %s", status)
 		transport.reconnectionCount = -1
 		transport.Unlock()
 	case Failing:
 		transport.Lock()
-		transport.status = status
-		Log.Debugf("APM server Transport status set to %s", transport.status)
+		transport.setStatus(status)
+		transport.debug.recordTransition(status)
+		atomic.AddInt64(&transport.metrics.stateChanges, 1)
+		Log.Debugf("APM server Transport status set to %s", transport.currentStatus())
 		transport.reconnectionCount++
-		transport.gracePeriodTimer = time.NewTimer(transport.computeGracePeriod())
+		gracePeriod := transport.computeGracePeriod()
+		atomic.StoreInt64(&transport.gracePeriodEnd, transport.clock.Now().Add(gracePeriod).UnixNano())
+		gracePeriodOver := transport.clock.After(gracePeriod)
 		Log.Debugf("Grace period entered, reconnection count : %d", transport.reconnectionCount)
 		go func() {
 			select {
-			case <-transport.gracePeriodTimer.C:
+			case <-gracePeriodOver:
 				Log.Debug("Grace period over - timer timed out")
 			case <-ctx.Done():
 				Log.Debug("Grace period over - context done")
 			}
-			transport.status = Pending
-			Log.Debugf("APM server Transport status set to %s", transport.status)
+			transport.setStatus(Pending)
+			transport.debug.recordTransition(Pending)
+			atomic.AddInt64(&transport.metrics.stateChanges, 1)
+			Log.Debugf("APM server Transport status set to %s", Pending)
 			transport.Unlock()
 		}()
 	default:
@@ -230,20 +589,144 @@ func (transport *ApmServerTransport) SetApmServerTransportState(ctx context.Cont
 	}
 }
 
+// currentStatus returns the status of the transport. The status is changed by the goroutines ending the
+// grace period and the throttling, hence is guarded by its own lock rather than the transport one, which
+// is held for the whole grace period.
+func (transport *ApmServerTransport) currentStatus() ApmServerTransportStatusType {
+	transport.statusMutex.RLock()
+	defer transport.statusMutex.RUnlock()
+	return transport.status
+}
+
+func (transport *ApmServerTransport) setStatus(status ApmServerTransportStatusType) {
+	transport.statusMutex.Lock()
+	transport.status = status
+	transport.statusMutex.Unlock()
+}
+
+// remainingGracePeriod returns how long the transport stays in the Failing state, as seen from now.
+func (transport *ApmServerTransport) remainingGracePeriod(now time.Time) time.Duration {
+	if remaining := time.Unix(0, atomic.LoadInt64(&transport.gracePeriodEnd)).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
 // ComputeGracePeriod https://github.com/elastic/apm/blob/main/specs/agents/transport.md#transport-errors
+// The reconnection count ceiling, the multiplier and the jitter can be configured.
 func (transport *ApmServerTransport) computeGracePeriod() time.Duration {
-	gracePeriodWithoutJitter := math.Pow(math.Min(float64(transport.reconnectionCount), 6), 2)
-	jitter := rand.Float64()/5 - 0.1
+	backoff := transport.backoff
+	gracePeriodWithoutJitter := math.Pow(math.Min(float64(transport.reconnectionCount), float64(backoff.maxReconnectionCount)), 2) * backoff.multiplierSeconds
+	jitter := (rand.Float64()*2 - 1) * backoff.jitter
 	return time.Duration((gracePeriodWithoutJitter + jitter*gracePeriodWithoutJitter) * float64(time.Second))
 }
 
 // EnqueueAPMData adds a AgentData struct to the agent data channel, effectively queueing for a send
-// to the APM server.
-func (transport *ApmServerTransport) EnqueueAPMData(agentData AgentData) {
+// to the APM server. It never blocks: if the channel is full, the oldest buffered data is dropped with
+// the drop_oldest buffer policy, and agentData is dropped otherwise. It reports whether agentData was queued.
+func (transport *ApmServerTransport) EnqueueAPMData(agentData AgentData) bool {
 	select {
 	case transport.dataChannel <- agentData:
 		Log.Debug("Adding agent data to buffer to be sent to apm server")
 	default:
+		if transport.config.dataBufferPolicy == DropOldest {
+			transport.replaceOldest(agentData)
+			return true
+		}
+		atomic.AddInt64(&transport.droppedPayloads, 1)
 		Log.Warn("Channel full: dropping a subset of agent data")
+		return false
+	}
+	return true
+}
+
+// ShedBuffers drops all the agent data waiting to be sent to the APM server, and returns the number
+// of dropped payloads. The pooled compression buffers are released by the next garbage collection.
+func (transport *ApmServerTransport) ShedBuffers() int {
+	dropped := 0
+	for {
+		select {
+		case <-transport.dataChannel:
+			dropped++
+		default:
+			if dropped > 0 {
+				Log.Warnf("Dropped %d buffered agent data payloads", dropped)
+			}
+			return dropped
+		}
+	}
+}
+
+// TakeDeliveryFailures returns the number of agent data payloads that could not be delivered to the
+// APM server since the previous call, and resets the count.
+func (transport *ApmServerTransport) TakeDeliveryFailures() int {
+	return int(atomic.SwapInt64(&transport.deliveryFailures, 0))
+}
+
+// BufferedDataCount returns the number of agent data payloads waiting to be sent to the APM server.
+func (transport *ApmServerTransport) BufferedDataCount() int {
+	return len(transport.dataChannel) + len(transport.priorityChannel) + len(transport.atomicFlush.pending())
+}
+
+// StartAgentDoneSignal creates the channel signaling that the agent flushed its data during the current
+// invocation. The channel is buffered, so that signaling never blocks the agent.
+// By default, a single flush is expected from the agent for each invocation.
+func (transport *ApmServerTransport) StartAgentDoneSignal() <-chan struct{} {
+	transport.agentDoneMutex.Lock()
+	defer transport.agentDoneMutex.Unlock()
+	transport.AgentDoneSignal = make(chan struct{}, 1)
+	transport.expectedFlushes = 1
+	transport.receivedFlushes = 0
+	return transport.AgentDoneSignal
+}
+
+// StopAgentDoneSignal detaches the channel of the current invocation, so that a late flush signal from
+// the agent is not mistaken for the end of the next invocation.
+func (transport *ApmServerTransport) StopAgentDoneSignal() {
+	transport.agentDoneMutex.Lock()
+	defer transport.agentDoneMutex.Unlock()
+	transport.AgentDoneSignal = nil
+}
+
+// expectFlushes sets the number of flushes the agent will perform during the current invocation, e.g.
+// one per record of a batch processed by the function. The current invocation is signaled as done once
+// all the expected flushes are received.
+func (transport *ApmServerTransport) expectFlushes(count int) {
+	transport.agentDoneMutex.Lock()
+	defer transport.agentDoneMutex.Unlock()
+	if transport.AgentDoneSignal == nil {
+		Log.Debug("Expected flush count received outside of an invocation, ignoring")
+		return
+	}
+	Log.Debugf("Agent expects %d flushes for this invocation", count)
+	transport.expectedFlushes = count
+	if transport.receivedFlushes > 0 {
+		transport.trySignalAgentDone()
+	}
+}
+
+// signalAgentDone notifies the current invocation, if any, that the agent flushed its data.
+func (transport *ApmServerTransport) signalAgentDone() {
+	transport.agentDoneMutex.Lock()
+	defer transport.agentDoneMutex.Unlock()
+	if transport.AgentDoneSignal == nil {
+		Log.Debug("Agent done signal received outside of an invocation, ignoring")
+		return
+	}
+	transport.receivedFlushes++
+	transport.trySignalAgentDone()
+}
+
+// trySignalAgentDone signals the current invocation as done if all the expected flushes were received.
+// It must be called with agentDoneMutex held.
+func (transport *ApmServerTransport) trySignalAgentDone() {
+	if transport.receivedFlushes < transport.expectedFlushes {
+		Log.Debugf("Received flush %d of %d for this invocation", transport.receivedFlushes, transport.expectedFlushes)
+		return
+	}
+	select {
+	case transport.AgentDoneSignal <- struct{}{}:
+	default:
+		Log.Debug("Agent done signal already sent for this invocation")
 	}
 }
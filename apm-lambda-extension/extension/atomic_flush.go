@@ -0,0 +1,161 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"math"
+	"sync"
+)
+
+// maxAtomicFlushHeldBytes is the maximum size of the agent data held until the next atomic flush, so that
+// the memory of the execution environment is not exhausted by the data of an invocation.
+const maxAtomicFlushHeldBytes = 32 * 1024 * 1024
+
+// atomicFlush holds the agent data received during the invocations until it is flushed, so that it is either
+// delivered to the APM server as a whole, or carried over as a whole, and partial traces, e.g. a transaction
+// without its spans, never reach the APM server.
+type atomicFlush struct {
+	mu         sync.Mutex
+	held       []AgentData
+	heldBytes  int
+	overflowed bool
+}
+
+// newAtomicFlush returns the atomic flush of the agent data, or nil if ELASTIC_APM_LAMBDA_ATOMIC_FLUSH is
+// disabled.
+func newAtomicFlush(config *extensionConfig) *atomicFlush {
+	if !config.atomicFlush {
+		return nil
+	}
+	return &atomicFlush{}
+}
+
+// hold keeps agentData until the next flush, and reports whether it did. The agent data is not held if the
+// atomic flush is disabled, or if too much agent data is already held.
+func (flush *atomicFlush) hold(agentData AgentData) bool {
+	if flush == nil {
+		return false
+	}
+	flush.mu.Lock()
+	defer flush.mu.Unlock()
+	if flush.heldBytes+len(agentData.Data) > maxAtomicFlushHeldBytes {
+		if !flush.overflowed {
+			Log.Warn("Too much agent data held for the atomic flush, forwarding the rest of the agent data right away")
+			flush.overflowed = true
+		}
+		return false
+	}
+	flush.held = append(flush.held, agentData)
+	flush.heldBytes += len(agentData.Data)
+	return true
+}
+
+// carryOver holds agentData again, ahead of the agent data held since it was released.
+func (flush *atomicFlush) carryOver(agentData []AgentData) {
+	flush.mu.Lock()
+	defer flush.mu.Unlock()
+	flush.held = append(append([]AgentData{}, agentData...), flush.held...)
+	for _, data := range agentData {
+		flush.heldBytes += len(data.Data)
+	}
+}
+
+// release returns the agent data held since the previous call.
+func (flush *atomicFlush) release() []AgentData {
+	if flush == nil {
+		return nil
+	}
+	flush.mu.Lock()
+	defer flush.mu.Unlock()
+	held := flush.held
+	flush.held, flush.heldBytes, flush.overflowed = nil, 0, false
+	return held
+}
+
+// pending returns the agent data held, which stays held.
+func (flush *atomicFlush) pending() []AgentData {
+	if flush == nil {
+		return nil
+	}
+	flush.mu.Lock()
+	defer flush.mu.Unlock()
+	return append([]AgentData{}, flush.held...)
+}
+
+// flushHeldData sends the agent data held for the atomic flush, followed by the buffered agent data,
+// coalesced into a single request when it shares the same metadata, which is the case for the data of a
+// single agent. Otherwise, the requests are sent in order, and the all-or-nothing guarantee holds for each
+// request: the requests preceding a failed one are delivered. The agent data of a failed request is buffered
+// again or persisted to the spill buffer or the dead-letter queue, as any undelivered data, or carried over to
+// the next flush if it could not be, along with the agent data following it.
+func (transport *ApmServerTransport) flushHeldData(ctx context.Context) FlushResult {
+	var result FlushResult
+	held := transport.atomicFlush.release()
+drain:
+	for {
+		select {
+		case agentData := <-transport.dataChannel:
+			held = append(held, agentData)
+		default:
+			break drain
+		}
+	}
+	payloads := coalesceAgentData(held)
+	if len(payloads) > 1 {
+		Log.Warnf("The agent data of the atomic flush does not share the same metadata, sending it in %d requests", len(payloads))
+	}
+	for i, agentData := range payloads {
+		if err := transport.PostToApmServer(ctx, agentData); err != nil {
+			Log.Errorf("Atomic flush failed, carrying over the rest of the agent data: %v", err)
+			result.Failed += len(payloads) - i
+			if agentDataRetained(err) {
+				// The agent data of the failed request was buffered again, or persisted
+				i++
+			}
+			transport.atomicFlush.carryOver(payloads[i:])
+			return result
+		}
+		result.Sent++
+	}
+	return result
+}
+
+// coalesceAgentData merges the consecutive agent data payloads sharing the same metadata and agent.
+func coalesceAgentData(payloads []AgentData) []AgentData {
+	var coalesced []AgentData
+	var batch *agentDataBatch
+	for _, agentData := range payloads {
+		if batch != nil && batch.add(agentData) {
+			continue
+		}
+		if batch != nil {
+			coalesced = append(coalesced, batch.agentData())
+			batch = nil
+		}
+		if next, ok := newAgentDataBatch(agentData, math.MaxInt32); ok {
+			batch = next
+		} else {
+			coalesced = append(coalesced, agentData)
+		}
+	}
+	if batch != nil {
+		coalesced = append(coalesced, batch.agentData())
+	}
+	return coalesced
+}
@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAtomicFlush(t *testing.T) {
+	apmServer, requests := newBatchTestApmServer(t)
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", atomicFlush: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	forwarded := make(chan error, 1)
+	metadataContainer := MetadataContainer{}
+	go func() {
+		forwarded <- transport.ForwardApmData(ctx, &metadataContainer)
+	}()
+
+	// The agent data received during the invocation is held until the flush
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"span":{"id":"1"}}`)})
+	require.Eventually(t, func() bool { return len(transport.atomicFlush.pending()) == 1 }, 5*time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, <-forwarded)
+	assert.True(t, metadataContainer.Known())
+	assert.Empty(t, requests())
+	assert.Equal(t, 1, transport.BufferedDataCount())
+
+	transport.EnqueueAPMData(gzipAgentData(t, batchTestMetadata+"\n"+`{"transaction":{"id":"2"}}`))
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	require.Len(t, requests(), 1)
+	assert.Equal(t, batchTestMetadata+"\n"+`{"span":{"id":"1"}}`+"\n"+`{"transaction":{"id":"2"}}`+"\n", requests()[0])
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestAtomicFlushCarryOver(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", atomicFlush: true})
+
+	transport.atomicFlush.hold(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"span":{"id":"1"}}`)})
+	transport.EnqueueAPMData(AgentData{Data: []byte(`{"metadata":{"service":{"name":"other"}}}` + "\n" + `{"span":{"id":"2"}}`)})
+	result := transport.flushHeldData(context.Background())
+	assert.Equal(t, FlushResult{Failed: 2}, result)
+
+	// Without a spill buffer, nothing is lost, and the agent data is sent again as a whole
+	pending := transport.atomicFlush.pending()
+	require.Len(t, pending, 2)
+	assert.Equal(t, batchTestMetadata+"\n"+`{"span":{"id":"1"}}`, string(pending[0].Data))
+
+	apmServer, requests := newBatchTestApmServer(t)
+	transport.endpoints.primary.url = apmServer.URL + "/"
+	transport.SetApmServerTransportState(context.Background(), Healthy)
+	assert.Equal(t, FlushResult{Sent: 2}, transport.flushHeldData(context.Background()))
+	assert.Len(t, requests(), 2)
+	assert.Empty(t, transport.atomicFlush.pending())
+}
+
+func TestCoalesceAgentData(t *testing.T) {
+	other := `{"metadata":{"service":{"name":"other"}}}`
+	coalesced := coalesceAgentData([]AgentData{
+		{Data: []byte(batchTestMetadata + "\n" + `{"span":{"id":"1"}}`)},
+		{Data: []byte(batchTestMetadata + "\n" + `{"span":{"id":"2"}}`)},
+		{Data: []byte(other + "\n" + `{"span":{"id":"3"}}`)},
+		{Data: []byte("not metadata")},
+	})
+	require.Len(t, coalesced, 3)
+	assert.Equal(t, batchTestMetadata+"\n"+`{"span":{"id":"1"}}`+"\n"+`{"span":{"id":"2"}}`+"\n", string(coalesced[0].Data))
+	assert.Equal(t, other+"\n"+`{"span":{"id":"3"}}`, string(coalesced[1].Data))
+	assert.Equal(t, "not metadata", string(coalesced[2].Data))
+}
+
+// TestAtomicFlushClientErrorCarryOver checks that the agent data refused by the APM server is carried over to
+// the next flush, as it is neither buffered again nor persisted, even though a spill buffer is configured.
+func TestAtomicFlushClientErrorCarryOver(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer apmServer.Close()
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:        apmServer.URL + "/",
+		atomicFlush:         true,
+		spillDir:            t.TempDir(),
+		spillBufferMaxBytes: 1024 * 1024,
+	})
+
+	transport.atomicFlush.hold(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"span":{"id":"1"}}`)})
+	assert.Equal(t, FlushResult{Failed: 1}, transport.flushHeldData(context.Background()))
+	pending := transport.atomicFlush.pending()
+	require.Len(t, pending, 1)
+	assert.Equal(t, batchTestMetadata+"\n"+`{"span":{"id":"1"}}`, string(pending[0].Data))
+}
@@ -0,0 +1,180 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// agentDataBatch coalesces agent data payloads sharing the same metadata into a single intake request.
+type agentDataBatch struct {
+	first    AgentData
+	metadata []byte
+	events   bytes.Buffer
+	payloads int
+	maxBytes int
+}
+
+// newAgentDataBatch starts a batch with agentData. It returns false if agentData cannot be batched, e.g.
+// because it does not start with metadata, in which case the batch only holds agentData.
+func newAgentDataBatch(agentData AgentData, maxBytes int) (*agentDataBatch, bool) {
+	batch := &agentDataBatch{first: agentData, maxBytes: maxBytes}
+	if agentData.retried {
+		// Retried events are sent on their own, so that they are not retried again with other events
+		return batch, false
+	}
+	metadata, events, err := splitAgentData(agentData)
+	if err != nil {
+		Log.Debugf("Agent data cannot be batched: %v", err)
+		return batch, false
+	}
+	batch.metadata = metadata
+	batch.events.Write(events)
+	batch.payloads = 1
+	return batch, true
+}
+
+// size returns the size of the uncompressed batch, in bytes.
+func (batch *agentDataBatch) size() int {
+	return len(batch.metadata) + 1 + batch.events.Len()
+}
+
+// add appends the events of agentData to the batch. It returns false, leaving the batch untouched, if
+// agentData does not share the metadata and the agent of the batch, or if the batch would exceed its
+// maximum size.
+func (batch *agentDataBatch) add(agentData AgentData) bool {
+	if agentData.retried {
+		return false
+	}
+	metadata, events, err := splitAgentData(agentData)
+	if err != nil || !bytes.Equal(metadata, batch.metadata) || agentData.agentUserAgent != batch.first.agentUserAgent ||
+		batch.size()+len(events) > batch.maxBytes {
+		return false
+	}
+	batch.events.Write(events)
+	batch.payloads++
+	return true
+}
+
+// agentData returns the agent data to send for the batch. A batch holding a single payload is sent as
+// received, to avoid compressing it again.
+func (batch *agentDataBatch) agentData() AgentData {
+	if batch.payloads <= 1 {
+		return batch.first
+	}
+	data := make([]byte, 0, batch.size())
+	data = append(data, batch.metadata...)
+	data = append(data, '\n')
+	data = append(data, batch.events.Bytes()...)
+	return AgentData{Data: data, agentUserAgent: batch.first.agentUserAgent, receivedAt: batch.first.receivedAt}
+}
+
+// splitAgentData returns the uncompressed metadata line and the newline terminated events of agentData.
+func splitAgentData(agentData AgentData) ([]byte, []byte, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata, events := data, []byte(nil)
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		metadata, events = data[:i], data[i+1:]
+	}
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(metadata, &event); err != nil || len(event) != 1 || event["metadata"] == nil {
+		return nil, nil, errors.New("agent data does not start with metadata")
+	}
+	if len(events) > 0 && events[len(events)-1] != '\n' {
+		events = append(events, '\n')
+	}
+	return metadata, events, nil
+}
+
+// postBatches posts first to the APM server. When batching is enabled, the agent data following first in
+// the agent data channel is coalesced with it, as long as it shares the same metadata and the batch does
+// not exceed the configured size. Agent data is collected for at most wait, or until ctx is done, while a
+// wait of 0 only collects the agent data already buffered.
+//
+// Posting stops at the first error, and the agent data collected for the next batch, if any, is queued again.
+func (transport *ApmServerTransport) postBatches(ctx context.Context, first AgentData, wait time.Duration) (FlushResult, error) {
+	var result FlushResult
+	if transport.config.batchMaxBytes <= 0 {
+		// The agent data is sent as received, without decoding it
+		if err := transport.PostToApmServer(ctx, first); err != nil {
+			result.Failed++
+			return result, err
+		}
+		result.Sent++
+		return result, nil
+	}
+	for next := &first; next != nil; {
+		batch, ok := newAgentDataBatch(*next, transport.config.batchMaxBytes)
+		next = nil
+		if ok {
+			next = transport.collectBatch(ctx, batch, wait)
+		}
+		if batch.payloads > 1 {
+			Log.Debugf("Sending a batch of %d agent data payloads", batch.payloads)
+		}
+		if err := transport.PostToApmServer(ctx, batch.agentData()); err != nil {
+			result.Failed++
+			if next != nil {
+				transport.EnqueueAPMData(*next)
+			}
+			return result, err
+		}
+		result.Sent++
+	}
+	return result, nil
+}
+
+// collectBatch adds the agent data received from the agent data channel to batch, until the batch is full,
+// wait elapses or ctx is done. It returns the agent data that did not fit in the batch, if any.
+func (transport *ApmServerTransport) collectBatch(ctx context.Context, batch *agentDataBatch, wait time.Duration) *AgentData {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for batch.size() < batch.maxBytes {
+		var agentData AgentData
+		if timeout == nil {
+			select {
+			case agentData = <-transport.dataChannel:
+			default:
+				return nil
+			}
+		} else {
+			select {
+			case agentData = <-transport.dataChannel:
+			case <-timeout:
+				return nil
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if !batch.add(agentData) {
+			return &agentData
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	batchTestMetadata      = `{"metadata":{"service":{"name":"foo"}}}`
+	batchTestOtherMetadata = `{"metadata":{"service":{"name":"bar"}}}`
+)
+
+// newBatchTestApmServer returns an APM server recording the uncompressed body of each intake request.
+func newBatchTestApmServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var requests []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		data, err := GetUncompressedBytes(body, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		mu.Lock()
+		requests = append(requests, string(data))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+	return apmServer, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, requests...)
+	}
+}
+
+func gzipAgentData(t *testing.T, data string) AgentData {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return AgentData{Data: buf.Bytes(), ContentEncoding: "gzip"}
+}
+
+func TestFlushAPMDataBatches(t *testing.T) {
+	apmServer, requests := newBatchTestApmServer(t)
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", batchMaxBytes: 1024})
+
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"transaction":{"id":"1"}}`)})
+	transport.EnqueueAPMData(gzipAgentData(t, batchTestMetadata+"\n"+`{"span":{"id":"2"}}`+"\n"+`{"span":{"id":"3"}}`+"\n"))
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestOtherMetadata + "\n" + `{"transaction":{"id":"4"}}`)})
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestOtherMetadata + "\n" + `{"transaction":{"id":"5"}}`)})
+	transport.EnqueueAPMData(AgentData{Data: []byte(`{"metricset":{}}`)})
+
+	listener := &recordingFlushListener{}
+	transport.AddFlushListener(listener)
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+
+	assert.Equal(t, []string{
+		batchTestMetadata + "\n" + `{"transaction":{"id":"1"}}` + "\n" + `{"span":{"id":"2"}}` + "\n" + `{"span":{"id":"3"}}` + "\n",
+		batchTestOtherMetadata + "\n" + `{"transaction":{"id":"4"}}` + "\n" + `{"transaction":{"id":"5"}}` + "\n",
+		`{"metricset":{}}`,
+	}, requests())
+	require.Len(t, listener.results, 1)
+	assert.Equal(t, FlushResult{Sent: 3}, listener.results[0])
+}
+
+// TestFlushAPMDataBatchesPerAgent checks that the data of different agents is not batched together, and is
+// sent on behalf of the agent that sent it.
+func TestFlushAPMDataBatchesPerAgent(t *testing.T) {
+	var userAgents []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", batchMaxBytes: 1024})
+
+	nodejs := "apm-agent-nodejs/3.38.0 (my-function 1.0.0)"
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"transaction":{"id":"1"}}`), agentUserAgent: nodejs})
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"span":{"id":"2"}}`), agentUserAgent: nodejs})
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"span":{"id":"3"}}`), agentUserAgent: "elasticapm-python/6.12.0"})
+	transport.EnqueueAPMData(AgentData{Data: []byte(`{"metricset":{}}`)})
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+
+	assert.Equal(t, []string{
+		userAgent + " " + nodejs,
+		userAgent + " elasticapm-python/6.12.0",
+		userAgent,
+	}, userAgents)
+}
+
+func TestFlushAPMDataBatchMaxBytes(t *testing.T) {
+	apmServer, requests := newBatchTestApmServer(t)
+	event := `{"transaction":{"id":"0102030405060708"}}`
+	// Room for the metadata and two events
+	maxBytes := len(batchTestMetadata) + 1 + 2*(len(event)+1)
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", batchMaxBytes: maxBytes})
+	for i := 0; i < 5; i++ {
+		transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + event)})
+	}
+
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+
+	batchOfTwo := batchTestMetadata + "\n" + event + "\n" + event + "\n"
+	assert.Equal(t, []string{batchOfTwo, batchOfTwo, batchTestMetadata + "\n" + event}, requests())
+}
+
+func TestFlushAPMDataBatchingDisabled(t *testing.T) {
+	apmServer, requests := newBatchTestApmServer(t)
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	for i := 0; i < 3; i++ {
+		transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"transaction":{}}`)})
+	}
+
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	assert.Len(t, requests(), 3)
+}
+
+func TestForwardApmDataBatchMaxWait(t *testing.T) {
+	apmServer, requests := newBatchTestApmServer(t)
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:   apmServer.URL + "/",
+		batchMaxBytes:  1024,
+		batchMaxWaitMs: 200,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwarded := make(chan error, 1)
+	go func() {
+		forwarded <- transport.ForwardApmData(ctx, &MetadataContainer{})
+	}()
+
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"transaction":{"id":"1"}}`)})
+	time.Sleep(20 * time.Millisecond)
+	transport.EnqueueAPMData(AgentData{Data: []byte(batchTestMetadata + "\n" + `{"transaction":{"id":"2"}}`)})
+
+	require.Eventually(t, func() bool { return len(requests()) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, batchTestMetadata+"\n"+`{"transaction":{"id":"1"}}`+"\n"+`{"transaction":{"id":"2"}}`+"\n", requests()[0])
+	cancel()
+	require.NoError(t, <-forwarded)
+}
@@ -0,0 +1,314 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCentralConfigErrorBytes bounds the size of the error responses of the APM server relayed to the agents.
+const maxCentralConfigErrorBytes = 64 * 1024
+
+// centralConfigKey identifies the agent configuration of a service, as set in Kibana.
+type centralConfigKey struct {
+	service     string
+	environment string
+}
+
+// centralConfigEntry is the agent configuration of a service, as last returned by the APM server.
+type centralConfigEntry struct {
+	etag         string
+	cacheControl string
+	body         []byte
+	settings     map[string]string
+}
+
+// centralConfigStatusError is returned when the APM server answers a central configuration request with a
+// status other than 200 or 304, e.g. 403 when central configuration is disabled in the APM server.
+type centralConfigStatusError struct {
+	statusCode int
+	body       []byte
+}
+
+func (e *centralConfigStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", e.statusCode)
+}
+
+// centralSettings are the central configuration settings applied by the extension itself, along with the
+// function applying a new value. The other settings, e.g. transaction_sample_rate, are only served to the
+// agents of the function.
+var centralSettings = map[string]func(config *extensionConfig, value string) error{
+	"log_level":     applyCentralLogLevel,
+	"send_strategy": applyCentralSendStrategy,
+}
+
+func applyCentralLogLevel(_ *extensionConfig, value string) error {
+	return applyLogLevel(value)
+}
+
+func applyCentralSendStrategy(config *extensionConfig, value string) error {
+	switch sendStrategy := SendStrategy(strings.ToLower(value)); sendStrategy {
+	case Background, SyncFlush, Adaptive, FlushOnNext:
+		config.SendStrategy = sendStrategy
+		return nil
+	default:
+		return fmt.Errorf("unknown send strategy %q", value)
+	}
+}
+
+// centralConfig caches the agent configurations returned by the /config/v1/agents endpoint of the APM
+// server, keyed by service name and environment, along with their ETag, so that the APM server only sends
+// them again once they changed. When polling is enabled, the configuration of the function is polled
+// between invocations.
+type centralConfig struct {
+	interval time.Duration
+	key      centralConfigKey
+	lastPoll time.Time
+	// local holds the values of the central settings before they were changed by the central configuration
+	local   map[string]string
+	applied map[string]string
+
+	mu      sync.Mutex
+	entries map[centralConfigKey]*centralConfigEntry
+}
+
+func newCentralConfig(config *extensionConfig) *centralConfig {
+	local := map[string]string{
+		"log_level":     config.LogLevel.String(),
+		"send_strategy": string(config.SendStrategy),
+	}
+	applied := make(map[string]string, len(local))
+	for name, value := range local {
+		applied[name] = value
+	}
+	return &centralConfig{
+		interval: config.centralConfigInterval,
+		key:      centralConfigKey{service: config.serviceName, environment: config.environment},
+		local:    local,
+		applied:  applied,
+		entries:  make(map[centralConfigKey]*centralConfigEntry),
+	}
+}
+
+func (c *centralConfig) entry(key centralConfigKey) *centralConfigEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+// keys returns the keys of the cached configurations, including the one of the function.
+func (c *centralConfig) keys() []centralConfigKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := []centralConfigKey{c.key}
+	for key := range c.entries {
+		if key != c.key {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// PollCentralConfig refreshes the cached central configurations if the poll interval elapsed since the last
+// poll, and applies the settings of the function. It is meant to be called between invocations, and does
+// nothing if polling the central configuration is disabled.
+func (transport *ApmServerTransport) PollCentralConfig(ctx context.Context, now time.Time) {
+	c := transport.centralConfig
+	if c.interval <= 0 || now.Sub(c.lastPoll) < c.interval {
+		return
+	}
+	if transport.backingOff() {
+		Log.Debug("Central configuration poll skipped - Transport backing off")
+		return
+	}
+	c.lastPoll = now
+	for _, key := range c.keys() {
+		if _, err := transport.fetchCentralConfig(ctx, key); err != nil {
+			// Keep the cached configuration
+			Log.Warnf("Could not poll the central configuration of service %q: %v", key.service, err)
+		}
+	}
+	c.apply(transport.config)
+}
+
+// apply applies the changes of the central settings of the function. Settings removed from the central
+// configuration get back their local value.
+func (c *centralConfig) apply(config *extensionConfig) {
+	var settings map[string]string
+	if entry := c.entry(c.key); entry != nil {
+		settings = entry.settings
+	}
+	names := make([]string, 0, len(centralSettings))
+	for name := range centralSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := settings[name]
+		if !ok {
+			value = c.local[name]
+		}
+		if value == c.applied[name] {
+			continue
+		}
+		if err := centralSettings[name](config, value); err != nil {
+			Log.Warnf("Could not apply central configuration %s=%q, keeping %q: %v", name, value, c.applied[name], err)
+			continue
+		}
+		Log.Infof("Applied central configuration %s=%q (was %q)", name, value, c.applied[name])
+		c.applied[name] = value
+	}
+}
+
+// fetchCentralConfig queries the agent configuration of the service identified by key from the APM server,
+// and caches it. The ETag of the cached configuration is sent along, so that the cached configuration is
+// returned as is if it did not change.
+func (transport *ApmServerTransport) fetchCentralConfig(ctx context.Context, key centralConfigKey) (*centralConfigEntry, error) {
+	c := transport.centralConfig
+	cached := c.entry(key)
+
+	query := url.Values{"service.name": []string{key.service}}
+	if key.environment != "" {
+		query.Set("service.environment", key.environment)
+	}
+	endpoint := transport.endpoints.active()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.url+"config/v1/agents?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	endpoint.credentials.setAuthorization(req)
+
+	resp, err := transport.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if cached == nil {
+			return nil, fmt.Errorf("not modified, but not cached")
+		}
+		return cached, nil
+	case http.StatusOK:
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxCentralConfigErrorBytes))
+		return nil, &centralConfigStatusError{statusCode: resp.StatusCode, body: body}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	entry := &centralConfigEntry{etag: resp.Header.Get("Etag"), cacheControl: resp.Header.Get("Cache-Control"), body: body}
+	if err := json.Unmarshal(body, &entry.settings); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+	Log.Debugf("Central configuration of service %q updated: %s", key.service, body)
+	return entry, nil
+}
+
+// URL: http://server/config/v1/agents
+//
+// handleCentralConfig forwards the central configuration requests of the agents to the APM server, with the
+// credentials of the extension, as agents running in the function cannot always reach the APM server
+// themselves. The cached configuration is returned when the APM server is unreachable, and, when polling is
+// enabled, instead of querying the APM server.
+func handleCentralConfig(transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		Log.Debug("Handling central configuration request")
+		key := centralConfigKey{
+			service:     r.URL.Query().Get("service.name"),
+			environment: r.URL.Query().Get("service.environment"),
+		}
+		if r.Method == http.MethodPost {
+			var body struct {
+				Service struct {
+					Name        string `json:"name"`
+					Environment string `json:"environment"`
+				} `json:"service"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid central configuration request: "+err.Error())
+				return
+			}
+			key = centralConfigKey{service: body.Service.Name, environment: body.Service.Environment}
+		}
+		if key.service == "" {
+			writeJSONError(w, http.StatusBadRequest, "service.name is required")
+			return
+		}
+
+		c := transport.centralConfig
+		entry := c.entry(key)
+		// The APM server is not queried while it is known to be unreachable, if the configuration is cached
+		if entry == nil || (c.interval <= 0 && transport.currentStatus() != Failing) {
+			fetched, err := transport.fetchCentralConfig(r.Context(), key)
+			var statusErr *centralConfigStatusError
+			switch {
+			case err == nil:
+				entry = fetched
+			case errors.As(err, &statusErr) && statusErr.statusCode < http.StatusInternalServerError:
+				// Errors of the agent request, or central configuration disabled in the APM server
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(statusErr.statusCode)
+				_, _ = w.Write(statusErr.body)
+				return
+			case entry != nil:
+				Log.Warnf("Could not fetch the central configuration of service %q, serving the cached one: %v", key.service, err)
+			default:
+				Log.Warnf("Could not fetch the central configuration of service %q: %v", key.service, err)
+				writeJSONError(w, http.StatusServiceUnavailable, "central configuration unavailable: "+err.Error())
+				return
+			}
+		}
+
+		if entry.cacheControl != "" {
+			w.Header().Set("Cache-Control", entry.cacheControl)
+		}
+		if entry.etag != "" {
+			w.Header().Set("Etag", entry.etag)
+			if r.Header.Get("If-None-Match") == entry.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(entry.body); err != nil {
+			Log.Errorf("Failed to write the central configuration: %v", err)
+		}
+	}
+}
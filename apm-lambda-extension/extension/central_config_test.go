@@ -0,0 +1,228 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+// newCentralConfigServer returns a mock APM server serving the given agent configuration, whose ETag is the
+// configuration itself, and which counts the requests that were answered with the configuration.
+func newCentralConfigServer(t *testing.T, config *atomic.Value, served *int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/config/v1/agents", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("service.name") != "foo" {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		body := config.Load().(string)
+		etag := `"` + strings.NewReplacer(`"`, ``, `{`, ``, `}`, ``).Replace(body) + `"`
+		w.Header().Set("Etag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt64(served, 1)
+		w.Header().Set("Cache-Control", "max-age=30")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPollCentralConfig(t *testing.T) {
+	defer Log.Level.SetLevel(Log.Level.Level())
+	var remote atomic.Value
+	remote.Store(`{"log_level":"debug","send_strategy":"background","transaction_sample_rate":"0.1"}`)
+	var served int64
+	apmServer := newCentralConfigServer(t, &remote, &served)
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerSecretToken:  "token",
+		serviceName:           "foo",
+		SendStrategy:          SyncFlush,
+		LogLevel:              zapcore.InfoLevel,
+		centralConfigInterval: time.Minute,
+	}
+	transport := InitApmServerTransport(&config)
+	now := time.Now()
+
+	transport.PollCentralConfig(context.Background(), now)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&served))
+	assert.Equal(t, Background, config.SendStrategy)
+	assert.Equal(t, zapcore.DebugLevel, Log.Level.Level())
+
+	// The configuration is not polled again before the interval elapsed
+	transport.PollCentralConfig(context.Background(), now.Add(time.Second))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&served))
+
+	// The cached configuration is kept while it did not change
+	transport.PollCentralConfig(context.Background(), now.Add(time.Minute))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&served))
+	assert.Equal(t, Background, config.SendStrategy)
+
+	// Removed settings get back their local value, and invalid values are ignored
+	remote.Store(`{"log_level":"verbose"}`)
+	transport.PollCentralConfig(context.Background(), now.Add(2*time.Minute))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&served))
+	assert.Equal(t, SyncFlush, config.SendStrategy)
+	assert.Equal(t, zapcore.DebugLevel, Log.Level.Level())
+}
+
+func TestPollCentralConfigDisabled(t *testing.T) {
+	var remote atomic.Value
+	remote.Store(`{"send_strategy":"background"}`)
+	var served int64
+	apmServer := newCentralConfigServer(t, &remote, &served)
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", apmServerSecretToken: "token", serviceName: "foo", SendStrategy: SyncFlush}
+	transport := InitApmServerTransport(&config)
+	transport.PollCentralConfig(context.Background(), time.Now())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&served))
+	assert.Equal(t, SyncFlush, config.SendStrategy)
+}
+
+func TestHandleCentralConfig(t *testing.T) {
+	var remote atomic.Value
+	remote.Store(`{"transaction_sample_rate":"0.1"}`)
+	var served int64
+	apmServer := newCentralConfigServer(t, &remote, &served)
+
+	config := extensionConfig{
+		apmServerUrl:          apmServer.URL + "/",
+		apmServerSecretToken:  "token",
+		serviceName:           "foo",
+		SendStrategy:          SyncFlush,
+		centralConfigInterval: time.Minute,
+	}
+	transport := InitApmServerTransport(&config)
+	transport.PollCentralConfig(context.Background(), time.Now())
+	require.Equal(t, int64(1), atomic.LoadInt64(&served))
+	handler := handleCentralConfig(transport)
+
+	// The cached configuration is served to the agents
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=foo", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"transaction_sample_rate":"0.1"}`, rec.Body.String())
+	assert.Equal(t, `"transaction_sample_rate:0.1"`, rec.Header().Get("Etag"))
+	assert.Equal(t, "max-age=30", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&served))
+
+	// Agents which already have the configuration are told it did not change
+	req := httptest.NewRequest(http.MethodPost, "/config/v1/agents", strings.NewReader(`{"service":{"name":"foo"}}`))
+	req.Header.Set("If-None-Match", `"transaction_sample_rate:0.1"`)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// The configuration of other services is fetched on demand, and then polled with the one of the function
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=bar&service.environment=prod", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{}`, rec.Body.String())
+	assert.Len(t, transport.centralConfig.keys(), 2)
+
+	// The service name is required
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandleCentralConfigPassthrough(t *testing.T) {
+	var remote atomic.Value
+	remote.Store(`{"transaction_sample_rate":"0.1"}`)
+	var served int64
+	apmServer := newCentralConfigServer(t, &remote, &served)
+
+	// Without polling, the requests are forwarded to the APM server, with the credentials of the extension
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", apmServerSecretToken: "token"}
+	transport := InitApmServerTransport(&config)
+	handler := handleCentralConfig(transport)
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=foo", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"transaction_sample_rate":"0.1"}`, rec.Body.String())
+	}
+	// The second request was answered by the APM server with the cached configuration
+	assert.Equal(t, int64(1), atomic.LoadInt64(&served))
+
+	remote.Store(`{"transaction_sample_rate":"0.5"}`)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=foo", nil))
+	assert.JSONEq(t, `{"transaction_sample_rate":"0.5"}`, rec.Body.String())
+
+	// The cached configuration is returned while the APM server is unreachable
+	apmServer.Close()
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=foo", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"transaction_sample_rate":"0.5"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=bar", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestHandleCentralConfigErrorRelayed(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"error":"forbidden request: Agent remote configuration is disabled"}`))
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", serviceName: "foo"}
+	transport := InitApmServerTransport(&config)
+	rec := httptest.NewRecorder()
+	handleCentralConfig(transport)(rec, httptest.NewRequest(http.MethodGet, "/config/v1/agents?service.name=foo", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "Agent remote configuration is disabled")
+}
+
+func TestProcessEnvCentralConfig(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, time.Duration(0), config.centralConfigInterval)
+
+	t.Setenv("ELASTIC_APM_CENTRAL_CONFIG_POLL_INTERVAL", "30s")
+	t.Setenv("ELASTIC_APM_ENVIRONMENT", "prod")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 30*time.Second, config.centralConfigInterval)
+	assert.Equal(t, "prod", config.environment)
+
+	t.Setenv("ELASTIC_APM_CENTRAL_CONFIG_POLL_INTERVAL", "-1s")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, time.Duration(0), config.centralConfigInterval)
+}
@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+)
+
+// defaultCertExpiryWarning is how long before the expiry of a certificate of the APM server a warning is
+// issued, unless configured otherwise.
+const defaultCertExpiryWarning = 30 * 24 * time.Hour
+
+// certExpiry is the certificate of the APM server chain expiring first, within the warning window.
+type certExpiry struct {
+	subject  string
+	notAfter time.Time
+}
+
+// certExpiryMonitor inspects the certificate chains presented by the APM server, and warns once per
+// certificate when one of them expires within the warning window, so that self-hosted APM servers can
+// renew their certificates before the extension stops sending data.
+type certExpiryMonitor struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	warned  map[string]bool
+	pending *certExpiry
+}
+
+func newCertExpiryMonitor(window time.Duration) *certExpiryMonitor {
+	return &certExpiryMonitor{window: window, warned: make(map[string]bool)}
+}
+
+// observe inspects the certificates of a TLS connection to the APM server, which is nil for plain HTTP
+// connections.
+func (m *certExpiryMonitor) observe(state *tls.ConnectionState, now time.Time) {
+	if m.window <= 0 || state == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cert := range state.PeerCertificates {
+		if cert.NotAfter.Sub(now) > m.window {
+			continue
+		}
+		id := cert.Subject.String() + "/" + cert.SerialNumber.String()
+		if m.warned[id] {
+			continue
+		}
+		m.warned[id] = true
+		if cert.NotAfter.Before(now) {
+			Log.Warnf("The certificate %q of the APM server expired on %s", cert.Subject.String(), cert.NotAfter.Format(time.RFC3339))
+		} else {
+			Log.Warnf("The certificate %q of the APM server expires on %s, in %s", cert.Subject.String(), cert.NotAfter.Format(time.RFC3339), cert.NotAfter.Sub(now).Round(time.Hour))
+		}
+		if m.pending == nil || cert.NotAfter.Before(m.pending.notAfter) {
+			m.pending = &certExpiry{subject: cert.Subject.String(), notAfter: cert.NotAfter}
+		}
+	}
+}
+
+// ReportCertExpiry queues a metricset holding the time left before the expiry of the certificate of the APM
+// server expiring first, once a certificate was found to expire within the warning window. If the metricset
+// cannot be queued, it is queued again later.
+func (transport *ApmServerTransport) ReportCertExpiry(metadataContainer *MetadataContainer) {
+	m := transport.certExpiry
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending == nil {
+		return
+	}
+	metricset := buildMetricset(metadataContainer, time.Now(), map[string]float64{
+		"aws.lambda.extension.tls.certificate.expires_in.sec": time.Until(m.pending.notAfter).Seconds(),
+	}, model.StringMap{{Key: "certificate_subject", Value: m.pending.subject}})
+	select {
+	case transport.dataChannel <- metricset:
+		m.pending = nil
+	default:
+		Log.Debug("Channel full: the certificate expiry will be reported later")
+	}
+}
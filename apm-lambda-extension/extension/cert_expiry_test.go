@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertExpiryMonitor(t *testing.T) {
+	now := time.Now()
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "apm.example.com"}, SerialNumber: big.NewInt(1), NotAfter: now.Add(10 * 24 * time.Hour)}
+	ca := &x509.Certificate{Subject: pkix.Name{CommonName: "Example CA"}, SerialNumber: big.NewInt(2), NotAfter: now.Add(365 * 24 * time.Hour)}
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	monitor := newCertExpiryMonitor(defaultCertExpiryWarning)
+	monitor.observe(nil, now)
+	assert.Nil(t, monitor.pending)
+	monitor.observe(state, now)
+	require.NotNil(t, monitor.pending)
+	assert.Equal(t, "CN=apm.example.com", monitor.pending.subject)
+	assert.Equal(t, leaf.NotAfter, monitor.pending.notAfter)
+
+	// Each certificate is only reported once
+	monitor.pending = nil
+	monitor.observe(state, now)
+	assert.Nil(t, monitor.pending)
+
+	// The warnings can be disabled
+	monitor = newCertExpiryMonitor(0)
+	monitor.observe(state, now)
+	assert.Nil(t, monitor.pending)
+}
+
+func TestReportCertExpiry(t *testing.T) {
+	apmServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	// The certificate of the test server expires in decades
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", certExpiryWarning: 100 * 365 * 24 * time.Hour}
+	transport := InitApmServerTransport(&config)
+	transport.client = apmServer.Client()
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	transport.ReportCertExpiry(metadataContainer)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("data")}))
+	transport.ReportCertExpiry(metadataContainer)
+	require.Equal(t, 1, transport.BufferedDataCount())
+	agentData := <-transport.dataChannel
+	assert.Contains(t, string(agentData.Data), `"certificate_subject":"O=Acme Co"`)
+	assert.Greater(t, selfMetricsSamples(t, agentData)["aws.lambda.extension.tls.certificate.expires_in.sec"], float64(0))
+
+	// The expiry is only reported once
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("data")}))
+	transport.ReportCertExpiry(metadataContainer)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestProcessEnvCertExpiryWarning(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	assert.Equal(t, defaultCertExpiryWarning, ProcessEnv(new(mockSecretManager)).certExpiryWarning)
+
+	t.Setenv("ELASTIC_APM_SERVER_CERT_EXPIRY_WARNING", "168h")
+	assert.Equal(t, 7*24*time.Hour, ProcessEnv(new(mockSecretManager)).certExpiryWarning)
+
+	t.Setenv("ELASTIC_APM_SERVER_CERT_EXPIRY_WARNING", "0")
+	assert.Equal(t, time.Duration(0), ProcessEnv(new(mockSecretManager)).certExpiryWarning)
+
+	t.Setenv("ELASTIC_APM_SERVER_CERT_EXPIRY_WARNING", "soon")
+	assert.Equal(t, defaultCertExpiryWarning, ProcessEnv(new(mockSecretManager)).certExpiryWarning)
+}
@@ -24,6 +24,8 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+
+	"elastic/apm-lambda-extension/failpoint"
 )
 
 // RegisterResponse is the body of the response for /register
@@ -41,6 +43,29 @@ type NextEventResponse struct {
 	RequestID          string    `json:"requestId"`
 	InvokedFunctionArn string    `json:"invokedFunctionArn"`
 	Tracing            Tracing   `json:"tracing"`
+	ShutdownReason     string    `json:"shutdownReason,omitempty"`
+	// RuntimeDoneStatus is the status of the platform.runtimeDone event received
+	// for this invocation, if any
+	RuntimeDoneStatus string `json:"-"`
+	// FunctionVersion is the version of the function reported by the platform.start
+	// event received for this invocation, if any
+	FunctionVersion string `json:"-"`
+	// StartTime is the time of the platform.start event received for this invocation,
+	// if any
+	StartTime time.Time `json:"-"`
+	// Coldstart is set when this is the first invocation of the execution environment
+	Coldstart bool `json:"-"`
+	// AgentDataSeen is set when agent data was received during this invocation
+	AgentDataSeen bool `json:"-"`
+	// FlushDeadlineReached is set when neither the agent nor the runtime reported
+	// the end of this invocation before the flush deadline
+	FlushDeadlineReached bool `json:"-"`
+	// SendStrategy is the send strategy applied to this invocation, which differs
+	// from the configured one for functions with a short timeout
+	SendStrategy SendStrategy `json:"-"`
+	// QueueTime is the time the trigger of this invocation waited before the
+	// runtime received its event, e.g. since its SQS message was sent, if known
+	QueueTime time.Duration `json:"-"`
 }
 
 // Tracing is part of the response for /event/next
@@ -54,6 +79,21 @@ type StatusResponse struct {
 	Status string `json:"status"`
 }
 
+// RegisterError is returned when the Extensions API rejects the registration of the extension.
+type RegisterError struct {
+	StatusCode   int
+	ErrorType    string `json:"errorType"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+func (e *RegisterError) Error() string {
+	msg := fmt.Sprintf("extension register request failed with status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.ErrorType != "" || e.ErrorMessage != "" {
+		msg += fmt.Sprintf(": %s: %s", e.ErrorType, e.ErrorMessage)
+	}
+	return msg
+}
+
 // EventType represents the type of events recieved from /event/next
 type EventType string
 
@@ -89,6 +129,9 @@ func NewClient(awsLambdaRuntimeAPI string) *Client {
 func (e *Client) Register(ctx context.Context, filename string) (*RegisterResponse, error) {
 	const action = "/register"
 	url := e.baseURL + action
+	if err := failpoint.Inject(failpoint.Register); err != nil {
+		return nil, err
+	}
 
 	reqBody, err := json.Marshal(map[string]interface{}{
 		"events": []EventType{Invoke, Shutdown},
@@ -108,7 +151,10 @@ func (e *Client) Register(ctx context.Context, filename string) (*RegisterRespon
 	defer httpRes.Body.Close()
 
 	if httpRes.StatusCode != 200 {
-		return nil, fmt.Errorf("extension register request failed with status %s", httpRes.Status)
+		registerErr := &RegisterError{StatusCode: httpRes.StatusCode}
+		// The body usually describes the error, but it is not guaranteed to
+		_ = json.NewDecoder(httpRes.Body).Decode(registerErr)
+		return nil, registerErr
 	}
 	res := RegisterResponse{}
 	if err := json.NewDecoder(httpRes.Body).Decode(&res); err != nil {
@@ -59,6 +59,23 @@ func TestRegister(t *testing.T) {
 	assert.Equal(t, "lambda_function.lambda_handler", res.Handler)
 }
 
+func TestRegisterError(t *testing.T) {
+	runtimeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errorMessage":"Extension name is not valid","errorType":"Extension.InvalidName"}`))
+	}))
+	defer runtimeServer.Close()
+
+	client := NewClient(runtimeServer.Listener.Addr().String())
+	_, err := client.Register(context.Background(), "renamed")
+	require.Error(t, err)
+	registerErr, ok := err.(*RegisterError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusForbidden, registerErr.StatusCode)
+	assert.Equal(t, "Extension.InvalidName", registerErr.ErrorType)
+	assert.Equal(t, "extension register request failed with status 403 Forbidden: Extension.InvalidName: Extension name is not valid", err.Error())
+}
+
 func TestNextEvent(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
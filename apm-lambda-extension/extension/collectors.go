@@ -0,0 +1,191 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// defaultCollectorsInterval is the minimum interval between two collections, unless configured otherwise.
+	defaultCollectorsInterval = time.Minute
+	// collectTimeout bounds the duration of a collection, as it delays the next invocation.
+	collectTimeout = time.Second
+)
+
+// Collector collects metrics between invocations, e.g. about the execution environment. Collectors other
+// than the built-in ones can be registered with Collectors.Register.
+type Collector interface {
+	// Name identifies the collector in the configuration and the logs.
+	Name() string
+	// Collect returns the samples of the metrics, by name.
+	Collect(ctx context.Context) (map[string]float64, error)
+}
+
+// Collectors runs the registered collectors between invocations, at most once per interval, and queues
+// the collected samples as a metricset.
+type Collectors struct {
+	interval   time.Duration
+	collectors []Collector
+	lastRun    time.Time
+}
+
+// NewCollectors returns the collectors enabled by ELASTIC_APM_LAMBDA_COLLECTORS.
+func NewCollectors(config *extensionConfig, transport *ApmServerTransport) *Collectors {
+	c := &Collectors{interval: config.collectorsInterval}
+	if c.interval <= 0 {
+		c.interval = defaultCollectorsInterval
+	}
+	builtins := map[string]Collector{
+		envSizeCollectorName:    envSizeCollector{},
+		openFDsCollectorName:    openFDsCollector{procDir: "/proc"},
+		dnsLatencyCollectorName: dnsLatencyCollector{apmServerURL: func() string { return transport.endpoints.active().url }},
+	}
+	for _, name := range config.collectors {
+		if collector, ok := builtins[name]; ok {
+			c.Register(collector)
+		} else {
+			Log.Warnf("Unknown collector %s in ELASTIC_APM_LAMBDA_COLLECTORS, ignoring it", name)
+		}
+	}
+	return c
+}
+
+// Register adds a collector run with the built-in ones.
+func (c *Collectors) Register(collector Collector) {
+	c.collectors = append(c.collectors, collector)
+}
+
+// Collect runs the collectors if the interval elapsed since they last ran, and queues the samples they
+// collected as a metricset. A collector that fails is skipped until the next collection.
+func (c *Collectors) Collect(ctx context.Context, transport *ApmServerTransport, metadataContainer *MetadataContainer, now time.Time) {
+	if len(c.collectors) == 0 || now.Sub(c.lastRun) < c.interval {
+		return
+	}
+	c.lastRun = now
+	ctx, cancel := context.WithTimeout(ctx, collectTimeout)
+	defer cancel()
+	samples := make(map[string]float64)
+	for _, collector := range c.collectors {
+		collected, err := collector.Collect(ctx)
+		if err != nil {
+			Log.Debugf("Collector %s failed: %v", collector.Name(), err)
+			continue
+		}
+		for name, value := range collected {
+			samples[name] = value
+		}
+	}
+	if len(samples) == 0 {
+		return
+	}
+	select {
+	case transport.dataChannel <- buildMetricset(metadataContainer, now, samples, nil):
+	default:
+		Log.Debug("Channel full: the collected metrics are dropped")
+	}
+}
+
+const envSizeCollectorName = "env_size"
+
+// envSizeCollector collects the number and the size of the environment variables, which Lambda limits to
+// 4KB in total.
+type envSizeCollector struct{}
+
+func (envSizeCollector) Name() string {
+	return envSizeCollectorName
+}
+
+func (envSizeCollector) Collect(context.Context) (map[string]float64, error) {
+	env := os.Environ()
+	size := 0
+	for _, variable := range env {
+		size += len(variable)
+	}
+	return map[string]float64{
+		"aws.lambda.extension.env.count": float64(len(env)),
+		"aws.lambda.extension.env.bytes": float64(size),
+	}, nil
+}
+
+const openFDsCollectorName = "open_fds"
+
+// openFDsCollector collects the number of file descriptors opened by the processes of the execution
+// environment, which Lambda limits to 1024.
+type openFDsCollector struct {
+	procDir string
+}
+
+func (openFDsCollector) Name() string {
+	return openFDsCollectorName
+}
+
+func (c openFDsCollector) Collect(context.Context) (map[string]float64, error) {
+	fdDirs, err := filepath.Glob(filepath.Join(c.procDir, "[0-9]*", "fd"))
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, fdDir := range fdDirs {
+		// The processes may have exited, or belong to another user
+		if fds, err := ioutil.ReadDir(fdDir); err == nil {
+			count += len(fds)
+		}
+	}
+	return map[string]float64{"system.process.fd.open": float64(count)}, nil
+}
+
+const dnsLatencyCollectorName = "dns_latency"
+
+// dnsLatencyCollector measures the latency of the DNS resolution of the host of the APM server, which adds
+// to the latency of each new connection.
+type dnsLatencyCollector struct {
+	apmServerURL func() string
+}
+
+func (dnsLatencyCollector) Name() string {
+	return dnsLatencyCollectorName
+}
+
+func (c dnsLatencyCollector) Collect(ctx context.Context) (map[string]float64, error) {
+	u, err := url.Parse(c.apmServerURL())
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return nil, nil
+	}
+	start := time.Now()
+	_, err = net.DefaultResolver.LookupHost(ctx, host)
+	failures := 0.0
+	if err != nil {
+		Log.Debugf("Could not resolve %s: %v", host, err)
+		failures = 1
+	}
+	return map[string]float64{
+		"aws.lambda.extension.dns.lookup.latency.us": float64(time.Since(start).Microseconds()),
+		"aws.lambda.extension.dns.lookup.failures":   failures,
+	}, nil
+}
@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCollector struct {
+	name    string
+	samples map[string]float64
+	err     error
+}
+
+func (c testCollector) Name() string {
+	return c.name
+}
+
+func (c testCollector) Collect(context.Context) (map[string]float64, error) {
+	return c.samples, c.err
+}
+
+func TestCollectors(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", collectors: []string{"env_size", "unknown"}, collectorsInterval: time.Minute}
+	transport := InitApmServerTransport(&config)
+	collectors := NewCollectors(&config, transport)
+	require.Len(t, collectors.collectors, 1)
+	collectors.Register(testCollector{name: "custom", samples: map[string]float64{"custom.metric": 42}})
+	collectors.Register(testCollector{name: "failing", err: errors.New("failure")})
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	now := time.Now()
+	collectors.Collect(context.Background(), transport, metadataContainer, now)
+	require.Equal(t, 1, transport.BufferedDataCount())
+	samples := selfMetricsSamples(t, <-transport.dataChannel)
+	assert.Equal(t, float64(42), samples["custom.metric"])
+	assert.Equal(t, float64(len(os.Environ())), samples["aws.lambda.extension.env.count"])
+	assert.Greater(t, samples["aws.lambda.extension.env.bytes"], float64(0))
+
+	// The collectors run at most once per interval
+	collectors.Collect(context.Background(), transport, metadataContainer, now.Add(30*time.Second))
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	collectors.Collect(context.Background(), transport, metadataContainer, now.Add(time.Minute))
+	assert.Equal(t, 1, transport.BufferedDataCount())
+}
+
+func TestCollectorsNone(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/"}
+	transport := InitApmServerTransport(&config)
+	collectors := NewCollectors(&config, transport)
+	collectors.Collect(context.Background(), transport, &MetadataContainer{}, time.Now())
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestOpenFDsCollector(t *testing.T) {
+	procDir := t.TempDir()
+	for _, fd := range []string{"1/fd/0", "1/fd/1", "2/fd/0", "self/fd/0"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(procDir, fd)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(procDir, fd), nil, 0644))
+	}
+	samples, err := openFDsCollector{procDir: procDir}.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"system.process.fd.open": 3}, samples)
+}
+
+func TestDNSLatencyCollector(t *testing.T) {
+	samples, err := dnsLatencyCollector{apmServerURL: func() string { return "http://127.0.0.1:8200/" }}.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, samples)
+
+	samples, err = dnsLatencyCollector{apmServerURL: func() string { return "http://localhost:8200/" }}.Collect(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), samples["aws.lambda.extension.dns.lookup.failures"])
+	assert.Contains(t, samples, "aws.lambda.extension.dns.lookup.latency.us")
+}
+
+func TestProcessEnvCollectors(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Empty(t, config.collectors)
+	assert.Equal(t, defaultCollectorsInterval, config.collectorsInterval)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_COLLECTORS", "env_size, open_fds")
+	t.Setenv("ELASTIC_APM_LAMBDA_COLLECTORS_INTERVAL", "5m")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, []string{"env_size", "open_fds"}, config.collectors)
+	assert.Equal(t, 5*time.Minute, config.collectorsInterval)
+}
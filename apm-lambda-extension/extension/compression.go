@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compression represents the algorithm used to compress the agent data sent uncompressed by the agents
+type Compression string
+
+const (
+	// GzipCompression compresses the agent data with gzip, at the configured level
+	GzipCompression Compression = "gzip"
+
+	// NoCompression sends the agent data as received from the agents
+	NoCompression Compression = "none"
+)
+
+// compressionConfig holds how the agent data sent uncompressed by the agents is compressed before it is
+// sent to the APM server. Payloads smaller than minBytes are sent uncompressed.
+type compressionConfig struct {
+	algorithm Compression
+	level     int
+	minBytes  int
+}
+
+// defaultCompressionConfig favors the CPU time of the function over the bandwidth.
+var defaultCompressionConfig = compressionConfig{
+	algorithm: GzipCompression,
+	level:     gzip.BestSpeed,
+}
+
+// contentEncoding returns the Content-Encoding of a payload of size bytes, or "" if it is sent uncompressed.
+func (config compressionConfig) contentEncoding(size int) string {
+	if config.algorithm == NoCompression || size < config.minBytes {
+		return ""
+	}
+	return "gzip"
+}
+
+// compress writes the compressed data to buf, and returns the Content-Encoding of the result. The data
+// is returned as is, with an empty encoding, when it is not compressed.
+func (config compressionConfig) compress(buf *bytes.Buffer, data []byte) ([]byte, string, error) {
+	encoding := config.contentEncoding(len(data))
+	if encoding == "" {
+		return data, "", nil
+	}
+	gw, err := gzip.NewWriterLevel(buf, config.level)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := gw.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), encoding, nil
+}
+
+// compressStream copies the data read from body to w, compressing it unless the algorithm is none. The
+// size of streamed data is unknown beforehand, so it is compressed whatever its size, and the result is
+// encoded with contentEncoding(math.MaxInt32).
+func (config compressionConfig) compressStream(w io.Writer, body io.Reader) error {
+	if config.algorithm == NoCompression {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	gw, err := gzip.NewWriterLevel(w, config.level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(gw, body); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// uncompressedReader returns a reader of the uncompressed data read from body, compressed with
+// contentEncoding, as GetUncompressedBytes does without reading the whole data in memory.
+func uncompressedReader(body io.Reader, contentEncoding string) (io.Reader, error) {
+	switch contentEncoding {
+	case "deflate":
+		reader, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("could not create zlib.NewReader: %v", err)
+		}
+		return reader, nil
+	case "gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("could not create gzip.NewReader: %v", err)
+		}
+		return reader, nil
+	default:
+		return body, nil
+	}
+}
+
+// transcodeDeflate re-encodes agent data compressed with deflate by the agent like the agent data the
+// extension compresses itself, so that the buffered agent data is either compressed with gzip or
+// uncompressed, whatever the agent, and batches can be built from any of them. The agent data is returned
+// as is if it is not compressed with deflate, or if it cannot be decompressed.
+func (transport *ApmServerTransport) transcodeDeflate(agentData AgentData) AgentData {
+	if agentData.ContentEncoding != "deflate" {
+		return agentData
+	}
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		Log.Warnf("Could not transcode deflate agent data, buffering it as is: %v", err)
+		return agentData
+	}
+	// The buffer is not pooled, as the result is buffered
+	var buf bytes.Buffer
+	compressed, encoding, err := transport.compression.compress(&buf, data)
+	if err != nil {
+		Log.Warnf("Could not compress the transcoded agent data, buffering it uncompressed: %v", err)
+		compressed, encoding = data, ""
+	}
+	agentData.Data = compressed
+	agentData.ContentEncoding = encoding
+	return agentData
+}
@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompress(t *testing.T) {
+	data := []byte(strings.Repeat("A long time ago in a galaxy far, far away...", 10))
+
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		var buf bytes.Buffer
+		config := compressionConfig{algorithm: GzipCompression, level: level}
+		compressed, encoding, err := config.compress(&buf, data)
+		require.NoError(t, err)
+		assert.Equal(t, "gzip", encoding)
+		uncompressed, err := GetUncompressedBytes(compressed, encoding)
+		require.NoError(t, err)
+		assert.Equal(t, data, uncompressed)
+	}
+
+	var buf bytes.Buffer
+	config := compressionConfig{algorithm: GzipCompression, level: gzip.BestSpeed, minBytes: len(data) + 1}
+	compressed, encoding, err := config.compress(&buf, data)
+	require.NoError(t, err)
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, data, compressed)
+
+	config = compressionConfig{algorithm: NoCompression}
+	compressed, encoding, err = config.compress(&buf, data)
+	require.NoError(t, err)
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, data, compressed)
+}
+
+func TestCompressStream(t *testing.T) {
+	data := []byte("A long time ago in a galaxy far, far away...")
+
+	var buf bytes.Buffer
+	config := compressionConfig{algorithm: GzipCompression, level: gzip.BestCompression, minBytes: 1024}
+	require.NoError(t, config.compressStream(&buf, bytes.NewReader(data)))
+	uncompressed, err := GetUncompressedBytes(buf.Bytes(), "gzip")
+	require.NoError(t, err)
+	assert.Equal(t, data, uncompressed)
+
+	buf.Reset()
+	config = compressionConfig{algorithm: NoCompression}
+	require.NoError(t, config.compressStream(&buf, bytes.NewReader(data)))
+	assert.Equal(t, data, buf.Bytes())
+}
+
+func TestPostToApmServerSmallPayloadNotCompressed(t *testing.T) {
+	data := []byte("A long time ago in a galaxy far, far away...")
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, data, body)
+		_, isSet := r.Header["Content-Encoding"]
+		assert.False(t, isSet)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		compression:  compressionConfig{algorithm: GzipCompression, level: gzip.BestSpeed, minBytes: 1024},
+	}
+	transport := InitApmServerTransport(&config)
+	assert.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: data}))
+}
+
+func TestTranscodeDeflate(t *testing.T) {
+	data := []byte(strings.Repeat("A long time ago in a galaxy far, far away...", 10))
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "https://example.com/"})
+	transcoded := transport.transcodeDeflate(AgentData{Data: deflated.Bytes(), ContentEncoding: "deflate"})
+	assert.Equal(t, "gzip", transcoded.ContentEncoding)
+	uncompressed, err := GetUncompressedBytes(transcoded.Data, transcoded.ContentEncoding)
+	require.NoError(t, err)
+	assert.Equal(t, data, uncompressed)
+
+	// Without compression, deflate agent data is buffered uncompressed
+	transport = InitApmServerTransport(&extensionConfig{apmServerUrl: "https://example.com/", compression: compressionConfig{algorithm: NoCompression}})
+	transcoded = transport.transcodeDeflate(AgentData{Data: deflated.Bytes(), ContentEncoding: "deflate"})
+	assert.Equal(t, "", transcoded.ContentEncoding)
+	assert.Equal(t, data, transcoded.Data)
+
+	// Other agent data, and invalid deflate data, are buffered as is
+	gzipped := AgentData{Data: []byte("gzipped"), ContentEncoding: "gzip"}
+	assert.Equal(t, gzipped, transport.transcodeDeflate(gzipped))
+	invalid := AgentData{Data: []byte("invalid"), ContentEncoding: "deflate"}
+	assert.Equal(t, invalid, transport.transcodeDeflate(invalid))
+}
+
+func TestProcessEnvCompression(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultCompressionConfig, config.compression)
+
+	t.Setenv("ELASTIC_APM_COMPRESSION", "NONE")
+	t.Setenv("ELASTIC_APM_COMPRESSION_LEVEL", "9")
+	t.Setenv("ELASTIC_APM_COMPRESSION_MIN_BYTES", "1024")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, compressionConfig{algorithm: NoCompression, level: 9, minBytes: 1024}, config.compression)
+
+	// The intake API of the APM server only accepts gzip and deflate compressed data
+	t.Setenv("ELASTIC_APM_COMPRESSION", "zstd")
+	t.Setenv("ELASTIC_APM_COMPRESSION_LEVEL", "10")
+	t.Setenv("ELASTIC_APM_COMPRESSION_MIN_BYTES", "-1")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultCompressionConfig, config.compression)
+}
@@ -0,0 +1,160 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+)
+
+const configSnapshotFileName = "config-snapshot.json"
+
+// configSnapshotVariables are the variables, besides those of the extension and the agents, whose changes
+// alter the behavior of the function.
+var configSnapshotVariables = map[string]bool{
+	"AWS_EXECUTION_ENV":               true,
+	"AWS_LAMBDA_EXEC_WRAPPER":         true,
+	"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": true,
+	"AWS_LAMBDA_FUNCTION_VERSION":     true,
+	"AWS_LAMBDA_INITIALIZATION_TYPE":  true,
+}
+
+// configSnapshot is the configuration of the execution environment at a cold start. Only the hashes of the
+// values are kept, so that the secrets among them are not written to /tmp.
+type configSnapshot struct {
+	Hash      string            `json:"hash"`
+	Variables map[string]string `json:"variables"`
+}
+
+// configDrift is a change of the configuration since the previous cold start of the execution environment.
+type configDrift struct {
+	hash         string
+	previousHash string
+	changed      []string
+}
+
+// takeConfigSnapshot takes a snapshot of the variables of environ relevant to the configuration.
+func takeConfigSnapshot(environ []string) configSnapshot {
+	snapshot := configSnapshot{Variables: make(map[string]string)}
+	for _, kv := range environ {
+		name, value := kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		if !strings.HasPrefix(name, envPrefix) && !configSnapshotVariables[name] {
+			continue
+		}
+		sum := sha256.Sum256([]byte(value))
+		snapshot.Variables[name] = hex.EncodeToString(sum[:8])
+	}
+	names := make([]string, 0, len(snapshot.Variables))
+	for name := range snapshot.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name + "=" + snapshot.Variables[name] + "\n"))
+	}
+	snapshot.Hash = hex.EncodeToString(hash.Sum(nil)[:8])
+	return snapshot
+}
+
+// changedVariables returns the names of the variables set, unset or changed since previous, sorted.
+func (snapshot configSnapshot) changedVariables(previous configSnapshot) []string {
+	var changed []string
+	for name, value := range snapshot.Variables {
+		if previous.Variables[name] != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous.Variables {
+		if _, ok := snapshot.Variables[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// RecordConfigSnapshot compares the configuration of the execution environment with the one recorded at the
+// previous cold start, and records it for the next one. As the snapshot is kept in /tmp, changes are
+// detected when /tmp outlives the extension process, e.g. when the execution environment is reset after
+// a failed invocation, or restored from a SnapStart snapshot taken with another configuration.
+func (transport *ApmServerTransport) RecordConfigSnapshot() {
+	transport.configDrift = recordConfigSnapshot(filepath.Join(transport.config.spillDir, configSnapshotFileName), os.Environ())
+}
+
+// recordConfigSnapshot replaces the snapshot at path with the one of environ, and returns the drift from the
+// previous one, if any.
+func recordConfigSnapshot(path string, environ []string) *configDrift {
+	snapshot := takeConfigSnapshot(environ)
+	var drift *configDrift
+	if content, err := ioutil.ReadFile(path); err == nil {
+		var previous configSnapshot
+		if err := json.Unmarshal(content, &previous); err != nil {
+			Log.Warnf("Could not read the previous configuration snapshot: %v", err)
+		} else if previous.Hash != snapshot.Hash {
+			drift = &configDrift{hash: snapshot.Hash, previousHash: previous.Hash, changed: snapshot.changedVariables(previous)}
+			Log.Warnf("The configuration changed since the previous cold start of the execution environment, from %s to %s: %s",
+				previous.Hash, snapshot.Hash, strings.Join(drift.changed, ", "))
+		}
+	}
+
+	content, err := json.Marshal(snapshot)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+			err = ioutil.WriteFile(path, content, 0600)
+		}
+	}
+	if err != nil {
+		Log.Warnf("Could not record the configuration snapshot: %v", err)
+	}
+	return drift
+}
+
+// ReportConfigDrift queues a metricset labelled with the changed variables, once the configuration was found
+// to differ from the previous cold start. If the metricset cannot be queued, it is queued again later.
+func (transport *ApmServerTransport) ReportConfigDrift(metadataContainer *MetadataContainer) {
+	drift := transport.configDrift
+	if drift == nil {
+		return
+	}
+	metricset := buildMetricset(metadataContainer, time.Now(), map[string]float64{
+		"aws.lambda.extension.config.drift": 1,
+	}, model.StringMap{
+		{Key: "config_hash", Value: drift.hash},
+		{Key: "previous_config_hash", Value: drift.previousHash},
+		{Key: "config_changed", Value: strings.Join(drift.changed, ",")},
+	})
+	select {
+	case transport.dataChannel <- metricset:
+		transport.configDrift = nil
+	default:
+		Log.Debug("Channel full: the configuration drift will be reported later")
+	}
+}
@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTakeConfigSnapshot(t *testing.T) {
+	snapshot := takeConfigSnapshot([]string{
+		"ELASTIC_APM_SECRET_TOKEN=secret",
+		"ELASTIC_APM_LOG_LEVEL=debug",
+		"AWS_LAMBDA_FUNCTION_VERSION=3",
+		"PATH=/usr/bin",
+	})
+	assert.Len(t, snapshot.Variables, 3)
+	assert.NotContains(t, snapshot.Variables, "PATH")
+	assert.NotEqual(t, "secret", snapshot.Variables["ELASTIC_APM_SECRET_TOKEN"])
+
+	// The snapshot does not depend on the order of the variables, only on their values
+	same := takeConfigSnapshot([]string{
+		"PATH=/bin",
+		"AWS_LAMBDA_FUNCTION_VERSION=3",
+		"ELASTIC_APM_LOG_LEVEL=debug",
+		"ELASTIC_APM_SECRET_TOKEN=secret",
+	})
+	assert.Equal(t, snapshot.Hash, same.Hash)
+
+	other := takeConfigSnapshot([]string{
+		"ELASTIC_APM_SECRET_TOKEN=other",
+		"AWS_LAMBDA_FUNCTION_VERSION=3",
+		"ELASTIC_APM_SEND_STRATEGY=background",
+	})
+	assert.NotEqual(t, snapshot.Hash, other.Hash)
+	assert.Equal(t, []string{"ELASTIC_APM_LOG_LEVEL", "ELASTIC_APM_SECRET_TOKEN", "ELASTIC_APM_SEND_STRATEGY"}, other.changedVariables(snapshot))
+}
+
+func TestRecordConfigSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "elastic-apm-lambda-extension", configSnapshotFileName)
+
+	// No drift is reported at the first cold start, nor when the configuration did not change
+	assert.Nil(t, recordConfigSnapshot(path, []string{"ELASTIC_APM_LOG_LEVEL=info"}))
+	assert.Nil(t, recordConfigSnapshot(path, []string{"ELASTIC_APM_LOG_LEVEL=info"}))
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "info")
+
+	drift := recordConfigSnapshot(path, []string{"ELASTIC_APM_LOG_LEVEL=debug"})
+	require.NotNil(t, drift)
+	assert.Equal(t, []string{"ELASTIC_APM_LOG_LEVEL"}, drift.changed)
+	assert.NotEqual(t, drift.previousHash, drift.hash)
+	assert.Nil(t, recordConfigSnapshot(path, []string{"ELASTIC_APM_LOG_LEVEL=debug"}))
+}
+
+func TestReportConfigDrift(t *testing.T) {
+	config := extensionConfig{spillDir: t.TempDir()}
+	transport := InitApmServerTransport(&config)
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	transport.ReportConfigDrift(metadataContainer)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+
+	transport.configDrift = recordConfigSnapshot(filepath.Join(config.spillDir, configSnapshotFileName), []string{"ELASTIC_APM_LOG_LEVEL=info"})
+	transport.configDrift = recordConfigSnapshot(filepath.Join(config.spillDir, configSnapshotFileName), []string{"ELASTIC_APM_LOG_LEVEL=debug"})
+	transport.ReportConfigDrift(metadataContainer)
+	require.Equal(t, 1, transport.BufferedDataCount())
+	agentData := <-transport.dataChannel
+	assert.Contains(t, string(agentData.Data), `"config_changed":"ELASTIC_APM_LOG_LEVEL"`)
+	assert.Equal(t, float64(1), selfMetricsSamples(t, agentData)["aws.lambda.extension.config.drift"])
+
+	// The drift is only reported once
+	transport.ReportConfigDrift(metadataContainer)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
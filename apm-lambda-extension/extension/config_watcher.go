@@ -0,0 +1,159 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/joho/godotenv"
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultConfigWatchInterval is the interval at which the dynamic configuration is checked when an SSM
+// parameter is configured without a watch interval.
+const defaultConfigWatchInterval = 5 * time.Minute
+
+// parameterStore is the subset of the SSM API used to read the dynamic configuration.
+type parameterStore interface {
+	GetParameter(*ssm.GetParameterInput) (*ssm.GetParameterOutput, error)
+}
+
+// dynamicSettings are the configuration variables which can be changed in a warm execution environment,
+// along with the function applying a new value. An empty value restores the default.
+var dynamicSettings = map[string]func(value string) error{
+	"ELASTIC_APM_LOG_LEVEL": applyLogLevel,
+}
+
+func applyLogLevel(value string) error {
+	level := zapcore.InfoLevel
+	if value != "" {
+		var err error
+		if level, err = ParseLogLevel(value); err != nil {
+			return err
+		}
+	}
+	Log.Level.SetLevel(level)
+	return nil
+}
+
+// ConfigWatcher applies configuration changes between invocations, without waiting for a cold start.
+// Environment variables only change with a new execution environment, so the changes come from the SSM
+// parameter holding the dynamic configuration, whose values take precedence over the environment
+// variables, and from the APM server credentials stored in Secrets Manager.
+type ConfigWatcher struct {
+	store         parameterStore
+	parameterName string
+	credentials   *credentials
+	interval      time.Duration
+	lastCheck     time.Time
+	applied       map[string]string
+}
+
+// NewConfigWatcher returns a ConfigWatcher for the given configuration, or nil if watching the
+// configuration is disabled.
+func NewConfigWatcher(config *extensionConfig, store parameterStore, transport *ApmServerTransport) *ConfigWatcher {
+	interval := config.configWatchInterval
+	if interval <= 0 && config.configSSMParameter != "" {
+		interval = defaultConfigWatchInterval
+	}
+	if interval <= 0 {
+		return nil
+	}
+	watcher := &ConfigWatcher{
+		store:         store,
+		parameterName: config.configSSMParameter,
+		credentials:   transport.credentials,
+		interval:      interval,
+		lastCheck:     time.Now(),
+		applied:       make(map[string]string, len(dynamicSettings)),
+	}
+	for name := range dynamicSettings {
+		watcher.applied[name] = getEnv(name)
+	}
+	return watcher
+}
+
+// Check looks for configuration changes if the watch interval elapsed since the last check, and applies
+// them. It is meant to be called between invocations, and does nothing on a nil ConfigWatcher.
+func (w *ConfigWatcher) Check(now time.Time) {
+	if w == nil || now.Sub(w.lastCheck) < w.interval {
+		return
+	}
+	w.lastCheck = now
+	Log.Debug("Checking for configuration changes")
+
+	w.credentials.refresh()
+
+	values := make(map[string]string, len(dynamicSettings))
+	for name := range dynamicSettings {
+		values[name] = getEnv(name)
+	}
+	if w.parameterName != "" {
+		overrides, err := w.fetchParameter()
+		if err != nil {
+			// Keep the current configuration rather than reverting to the environment variables
+			Log.Warnf("Could not read the dynamic configuration from SSM parameter %s: %v", w.parameterName, err)
+			return
+		}
+		for name, value := range overrides {
+			if _, ok := dynamicSettings[name]; !ok {
+				Log.Warnf("%s cannot be changed without a cold start, ignoring it", name)
+				continue
+			}
+			values[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := values[name]
+		if value == w.applied[name] {
+			continue
+		}
+		if err := dynamicSettings[name](value); err != nil {
+			Log.Warnf("Could not apply %s=%q, keeping %q: %v", name, value, w.applied[name], err)
+			continue
+		}
+		Log.Infof("Applied configuration change %s=%q (was %q)", name, value, w.applied[name])
+		w.applied[name] = value
+	}
+}
+
+// fetchParameter reads the SSM parameter holding the dynamic configuration, written in the dotenv
+// format, e.g. ELASTIC_APM_LOG_LEVEL=debug.
+func (w *ConfigWatcher) fetchParameter() (map[string]string, error) {
+	output, err := w.store.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(w.parameterName),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.Parameter == nil || output.Parameter.Value == nil {
+		return nil, fmt.Errorf("parameter has no value")
+	}
+	return godotenv.Unmarshal(*output.Parameter.Value)
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+// mockParameterStore returns the current value of an SSM parameter, or an error.
+type mockParameterStore struct {
+	value string
+	err   error
+	calls int
+}
+
+func (s *mockParameterStore) GetParameter(input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String(s.value)}}, nil
+}
+
+func TestConfigWatcherDisabled(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "http://localhost:8200/"}
+	assert.Nil(t, NewConfigWatcher(&config, &mockParameterStore{}, InitApmServerTransport(&config)))
+
+	var watcher *ConfigWatcher
+	watcher.Check(time.Now())
+}
+
+func TestConfigWatcherDefaultInterval(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "http://localhost:8200/", configSSMParameter: "/lambda/apm"}
+	watcher := NewConfigWatcher(&config, &mockParameterStore{}, InitApmServerTransport(&config))
+	require.NotNil(t, watcher)
+	assert.Equal(t, defaultConfigWatchInterval, watcher.interval)
+}
+
+func TestConfigWatcherAppliesLogLevel(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LOG_LEVEL", "info")
+	defer Log.Level.SetLevel(Log.Level.Level())
+	Log.Level.SetLevel(zapcore.InfoLevel)
+
+	store := &mockParameterStore{value: "ELASTIC_APM_LOG_LEVEL=debug\nELASTIC_APM_LAMBDA_APM_SERVER=http://other:8200\n"}
+	config := extensionConfig{apmServerUrl: "http://localhost:8200/", configSSMParameter: "/lambda/apm", configWatchInterval: time.Minute}
+	watcher := NewConfigWatcher(&config, store, InitApmServerTransport(&config))
+	start := watcher.lastCheck
+
+	// The parameter is only read once the watch interval elapsed
+	watcher.Check(start.Add(time.Second))
+	assert.Equal(t, 0, store.calls)
+	assert.Equal(t, zapcore.InfoLevel, Log.Level.Level())
+
+	watcher.Check(start.Add(time.Minute))
+	assert.Equal(t, 1, store.calls)
+	assert.Equal(t, zapcore.DebugLevel, Log.Level.Level())
+
+	// Invalid values are ignored
+	store.value = "ELASTIC_APM_LOG_LEVEL=verbose"
+	watcher.Check(start.Add(2 * time.Minute))
+	assert.Equal(t, zapcore.DebugLevel, Log.Level.Level())
+
+	// A failure to read the parameter keeps the current configuration
+	store.err = errors.New("throttled")
+	watcher.Check(start.Add(3 * time.Minute))
+	assert.Equal(t, zapcore.DebugLevel, Log.Level.Level())
+
+	// Removing the setting from the parameter restores the environment variable value
+	store.err = nil
+	store.value = ""
+	watcher.Check(start.Add(4 * time.Minute))
+	assert.Equal(t, zapcore.InfoLevel, Log.Level.Level())
+	assert.Equal(t, 4, store.calls)
+}
+
+func TestConfigWatcherRefreshesCredentials(t *testing.T) {
+	manager := &rotatingSecretManager{value: "rotated"}
+	config := extensionConfig{
+		apmServerUrl:              "http://localhost:8200/",
+		apmServerApiKey:           "original",
+		secretManager:             manager,
+		apmServerApiKeySMSecretId: "apikey-id",
+		configWatchInterval:       time.Minute,
+	}
+	transport := InitApmServerTransport(&config)
+	transport.credentials.lastRefresh = time.Time{}
+	watcher := NewConfigWatcher(&config, &mockParameterStore{}, transport)
+	require.NotNil(t, watcher)
+
+	watcher.Check(time.Now().Add(time.Minute))
+	assert.Equal(t, 1, manager.calls)
+	assert.Equal(t, "rotated", transport.credentials.apiKey)
+}
@@ -0,0 +1,103 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minCredentialsRefreshInterval limits how often the credentials are fetched again from Secrets Manager,
+// so that an APM server persistently rejecting them does not result in a flood of Secrets Manager calls.
+const minCredentialsRefreshInterval = time.Minute
+
+// credentials holds the API key or secret token used to authenticate against the APM server. When they
+// were retrieved from Secrets Manager, they can be refreshed, e.g. after a rotation of the secret.
+type credentials struct {
+	mu                  sync.RWMutex
+	apiKey              string
+	secretToken         string
+	manager             secretManager
+	apiKeySecretID      string
+	secretTokenSecretID string
+	lastRefresh         time.Time
+	minRefreshInterval  time.Duration
+}
+
+func newCredentials(config *extensionConfig) *credentials {
+	return &credentials{
+		apiKey:              config.apmServerApiKey,
+		secretToken:         config.apmServerSecretToken,
+		manager:             config.secretManager,
+		apiKeySecretID:      config.apmServerApiKeySMSecretId,
+		secretTokenSecretID: config.apmServerSecretTokenSMSecretId,
+		lastRefresh:         time.Now(),
+		minRefreshInterval:  minCredentialsRefreshInterval,
+	}
+}
+
+// setAuthorization sets the Authorization header of req, giving precedence to the API key.
+func (c *credentials) setAuthorization(req *http.Request) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	} else if c.secretToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.secretToken)
+	}
+}
+
+// refresh fetches the credentials from Secrets Manager again, and reports whether they changed.
+// Credentials that were not retrieved from Secrets Manager are never refreshed.
+func (c *credentials) refresh() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.manager == nil || (c.apiKeySecretID == "" && c.secretTokenSecretID == "") {
+		return false
+	}
+	if time.Since(c.lastRefresh) < c.minRefreshInterval {
+		Log.Debug("Credentials refreshed recently, not fetching them from Secrets Manager again")
+		return false
+	}
+	c.lastRefresh = time.Now()
+
+	changed := false
+	if c.apiKeySecretID != "" {
+		apiKey, err := getSecret(c.manager, c.apiKeySecretID)
+		if err != nil {
+			Log.Errorf("Failed refreshing APM Server ApiKey from Secrets Manager: %v", err)
+		} else if apiKey != c.apiKey {
+			c.apiKey = apiKey
+			changed = true
+		}
+	}
+	if c.secretTokenSecretID != "" {
+		secretToken, err := getSecret(c.manager, c.secretTokenSecretID)
+		if err != nil {
+			Log.Errorf("Failed refreshing APM Server Secret Token from Secrets Manager: %v", err)
+		} else if secretToken != c.secretToken {
+			c.secretToken = secretToken
+			changed = true
+		}
+	}
+	if changed {
+		Log.Info("APM Server credentials refreshed from Secrets Manager")
+	}
+	return changed
+}
@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatingSecretManager returns the current value of a secret that can be rotated.
+type rotatingSecretManager struct {
+	value string
+	calls int
+}
+
+func (s *rotatingSecretManager) GetSecretValue(*secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	s.calls++
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(s.value)}, nil
+}
+
+func TestCredentialsRefreshOnUnauthorized(t *testing.T) {
+	var authorizations []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "ApiKey rotated" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	manager := &rotatingSecretManager{value: "rotated"}
+	config := extensionConfig{
+		apmServerUrl:              apmServer.URL + "/",
+		apmServerApiKey:           "original",
+		secretManager:             manager,
+		apmServerApiKeySMSecretId: "apikey-id",
+	}
+	transport := InitApmServerTransport(&config)
+	transport.credentials.lastRefresh = time.Time{}
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, []string{"ApiKey original", "ApiKey rotated"}, authorizations)
+	assert.Equal(t, 1, manager.calls)
+
+	// The refreshed credentials are used for the subsequent requests
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, "ApiKey rotated", authorizations[2])
+}
+
+func TestCredentialsRefreshRateLimited(t *testing.T) {
+	manager := &rotatingSecretManager{value: "rotated"}
+	c := newCredentials(&extensionConfig{
+		apmServerSecretToken:           "original",
+		secretManager:                  manager,
+		apmServerSecretTokenSMSecretId: "token-id",
+	})
+
+	// The credentials were just fetched at cold start
+	assert.False(t, c.refresh())
+	assert.Equal(t, 0, manager.calls)
+
+	c.lastRefresh = time.Now().Add(-minCredentialsRefreshInterval)
+	assert.True(t, c.refresh())
+	assert.False(t, c.refresh())
+	assert.Equal(t, 1, manager.calls)
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	c.setAuthorization(req)
+	assert.Equal(t, "Bearer rotated", req.Header.Get("Authorization"))
+}
+
+func TestCredentialsNotManaged(t *testing.T) {
+	c := newCredentials(&extensionConfig{apmServerApiKey: "unmanaged", secretManager: &rotatingSecretManager{}})
+	c.lastRefresh = time.Time{}
+	assert.False(t, c.refresh())
+}
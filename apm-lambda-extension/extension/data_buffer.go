@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBufferFull is returned when agent data is rejected because the agent data buffer is full.
+var ErrBufferFull = errors.New("agent data buffer is full")
+
+// bufferDrops counts the agent data payloads discarded because the agent data buffer was full.
+type bufferDrops struct {
+	dropped  int64
+	rejected int64
+}
+
+// enqueueAgentData queues the agent data received from an agent request, applying the buffer policy
+// when the agent data buffer is full. With the block policy, it waits until there is room in the
+// buffer or ctx is done. With the reject policy, it returns ErrBufferFull.
+func (transport *ApmServerTransport) enqueueAgentData(ctx context.Context, agentData AgentData) error {
+	switch transport.config.dataBufferPolicy {
+	case Block:
+		select {
+		case transport.dataChannel <- agentData:
+			Log.Debug("Adding agent data to buffer to be sent to apm server")
+			return nil
+		default:
+		}
+		Log.Debug("Channel full: waiting for room in the buffer")
+		select {
+		case transport.dataChannel <- agentData:
+			return nil
+		case <-ctx.Done():
+			atomic.AddInt64(&transport.droppedPayloads, 1)
+			return ctx.Err()
+		}
+	case Reject:
+		select {
+		case transport.dataChannel <- agentData:
+			Log.Debug("Adding agent data to buffer to be sent to apm server")
+			return nil
+		default:
+			atomic.AddInt64(&transport.rejectedPayloads, 1)
+			Log.Warn("Channel full: rejecting agent data")
+			return ErrBufferFull
+		}
+	default:
+		transport.EnqueueAPMData(agentData)
+		return nil
+	}
+}
+
+// replaceOldest drops the oldest buffered agent data until agentData fits in the agent data buffer.
+func (transport *ApmServerTransport) replaceOldest(agentData AgentData) {
+	for {
+		select {
+		case transport.dataChannel <- agentData:
+			return
+		default:
+		}
+		select {
+		case <-transport.dataChannel:
+			atomic.AddInt64(&transport.droppedPayloads, 1)
+			Log.Warn("Channel full: dropping the oldest agent data")
+		default:
+		}
+	}
+}
+
+// ReportBufferDrops queues a metricset counting the agent data payloads dropped or rejected because the
+// agent data buffer was full since the previous report. Nothing is reported if no payload was discarded.
+// If the metricset itself cannot be queued, the payloads are counted in the next report.
+func (transport *ApmServerTransport) ReportBufferDrops(metadataContainer *MetadataContainer) {
+	total := bufferDrops{
+		dropped:  atomic.LoadInt64(&transport.droppedPayloads),
+		rejected: atomic.LoadInt64(&transport.rejectedPayloads),
+	}
+	dropped := total.dropped - transport.reportedDrops.dropped
+	rejected := total.rejected - transport.reportedDrops.rejected
+	if dropped == 0 && rejected == 0 {
+		return
+	}
+	Log.Warnf("Agent data buffer full: %d payloads dropped and %d rejected since the last report", dropped, rejected)
+
+	metricset := buildMetricset(metadataContainer, time.Now(), map[string]float64{
+		"aws.lambda.extension.buffer.capacity":          float64(cap(transport.dataChannel)),
+		"aws.lambda.extension.buffer.dropped_payloads":  float64(dropped),
+		"aws.lambda.extension.buffer.rejected_payloads": float64(rejected),
+	}, nil)
+	select {
+	case transport.dataChannel <- metricset:
+		transport.reportedDrops = total
+	default:
+		Log.Debug("Channel full: buffer drops will be reported later")
+	}
+}
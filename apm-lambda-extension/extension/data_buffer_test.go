@@ -0,0 +1,152 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBufferTestTransport(policy BufferPolicy) *ApmServerTransport {
+	return InitApmServerTransport(&extensionConfig{dataBufferSize: 2, dataBufferPolicy: policy})
+}
+
+func bufferedData(transport *ApmServerTransport) []string {
+	var data []string
+	for len(transport.dataChannel) > 0 {
+		data = append(data, string((<-transport.dataChannel).Data))
+	}
+	return data
+}
+
+func TestEnqueueAgentDataDropNewest(t *testing.T) {
+	transport := newBufferTestTransport(DropNewest)
+	for _, data := range []string{"1", "2", "3"} {
+		require.NoError(t, transport.enqueueAgentData(context.Background(), AgentData{Data: []byte(data)}))
+	}
+	assert.Equal(t, []string{"1", "2"}, bufferedData(transport))
+	assert.Equal(t, int64(1), transport.DebugVars().Buffer.DroppedPayloads)
+}
+
+func TestEnqueueAgentDataDropOldest(t *testing.T) {
+	transport := newBufferTestTransport(DropOldest)
+	for _, data := range []string{"1", "2", "3"} {
+		require.NoError(t, transport.enqueueAgentData(context.Background(), AgentData{Data: []byte(data)}))
+	}
+	assert.Equal(t, []string{"2", "3"}, bufferedData(transport))
+	assert.Equal(t, int64(1), transport.DebugVars().Buffer.DroppedPayloads)
+}
+
+func TestEnqueueAgentDataBlock(t *testing.T) {
+	transport := newBufferTestTransport(Block)
+	for _, data := range []string{"1", "2"} {
+		require.NoError(t, transport.enqueueAgentData(context.Background(), AgentData{Data: []byte(data)}))
+	}
+
+	enqueued := make(chan error, 1)
+	go func() {
+		enqueued <- transport.enqueueAgentData(context.Background(), AgentData{Data: []byte("3")})
+	}()
+	select {
+	case <-enqueued:
+		t.Fatal("Agent data enqueued while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, "1", string((<-transport.dataChannel).Data))
+	require.NoError(t, <-enqueued)
+	assert.Equal(t, []string{"2", "3"}, bufferedData(transport))
+
+	// The wait ends with the agent request
+	for _, data := range []string{"1", "2"} {
+		require.NoError(t, transport.enqueueAgentData(context.Background(), AgentData{Data: []byte(data)}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, transport.enqueueAgentData(ctx, AgentData{Data: []byte("3")}), context.DeadlineExceeded)
+	assert.Equal(t, int64(1), transport.DebugVars().Buffer.DroppedPayloads)
+}
+
+func TestHandleIntakeV2EventsReject(t *testing.T) {
+	transport := newBufferTestTransport(Reject)
+	handler := handleIntakeV2Events(context.Background(), transport)
+	agentDone := transport.StartAgentDoneSignal()
+	defer transport.StopAgentDoneSignal()
+
+	for _, data := range []string{"1", "2"} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(data)))
+		assert.Equal(t, http.StatusAccepted, recorder.Code)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/intake/v2/events?flushed=true", strings.NewReader("3")))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, int64(1), transport.DebugVars().Buffer.RejectedPayloads)
+
+	// The flush signal is handled even though the agent data was rejected
+	select {
+	case <-agentDone:
+	default:
+		t.Fatal("Agent done signal not sent")
+	}
+	assert.Equal(t, []string{"1", "2"}, bufferedData(transport))
+}
+
+func TestReportBufferDrops(t *testing.T) {
+	transport := newBufferTestTransport(DropNewest)
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	// Nothing is reported without drops
+	transport.ReportBufferDrops(metadataContainer)
+	assert.Empty(t, bufferedData(transport))
+
+	for _, data := range []string{"1", "2", "3", "4"} {
+		transport.EnqueueAPMData(AgentData{Data: []byte(data)})
+	}
+	// The buffer is full, so the report is postponed
+	transport.ReportBufferDrops(metadataContainer)
+	assert.Equal(t, []string{"1", "2"}, bufferedData(transport))
+
+	transport.ReportBufferDrops(metadataContainer)
+	data := bufferedData(transport)
+	require.Len(t, data, 1)
+	lines := strings.Split(data[0], "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, `{"metadata":{}}`, lines[0])
+	var metricset struct {
+		Metricset struct {
+			Samples map[string]struct{ Value float64 }
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &metricset))
+	samples := metricset.Metricset.Samples
+	assert.Equal(t, float64(2), samples["aws.lambda.extension.buffer.capacity"].Value)
+	assert.Equal(t, float64(2), samples["aws.lambda.extension.buffer.dropped_payloads"].Value)
+	assert.Equal(t, float64(0), samples["aws.lambda.extension.buffer.rejected_payloads"].Value)
+
+	// The drops are only reported once
+	transport.ReportBufferDrops(metadataContainer)
+	assert.Empty(t, bufferedData(transport))
+}
@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// maxSQSMessageBytes is the maximum size of an SQS message, including its attributes.
+	maxSQSMessageBytes = 256 * 1024
+	// deadLetterTimeout bounds the time spent sending undelivered agent data to the dead-letter queue, as it
+	// happens while the agent data is forwarded or flushed.
+	deadLetterTimeout = 2 * time.Second
+)
+
+// sqsSender is the subset of the SQS API used to send the undelivered agent data to the dead-letter queue.
+type sqsSender interface {
+	SendMessageWithContext(aws.Context, *sqs.SendMessageInput, ...request.Option) (*sqs.SendMessageOutput, error)
+}
+
+// DeadLetterQueue sends the agent data which could not be delivered to the APM server, and cannot be
+// persisted to the spill buffer either, to an SQS queue, so that a replayer function can send it again
+// later. The body of each message is a base64-encoded, gzip-compressed intake v2 payload, and its
+// ContentEncoding and UserAgent attributes are the headers to send it with.
+type DeadLetterQueue struct {
+	url    string
+	client sqsSender
+	sent   int64
+}
+
+// NewDeadLetterQueue returns the dead-letter queue configured by ELASTIC_APM_DLQ_SQS_URL, or nil if it is
+// not configured.
+func NewDeadLetterQueue(config *extensionConfig, client sqsSender) *DeadLetterQueue {
+	if config.dlqSQSURL == "" {
+		return nil
+	}
+	return &DeadLetterQueue{url: config.dlqSQSURL, client: client}
+}
+
+// SetDeadLetterQueue sets the queue to which the undelivered agent data is sent.
+func (transport *ApmServerTransport) SetDeadLetterQueue(queue *DeadLetterQueue) {
+	if queue != nil {
+		transport.deadLetters = queue
+	}
+}
+
+// send sends agentData to the queue, unless it does not fit in an SQS message once encoded.
+func (queue *DeadLetterQueue) send(agentData AgentData) error {
+	data, err := gzipRecord(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return err
+	}
+	attributes := map[string]*sqs.MessageAttributeValue{
+		"ContentEncoding": {DataType: aws.String("String"), StringValue: aws.String("gzip")},
+	}
+	if agentData.agentUserAgent != "" {
+		attributes["UserAgent"] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(agentData.agentUserAgent)}
+	}
+	body := base64.StdEncoding.EncodeToString(data)
+	size := len(body)
+	for name, value := range attributes {
+		size += len(name) + len(*value.DataType) + len(*value.StringValue)
+	}
+	if size > maxSQSMessageBytes {
+		return fmt.Errorf("agent data of %d bytes is larger than the maximum SQS message size once encoded", len(data))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+	defer cancel()
+	if _, err := queue.client.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queue.url),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attributes,
+	}); err != nil {
+		return err
+	}
+	atomic.AddInt64(&queue.sent, 1)
+	return nil
+}
+
+// sendToDeadLetterQueue sends the undelivered agentData to the dead-letter queue, if any, and reports whether
+// it was sent.
+func (transport *ApmServerTransport) sendToDeadLetterQueue(agentData AgentData) bool {
+	if transport.deadLetters == nil {
+		return false
+	}
+	if err := transport.deadLetters.send(agentData); err != nil {
+		Log.Warnf("Could not send undelivered agent data to the dead-letter queue, dropping it: %v", err)
+		return false
+	}
+	Log.Debug("Undelivered agent data sent to the dead-letter queue")
+	return true
+}
+
+// DeadLetteredPayloads returns the number of agent data payloads sent to the dead-letter queue.
+func (transport *ApmServerTransport) DeadLetteredPayloads() int64 {
+	if transport.deadLetters == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&transport.deadLetters.sent)
+}
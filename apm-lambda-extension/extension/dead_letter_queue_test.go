@@ -0,0 +1,147 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSQS struct {
+	messages []*sqs.SendMessageInput
+	err      error
+}
+
+func (m *mockSQS) SendMessageWithContext(_ aws.Context, input *sqs.SendMessageInput, _ ...request.Option) (*sqs.SendMessageOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.messages = append(m.messages, input)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func unreachableApmServerConfig(t *testing.T) extensionConfig {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+	return extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		dlqSQSURL:    "https://sqs.us-east-1.amazonaws.com/123456789012/apm-dlq",
+	}
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	config := unreachableApmServerConfig(t)
+	client := &mockSQS{}
+	transport := InitApmServerTransport(&config)
+	transport.SetDeadLetterQueue(NewDeadLetterQueue(&config, client))
+
+	transport.reconnectionCount = 0
+	agentData := AgentData{Data: []byte(`{"metadata":{}}`), agentUserAgent: "apm-agent-nodejs/3.30.0"}
+	assert.Error(t, transport.PostToApmServer(context.Background(), agentData))
+	require.Len(t, client.messages, 1)
+	assert.Equal(t, int64(1), transport.DeadLetteredPayloads())
+
+	message := client.messages[0]
+	assert.Equal(t, config.dlqSQSURL, *message.QueueUrl)
+	assert.Equal(t, "gzip", *message.MessageAttributes["ContentEncoding"].StringValue)
+	assert.Equal(t, "apm-agent-nodejs/3.30.0", *message.MessageAttributes["UserAgent"].StringValue)
+	data, err := base64.StdEncoding.DecodeString(*message.MessageBody)
+	require.NoError(t, err)
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, `{"metadata":{}}`, string(body))
+}
+
+func TestDeadLetterQueueAfterSpillBuffer(t *testing.T) {
+	config := unreachableApmServerConfig(t)
+	config.spillDir = t.TempDir()
+	config.spillBufferMaxBytes = 1024
+	client := &mockSQS{}
+	transport := InitApmServerTransport(&config)
+	transport.SetDeadLetterQueue(NewDeadLetterQueue(&config, client))
+
+	// The agent data is only sent to the queue once the spill buffer is full
+	transport.reconnectionCount = 0
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Empty(t, client.messages)
+
+	transport.setStatus(Healthy)
+	transport.reconnectionCount = 0
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: bytes.Repeat([]byte("a"), 2048)}))
+	assert.Len(t, client.messages, 1)
+}
+
+func TestDeadLetterQueueOversized(t *testing.T) {
+	config := unreachableApmServerConfig(t)
+	client := &mockSQS{}
+	queue := NewDeadLetterQueue(&config, client)
+
+	data := make([]byte, maxSQSMessageBytes)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	err = queue.send(AgentData{Data: data})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "larger than the maximum SQS message size")
+	assert.Empty(t, client.messages)
+}
+
+func TestDeadLetterQueueFailure(t *testing.T) {
+	config := unreachableApmServerConfig(t)
+	transport := InitApmServerTransport(&config)
+	transport.SetDeadLetterQueue(NewDeadLetterQueue(&config, &mockSQS{err: errors.New("AccessDenied")}))
+
+	transport.reconnectionCount = 0
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int64(0), transport.DeadLetteredPayloads())
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+}
+
+func TestNewDeadLetterQueue(t *testing.T) {
+	assert.Nil(t, NewDeadLetterQueue(&extensionConfig{}, &mockSQS{}))
+
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.SetDeadLetterQueue(nil)
+	assert.Nil(t, transport.deadLetters)
+	assert.Equal(t, int64(0), transport.DeadLetteredPayloads())
+}
+
+func TestProcessEnvDeadLetterQueue(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, "", config.dlqSQSURL)
+
+	t.Setenv("ELASTIC_APM_DLQ_SQS_URL", "https://sqs.us-east-1.amazonaws.com/123456789012/apm-dlq")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, "https://sqs.us-east-1.amazonaws.com/123456789012/apm-dlq", config.dlqSQSURL)
+}
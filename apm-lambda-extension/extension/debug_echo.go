@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxEchoErrors is the maximum number of invalid lines described in the response of the echo endpoint.
+const maxEchoErrors = 10
+
+// EchoResponse describes the agent data received by the echo endpoint.
+type EchoResponse struct {
+	ContentEncoding   string         `json:"content_encoding,omitempty"`
+	Bytes             int            `json:"bytes"`
+	UncompressedBytes int            `json:"uncompressed_bytes"`
+	Events            map[string]int `json:"events"`
+	InvalidLines      int            `json:"invalid_lines"`
+	Errors            []EchoError    `json:"errors,omitempty"`
+}
+
+// EchoError describes a line of agent data that is not a valid intake v2 event.
+type EchoError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// URL: http://server/debug/echo
+//
+// The echo endpoint parses agent data the way the intake endpoint does and responds with the number of
+// events of each type, without sending anything to the APM server. It lets agent developers check that
+// their payloads reach the extension and are understood by it.
+func handleDebugEcho() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rawBytes, err := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			Log.Errorf("Could not read echo request body: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		contentEncoding := r.Header.Get("Content-Encoding")
+		data, err := GetUncompressedBytes(rawBytes, contentEncoding)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response := parseEchoData(data)
+		response.ContentEncoding = contentEncoding
+		response.Bytes = len(rawBytes)
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(response); err != nil {
+			Log.Errorf("Failed to send echo response: %v", err)
+		}
+	}
+}
+
+// parseEchoData counts the events of each type in uncompressed, newline-delimited, agent data.
+// Each line must be a JSON object with a single key, which is the event type.
+func parseEchoData(data []byte) EchoResponse {
+	response := EchoResponse{
+		UncompressedBytes: len(data),
+		Events:            make(map[string]int),
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var event map[string]json.RawMessage
+		err := json.Unmarshal(line, &event)
+		if err == nil && len(event) != 1 {
+			err = fmt.Errorf("expected a single event type, got %d keys", len(event))
+		}
+		if err != nil {
+			response.InvalidLines++
+			if len(response.Errors) < maxEchoErrors {
+				response.Errors = append(response.Errors, EchoError{Line: i + 1, Message: err.Error()})
+			}
+			continue
+		}
+		for eventType := range event {
+			response.Events[eventType]++
+		}
+	}
+	return response
+}
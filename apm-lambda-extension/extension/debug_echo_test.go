@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleDebugEcho(t *testing.T) {
+	payload := strings.Join([]string{
+		`{"metadata":{"service":{"name":"foo"}}}`,
+		`{"transaction":{"id":"0102030405060708"}}`,
+		`{"span":{"id":"0102030405060709"}}`,
+		`{"span":{"id":"010203040506070a"}}`,
+		`not json`,
+		`{"span":{},"error":{}}`,
+		``,
+	}, "\n")
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, err := gw.Write([]byte(payload))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/debug/echo", bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	handleDebugEcho()(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	var response EchoResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "gzip", response.ContentEncoding)
+	assert.Equal(t, compressed.Len(), response.Bytes)
+	assert.Equal(t, len(payload), response.UncompressedBytes)
+	assert.Equal(t, map[string]int{"metadata": 1, "transaction": 1, "span": 2}, response.Events)
+	assert.Equal(t, 2, response.InvalidLines)
+	require.Len(t, response.Errors, 2)
+	assert.Equal(t, 5, response.Errors[0].Line)
+	assert.Equal(t, 6, response.Errors[1].Line)
+}
+
+func TestHandleDebugEchoInvalidEncoding(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/debug/echo", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	handleDebugEcho()(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestHandleDebugEchoMethodNotAllowed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	handleDebugEcho()(recorder, httptest.NewRequest(http.MethodGet, "/debug/echo", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, http.MethodPost, recorder.Header().Get("Allow"))
+}
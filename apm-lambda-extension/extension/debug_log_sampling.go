@@ -0,0 +1,71 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// DebugLogSampler enables debug logging for one invocation out of every ELASTIC_APM_LAMBDA_DEBUG_LOG_SAMPLING,
+// which gives representative diagnostics of functions running in production without logging every
+// invocation at the debug level. The first invocation of an execution environment, which includes its cold
+// start, is always sampled.
+type DebugLogSampler struct {
+	every       int
+	invocations int
+	// restore is the log level to restore at the end of the sampled invocation, if any
+	restore *zapcore.Level
+}
+
+// NewDebugLogSampler returns a DebugLogSampler for the given configuration, or nil if debug log sampling is
+// disabled.
+func NewDebugLogSampler(config *extensionConfig) *DebugLogSampler {
+	if config.debugLogSampling <= 0 {
+		return nil
+	}
+	return &DebugLogSampler{every: config.debugLogSampling}
+}
+
+// Start counts an invocation, and enables debug logging until End is called if the invocation is sampled and
+// the log level is higher than debug. It does nothing on a nil DebugLogSampler.
+func (s *DebugLogSampler) Start() {
+	if s == nil {
+		return
+	}
+	sampled := s.invocations%s.every == 0
+	s.invocations++
+	level := Log.Level.Level()
+	if !sampled || level <= zapcore.DebugLevel {
+		return
+	}
+	s.restore = &level
+	Log.Level.SetLevel(zapcore.DebugLevel)
+	Log.Debugf("Debug logging enabled for this invocation, sampled 1 in %d", s.every)
+}
+
+// End restores the log level changed by Start, unless it was changed again in the meantime, e.g. by a
+// configuration change. It does nothing on a nil DebugLogSampler.
+func (s *DebugLogSampler) End() {
+	if s == nil || s.restore == nil {
+		return
+	}
+	if Log.Level.Level() == zapcore.DebugLevel {
+		Log.Level.SetLevel(*s.restore)
+	}
+	s.restore = nil
+}
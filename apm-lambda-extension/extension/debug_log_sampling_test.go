@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestDebugLogSampler(t *testing.T) {
+	defer Log.Level.SetLevel(Log.Level.Level())
+	Log.Level.SetLevel(zapcore.InfoLevel)
+	sampler := NewDebugLogSampler(&extensionConfig{debugLogSampling: 3})
+
+	var levels []zapcore.Level
+	for i := 0; i < 6; i++ {
+		sampler.Start()
+		levels = append(levels, Log.Level.Level())
+		sampler.End()
+		assert.Equal(t, zapcore.InfoLevel, Log.Level.Level())
+	}
+	assert.Equal(t, []zapcore.Level{
+		zapcore.DebugLevel, zapcore.InfoLevel, zapcore.InfoLevel,
+		zapcore.DebugLevel, zapcore.InfoLevel, zapcore.InfoLevel,
+	}, levels)
+
+	// A log level changed during the sampled invocation is kept
+	sampler.Start()
+	Log.Level.SetLevel(zapcore.WarnLevel)
+	sampler.End()
+	assert.Equal(t, zapcore.WarnLevel, Log.Level.Level())
+}
+
+func TestDebugLogSamplerDisabled(t *testing.T) {
+	defer Log.Level.SetLevel(Log.Level.Level())
+	Log.Level.SetLevel(zapcore.InfoLevel)
+	sampler := NewDebugLogSampler(&extensionConfig{})
+	assert.Nil(t, sampler)
+	sampler.Start()
+	assert.Equal(t, zapcore.InfoLevel, Log.Level.Level())
+	sampler.End()
+}
+
+func TestProcessEnvDebugLogSampling(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	assert.Equal(t, 0, ProcessEnv(new(mockSecretManager)).debugLogSampling)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_DEBUG_LOG_SAMPLING", "100")
+	assert.Equal(t, 100, ProcessEnv(new(mockSecretManager)).debugLogSampling)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_DEBUG_LOG_SAMPLING", "-1")
+	assert.Equal(t, 0, ProcessEnv(new(mockSecretManager)).debugLogSampling)
+}
@@ -0,0 +1,331 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"elastic/apm-lambda-extension/buildinfo"
+)
+
+// maxDebugSamples is the number of transport state transitions and errors kept for debugging purposes.
+const maxDebugSamples = 20
+
+// redacted replaces the credentials in the debug output.
+const redacted = "[REDACTED]"
+
+type stateTransition struct {
+	Status ApmServerTransportStatusType `json:"status"`
+	Time   time.Time                    `json:"time"`
+}
+
+type errorSample struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// debugState keeps track of the recent transport state transitions and errors, and of the times of the
+// last flush and of the last data sent, for bug reports. It has its own lock, as the transport lock is held
+// for the whole duration of the grace periods.
+type debugState struct {
+	mu             sync.Mutex
+	transitions    []stateTransition
+	errors         []errorSample
+	lastFlushStart time.Time
+	lastFlushEnd   time.Time
+	lastSent       time.Time
+}
+
+func (d *debugState) recordFlushStart() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastFlushStart = time.Now()
+}
+
+func (d *debugState) recordFlushEnd() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastFlushEnd = time.Now()
+}
+
+func (d *debugState) recordSent() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastSent = time.Now()
+}
+
+// flushes returns the times of the last flush and of the last data sent, if any.
+func (d *debugState) flushes() DebugFlushes {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DebugFlushes{
+		LastFlushStart: optionalTime(d.lastFlushStart),
+		LastFlushEnd:   optionalTime(d.lastFlushEnd),
+		LastSent:       optionalTime(d.lastSent),
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (d *debugState) recordTransition(status ApmServerTransportStatusType) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.transitions) >= maxDebugSamples {
+		d.transitions = d.transitions[1:]
+	}
+	d.transitions = append(d.transitions, stateTransition{Status: status, Time: time.Now()})
+}
+
+func (d *debugState) recordError(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.errors) >= maxDebugSamples {
+		d.errors = d.errors[1:]
+	}
+	d.errors = append(d.errors, errorSample{Message: err.Error(), Time: time.Now()})
+}
+
+// DebugConfig is the effective configuration of the extension, with the credentials redacted.
+type DebugConfig struct {
+	ApmServerUrl                string            `json:"apm_server_url"`
+	ApmServerFallbackUrl        string            `json:"apm_server_fallback_url,omitempty"`
+	ApiKey                      string            `json:"api_key,omitempty"`
+	SecretToken                 string            `json:"secret_token,omitempty"`
+	DataReceiverServerAddress   string            `json:"data_receiver_server_address,omitempty"`
+	DataReceiverServerPort      string            `json:"data_receiver_server_port"`
+	DataReceiverTimeoutSeconds  int               `json:"data_receiver_timeout_seconds"`
+	DataForwarderTimeoutSeconds int               `json:"data_forwarder_timeout_seconds"`
+	ServerTimeout               string            `json:"server_timeout"`
+	ProxyUrl                    string            `json:"proxy_url,omitempty"`
+	VerifyServerCert            bool              `json:"verify_server_cert"`
+	SendStrategy                SendStrategy      `json:"send_strategy"`
+	DataForwarderMode           DataForwarderMode `json:"data_forwarder_mode"`
+	DataBufferPolicy            BufferPolicy      `json:"data_buffer_policy"`
+	LogLevel                    string            `json:"log_level"`
+	StrictDelivery              bool              `json:"strict_delivery"`
+	SendFunctionLogs            bool              `json:"send_function_logs"`
+	MemoryBudgetPercent         int               `json:"memory_budget_percent"`
+	BackoffMaxReconnectionCount int               `json:"backoff_max_reconnection_count"`
+	BackoffMultiplierSeconds    float64           `json:"backoff_multiplier_seconds"`
+	BackoffJitter               float64           `json:"backoff_jitter"`
+	SpillBufferMaxBytes         int64             `json:"spill_buffer_max_bytes"`
+	Compression                 Compression       `json:"compression"`
+	CompressionLevel            int               `json:"compression_level"`
+	CompressionMinBytes         int               `json:"compression_min_bytes"`
+	Runtime                     string            `json:"runtime"`
+	FlushDeadlineMargin         string            `json:"flush_deadline_margin"`
+	AgentDoneWait               string            `json:"agent_done_wait"`
+	CentralConfigPollInterval   string            `json:"central_config_poll_interval"`
+	MaxInFlightRequests         int               `json:"max_in_flight_requests"`
+}
+
+// DebugTransport describes the current and recent states of the APM server transport.
+type DebugTransport struct {
+	Status            ApmServerTransportStatusType `json:"status"`
+	ActiveApmServer   string                       `json:"active_apm_server"`
+	ReconnectionCount int                          `json:"reconnection_count"`
+	InFlightRequests  int64                        `json:"in_flight_requests"`
+	QueuedRequests    int64                        `json:"queued_requests"`
+	Transitions       []stateTransition            `json:"transitions"`
+}
+
+// DebugBuffer describes the agent data waiting to be sent to the APM server.
+type DebugBuffer struct {
+	BufferedPayloads int   `json:"buffered_payloads"`
+	Capacity         int   `json:"capacity"`
+	DroppedPayloads  int64 `json:"dropped_payloads"`
+	RejectedPayloads int64 `json:"rejected_payloads"`
+	SpilledBytes     int64 `json:"spilled_bytes"`
+	DeliveryFailures int64 `json:"delivery_failures"`
+	RejectedEvents   int64 `json:"rejected_events"`
+	RetriedEvents    int64 `json:"retried_events"`
+	RetriedRequests  int64 `json:"retried_requests"`
+	FilteredEvents   int64 `json:"filtered_events"`
+	SampledOutTraces int64 `json:"sampled_out_traces"`
+}
+
+// DebugFlushes holds the times of the last flush of the buffered agent data, and of the last data
+// successfully sent to the APM server, which also happens outside of flushes with the background strategy.
+type DebugFlushes struct {
+	LastFlushStart *time.Time `json:"last_flush_start,omitempty"`
+	LastFlushEnd   *time.Time `json:"last_flush_end,omitempty"`
+	LastSent       *time.Time `json:"last_sent,omitempty"`
+}
+
+// DebugVars is a snapshot of the effective state of the extension, meant to be attached to bug reports.
+type DebugVars struct {
+	Version      string         `json:"version"`
+	Commit       string         `json:"commit"`
+	Config       DebugConfig    `json:"config"`
+	Transport    DebugTransport `json:"transport"`
+	Buffer       DebugBuffer    `json:"buffer"`
+	Flushes      DebugFlushes   `json:"flushes"`
+	RecentErrors []errorSample  `json:"recent_errors"`
+}
+
+// Health is a summary of the state of the extension, meant to be checked by operators and test harnesses.
+type Health struct {
+	Version           string                       `json:"version"`
+	Status            ApmServerTransportStatusType `json:"status"`
+	ReconnectionCount int                          `json:"reconnection_count"`
+	BufferedPayloads  int                          `json:"buffered_payloads"`
+	Features          []string                     `json:"features"`
+	DebugFlushes
+}
+
+// DebugVars returns a snapshot of the effective state of the extension.
+func (transport *ApmServerTransport) DebugVars() DebugVars {
+	config := transport.config
+	vars := DebugVars{
+		Version: buildinfo.Version(),
+		Commit:  buildinfo.Commit(),
+		Config: DebugConfig{
+			ApmServerUrl:                config.apmServerUrl,
+			ApmServerFallbackUrl:        config.apmServerFallbackUrl,
+			DataReceiverServerAddress:   config.dataReceiverServerAddress,
+			DataReceiverServerPort:      config.dataReceiverServerPort,
+			DataReceiverTimeoutSeconds:  config.dataReceiverTimeoutSeconds,
+			DataForwarderTimeoutSeconds: config.DataForwarderTimeoutSeconds,
+			ServerTimeout:               transport.client.Timeout.String(),
+			ProxyUrl:                    redactedURL(config.httpClient.proxyURL),
+			VerifyServerCert:            config.httpClient.tlsConfig == nil || !config.httpClient.tlsConfig.InsecureSkipVerify,
+			SendStrategy:                config.SendStrategy,
+			DataForwarderMode:           config.dataForwarderMode,
+			DataBufferPolicy:            config.dataBufferPolicy,
+			LogLevel:                    config.LogLevel.String(),
+			StrictDelivery:              config.StrictDelivery,
+			SendFunctionLogs:            config.SendFunctionLogs,
+			MemoryBudgetPercent:         config.memoryBudgetPercent,
+			BackoffMaxReconnectionCount: transport.backoff.maxReconnectionCount,
+			BackoffMultiplierSeconds:    transport.backoff.multiplierSeconds,
+			BackoffJitter:               transport.backoff.jitter,
+			SpillBufferMaxBytes:         config.spillBufferMaxBytes,
+			Compression:                 transport.compression.algorithm,
+			CompressionLevel:            transport.compression.level,
+			CompressionMinBytes:         transport.compression.minBytes,
+			Runtime:                     config.RuntimeQuirks.Runtime,
+			FlushDeadlineMargin:         config.RuntimeQuirks.DeadlineMargin.String(),
+			AgentDoneWait:               config.RuntimeQuirks.AgentDoneWait.String(),
+			CentralConfigPollInterval:   config.centralConfigInterval.String(),
+			MaxInFlightRequests:         cap(transport.requests.slots),
+		},
+		Transport: DebugTransport{
+			Status:            transport.currentStatus(),
+			ActiveApmServer:   transport.endpoints.active().url,
+			ReconnectionCount: transport.reconnectionCount,
+		},
+		Buffer: DebugBuffer{
+			BufferedPayloads: len(transport.dataChannel),
+			Capacity:         cap(transport.dataChannel),
+			DroppedPayloads:  atomic.LoadInt64(&transport.droppedPayloads),
+			RejectedPayloads: atomic.LoadInt64(&transport.rejectedPayloads),
+			DeliveryFailures: atomic.LoadInt64(&transport.deliveryFailures),
+			RejectedEvents:   atomic.LoadInt64(&transport.rejectedEvents),
+			RetriedEvents:    atomic.LoadInt64(&transport.retriedEvents),
+			RetriedRequests:  atomic.LoadInt64(&transport.retriedRequests),
+			FilteredEvents:   transport.FilteredEvents(),
+			SampledOutTraces: transport.SampledOutTraces(),
+		},
+	}
+	if config.apmServerApiKey != "" {
+		vars.Config.ApiKey = redacted
+	}
+	if config.apmServerSecretToken != "" {
+		vars.Config.SecretToken = redacted
+	}
+	if transport.spillBuffer != nil {
+		vars.Buffer.SpilledBytes = transport.spillBuffer.Size()
+	}
+	vars.Flushes = transport.debug.flushes()
+	vars.Transport.InFlightRequests, vars.Transport.QueuedRequests = transport.InFlightRequests()
+
+	transport.debug.mu.Lock()
+	defer transport.debug.mu.Unlock()
+	vars.Transport.Transitions = append([]stateTransition{}, transport.debug.transitions...)
+	vars.RecentErrors = append([]errorSample{}, transport.debug.errors...)
+	return vars
+}
+
+// LogDebugVars logs the effective state of the extension at the debug level.
+func (transport *ApmServerTransport) LogDebugVars() {
+	vars, err := json.Marshal(transport.DebugVars())
+	if err != nil {
+		Log.Errorf("Could not marshal the extension state: %v", err)
+		return
+	}
+	Log.Debugf("Extension state: %s", vars)
+}
+
+// URL: http://server/debug/vars and http://server/debug
+func handleDebugVars(transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(transport.DebugVars()); err != nil {
+			Log.Errorf("Failed to send the extension state: %v", err)
+		}
+	}
+}
+
+// Health returns a summary of the state of the extension.
+func (transport *ApmServerTransport) Health() Health {
+	return Health{
+		Version:           buildinfo.Version(),
+		Status:            transport.currentStatus(),
+		ReconnectionCount: transport.reconnectionCount,
+		BufferedPayloads:  len(transport.dataChannel),
+		Features:          transport.config.Features.Names(),
+		DebugFlushes:      transport.debug.flushes(),
+	}
+}
+
+// URL: http://server/healthcheck
+//
+// handleHealthcheck responds with a summary of the state of the extension. The status code is 503 while the
+// APM server is known to be unreachable, so that checks fail while agent data cannot be delivered.
+func handleHealthcheck(transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := transport.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if health.Status == Failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(health); err != nil {
+			Log.Errorf("Failed to send the extension health: %v", err)
+		}
+	}
+}
+
+// redactedURL returns u with its password redacted, or an empty string if u is nil.
+func redactedURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
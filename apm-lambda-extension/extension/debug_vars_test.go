@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugVars(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:    apmServer.URL + "/",
+		apmServerApiKey: "very-secret",
+		SendStrategy:    SyncFlush,
+	}
+	transport := InitApmServerTransport(&config)
+	transport.reconnectionCount = 0
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	transport.EnqueueAPMData(AgentData{Data: []byte("bar")})
+
+	recorder := httptest.NewRecorder()
+	handleDebugVars(transport)(recorder, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.NotContains(t, recorder.Body.String(), "very-secret")
+
+	var vars DebugVars
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &vars))
+	assert.Equal(t, redacted, vars.Config.ApiKey)
+	assert.Empty(t, vars.Config.SecretToken)
+	assert.Equal(t, SyncFlush, vars.Config.SendStrategy)
+	assert.Equal(t, Failing, vars.Transport.Status)
+	require.Len(t, vars.Transport.Transitions, 1)
+	assert.Equal(t, Failing, vars.Transport.Transitions[0].Status)
+	assert.Equal(t, DebugBuffer{BufferedPayloads: 1, Capacity: 100, DeliveryFailures: 1}, vars.Buffer)
+	require.Len(t, vars.RecentErrors, 1)
+	assert.Contains(t, vars.RecentErrors[0].Message, "failed to post to APM server")
+}
+
+func TestHealthcheck(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		Features:     FeatureFlags{TelemetryAPIFeature: true, TailSamplingFeature: false},
+	})
+	recorder := httptest.NewRecorder()
+	handleHealthcheck(transport)(recorder, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var health Health
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &health))
+	assert.Equal(t, Healthy, health.Status)
+	assert.Equal(t, []string{"telemetry_api"}, health.Features)
+	assert.Nil(t, health.LastFlushEnd)
+	assert.Nil(t, health.LastSent)
+
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	transport.EnqueueAPMData(AgentData{Data: []byte("bar")})
+	recorder = httptest.NewRecorder()
+	handleHealthcheck(transport)(recorder, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &health))
+	assert.Equal(t, 1, health.BufferedPayloads)
+	require.NotNil(t, health.LastFlushStart)
+	require.NotNil(t, health.LastFlushEnd)
+	require.NotNil(t, health.LastSent)
+	assert.False(t, health.LastFlushEnd.Before(*health.LastSent))
+
+	// Health checks fail while the APM server is unreachable
+	apmServer.Close()
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("baz")}))
+	recorder = httptest.NewRecorder()
+	handleHealthcheck(transport)(recorder, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &health))
+	assert.Equal(t, Failing, health.Status)
+}
+
+func TestDebugStateBounded(t *testing.T) {
+	var d debugState
+	for i := 0; i < 2*maxDebugSamples; i++ {
+		d.recordError(fmt.Errorf("error %d", i))
+		d.recordTransition(Healthy)
+	}
+	assert.Len(t, d.errors, maxDebugSamples)
+	assert.Len(t, d.transitions, maxDebugSamples)
+	assert.Equal(t, fmt.Sprintf("error %d", 2*maxDebugSamples-1), d.errors[maxDebugSamples-1].Message)
+}
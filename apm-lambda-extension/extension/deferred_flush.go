@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"time"
+)
+
+// defaultFlushOnNextMaxAge is the default maximum age of the agent data deferred by the flushonnext send strategy.
+const defaultFlushOnNextMaxAge = 5 * time.Minute
+
+// DeferredFlush implements the flushonnext send strategy: the agent data buffered at the end of an invocation
+// is flushed at the start of the next one, while the function runs, so that the extension adds no duration
+// to the invocations.
+//
+// As the execution environment is frozen between the invocations, the deferred data waits for as long as the
+// function is idle. The data is therefore flushed at the end of the invocation once it was deferred for
+// longer than the maximum age, or when the function was idle for longer than the maximum age before the
+// invocation, which is expected to happen again for low-traffic functions.
+type DeferredFlush struct {
+	maxAge time.Duration
+	// deferredAt is the end of the first invocation whose data is still deferred, zero if none is
+	deferredAt time.Time
+	// lastEnd is the end of the last invocation, and idle the time elapsed until the start of the current one
+	lastEnd time.Time
+	idle    time.Duration
+}
+
+// NewDeferredFlush returns the flushonnext send strategy, which bounds the age of the deferred agent data to
+// ELASTIC_APM_FLUSH_ON_NEXT_MAX_AGE.
+func NewDeferredFlush(config *extensionConfig) *DeferredFlush {
+	return &DeferredFlush{maxAge: config.flushOnNextMaxAge}
+}
+
+// Start flushes the agent data deferred by the previous invocation, at the start of the invocation described
+// by event, before the agent data of the invocation is forwarded.
+func (deferred *DeferredFlush) Start(ctx context.Context, transport *ApmServerTransport, event *NextEventResponse) {
+	if !deferred.lastEnd.IsZero() {
+		deferred.idle = event.Timestamp.Sub(deferred.lastEnd)
+	}
+	if deferred.deferredAt.IsZero() {
+		return
+	}
+	Log.Debugf("Flushing the agent data deferred %s ago", event.Timestamp.Sub(deferred.deferredAt))
+	transport.FlushAPMData(ctx, NewFlushInfo(event))
+	if transport.BufferedDataCount() == 0 {
+		deferred.deferredAt = time.Time{}
+	}
+}
+
+// End returns the send strategy applied at the end of the invocation, at now: the agent data is deferred to
+// the next invocation, unless its age or the idle time of the function exceeded the maximum age.
+func (deferred *DeferredFlush) End(transport *ApmServerTransport, now time.Time) SendStrategy {
+	deferred.lastEnd = now
+	if transport.BufferedDataCount() == 0 {
+		deferred.deferredAt = time.Time{}
+		return Background
+	}
+	if deferred.deferredAt.IsZero() {
+		deferred.deferredAt = now
+	}
+	if now.Sub(deferred.deferredAt) >= deferred.maxAge || deferred.idle >= deferred.maxAge {
+		Log.Debugf("Flushing the agent data deferred %s ago, the function was idle for %s", now.Sub(deferred.deferredAt), deferred.idle)
+		deferred.deferredAt = time.Time{}
+		return SyncFlush
+	}
+	return Background
+}
@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeferredFlush(t *testing.T) {
+	var requests int
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	deferred := NewDeferredFlush(&extensionConfig{flushOnNextMaxAge: time.Minute})
+	start := time.Now()
+
+	// Nothing deferred yet
+	deferred.Start(context.Background(), transport, &NextEventResponse{Timestamp: start})
+	assert.Equal(t, 0, requests)
+
+	// The agent data is deferred to the next invocation
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	assert.Equal(t, Background, deferred.End(transport, start.Add(time.Second)))
+	assert.Equal(t, 1, transport.BufferedDataCount())
+
+	// and flushed at its start
+	start = start.Add(10 * time.Second)
+	deferred.Start(context.Background(), transport, &NextEventResponse{Timestamp: start})
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	assert.True(t, deferred.deferredAt.IsZero())
+	assert.Equal(t, Background, deferred.End(transport, start.Add(time.Second)))
+}
+
+func TestDeferredFlushMaxAge(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	deferred := NewDeferredFlush(&extensionConfig{flushOnNextMaxAge: time.Minute})
+	start := time.Now()
+
+	// The agent data could not be flushed, e.g. as the APM server is unreachable
+	transport.setStatus(Failing)
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	assert.Equal(t, Background, deferred.End(transport, start))
+	deferred.Start(context.Background(), transport, &NextEventResponse{Timestamp: start.Add(30 * time.Second)})
+	assert.Equal(t, Background, deferred.End(transport, start.Add(31*time.Second)))
+	deferred.Start(context.Background(), transport, &NextEventResponse{Timestamp: start.Add(59 * time.Second)})
+	assert.Equal(t, SyncFlush, deferred.End(transport, start.Add(time.Minute)))
+}
+
+func TestDeferredFlushIdleFunction(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	deferred := NewDeferredFlush(&extensionConfig{flushOnNextMaxAge: time.Minute})
+	start := time.Now()
+
+	assert.Equal(t, Background, deferred.End(transport, start))
+	deferred.Start(context.Background(), transport, &NextEventResponse{Timestamp: start.Add(2 * time.Minute)})
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	assert.Equal(t, SyncFlush, deferred.End(transport, start.Add(2*time.Minute+time.Second)))
+}
+
+func TestProcessEnvFlushOnNext(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("ELASTIC_APM_SEND_STRATEGY", "flushonnext")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, FlushOnNext, config.SendStrategy)
+	assert.Equal(t, 5*time.Minute, config.flushOnNextMaxAge)
+
+	t.Setenv("ELASTIC_APM_FLUSH_ON_NEXT_MAX_AGE", "10m")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 10*time.Minute, config.flushOnNextMaxAge)
+
+	t.Setenv("ELASTIC_APM_FLUSH_ON_NEXT_MAX_AGE", "foo")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 5*time.Minute, config.flushOnNextMaxAge)
+}
@@ -0,0 +1,200 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// dnsRefreshTimeout bounds each resolution of the background refreshes of the DNS cache.
+const dnsRefreshTimeout = 2 * time.Second
+
+// hostResolver is the subset of net.Resolver used by the DNS cache.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type dnsCacheEntry struct {
+	addrs      []string
+	resolvedAt time.Time
+}
+
+// dnsCache holds the addresses of the hosts the extension connects to, i.e. the APM servers, for
+// ELASTIC_APM_SERVER_DNS_CACHE_TTL, so that the resolution of their names does not delay the flushes, e.g. in
+// VPCs with slow resolvers. The addresses are resolved when the extension starts, and refreshed in the
+// background between the invocations, before they expire. When a name cannot be resolved, the expired
+// addresses are used until it can be again.
+type dnsCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	resolver   hostResolver
+	clock      clock
+	entries    map[string]dnsCacheEntry
+	refreshing bool
+}
+
+// newDNSCache returns the DNS cache, or nil if caching is disabled.
+func newDNSCache(config *extensionConfig) *dnsCache {
+	if config.httpClient.dnsCacheTTL <= 0 {
+		return nil
+	}
+	return &dnsCache{
+		ttl:      config.httpClient.dnsCacheTTL,
+		resolver: net.DefaultResolver,
+		clock:    systemClock{},
+		entries:  make(map[string]dnsCacheEntry),
+	}
+}
+
+// wrap makes client resolve the names of the hosts it connects to with the cache.
+func (cache *dnsCache) wrap(client *http.Client) {
+	if cache == nil {
+		return
+	}
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = cache.dialContext(transport.DialContext)
+}
+
+// dialContext returns a dial function connecting to the cached addresses of the host with dial. The name of
+// the host is resolved by dial again if none of its cached addresses is reachable.
+func (cache *dnsCache) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+		for _, addr := range cache.lookup(ctx, host) {
+			conn, err := dial(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			Log.Debugf("Could not connect to the cached address %s of %s: %v", addr, host, err)
+		}
+		cache.invalidate(host)
+		return dial(ctx, network, address)
+	}
+}
+
+// lookup returns the cached addresses of host, resolving its name if they expired. The expired addresses are
+// returned if the name cannot be resolved.
+func (cache *dnsCache) lookup(ctx context.Context, host string) []string {
+	cache.mu.Lock()
+	entry, ok := cache.entries[host]
+	cache.mu.Unlock()
+	age := cache.clock.Now().Sub(entry.resolvedAt)
+	if ok && age < cache.ttl {
+		return entry.addrs
+	}
+	addrs, err := cache.resolve(ctx, host)
+	if err != nil {
+		if !ok {
+			return nil
+		}
+		Log.Warnf("Could not resolve %s, using the addresses resolved %s ago: %v", host, age.Round(time.Second), err)
+		return entry.addrs
+	}
+	return addrs
+}
+
+// resolve resolves the name of host, and caches its addresses.
+func (cache *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	addrs, err := cache.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address found for %s", host)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.entries[host] = dnsCacheEntry{addrs: addrs, resolvedAt: cache.clock.Now()}
+	return addrs, nil
+}
+
+// invalidate removes the addresses of host, none of which is reachable, from the cache.
+func (cache *dnsCache) invalidate(host string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.entries, host)
+}
+
+// refresh resolves again, in the background, the names of hosts and of the cached hosts whose addresses
+// are not cached yet, or are older than half the TTL.
+func (cache *dnsCache) refresh(hosts []string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.refreshing {
+		return
+	}
+	for host := range cache.entries {
+		hosts = append(hosts, host)
+	}
+	now := cache.clock.Now()
+	stale := make(map[string]bool)
+	for _, host := range hosts {
+		if entry, ok := cache.entries[host]; !ok || now.Sub(entry.resolvedAt) >= cache.ttl/2 {
+			stale[host] = true
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	cache.refreshing = true
+	go func() {
+		for host := range stale {
+			ctx, cancel := context.WithTimeout(context.Background(), dnsRefreshTimeout)
+			if _, err := cache.resolve(ctx, host); err != nil {
+				Log.Debugf("Could not refresh the addresses of %s: %v", host, err)
+			}
+			cancel()
+		}
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		cache.refreshing = false
+	}()
+}
+
+// RefreshDNSCache resolves again, in the background, the names of the APM servers whose cached addresses
+// are about to expire. It is called between the invocations, so that the flushes do not wait for the resolver.
+func (transport *ApmServerTransport) RefreshDNSCache() {
+	if transport.dnsCache == nil {
+		return
+	}
+	var hosts []string
+	for _, endpoint := range []*apmServerEndpoint{transport.endpoints.primary, transport.endpoints.fallback} {
+		if endpoint == nil {
+			continue
+		}
+		if u, err := url.Parse(endpoint.url); err == nil && u.Hostname() != "" && net.ParseIP(u.Hostname()) == nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	transport.dnsCache.refresh(hosts)
+}
@@ -0,0 +1,176 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockResolver struct {
+	mu      sync.Mutex
+	addrs   map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *mockResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *mockResolver) setError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+func (r *mockResolver) lookupCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+func newTestDNSCache(resolver hostResolver, clock clock) *dnsCache {
+	return &dnsCache{ttl: time.Minute, resolver: resolver, clock: clock, entries: make(map[string]dnsCacheEntry)}
+}
+
+func TestDNSCache(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Host, "apm.example.com:")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+	serverURL, err := url.Parse(apmServer.URL)
+	require.NoError(t, err)
+
+	resolver := &mockResolver{addrs: map[string][]string{"apm.example.com": {"127.0.0.1"}}}
+	clock := newManualClock()
+	cache := newTestDNSCache(resolver, clock)
+	client := newApmServerHTTPClient(&extensionConfig{DataForwarderTimeoutSeconds: 3})
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+	cache.wrap(client)
+
+	get := func() {
+		resp, err := client.Get("http://apm.example.com:" + serverURL.Port() + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	get()
+	get()
+	assert.Equal(t, 1, resolver.lookupCount())
+
+	// The expired addresses are resolved again
+	clock.Advance(time.Minute)
+	get()
+	assert.Equal(t, 2, resolver.lookupCount())
+
+	// or used as they are if the name cannot be resolved
+	clock.Advance(time.Minute)
+	resolver.setError(errors.New("i/o timeout"))
+	get()
+	assert.Equal(t, 3, resolver.lookupCount())
+}
+
+func TestDNSCacheUnreachableAddress(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serverURL, err := url.Parse(apmServer.URL)
+	require.NoError(t, err)
+	apmServer.Close()
+
+	cache := newTestDNSCache(&mockResolver{addrs: map[string][]string{"apm.example.com": {"127.0.0.1"}}}, newManualClock())
+	var dialed []string
+	dial := cache.dialContext(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, errors.New("connection refused")
+	})
+	_, err = dial(context.Background(), "tcp", "apm.example.com:"+serverURL.Port())
+	assert.Error(t, err)
+	// The name is resolved again by the dialer, and the unreachable addresses are not cached anymore
+	assert.Equal(t, []string{"127.0.0.1:" + serverURL.Port(), "apm.example.com:" + serverURL.Port()}, dialed)
+	assert.Empty(t, cache.entries)
+}
+
+func TestDNSCacheRefresh(t *testing.T) {
+	resolver := &mockResolver{addrs: map[string][]string{"apm.example.com": {"10.0.0.1"}, "fallback.example.com": {"10.0.0.2"}}}
+	clock := newManualClock()
+	cache := newTestDNSCache(resolver, clock)
+
+	waitRefresh := func() {
+		for {
+			cache.mu.Lock()
+			refreshing := cache.refreshing
+			cache.mu.Unlock()
+			if !refreshing {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cache.refresh([]string{"apm.example.com", "fallback.example.com"})
+	waitRefresh()
+	assert.Equal(t, 2, resolver.lookupCount())
+	assert.Equal(t, []string{"10.0.0.1"}, cache.lookup(context.Background(), "apm.example.com"))
+
+	// The addresses are only refreshed once they are older than half the TTL
+	clock.Advance(29 * time.Second)
+	cache.refresh([]string{"apm.example.com"})
+	waitRefresh()
+	assert.Equal(t, 2, resolver.lookupCount())
+	clock.Advance(time.Second)
+	cache.refresh([]string{"apm.example.com"})
+	waitRefresh()
+	assert.Equal(t, 4, resolver.lookupCount())
+}
+
+func TestDNSCacheDisabled(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "https://apm.example.com/"})
+	assert.Nil(t, transport.dnsCache)
+	transport.RefreshDNSCache()
+}
+
+func TestProcessEnvDNSCacheTTL(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("ELASTIC_APM_SERVER_DNS_CACHE_TTL", "5m")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 5*time.Minute, config.httpClient.dnsCacheTTL)
+
+	t.Setenv("ELASTIC_APM_SERVER_DNS_CACHE_TTL", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, time.Duration(0), config.httpClient.dnsCacheTTL)
+}
@@ -0,0 +1,73 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	envPrefix       = "ELASTIC_APM_"
+	lambdaEnvPrefix = "ELASTIC_APM_LAMBDA_"
+)
+
+// deprecatedEnvWarnings records the alternate variable names for which a deprecation warning was
+// already emitted, so that each warning is only emitted once.
+var deprecatedEnvWarnings sync.Map
+
+// alternateEnvName returns the alternate name of a configuration variable, which is obtained by
+// adding or removing the LAMBDA_ prefix (e.g. ELASTIC_APM_LAMBDA_SEND_STRATEGY for
+// ELASTIC_APM_SEND_STRATEGY, and ELASTIC_APM_APM_SERVER for ELASTIC_APM_LAMBDA_APM_SERVER).
+// Fleets of functions configured with older releases or other tooling may use either form.
+func alternateEnvName(name string) string {
+	if strings.HasPrefix(name, lambdaEnvPrefix) {
+		return envPrefix + strings.TrimPrefix(name, lambdaEnvPrefix)
+	}
+	if strings.HasPrefix(name, envPrefix) {
+		return lambdaEnvPrefix + strings.TrimPrefix(name, envPrefix)
+	}
+	return ""
+}
+
+// lookupEnv retrieves the value of the configuration variable name. When name is not set, the value
+// of its alternate name is used instead, and a deprecation warning is emitted once.
+func lookupEnv(name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	alternate := alternateEnvName(name)
+	if alternate == "" {
+		return "", false
+	}
+	value, ok := os.LookupEnv(alternate)
+	if !ok {
+		return "", false
+	}
+	if _, warned := deprecatedEnvWarnings.LoadOrStore(alternate, true); !warned {
+		Log.Warnf("%s is deprecated and will be removed in a future release, use %s instead", alternate, name)
+	}
+	return value, true
+}
+
+// getEnv retrieves the value of the configuration variable name, or of its alternate name.
+func getEnv(name string) string {
+	value, _ := lookupEnv(name)
+	return value
+}
@@ -0,0 +1,59 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlternateEnvName(t *testing.T) {
+	assert.Equal(t, "ELASTIC_APM_LAMBDA_SEND_STRATEGY", alternateEnvName("ELASTIC_APM_SEND_STRATEGY"))
+	assert.Equal(t, "ELASTIC_APM_APM_SERVER", alternateEnvName("ELASTIC_APM_LAMBDA_APM_SERVER"))
+	assert.Equal(t, "", alternateEnvName("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+}
+
+func TestLookupEnvPrecedence(t *testing.T) {
+	t.Cleanup(func() { deprecatedEnvWarnings = sync.Map{} })
+
+	_, ok := lookupEnv("ELASTIC_APM_SEND_STRATEGY")
+	assert.False(t, ok)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_SEND_STRATEGY", "background")
+	assert.Equal(t, "background", getEnv("ELASTIC_APM_SEND_STRATEGY"))
+	_, warned := deprecatedEnvWarnings.Load("ELASTIC_APM_LAMBDA_SEND_STRATEGY")
+	assert.True(t, warned)
+
+	// The documented name takes precedence over its alternate
+	t.Setenv("ELASTIC_APM_SEND_STRATEGY", "syncflush")
+	assert.Equal(t, "syncflush", getEnv("ELASTIC_APM_SEND_STRATEGY"))
+}
+
+func TestProcessEnvAlternateNames(t *testing.T) {
+	t.Cleanup(func() { deprecatedEnvWarnings = sync.Map{} })
+	t.Setenv("ELASTIC_APM_APM_SERVER", "legacy.example.com")
+	t.Setenv("ELASTIC_APM_LAMBDA_DATA_RECEIVER_TIMEOUT_SECONDS", "10")
+	t.Setenv("ELASTIC_APM_LAMBDA_SEND_STRATEGY", "background")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, "legacy.example.com/", config.apmServerUrl)
+	assert.Equal(t, 10, config.dataReceiverTimeoutSeconds)
+	assert.Equal(t, Background, config.SendStrategy)
+}
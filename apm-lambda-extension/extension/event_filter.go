@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+)
+
+// eventFilter drops the agent events of the types listed in ELASTIC_APM_FILTER_EVENT_TYPES before they are
+// sent to the APM server, e.g. the spans, to reduce the ingested volume. The metadata is never dropped, as
+// the APM server rejects the payloads without it.
+type eventFilter struct {
+	types    map[string]bool
+	filtered int64
+}
+
+// newEventFilter returns the filter of the agent events, or nil if no event type is filtered.
+func newEventFilter(config *extensionConfig) *eventFilter {
+	types := make(map[string]bool)
+	for _, eventType := range config.filterEventTypes {
+		eventType = strings.ToLower(eventType)
+		if eventType == "metadata" {
+			Log.Warn("The metadata cannot be filtered out of the agent data, ignoring")
+			continue
+		}
+		types[eventType] = true
+	}
+	if len(types) == 0 {
+		return nil
+	}
+	return &eventFilter{types: types}
+}
+
+// reader returns a reader of the newline-delimited agent data read from r, without the filtered events.
+// The events are filtered line by line, so that the agent data does not need to be read in memory.
+func (filter *eventFilter) reader(r io.Reader) io.Reader {
+	return &eventFilterReader{filter: filter, src: bufio.NewReader(r)}
+}
+
+// filterAgentData returns the uncompressed agent data without the filtered events, and whether any event
+// was filtered.
+func (transport *ApmServerTransport) filterAgentData(agentData AgentData) ([]byte, bool, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, false, err
+	}
+	filtered, err := ioutil.ReadAll(transport.filter.reader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, false, err
+	}
+	return filtered, len(filtered) != len(data), nil
+}
+
+// FilteredEvents returns the number of agent events dropped because of their type.
+func (transport *ApmServerTransport) FilteredEvents() int64 {
+	if transport.filter == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&transport.filter.filtered)
+}
+
+type eventFilterReader struct {
+	filter  *eventFilter
+	src     *bufio.Reader
+	pending []byte
+	err     error
+}
+
+func (r *eventFilterReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var line []byte
+		line, r.err = r.src.ReadBytes('\n')
+		if len(line) == 0 {
+			continue
+		}
+		if r.filter.types[eventType(line)] {
+			atomic.AddInt64(&r.filter.filtered, 1)
+			continue
+		}
+		r.pending = line
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// eventType returns the type of the event held by an ndjson line of agent data, i.e. the key of the
+// object, without decoding the event. An empty string is returned if the line is not an object.
+func eventType(line []byte) string {
+	line = bytes.TrimLeft(line, " \t\r")
+	if !bytes.HasPrefix(line, []byte("{")) {
+		return ""
+	}
+	line = bytes.TrimLeft(line[1:], " \t\r")
+	if !bytes.HasPrefix(line, []byte(`"`)) {
+		return ""
+	}
+	end := bytes.IndexByte(line[1:], '"')
+	if end < 0 {
+		return ""
+	}
+	return string(line[1 : end+1])
+}
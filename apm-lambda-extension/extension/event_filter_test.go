@@ -0,0 +1,156 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const filterTestData = `{"metadata":{}}
+{"transaction":{"id":"1"}}
+{"span":{"id":"2","transaction_id":"1"}}
+ { "span" : {"id":"3"}}
+{"error":{"id":"4","transaction":{"sampled":true}}}
+{"metricset":{"samples":{}}}`
+
+func TestEventType(t *testing.T) {
+	for line, expected := range map[string]string{
+		`{"metadata":{}}`:              "metadata",
+		` { "span" : {}}` + "\n":       "span",
+		`{"error":{"transaction":{}}}`: "error",
+		`[]`:                           "",
+		`{}`:                           "",
+		`{"unterminated`:               "",
+		``:                             "",
+	} {
+		assert.Equal(t, expected, eventType([]byte(line)), line)
+	}
+}
+
+func TestNewEventFilter(t *testing.T) {
+	assert.Nil(t, newEventFilter(&extensionConfig{}))
+	assert.Nil(t, newEventFilter(&extensionConfig{filterEventTypes: []string{"metadata"}}))
+	filter := newEventFilter(&extensionConfig{filterEventTypes: []string{"Span", "metadata", "metricset"}})
+	assert.Equal(t, map[string]bool{"span": true, "metricset": true}, filter.types)
+}
+
+func TestEventFilterReader(t *testing.T) {
+	filter := newEventFilter(&extensionConfig{filterEventTypes: []string{"span", "metricset"}})
+	// Reading one byte at a time checks that the lines are not mixed up across reads
+	filtered, err := ioutil.ReadAll(iotest.OneByteReader(filter.reader(bytes.NewReader([]byte(filterTestData)))))
+	require.NoError(t, err)
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"id":"1"}}
+{"error":{"id":"4","transaction":{"sampled":true}}}
+`, string(filtered))
+	assert.Equal(t, int64(3), filter.filtered)
+}
+
+func TestPostToApmServerFiltered(t *testing.T) {
+	var body []byte
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, err = GetUncompressedBytes(data, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", filterEventTypes: []string{"span"}}
+	transport := InitApmServerTransport(&config)
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(filterTestData)}))
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"id":"1"}}
+{"error":{"id":"4","transaction":{"sampled":true}}}
+{"metricset":{"samples":{}}}`, string(body))
+	assert.Equal(t, int64(2), transport.DebugVars().Buffer.FilteredEvents)
+}
+
+func TestPostToApmServerFilteredEnriched(t *testing.T) {
+	var body []byte
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, err = GetUncompressedBytes(data, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	// The metadata enrichment applies to the filtered agent data
+	config := extensionConfig{
+		apmServerUrl:     apmServer.URL + "/",
+		filterEventTypes: []string{"span"},
+		globalLabels:     map[string]string{"team": "payments"},
+	}
+	transport := InitApmServerTransport(&config)
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(filterTestData)}))
+	lines := strings.Split(string(body), "\n")
+	require.Len(t, lines, 4)
+	assert.JSONEq(t, `{"metadata":{"labels":{"team":"payments"}}}`, lines[0])
+	assert.Equal(t, `{"transaction":{"id":"1"}}
+{"error":{"id":"4","transaction":{"sampled":true}}}
+{"metricset":{"samples":{}}}`, strings.Join(lines[1:], "\n"))
+	assert.NotContains(t, string(body), `"span"`)
+}
+
+func TestStreamToApmServerFiltered(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	_, err := zw.Write([]byte(filterTestData))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	var body []byte
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, err = GetUncompressedBytes(data, "gzip")
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", filterEventTypes: []string{"span", "error"}}
+	transport := InitApmServerTransport(&config)
+	require.NoError(t, transport.StreamToApmServer(context.Background(), &compressed, "deflate", ""))
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"id":"1"}}
+{"metricset":{"samples":{}}}`, string(body))
+	assert.Equal(t, int64(3), transport.FilteredEvents())
+}
+
+func TestProcessEnvFilterEventTypes(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("ELASTIC_APM_FILTER_EVENT_TYPES", "span, metricset")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, []string{"span", "metricset"}, config.filterEventTypes)
+}
@@ -0,0 +1,133 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// apmServerEndpoint is an APM server the extension can send data to, along with its credentials.
+type apmServerEndpoint struct {
+	url         string
+	credentials *credentials
+}
+
+// apmServerEndpoints holds the primary APM server and, for cross-region disaster recovery, an optional
+// fallback APM server. Data is sent to the fallback while the primary is unreachable. The primary is then
+// probed periodically, and used again as soon as it responds.
+type apmServerEndpoints struct {
+	mu            sync.Mutex
+	primary       *apmServerEndpoint
+	fallback      *apmServerEndpoint
+	usingFallback bool
+	probeInterval time.Duration
+	lastProbe     time.Time
+	probing       bool
+}
+
+func newApmServerEndpoints(config *extensionConfig, primaryCredentials *credentials) *apmServerEndpoints {
+	endpoints := &apmServerEndpoints{
+		primary:       &apmServerEndpoint{url: config.apmServerUrl, credentials: primaryCredentials},
+		probeInterval: config.fallbackProbeInterval,
+	}
+	if endpoints.probeInterval <= 0 {
+		endpoints.probeInterval = defaultFallbackProbeInterval
+	}
+	if config.apmServerFallbackUrl != "" {
+		// The fallback shares the credentials of the primary unless it has its own
+		fallbackCredentials := primaryCredentials
+		if config.apmServerFallbackApiKey != "" || config.apmServerFallbackSecretToken != "" {
+			fallbackCredentials = &credentials{
+				apiKey:      config.apmServerFallbackApiKey,
+				secretToken: config.apmServerFallbackSecretToken,
+			}
+		}
+		endpoints.fallback = &apmServerEndpoint{url: config.apmServerFallbackUrl, credentials: fallbackCredentials}
+	}
+	return endpoints
+}
+
+// active returns the APM server data is currently sent to.
+func (endpoints *apmServerEndpoints) active() *apmServerEndpoint {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+	if endpoints.usingFallback {
+		return endpoints.fallback
+	}
+	return endpoints.primary
+}
+
+// failOver switches to the fallback APM server, and reports whether it did. It does not switch if there
+// is no fallback, or if the fallback is already in use.
+func (endpoints *apmServerEndpoints) failOver() bool {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+	if endpoints.fallback == nil || endpoints.usingFallback {
+		return false
+	}
+	endpoints.usingFallback = true
+	endpoints.lastProbe = time.Now()
+	Log.Warnf("Primary APM server unreachable, failing over to %s", endpoints.fallback.url)
+	return true
+}
+
+// probePrimary checks, in the background, whether the primary APM server is reachable again while the
+// fallback is in use, at most once per probe interval. The primary is used again if it responds.
+// The probe is only triggered when data is sent, so that nothing runs while the function is idle.
+func (endpoints *apmServerEndpoints) probePrimary(client *http.Client) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+	if !endpoints.usingFallback || endpoints.probing || time.Since(endpoints.lastProbe) < endpoints.probeInterval {
+		return
+	}
+	endpoints.probing = true
+	endpoints.lastProbe = time.Now()
+	go func() {
+		reachable := isApmServerReachable(client, endpoints.primary)
+		endpoints.mu.Lock()
+		defer endpoints.mu.Unlock()
+		endpoints.probing = false
+		if reachable {
+			endpoints.usingFallback = false
+			Log.Infof("Primary APM server reachable again, failing back to %s", endpoints.primary.url)
+		}
+	}()
+}
+
+// isApmServerReachable queries the server information endpoint of the APM server. Any response that is
+// not a server error denotes a reachable server.
+func isApmServerReachable(client *http.Client, endpoint *apmServerEndpoint) bool {
+	req, err := http.NewRequest(http.MethodGet, endpoint.url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", userAgent)
+	endpoint.credentials.setAuthorization(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		Log.Debugf("Primary APM server still unreachable: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode < http.StatusInternalServerError
+}
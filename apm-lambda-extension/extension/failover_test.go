@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFailoverTestApmServer returns an APM server closing the connections while it is down, and
+// recording the Authorization header of the intake requests it accepts.
+func newFailoverTestApmServer(t *testing.T, down *int32, authorizations chan<- string) *httptest.Server {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(down) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		if r.URL.Path == "/intake/v2/events" {
+			authorizations <- r.Header.Get("Authorization")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+	return apmServer
+}
+
+func TestPostToApmServerFailover(t *testing.T) {
+	primaryDown, fallbackDown := int32(1), int32(0)
+	primaryRequests := make(chan string, 10)
+	fallbackRequests := make(chan string, 10)
+	primary := newFailoverTestApmServer(t, &primaryDown, primaryRequests)
+	fallback := newFailoverTestApmServer(t, &fallbackDown, fallbackRequests)
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:                 primary.URL + "/",
+		apmServerSecretToken:         "primary-token",
+		apmServerFallbackUrl:         fallback.URL + "/",
+		apmServerFallbackSecretToken: "fallback-token",
+		fallbackProbeInterval:        50 * time.Millisecond,
+	})
+
+	// The data is sent to the fallback as soon as the primary is unreachable
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, "Bearer fallback-token", <-fallbackRequests)
+	assert.Equal(t, Healthy, transport.currentStatus())
+	assert.Equal(t, fallback.URL+"/", transport.DebugVars().Transport.ActiveApmServer)
+	assert.Equal(t, 0, transport.TakeDeliveryFailures())
+
+	// The primary is probed once the probe interval elapsed, and used again once reachable
+	atomic.StoreInt32(&primaryDown, 0)
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, "Bearer fallback-token", <-fallbackRequests)
+	require.Eventually(t, func() bool {
+		return transport.endpoints.active().url == primary.URL+"/"
+	}, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, "Bearer primary-token", <-primaryRequests)
+	assert.Empty(t, fallbackRequests)
+}
+
+func TestPostToApmServerFailoverSharedCredentials(t *testing.T) {
+	primaryDown, fallbackDown := int32(1), int32(0)
+	fallbackRequests := make(chan string, 10)
+	primary := newFailoverTestApmServer(t, &primaryDown, nil)
+	fallback := newFailoverTestApmServer(t, &fallbackDown, fallbackRequests)
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:         primary.URL + "/",
+		apmServerApiKey:      "api-key",
+		apmServerFallbackUrl: fallback.URL + "/",
+	})
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, "ApiKey api-key", <-fallbackRequests)
+}
+
+func TestPostToApmServerFallbackDown(t *testing.T) {
+	primaryDown, fallbackDown := int32(1), int32(1)
+	primary := newFailoverTestApmServer(t, &primaryDown, nil)
+	fallback := newFailoverTestApmServer(t, &fallbackDown, nil)
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:         primary.URL + "/",
+		apmServerFallbackUrl: fallback.URL + "/",
+	})
+	// Ensure that the grace period is not 0, to avoid a race between reaching the pending status and the assertion
+	transport.reconnectionCount = 0
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, Failing, transport.currentStatus())
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+}
@@ -0,0 +1,106 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"sort"
+	"strings"
+
+	"elastic/apm-lambda-extension/buildinfo"
+)
+
+// Feature is an experimental subsystem of the extension, which can be enabled or disabled regardless of its
+// configuration, so that it can ship dark and be enabled per fleet.
+type Feature string
+
+const (
+	// TelemetryAPIFeature subscribes to the Telemetry API rather than to the Logs API.
+	TelemetryAPIFeature Feature = "telemetry_api"
+	// BatchingFeature batches agent data before sending it to the APM server (ELASTIC_APM_BATCH_MAX_BYTES).
+	BatchingFeature Feature = "batching"
+	// TailSamplingFeature holds the agent data until the end of the invocation (ELASTIC_APM_LAMBDA_TAIL_SAMPLING).
+	TailSamplingFeature Feature = "tail_sampling"
+)
+
+// featureDefaults lists, for each feature, the build channels in which it is enabled by default.
+var featureDefaults = map[Feature][]string{
+	TelemetryAPIFeature: {buildinfo.ReleaseChannel, buildinfo.SnapshotChannel},
+	BatchingFeature:     {buildinfo.ReleaseChannel, buildinfo.SnapshotChannel},
+	TailSamplingFeature: {buildinfo.SnapshotChannel},
+}
+
+// FeatureFlags holds whether each feature is enabled.
+type FeatureFlags map[Feature]bool
+
+// defaultFeatureFlags returns the features enabled by default in the given build channel.
+func defaultFeatureFlags(channel string) FeatureFlags {
+	flags := make(FeatureFlags, len(featureDefaults))
+	for feature, channels := range featureDefaults {
+		for _, c := range channels {
+			if c == channel {
+				flags[feature] = true
+			}
+		}
+	}
+	return flags
+}
+
+// getFeatureFlags returns the features enabled by default in the given build channel, updated with
+// ELASTIC_APM_LAMBDA_FEATURES: a comma-separated list of features to enable, prefixed with "-" to disable them.
+// Unknown features are skipped.
+func getFeatureFlags(channel string) FeatureFlags {
+	flags := defaultFeatureFlags(channel)
+	for _, item := range getListFromEnv("ELASTIC_APM_LAMBDA_FEATURES") {
+		feature, enabled := Feature(strings.TrimPrefix(item, "-")), !strings.HasPrefix(item, "-")
+		if _, ok := featureDefaults[feature]; !ok {
+			Log.Warnf("Unknown feature %q in ELASTIC_APM_LAMBDA_FEATURES, skipping it", feature)
+			continue
+		}
+		flags[feature] = enabled
+	}
+	return flags
+}
+
+// Enabled reports whether feature is enabled.
+func (flags FeatureFlags) Enabled(feature Feature) bool {
+	return flags[feature]
+}
+
+// Names returns the sorted names of the enabled features.
+func (flags FeatureFlags) Names() []string {
+	names := []string{}
+	for feature, enabled := range flags {
+		if enabled {
+			names = append(names, string(feature))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyFeatureFlags disables the configured subsystems whose feature is disabled.
+func (config *extensionConfig) applyFeatureFlags() {
+	if config.batchMaxBytes > 0 && !config.Features.Enabled(BatchingFeature) {
+		Log.Warnf("ELASTIC_APM_BATCH_MAX_BYTES is set but the %s feature is disabled, batching is disabled", BatchingFeature)
+		config.batchMaxBytes = 0
+	}
+	if config.tailSampling.enabled && !config.Features.Enabled(TailSamplingFeature) {
+		Log.Warnf("ELASTIC_APM_LAMBDA_TAIL_SAMPLING is set but the %s feature is disabled, tail sampling is disabled", TailSamplingFeature)
+		config.tailSampling.enabled = false
+	}
+}
@@ -0,0 +1,63 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+
+	"elastic/apm-lambda-extension/buildinfo"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultFeatureFlags(t *testing.T) {
+	release := getFeatureFlags(buildinfo.ReleaseChannel)
+	assert.True(t, release.Enabled(TelemetryAPIFeature))
+	assert.True(t, release.Enabled(BatchingFeature))
+	assert.False(t, release.Enabled(TailSamplingFeature))
+	assert.Equal(t, []string{"batching", "telemetry_api"}, release.Names())
+
+	snapshot := getFeatureFlags(buildinfo.SnapshotChannel)
+	assert.Equal(t, []string{"batching", "tail_sampling", "telemetry_api"}, snapshot.Names())
+}
+
+func TestFeatureFlagsFromEnv(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_FEATURES", "tail_sampling, -telemetry_api,unknown")
+	flags := getFeatureFlags(buildinfo.ReleaseChannel)
+	assert.True(t, flags.Enabled(TailSamplingFeature))
+	assert.False(t, flags.Enabled(TelemetryAPIFeature))
+	assert.True(t, flags.Enabled(BatchingFeature))
+	assert.False(t, flags.Enabled("unknown"))
+}
+
+func TestApplyFeatureFlags(t *testing.T) {
+	config := extensionConfig{
+		batchMaxBytes: 1024,
+		tailSampling:  tailSamplingConfig{enabled: true},
+		Features:      FeatureFlags{BatchingFeature: true},
+	}
+	config.applyFeatureFlags()
+	assert.Equal(t, 1024, config.batchMaxBytes)
+	assert.False(t, config.tailSampling.enabled)
+
+	config.Features = FeatureFlags{TailSamplingFeature: true}
+	config.tailSampling.enabled = true
+	config.applyFeatureFlags()
+	assert.Equal(t, 0, config.batchMaxBytes)
+	assert.True(t, config.tailSampling.enabled)
+}
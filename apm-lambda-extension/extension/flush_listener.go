@@ -0,0 +1,78 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"time"
+)
+
+// FlushInfo describes the invocation after which the buffered APM data is flushed.
+// It is empty when the flush is not tied to an invocation (e.g. at shutdown).
+type FlushInfo struct {
+	RequestID          string
+	InvokedFunctionArn string
+	Deadline           time.Time
+}
+
+// FlushResult summarizes the outcome of a flush.
+type FlushResult struct {
+	Sent   int
+	Failed int
+}
+
+// FlushListener is notified of the lifecycle of each flush of the APM data buffered by the extension.
+// It allows custom senders needing transaction-like semantics (e.g. aggregating the records sent during
+// a flush) to be implemented outside of the core. The callbacks are invoked synchronously, from the
+// goroutine performing the flush, and must not block.
+type FlushListener interface {
+	OnFlushStart(ctx context.Context, info FlushInfo)
+	OnFlushEnd(ctx context.Context, info FlushInfo, result FlushResult)
+}
+
+// NewFlushInfo returns the FlushInfo describing the given invocation event, which may be nil.
+func NewFlushInfo(event *NextEventResponse) FlushInfo {
+	if event == nil {
+		return FlushInfo{}
+	}
+	return FlushInfo{
+		RequestID:          event.RequestID,
+		InvokedFunctionArn: event.InvokedFunctionArn,
+		Deadline:           time.UnixMilli(event.DeadlineMs),
+	}
+}
+
+// AddFlushListener registers a listener notified of every subsequent flush.
+// Listeners must be registered before the transport starts forwarding data.
+func (transport *ApmServerTransport) AddFlushListener(listener FlushListener) {
+	transport.flushListeners = append(transport.flushListeners, listener)
+}
+
+func (transport *ApmServerTransport) notifyFlushStart(ctx context.Context, info FlushInfo) {
+	transport.debug.recordFlushStart()
+	for _, listener := range transport.flushListeners {
+		listener.OnFlushStart(ctx, info)
+	}
+}
+
+func (transport *ApmServerTransport) notifyFlushEnd(ctx context.Context, info FlushInfo, result FlushResult) {
+	transport.debug.recordFlushEnd()
+	for _, listener := range transport.flushListeners {
+		listener.OnFlushEnd(ctx, info, result)
+	}
+}
@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingFlushListener struct {
+	calls   []string
+	info    FlushInfo
+	results []FlushResult
+}
+
+func (l *recordingFlushListener) OnFlushStart(_ context.Context, info FlushInfo) {
+	l.calls = append(l.calls, "start")
+	l.info = info
+}
+
+func (l *recordingFlushListener) OnFlushEnd(_ context.Context, info FlushInfo, result FlushResult) {
+	l.calls = append(l.calls, "end")
+	l.results = append(l.results, result)
+}
+
+func TestFlushListener(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+	}
+	transport := InitApmServerTransport(&config)
+	listener := &recordingFlushListener{}
+	transport.AddFlushListener(listener)
+
+	transport.dataChannel <- AgentData{Data: []byte(`{"metadata":{}}`)}
+	transport.dataChannel <- AgentData{Data: []byte(`{"metadata":{}}`)}
+
+	event := NextEventResponse{
+		RequestID:          "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+		DeadlineMs:         1659441683000,
+	}
+	transport.FlushAPMData(context.Background(), NewFlushInfo(&event))
+
+	assert.Equal(t, []string{"start", "end"}, listener.calls)
+	assert.Equal(t, "8476a536-e9f4-11e8-9739-2dfe598c3fcd", listener.info.RequestID)
+	assert.Equal(t, event.InvokedFunctionArn, listener.info.InvokedFunctionArn)
+	assert.True(t, time.UnixMilli(1659441683000).Equal(listener.info.Deadline))
+	assert.Equal(t, []FlushResult{{Sent: 2}}, listener.results)
+
+	// Flushing an empty buffer is still reported to the listeners
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	assert.Equal(t, []string{"start", "end", "start", "end"}, listener.calls)
+	assert.Equal(t, FlushInfo{}, listener.info)
+	assert.Equal(t, FlushResult{}, listener.results[1])
+}
+
+func TestFlushListenerFailingTransport(t *testing.T) {
+	config := extensionConfig{}
+	transport := InitApmServerTransport(&config)
+	listener := &recordingFlushListener{}
+	transport.AddFlushListener(listener)
+	transport.SetApmServerTransportState(context.Background(), Failing)
+
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	assert.Empty(t, listener.calls)
+}
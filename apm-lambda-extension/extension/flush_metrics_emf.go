@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// flushMetricsNamespace is the CloudWatch namespace of the flush metrics.
+const flushMetricsNamespace = "ElasticAPM/LambdaExtension"
+
+// emfMetric describes a metric of a CloudWatch Embedded Metric Format document.
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// emfDirective tells CloudWatch which fields of the document are metrics, and which are their dimensions.
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// flushMetricsDocument is the Embedded Metric Format document written at the end of each flush.
+type flushMetricsDocument struct {
+	AWS            emfMetadata `json:"_aws"`
+	FunctionName   string      `json:"FunctionName"`
+	RequestID      string      `json:"RequestId,omitempty"`
+	Outcome        string      `json:"Outcome"`
+	FlushDuration  float64     `json:"FlushDuration"`
+	SentPayloads   int         `json:"SentPayloads"`
+	FailedPayloads int         `json:"FailedPayloads"`
+	FailedFlushes  int         `json:"FailedFlushes"`
+}
+
+var flushMetricsDirective = emfDirective{
+	Namespace:  flushMetricsNamespace,
+	Dimensions: [][]string{{"FunctionName"}},
+	Metrics: []emfMetric{
+		{Name: "FlushDuration", Unit: "Milliseconds"},
+		{Name: "SentPayloads", Unit: "Count"},
+		{Name: "FailedPayloads", Unit: "Count"},
+		{Name: "FailedFlushes", Unit: "Count"},
+	},
+}
+
+// FlushMetricsEmitter writes the outcome and the duration of each flush as a CloudWatch Embedded Metric
+// Format document. The output of the extension is sent to CloudWatch Logs along with the function logs, which
+// turns the documents into CloudWatch metrics, so that the delivery health of the APM data is visible in
+// the AWS tooling as well.
+type FlushMetricsEmitter struct {
+	output       io.Writer
+	functionName string
+	flushStart   time.Time
+}
+
+// NewFlushMetricsEmitter returns a FlushMetricsEmitter writing to output, or nil if the flush metrics are
+// disabled.
+func NewFlushMetricsEmitter(config *extensionConfig, output io.Writer) *FlushMetricsEmitter {
+	if !config.flushMetricsEMF {
+		return nil
+	}
+	return &FlushMetricsEmitter{output: output, functionName: config.functionName}
+}
+
+// OnFlushStart records the start of the flush.
+func (e *FlushMetricsEmitter) OnFlushStart(_ context.Context, _ FlushInfo) {
+	e.flushStart = time.Now()
+}
+
+// OnFlushEnd writes the metrics of the flush. Flushes which had nothing to send are not reported.
+func (e *FlushMetricsEmitter) OnFlushEnd(_ context.Context, info FlushInfo, result FlushResult) {
+	if result.Sent == 0 && result.Failed == 0 {
+		return
+	}
+	now := time.Now()
+	document := flushMetricsDocument{
+		AWS: emfMetadata{
+			Timestamp:         now.UnixMilli(),
+			CloudWatchMetrics: []emfDirective{flushMetricsDirective},
+		},
+		FunctionName:   e.functionName,
+		RequestID:      info.RequestID,
+		Outcome:        "success",
+		FlushDuration:  float64(now.Sub(e.flushStart)) / float64(time.Millisecond),
+		SentPayloads:   result.Sent,
+		FailedPayloads: result.Failed,
+	}
+	if result.Failed > 0 {
+		document.Outcome = "failure"
+		document.FailedFlushes = 1
+	}
+	line, err := json.Marshal(document)
+	if err != nil {
+		Log.Errorf("Could not marshal the flush metrics: %v", err)
+		return
+	}
+	if _, err := e.output.Write(append(line, '\n')); err != nil {
+		Log.Errorf("Could not write the flush metrics: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlushMetricsEmitter(t *testing.T) {
+	var output bytes.Buffer
+	emitter := NewFlushMetricsEmitter(&extensionConfig{flushMetricsEMF: true, functionName: "foo"}, &output)
+	require.NotNil(t, emitter)
+
+	info := FlushInfo{RequestID: "8476a536-e9f4-11e8-9739-2dfe598c3fcd"}
+	emitter.OnFlushStart(context.Background(), info)
+	emitter.OnFlushEnd(context.Background(), info, FlushResult{Sent: 2, Failed: 1})
+
+	var document map[string]interface{}
+	require.NoError(t, json.Unmarshal(output.Bytes(), &document))
+	assert.Equal(t, "foo", document["FunctionName"])
+	assert.Equal(t, info.RequestID, document["RequestId"])
+	assert.Equal(t, "failure", document["Outcome"])
+	assert.Equal(t, float64(2), document["SentPayloads"])
+	assert.Equal(t, float64(1), document["FailedPayloads"])
+	assert.Equal(t, float64(1), document["FailedFlushes"])
+	assert.GreaterOrEqual(t, document["FlushDuration"], float64(0))
+
+	metadata := document["_aws"].(map[string]interface{})
+	directive := metadata["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, flushMetricsNamespace, directive["Namespace"])
+	assert.Equal(t, []interface{}{[]interface{}{"FunctionName"}}, directive["Dimensions"])
+	assert.Len(t, directive["Metrics"], 4)
+
+	// Flushes which had nothing to send are not reported
+	output.Reset()
+	emitter.OnFlushStart(context.Background(), info)
+	emitter.OnFlushEnd(context.Background(), info, FlushResult{})
+	assert.Empty(t, output.String())
+}
+
+func TestFlushMetricsEmitterTransport(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	var output bytes.Buffer
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", flushMetricsEMF: true, functionName: "foo"}
+	transport := InitApmServerTransport(&config)
+	transport.AddFlushListener(NewFlushMetricsEmitter(&config, &output))
+	transport.EnqueueAPMData(AgentData{Data: []byte(`{"metadata":{}}`)})
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+
+	var document flushMetricsDocument
+	require.NoError(t, json.Unmarshal(output.Bytes(), &document))
+	assert.Equal(t, "success", document.Outcome)
+	assert.Equal(t, 1, document.SentPayloads)
+	assert.Equal(t, 0, document.FailedFlushes)
+}
+
+func TestNewFlushMetricsEmitterDisabled(t *testing.T) {
+	assert.Nil(t, NewFlushMetricsEmitter(&extensionConfig{}, &bytes.Buffer{}))
+
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("ELASTIC_APM_LAMBDA_FLUSH_METRICS_EMF", "true")
+	assert.True(t, ProcessEnv(new(mockSecretManager)).flushMetricsEMF)
+}
@@ -0,0 +1,139 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// slowFlushProfileFile is the name of the file the CPU profile of the latest slow flush is written to.
+const slowFlushProfileFile = "slow-flush-cpu.pprof"
+
+// maxGoroutineSummaryBytes bounds the size of the goroutine summary logged after a slow flush.
+const maxGoroutineSummaryBytes = 4096
+
+// SlowFlushProfiler captures a short CPU profile when a flush lasts longer than a threshold, so that rare
+// slow flushes observed in production can be investigated. The profile is written to a file, and a summary
+// is logged along with its location.
+type SlowFlushProfiler struct {
+	mu          sync.Mutex
+	threshold   time.Duration
+	maxDuration time.Duration
+	dir         string
+	flushStart  time.Time
+	startTimer  *time.Timer
+	stopTimer   *time.Timer
+	profile     *os.File
+}
+
+// NewSlowFlushProfiler returns the profiler derived from the configuration, or nil if it is disabled.
+func NewSlowFlushProfiler(config *extensionConfig) *SlowFlushProfiler {
+	if config.slowFlushThresholdMs <= 0 {
+		return nil
+	}
+	return &SlowFlushProfiler{
+		threshold:   time.Duration(config.slowFlushThresholdMs) * time.Millisecond,
+		maxDuration: time.Duration(config.slowFlushProfileDurationMs) * time.Millisecond,
+		dir:         config.spillDir,
+	}
+}
+
+// OnFlushStart arms the profiler, which starts profiling once the flush exceeds the threshold.
+func (p *SlowFlushProfiler) OnFlushStart(_ context.Context, _ FlushInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushStart = time.Now()
+	p.startTimer = time.AfterFunc(p.threshold, p.startProfile)
+}
+
+// OnFlushEnd disarms the profiler, and stops the profile if one was being captured.
+func (p *SlowFlushProfiler) OnFlushEnd(_ context.Context, info FlushInfo, result FlushResult) {
+	p.mu.Lock()
+	if p.startTimer != nil {
+		p.startTimer.Stop()
+		p.startTimer = nil
+	}
+	profiling := p.profile != nil
+	flushDuration := time.Since(p.flushStart)
+	p.mu.Unlock()
+
+	if profiling {
+		p.stopProfile()
+		Log.Warnf("Slow flush of %d payloads for request %s took %v, CPU profile written to %s, goroutines:\n%s",
+			result.Sent+result.Failed, info.RequestID, flushDuration, filepath.Join(p.dir, slowFlushProfileFile), goroutineSummary())
+	}
+}
+
+func (p *SlowFlushProfiler) startProfile() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.startTimer == nil || p.profile != nil {
+		// The flush ended in the meantime
+		return
+	}
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		Log.Warnf("Could not create the directory of the slow flush CPU profile: %v", err)
+		return
+	}
+	profile, err := os.Create(filepath.Join(p.dir, slowFlushProfileFile))
+	if err != nil {
+		Log.Warnf("Could not create the slow flush CPU profile: %v", err)
+		return
+	}
+	if err := pprof.StartCPUProfile(profile); err != nil {
+		Log.Warnf("Could not start the slow flush CPU profile: %v", err)
+		profile.Close()
+		return
+	}
+	Log.Debugf("Flush exceeded %v, capturing a CPU profile", p.threshold)
+	p.profile = profile
+	p.stopTimer = time.AfterFunc(p.maxDuration, p.stopProfile)
+}
+
+// stopProfile stops the profile being captured, if any.
+func (p *SlowFlushProfiler) stopProfile() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.profile == nil {
+		return
+	}
+	p.stopTimer.Stop()
+	pprof.StopCPUProfile()
+	if err := p.profile.Close(); err != nil {
+		Log.Warnf("Could not write the slow flush CPU profile: %v", err)
+	}
+	p.profile = nil
+}
+
+// goroutineSummary returns the goroutines of the extension, grouped by stack trace.
+func goroutineSummary() string {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return err.Error()
+	}
+	if buf.Len() > maxGoroutineSummaryBytes {
+		return string(buf.Bytes()[:maxGoroutineSummaryBytes]) + "..."
+	}
+	return buf.String()
+}
@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowFlushProfilerDisabled(t *testing.T) {
+	assert.Nil(t, NewSlowFlushProfiler(&extensionConfig{}))
+}
+
+func TestSlowFlushProfiler(t *testing.T) {
+	dir := t.TempDir()
+	profiler := NewSlowFlushProfiler(&extensionConfig{
+		slowFlushThresholdMs:       10,
+		slowFlushProfileDurationMs: 1000,
+		spillDir:                   dir,
+	})
+	require.NotNil(t, profiler)
+	profilePath := filepath.Join(dir, slowFlushProfileFile)
+
+	// A fast flush is not profiled
+	profiler.OnFlushStart(context.Background(), FlushInfo{})
+	profiler.OnFlushEnd(context.Background(), FlushInfo{}, FlushResult{})
+	time.Sleep(20 * time.Millisecond)
+	_, err := os.Stat(profilePath)
+	assert.True(t, os.IsNotExist(err))
+
+	// A slow flush is profiled until it ends
+	profiler.OnFlushStart(context.Background(), FlushInfo{RequestID: "slow"})
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+	}
+	profiler.OnFlushEnd(context.Background(), FlushInfo{RequestID: "slow"}, FlushResult{Sent: 1})
+	info, err := os.Stat(profilePath)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Size())
+	assert.Nil(t, profiler.profile)
+}
+
+func TestGoroutineSummary(t *testing.T) {
+	summary := goroutineSummary()
+	assert.Contains(t, summary, "goroutine profile")
+	assert.LessOrEqual(t, len(summary), maxGoroutineSummaryBytes+len("..."))
+}
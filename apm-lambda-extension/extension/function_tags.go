@@ -0,0 +1,55 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// functionGetter is the subset of the Lambda API used to look up the tags of the function.
+type functionGetter interface {
+	GetFunction(*lambda.GetFunctionInput) (*lambda.GetFunctionOutput, error)
+}
+
+// labelKeyReplacer replaces the characters APM labels keys cannot contain.
+var labelKeyReplacer = strings.NewReplacer(".", "_", "*", "_", `"`, "_")
+
+// LookupTagLabels returns the labels to add to the metadata of the agent data, from the function tags
+// configured in ELASTIC_APM_LAMBDA_TAGS_AS_LABELS. It returns nil if no tag is configured, or if the
+// tags cannot be looked up.
+func LookupTagLabels(config *extensionConfig, getter functionGetter) map[string]string {
+	if len(config.tagsAsLabels) == 0 {
+		return nil
+	}
+	output, err := getter.GetFunction(&lambda.GetFunctionInput{FunctionName: aws.String(config.functionName)})
+	if err != nil {
+		Log.Warnf("Could not look up the tags of the function, they are not added as labels: %v", err)
+		return nil
+	}
+	labels := make(map[string]string, len(config.tagsAsLabels))
+	for _, tag := range config.tagsAsLabels {
+		if value, ok := output.Tags[tag]; ok && value != nil {
+			labels[labelKeyReplacer.Replace(tag)] = *value
+		}
+	}
+	Log.Debugf("Function tags added as labels: %v", labels)
+	return labels
+}
@@ -0,0 +1,90 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockFunctionGetter returns the given tags for any function.
+type mockFunctionGetter struct {
+	tags  map[string]*string
+	err   error
+	calls int
+}
+
+func (g *mockFunctionGetter) GetFunction(*lambda.GetFunctionInput) (*lambda.GetFunctionOutput, error) {
+	g.calls++
+	if g.err != nil {
+		return nil, g.err
+	}
+	return &lambda.GetFunctionOutput{Tags: g.tags}, nil
+}
+
+func TestLookupTagLabels(t *testing.T) {
+	getter := &mockFunctionGetter{tags: map[string]*string{
+		"team":                          aws.String("payments"),
+		"cost.center":                   aws.String("cc-42"),
+		"aws:cloudformation:stack-name": aws.String("stack"),
+	}}
+
+	assert.Nil(t, LookupTagLabels(&extensionConfig{}, getter))
+	assert.Equal(t, 0, getter.calls)
+
+	config := extensionConfig{functionName: "my-function", tagsAsLabels: []string{"team", "cost.center", "missing"}}
+	assert.Equal(t, map[string]string{"team": "payments", "cost_center": "cc-42"}, LookupTagLabels(&config, getter))
+
+	getter.err = errors.New("AccessDeniedException")
+	assert.Nil(t, LookupTagLabels(&config, getter))
+}
+
+func TestPostToApmServerAddsMetadataLabels(t *testing.T) {
+	var received []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := GetUncompressedBytes(mustReadAll(t, r), r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/"}
+	transport := InitApmServerTransport(&config)
+	transport.SetMetadataLabels(map[string]string{"team": "payments"})
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}` + "\n" + `{"span":{}}`)}))
+	// Agent data that does not start with metadata is sent as is
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"span":{}}`)}))
+	assert.Equal(t, []string{`{"metadata":{"labels":{"team":"payments"}}}` + "\n" + `{"span":{}}`, `{"span":{}}`}, received)
+}
+
+func mustReadAll(t *testing.T, r *http.Request) []byte {
+	body, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	return body
+}
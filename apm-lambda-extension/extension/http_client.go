@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpClientConfig holds the settings of the HTTP client sending data to the APM server.
+// The zero value of a setting stands for the default of the client.
+type httpClientConfig struct {
+	// timeout is the maximum duration of a request, including reading the response body.
+	// It defaults to the data forwarder timeout.
+	timeout             time.Duration
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	// maxIdleConns is the maximum number of idle connections kept open to the APM server.
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+	// keepAlive is the interval between the TCP keep-alive probes of the connections.
+	keepAlive time.Duration
+	// tlsConfig holds the client certificate and trusted CAs of the connections, if customized.
+	tlsConfig *tls.Config
+	// proxyURL is the proxy of all the requests to the APM server, if set. Otherwise the proxy is read
+	// from the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+	proxyURL *url.URL
+	// dnsCacheTTL is the time the addresses of the APM servers are cached, or 0 to disable the cache.
+	dnsCacheTTL time.Duration
+}
+
+// Defaults of the HTTP client sending data to the APM server, matching those of http.DefaultTransport.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newApmServerHTTPClient returns the HTTP client sending data to the APM server.
+func newApmServerHTTPClient(config *extensionConfig) *http.Client {
+	clientConfig := config.httpClient
+	timeout := clientConfig.timeout
+	if timeout == 0 {
+		timeout = time.Duration(config.DataForwarderTimeoutSeconds) * time.Second
+	}
+	dialer := &net.Dialer{
+		Timeout:   durationOrDefault(clientConfig.dialTimeout, defaultDialTimeout),
+		KeepAlive: durationOrDefault(clientConfig.keepAlive, defaultKeepAlive),
+	}
+	maxIdleConns := clientConfig.maxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = durationOrDefault(clientConfig.tlsHandshakeTimeout, defaultTLSHandshakeTimeout)
+	transport.IdleConnTimeout = durationOrDefault(clientConfig.idleConnTimeout, defaultIdleConnTimeout)
+	// All the connections go to the APM server, so that the pool is not shared between hosts.
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	if clientConfig.tlsConfig != nil {
+		transport.TLSClientConfig = clientConfig.tlsConfig
+	}
+	// The credentials of the proxy URL, if any, are sent in the Proxy-Authorization header
+	transport.Proxy = http.ProxyFromEnvironment
+	if clientConfig.proxyURL != nil {
+		transport.Proxy = http.ProxyURL(clientConfig.proxyURL)
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
+
+// parseProxyURL parses the URL of a proxy, which defaults to the http scheme, as for HTTPS_PROXY. The
+// errors do not include the URL, as it may hold the credentials of the proxy.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		// e.g. proxy.example.com:3128
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("invalid proxy URL")
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("missing proxy host in %q", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+func durationOrDefault(value, defaultValue time.Duration) time.Duration {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
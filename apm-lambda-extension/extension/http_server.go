@@ -21,6 +21,7 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -28,10 +29,19 @@ import (
 func StartHttpServer(ctx context.Context, transport *ApmServerTransport) (agentDataServer *http.Server, err error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handleInfoRequest(ctx, transport))
-	mux.HandleFunc("/intake/v2/events", handleIntakeV2Events(transport))
+	mux.HandleFunc("/intake/v2/events", handleIntakeV2Events(ctx, transport))
+	mux.HandleFunc("/intake/v3/events", handleIntakeV3Events(ctx, transport))
+	mux.HandleFunc("/v1/traces", handleOTLPTraces(transport))
+	mux.HandleFunc("/healthcheck", handleHealthcheck(transport))
+	mux.HandleFunc("/debug", handleDebugVars(transport))
+	mux.HandleFunc("/debug/vars", handleDebugVars(transport))
+	mux.HandleFunc("/debug/echo", handleDebugEcho())
+	mux.HandleFunc("/debug/support-bundle", handleSupportBundle(transport))
+	mux.HandleFunc("/config/v1/agents", handleCentralConfig(transport))
+	mux.HandleFunc("/assets/v1/sourcemaps", handleSourceMaps(ctx, transport))
 	timeout := time.Duration(transport.config.dataReceiverTimeoutSeconds) * time.Second
 	server := &http.Server{
-		Addr:           transport.config.dataReceiverServerPort,
+		Addr:           transport.config.dataReceiverListenAddress(),
 		Handler:        mux,
 		ReadTimeout:    timeout,
 		WriteTimeout:   timeout,
@@ -42,16 +52,49 @@ func StartHttpServer(ctx context.Context, transport *ApmServerTransport) (agentD
 	if err != nil {
 		return
 	}
+	go serve(server, ln)
 
-	go func() {
-		Log.Infof("Extension listening for apm data on %s", server.Addr)
-		if err = server.Serve(ln); err != nil {
-			if err.Error() == "http: server closed" {
-				Log.Debug(err)
-			} else {
-				Log.Errorf("Error upon APM data server start : %v", err)
-			}
+	// The agents may also send their data over a Unix domain socket, which avoids the overhead of the
+	// loopback interface and conflicts with the ports used by other extensions
+	if socket := transport.config.dataReceiverSocket; socket != "" {
+		if socketLn, err := listenUnix(socket); err != nil {
+			Log.Errorf("Could not listen for APM data on %s, only listening on %s : %v", socket, server.Addr, err)
+		} else {
+			go serve(server, socketLn)
 		}
-	}()
+	}
 	return server, nil
 }
+
+// serve serves the APM data received on ln until the server is closed.
+func serve(server *http.Server, ln net.Listener) {
+	Log.Infof("Extension listening for apm data on %s", ln.Addr())
+	if err := server.Serve(ln); err != nil {
+		if err.Error() == "http: server closed" {
+			Log.Debug(err)
+		} else {
+			Log.Errorf("Error upon APM data server start : %v", err)
+		}
+	}
+}
+
+// listenUnix listens on the Unix domain socket at path, which is removed when the listener is closed. A
+// socket left at path, e.g. by a previous extension process of the execution environment, is replaced.
+// The socket can be written by the processes of other users, as the function may not run as the user of
+// the extension.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -25,6 +25,8 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -194,7 +196,7 @@ func Test_handleInfoRequestInvalidBody(t *testing.T) {
 	transport := InitApmServerTransport(&extensionConfig{})
 	mux := http.NewServeMux()
 	urlPath := "/intake/v2/events"
-	mux.HandleFunc(urlPath, handleIntakeV2Events(transport))
+	mux.HandleFunc(urlPath, handleIntakeV2Events(context.Background(), transport))
 	req := httptest.NewRequest(http.MethodGet, urlPath, errReader(0))
 	recorder := httptest.NewRecorder()
 
@@ -255,6 +257,104 @@ func Test_handleIntakeV2EventsQueryParam(t *testing.T) {
 	}
 }
 
+func Test_handleIntakeV2EventsQueryParamOutsideInvocation(t *testing.T) {
+	body := []byte(`{"metadata": {}`)
+
+	// Create apm server and handler
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Create extension config and start the server
+	config := extensionConfig{
+		apmServerUrl:               apmServer.URL,
+		dataReceiverServerPort:     ":1234",
+		dataReceiverTimeoutSeconds: 15,
+	}
+	transport := InitApmServerTransport(&config)
+	agentDataServer, err := StartHttpServer(context.Background(), transport)
+	if err != nil {
+		t.Fail()
+		return
+	}
+	defer agentDataServer.Close()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events?flushed=true"
+
+	// The flush signals of a previous invocation must neither block the agent nor be delivered to the next one
+	agentDoneSignal := transport.StartAgentDoneSignal()
+	transport.StopAgentDoneSignal()
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(url, "application/x-ndjson", bytes.NewReader(body))
+		assert.NilError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		resp.Body.Close()
+		<-transport.dataChannel
+	}
+	assert.Equal(t, len(agentDoneSignal), 0)
+
+	agentDoneSignal = transport.StartAgentDoneSignal()
+	defer transport.StopAgentDoneSignal()
+	assert.Equal(t, len(agentDoneSignal), 0)
+}
+
+func Test_handleIntakeV2EventsExpectedFlushes(t *testing.T) {
+	// Create apm server and handler
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	}))
+	defer apmServer.Close()
+
+	// Create extension config and start the server
+	config := extensionConfig{
+		apmServerUrl:               apmServer.URL,
+		dataReceiverServerPort:     ":1234",
+		dataReceiverTimeoutSeconds: 15,
+	}
+	transport := InitApmServerTransport(&config)
+	agentDataServer, err := StartHttpServer(context.Background(), transport)
+	if err != nil {
+		t.Fail()
+		return
+	}
+	defer agentDataServer.Close()
+
+	hosts, _ := net.LookupHost("localhost")
+	url := "http://" + hosts[0] + ":1234/intake/v2/events"
+	post := func(query string) {
+		resp, err := http.Post(url+query, "application/x-ndjson", bytes.NewReader(nil))
+		assert.NilError(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	// The agent of a function processing a batch of three records flushes once per record
+	agentDoneSignal := transport.StartAgentDoneSignal()
+	defer transport.StopAgentDoneSignal()
+	post("?expected_flushes=3&flushed=true")
+	post("?flushed=true")
+	assert.Equal(t, len(agentDoneSignal), 0)
+	post("?flushed=true")
+	assert.Equal(t, len(agentDoneSignal), 1)
+
+	// The expected flush count is reset for each invocation
+	agentDoneSignal = transport.StartAgentDoneSignal()
+	post("?flushed=true")
+	assert.Equal(t, len(agentDoneSignal), 1)
+
+	// Lowering the expected flush count signals the invocation if enough flushes were received
+	agentDoneSignal = transport.StartAgentDoneSignal()
+	post("?expected_flushes=2&flushed=true")
+	assert.Equal(t, len(agentDoneSignal), 0)
+	post("?expected_flushes=1")
+	assert.Equal(t, len(agentDoneSignal), 1)
+
+	// Invalid expected flush counts are ignored
+	agentDoneSignal = transport.StartAgentDoneSignal()
+	post("?expected_flushes=invalid&flushed=true")
+	assert.Equal(t, len(agentDoneSignal), 1)
+}
+
 func Test_handleIntakeV2EventsNoQueryParam(t *testing.T) {
 	body := []byte(`{"metadata": {}`)
 
@@ -349,3 +449,148 @@ func Test_handleIntakeV2EventsQueryParamEmptyData(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestInfoProxyUnreachableApmServer(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	transport.reconnectionCount = 0
+	recorder := httptest.NewRecorder()
+	handleInfoRequest(context.Background(), transport)(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Assert(t, strings.Contains(recorder.Body.String(), "APM server unreachable"))
+	// The transport enters a grace period, which is over right away on the first failure
+	assert.Assert(t, transport.currentStatus() != Healthy)
+}
+
+func TestInfoRequestWhileFailing(t *testing.T) {
+	var requests int
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	transport.setStatus(Failing)
+	transport.gracePeriodEnd = time.Now().Add(9500 * time.Millisecond).UnixNano()
+	recorder := httptest.NewRecorder()
+	handleInfoRequest(context.Background(), transport)(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// The extension answers on behalf of the APM server, which is not queried
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "10", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, 0, requests)
+
+	transport.setStatus(Healthy)
+	recorder = httptest.NewRecorder()
+	handleInfoRequest(context.Background(), transport)(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 1, requests)
+}
+
+func TestUnixSocketIntake(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "apm.sock")
+	// A socket left by a previous extension process is replaced
+	stale, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := extensionConfig{
+		apmServerUrl:               "https://example.com/",
+		dataReceiverServerPort:     ":1234",
+		dataReceiverSocket:         socket,
+		dataReceiverTimeoutSeconds: 15,
+	}
+	transport := InitApmServerTransport(&config)
+	agentDataServer, err := StartHttpServer(context.Background(), transport)
+	assert.NilError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Post("http://localhost/intake/v2/events", "application/x-ndjson", strings.NewReader(`{"metadata":{}}`))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, 1, transport.BufferedDataCount())
+
+	// The socket is removed when the server is closed
+	agentDataServer.Close()
+	_, err = os.Stat(socket)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestListenAddress(t *testing.T) {
+	config := extensionConfig{
+		apmServerUrl:               "https://example.com/",
+		dataReceiverServerAddress:  "127.0.0.1",
+		dataReceiverServerPort:     ":1234",
+		dataReceiverTimeoutSeconds: 15,
+	}
+	transport := InitApmServerTransport(&config)
+	agentDataServer, err := StartHttpServer(context.Background(), transport)
+	assert.NilError(t, err)
+	defer agentDataServer.Close()
+	assert.Equal(t, "127.0.0.1:1234", agentDataServer.Addr)
+
+	resp, err := http.Post("http://127.0.0.1:1234/intake/v2/events", "application/x-ndjson", strings.NewReader(`{"metadata":{}}`))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+}
+
+func TestIntakeAgentUserAgent(t *testing.T) {
+	config := extensionConfig{
+		apmServerUrl:               "https://example.com/",
+		dataReceiverServerPort:     ":1234",
+		dataReceiverTimeoutSeconds: 15,
+	}
+	transport := InitApmServerTransport(&config)
+	agentDataServer, err := StartHttpServer(context.Background(), transport)
+	assert.NilError(t, err)
+	defer agentDataServer.Close()
+
+	req, err := http.NewRequest("POST", "http://localhost:1234/intake/v2/events", strings.NewReader(`{"metadata":{}}`))
+	assert.NilError(t, err)
+	req.Header.Set("User-Agent", "apm-agent-nodejs/3.38.0 (my-function 1.0.0)")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	resp.Body.Close()
+
+	agentData := <-transport.dataChannel
+	assert.Equal(t, "apm-agent-nodejs/3.38.0 (my-function 1.0.0)", agentData.agentUserAgent)
+}
+
+func TestIntakeValidation(t *testing.T) {
+	config := extensionConfig{
+		apmServerUrl:   "https://example.com/",
+		validateIntake: true,
+	}
+	transport := InitApmServerTransport(&config)
+	handler := handleIntakeV2Events(context.Background(), transport)
+	transport.StartAgentDoneSignal()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/intake/v2/events?flushed=true", strings.NewReader("{\"transaction\":{}}\n")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, `{"accepted":0,"errors":[{"message":"line 1: the first event must be metadata","document":"{\"transaction\":{}}"}]}`+"\n", w.Body.String())
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	// The flush signal is handled even though the payload is rejected
+	select {
+	case <-transport.AgentDoneSignal:
+	default:
+		t.Fatal("Expected the agent done signal")
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader("{\"metadata\":{}}\n{\"transaction\":{}}\n")))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, 1, transport.BufferedDataCount())
+}
@@ -0,0 +1,151 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// intakeResponse is the response of the APM server intake API, describing the events it accepted and the
+// errors it encountered while processing a payload.
+type intakeResponse struct {
+	Accepted int           `json:"accepted"`
+	Errors   []intakeError `json:"errors"`
+}
+
+// intakeError is an error reported by the APM server intake API. Document is set when the error is
+// specific to an event, e.g. because the event is invalid.
+type intakeError struct {
+	Message  string `json:"message"`
+	Document string `json:"document,omitempty"`
+}
+
+// intakeRejectedError is the response of the APM server rejecting some or all of the events of streamed
+// agent data, relayed to the agent when ELASTIC_APM_LAMBDA_RELAY_INTAKE_ERRORS is set. It wraps the error
+// the response caused, e.g. when the APM server throttles the extension.
+type intakeRejectedError struct {
+	statusCode int
+	body       []byte
+	err        error
+}
+
+func (e *intakeRejectedError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("APM server rejected the agent data with status %d: %s", e.statusCode, truncateForLog(e.body))
+}
+
+func (e *intakeRejectedError) Unwrap() error {
+	return e.err
+}
+
+// wrap returns err wrapped in the rejection, or err if there is no rejection to relay.
+func (e *intakeRejectedError) wrap(err error) error {
+	if e == nil {
+		return err
+	}
+	e.err = err
+	return e
+}
+
+// write relays the response of the APM server to the agent.
+func (e *intakeRejectedError) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.statusCode)
+	if _, err := w.Write(e.body); err != nil {
+		Log.Errorf("Failed to relay the APM server response to the APM agent: %v", err)
+	}
+}
+
+// invalidEvents returns the number of events rejected because they are invalid.
+func (response intakeResponse) invalidEvents() int {
+	var invalid int
+	for _, intakeErr := range response.Errors {
+		if intakeErr.Document != "" {
+			invalid++
+		}
+	}
+	return invalid
+}
+
+// isRetryableIntakeStatus reports whether the events not processed by the APM server because of a
+// response with status code can be sent again, as the APM server was temporarily unable to process them.
+func isRetryableIntakeStatus(statusCode int) bool {
+	return statusCode == http.StatusServiceUnavailable || statusCode == http.StatusTooManyRequests
+}
+
+// recordIntakeResponse accounts for the events of agentData rejected by the APM server, according to the
+// response body, so that only the accepted events are counted as delivered. When some events were not processed for a retryable reason, and
+// ELASTIC_APM_RETRY_REJECTED_EVENTS is set, they are queued again, once, as a smaller payload.
+//
+// The APM server processes the events in order: the events that were not processed are the ones following
+// the accepted and the invalid events.
+func (transport *ApmServerTransport) recordIntakeResponse(statusCode int, respBody []byte, agentData AgentData) {
+	var response intakeResponse
+	if len(bytes.TrimSpace(respBody)) == 0 || json.Unmarshal(respBody, &response) != nil {
+		return
+	}
+	metadata, events, err := splitAgentData(agentData)
+	if err != nil {
+		return
+	}
+	lines := bytes.SplitAfter(events, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	processed := response.Accepted + response.invalidEvents()
+	if processed > len(lines) {
+		processed = len(lines)
+	}
+	rejected := len(lines) - response.Accepted
+	if rejected < 0 {
+		rejected = 0
+	}
+	if rejected == 0 {
+		return
+	}
+	atomic.AddInt64(&transport.rejectedEvents, int64(rejected))
+	for _, intakeErr := range response.Errors {
+		Log.Debugf("APM server rejected agent data: %s %s", intakeErr.Message, intakeErr.Document)
+	}
+
+	unprocessed := lines[processed:]
+	if len(unprocessed) == 0 || !isRetryableIntakeStatus(statusCode) || !transport.config.retryRejectedEvents {
+		Log.Warnf("APM server rejected %d of the %d events of the agent data", rejected, len(lines))
+		return
+	}
+	if agentData.retried {
+		Log.Warnf("APM server rejected %d of the %d events of the agent data again, dropping them", rejected, len(lines))
+		return
+	}
+	Log.Infof("APM server could not process %d of the %d events of the agent data, sending them again", len(unprocessed), len(lines))
+	data := make([]byte, 0, len(metadata)+1+len(events))
+	data = append(data, metadata...)
+	data = append(data, '\n')
+	for _, line := range unprocessed {
+		data = append(data, line...)
+	}
+	atomic.AddInt64(&transport.rejectedEvents, -int64(len(unprocessed)))
+	atomic.AddInt64(&transport.retriedEvents, int64(len(unprocessed)))
+	transport.EnqueueAPMData(AgentData{Data: data, retried: true, agentUserAgent: agentData.agentUserAgent})
+}
@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const partialPayload = `{"metadata":{"service":{"name":"foo"}}}
+{"transaction":{"id":"1"}}
+{"span":{"id":"2"}}
+{"span":{"id":"3"}}
+{"span":{"id":"4"}}
+`
+
+func newPartialAcceptanceServer(t *testing.T, statusCode int, response string, requests chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		data, err := GetUncompressedBytes(body, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		requests <- string(data)
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(response))
+	}))
+}
+
+func TestPartialAcceptanceInvalidEvents(t *testing.T) {
+	requests := make(chan string, 1)
+	apmServer := newPartialAcceptanceServer(t, http.StatusBadRequest,
+		`{"accepted":3,"errors":[{"message":"invalid span","document":"{\"span\":{\"id\":\"3\"}}"}]}`, requests)
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", retryRejectedEvents: true})
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(partialPayload)}))
+	<-requests
+
+	// Invalid events cannot be sent again
+	assert.Equal(t, int64(1), transport.DebugVars().Buffer.RejectedEvents)
+	assert.Equal(t, int64(0), transport.DebugVars().Buffer.RetriedEvents)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestPartialAcceptanceRetry(t *testing.T) {
+	requests := make(chan string, 2)
+	apmServer := newPartialAcceptanceServer(t, http.StatusServiceUnavailable,
+		`{"accepted":1,"errors":[{"message":"queue is full"}]}`, requests)
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", retryRejectedEvents: true})
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(partialPayload)}))
+	<-requests
+
+	// The events following the accepted one are sent again, along with the metadata
+	require.Equal(t, 1, transport.BufferedDataCount())
+	assert.Equal(t, int64(3), transport.DebugVars().Buffer.RetriedEvents)
+	assert.Equal(t, int64(0), transport.DebugVars().Buffer.RejectedEvents)
+	retry := <-transport.dataChannel
+	assert.True(t, retry.retried)
+	assert.Equal(t, `{"metadata":{"service":{"name":"foo"}}}
+{"span":{"id":"2"}}
+{"span":{"id":"3"}}
+{"span":{"id":"4"}}
+`, string(retry.Data))
+
+	// Events rejected again are dropped
+	require.NoError(t, transport.PostToApmServer(context.Background(), retry))
+	assert.Equal(t, string(retry.Data), <-requests)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	assert.Equal(t, int64(2), transport.DebugVars().Buffer.RejectedEvents)
+}
+
+func TestPartialAcceptanceRetryDisabled(t *testing.T) {
+	requests := make(chan string, 1)
+	apmServer := newPartialAcceptanceServer(t, http.StatusServiceUnavailable,
+		`{"accepted":0,"errors":[{"message":"queue is full"}]}`, requests)
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(partialPayload)}))
+	<-requests
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	assert.Equal(t, int64(4), transport.DebugVars().Buffer.RejectedEvents)
+}
+
+func TestRetriedAgentDataNotBatched(t *testing.T) {
+	retried := AgentData{Data: []byte(partialPayload), retried: true}
+	_, ok := newAgentDataBatch(retried, 1024)
+	assert.False(t, ok)
+
+	batch, ok := newAgentDataBatch(AgentData{Data: []byte(partialPayload)}, 1024)
+	require.True(t, ok)
+	assert.False(t, batch.add(retried))
+}
+
+func TestProcessEnvRetryRejectedEvents(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.retryRejectedEvents)
+
+	t.Setenv("ELASTIC_APM_RETRY_REJECTED_EVENTS", "true")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.retryRejectedEvents)
+}
@@ -0,0 +1,394 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// intakeVersionsHeader is set on the responses of the info endpoint to advertise the intake formats the
+// extension accepts, so that agents can send the compact format only to the extensions which support it.
+const intakeVersionsHeader = "X-Elastic-Apm-Intake-Versions"
+
+// intakeVersions are the intake formats accepted by the extension.
+const intakeVersions = "v2, v3"
+
+// compactField describes a field of the compact intake v3 format: its name in the intake v2 format, and
+// either the schema of its fields, or the schema of the values of an object whose keys are free.
+type compactField struct {
+	name   string
+	fields compactSchema
+	values compactSchema
+}
+
+// compactSchema maps the keys of the compact format to the fields of the intake v2 format. Keys which are
+// not in the schema are kept as they are.
+type compactSchema map[string]compactField
+
+var (
+	compactNameVersion = compactSchema{
+		"n":  {name: "name"},
+		"ve": {name: "version"},
+	}
+	compactService = compactSchema{
+		"a":  {name: "agent", fields: compactNameVersion},
+		"en": {name: "environment"},
+		"fw": {name: "framework", fields: compactNameVersion},
+		"la": {name: "language", fields: compactNameVersion},
+		"n":  {name: "name"},
+		"ru": {name: "runtime", fields: compactNameVersion},
+		"ve": {name: "version"},
+	}
+	compactUser = compactSchema{
+		"em": {name: "email"},
+		"id": {name: "id"},
+		"un": {name: "username"},
+	}
+	compactMetadata = compactSchema{
+		"l":  {name: "labels"},
+		"n":  {name: "network", fields: compactSchema{"c": {name: "connection", fields: compactSchema{"t": {name: "type"}}}}},
+		"se": {name: "service", fields: compactService},
+		"u":  {name: "user", fields: compactUser},
+	}
+	compactStacktrace = compactSchema{
+		"ap":  {name: "abs_path"},
+		"cli": {name: "context_line"},
+		"co":  {name: "colno"},
+		"f":   {name: "filename"},
+		"fn":  {name: "function"},
+		"li":  {name: "lineno"},
+		"mo":  {name: "module"},
+		"poc": {name: "post_context"},
+		"prc": {name: "pre_context"},
+	}
+	compactResponse = compactSchema{
+		"dbs": {name: "decoded_body_size"},
+		"ebs": {name: "encoded_body_size"},
+		"he":  {name: "headers"},
+		"sc":  {name: "status_code"},
+		"ts":  {name: "transfer_size"},
+	}
+	compactContext = compactSchema{
+		"cu": {name: "custom"},
+		"g":  {name: "tags"},
+		"p":  {name: "page", fields: compactSchema{"rf": {name: "referer"}}},
+		"q": {name: "request", fields: compactSchema{
+			"en":  {name: "env"},
+			"he":  {name: "headers"},
+			"hve": {name: "http_version"},
+			"mt":  {name: "method"},
+		}},
+		"r":  {name: "response", fields: compactResponse},
+		"se": {name: "service", fields: compactService},
+		"u":  {name: "user", fields: compactUser},
+	}
+	compactSpanContext = compactSchema{
+		"db": {name: "db", fields: compactSchema{
+			"i":  {name: "instance"},
+			"l":  {name: "link"},
+			"rc": {name: "rows_affected"},
+			"st": {name: "statement"},
+			"t":  {name: "type"},
+			"u":  {name: "user"},
+		}},
+		"dt": {name: "destination", fields: compactSchema{
+			"ad": {name: "address"},
+			"po": {name: "port"},
+			"se": {name: "service", fields: compactSchema{
+				"n":  {name: "name"},
+				"rc": {name: "resource"},
+				"t":  {name: "type"},
+			}},
+		}},
+		"g": {name: "tags"},
+		"h": {name: "http", fields: compactSchema{
+			"mt": {name: "method"},
+			"r":  {name: "response", fields: compactResponse},
+			"sc": {name: "status_code"},
+		}},
+		"se": {name: "service", fields: compactService},
+	}
+	compactSpan = compactSchema{
+		"ac":  {name: "action"},
+		"c":   {name: "context", fields: compactSpanContext},
+		"d":   {name: "duration"},
+		"n":   {name: "name"},
+		"o":   {name: "outcome"},
+		"pi":  {name: "parent_idx"},
+		"pid": {name: "parent_id"},
+		"s":   {name: "start"},
+		"sr":  {name: "sample_rate"},
+		"st":  {name: "stacktrace", fields: compactStacktrace},
+		"su":  {name: "subtype"},
+		"sy":  {name: "sync"},
+		"t":   {name: "type"},
+		"tid": {name: "trace_id"},
+		"xid": {name: "transaction_id"},
+	}
+	compactMetricset = compactSchema{
+		"g":  {name: "tags"},
+		"sa": {name: "samples", values: compactSchema{"v": {name: "value"}}},
+		"y":  {name: "span", fields: compactSchema{"su": {name: "subtype"}, "t": {name: "type"}}},
+	}
+	compactTransaction = compactSchema{
+		"c":   {name: "context", fields: compactContext},
+		"d":   {name: "duration"},
+		"exp": {name: "experience"},
+		"k":   {name: "marks"},
+		"me":  {name: "metricsets", fields: compactMetricset},
+		"n":   {name: "name"},
+		"o":   {name: "outcome"},
+		"pid": {name: "parent_id"},
+		"rt":  {name: "result"},
+		"ses": {name: "session", fields: compactSchema{"sq": {name: "sequence"}}},
+		"sm":  {name: "sampled"},
+		"sr":  {name: "sample_rate"},
+		"t":   {name: "type"},
+		"tid": {name: "trace_id"},
+		"y":   {name: "spans", fields: compactSpan},
+		"yc":  {name: "span_count", fields: compactSchema{"sd": {name: "dropped"}, "st": {name: "started"}}},
+	}
+	compactException = compactSchema{
+		"at": {name: "attributes"},
+		"cd": {name: "code"},
+		"hd": {name: "handled"},
+		"mg": {name: "message"},
+		"mo": {name: "module"},
+		"st": {name: "stacktrace", fields: compactStacktrace},
+		"t":  {name: "type"},
+	}
+	compactError = compactSchema{
+		"c":   {name: "context", fields: compactContext},
+		"cl":  {name: "culprit"},
+		"ex":  {name: "exception", fields: compactException},
+		"pid": {name: "parent_id"},
+		"tid": {name: "trace_id"},
+		"x":   {name: "transaction", fields: compactSchema{"n": {name: "name"}, "sm": {name: "sampled"}, "t": {name: "type"}}},
+		"xid": {name: "transaction_id"},
+		"log": {name: "log", fields: compactSchema{
+			"ln":  {name: "logger_name"},
+			"lv":  {name: "level"},
+			"mg":  {name: "message"},
+			"pmg": {name: "param_message"},
+			"st":  {name: "stacktrace", fields: compactStacktrace},
+		}},
+	}
+)
+
+// compactEvents maps the event types of the compact format to those of the intake v2 format.
+var compactEvents = map[string]compactField{
+	"e":  {name: "error", fields: compactError},
+	"m":  {name: "metadata", fields: compactMetadata},
+	"me": {name: "metricset", fields: compactMetricset},
+	"x":  {name: "transaction", fields: compactTransaction},
+	"y":  {name: "span", fields: compactSpan},
+}
+
+// compactSampleNames maps the abbreviated names of the samples of the breakdown metrics to their names.
+var compactSampleNames = map[string]string{
+	"xbc": "transaction.breakdown.count",
+	"xdc": "transaction.duration.count",
+	"xds": "transaction.duration.sum.us",
+	"ysc": "span.self_time.count",
+	"yss": "span.self_time.sum.us",
+}
+
+func init() {
+	// The cause of an exception is a list of exceptions
+	compactException["ca"] = compactField{name: "cause", fields: compactException}
+}
+
+// expand returns value with the keys of schema replaced by the names of the fields of the intake v2 format.
+func (schema compactSchema) expand(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		for i, element := range value {
+			value[i] = schema.expand(element)
+		}
+		return value
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(value))
+		for key, fieldValue := range value {
+			field, ok := schema[key]
+			if !ok {
+				expanded[key] = fieldValue
+				continue
+			}
+			if values, ok := fieldValue.(map[string]interface{}); ok && field.values != nil {
+				for name, v := range values {
+					values[name] = field.values.expand(v)
+				}
+				fieldValue = values
+			} else if field.fields != nil {
+				fieldValue = field.fields.expand(fieldValue)
+			}
+			expanded[field.name] = fieldValue
+		}
+		return expanded
+	}
+	return value
+}
+
+// expandCompactEvents converts uncompressed agent data in the compact intake v3 format, as used by the RUM
+// agents, to the intake v2 format. The spans and metricsets nested in the transactions are sent as events
+// of their own, and events already in the intake v2 format are kept as they are.
+func expandCompactEvents(data []byte) ([]byte, *intakeValidationError) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	var invalid []intakeError
+	lineNumber := 0
+	forEachLine(data, func(line []byte) {
+		lineNumber++
+		if len(invalid) == maxIntakeValidationErrors {
+			return
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			return
+		}
+		for _, event := range expandCompactEvent(line, &invalid, lineNumber) {
+			if err := encoder.Encode(event); err != nil {
+				invalid = append(invalid, intakeError{Message: fmt.Sprintf("line %d: %v", lineNumber, err)})
+				return
+			}
+		}
+	})
+	if len(invalid) > 0 {
+		return nil, &intakeValidationError{errors: invalid}
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// expandCompactEvent converts a line of the compact intake v3 format to intake v2 events, and appends an
+// error to invalid if it cannot be parsed.
+func expandCompactEvent(line []byte, invalid *[]intakeError, lineNumber int) []map[string]interface{} {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var event map[string]interface{}
+	err := decoder.Decode(&event)
+	if err == nil && len(event) != 1 {
+		err = fmt.Errorf("expected a single event type, got %d keys", len(event))
+	}
+	if err != nil {
+		if len(line) > maxIntakeValidationDocument {
+			line = line[:maxIntakeValidationDocument]
+		}
+		*invalid = append(*invalid, intakeError{Message: fmt.Sprintf("line %d: %v", lineNumber, err), Document: string(line)})
+		return nil
+	}
+
+	for key, value := range event {
+		field, ok := compactEvents[key]
+		if !ok {
+			return []map[string]interface{}{event}
+		}
+		expanded := field.fields.expand(value)
+		object, ok := expanded.(map[string]interface{})
+		switch {
+		case !ok:
+			return []map[string]interface{}{{field.name: expanded}}
+		case field.name == "transaction":
+			return liftTransactionEvents(object)
+		case field.name == "metricset":
+			expandSampleNames(object)
+		}
+		return []map[string]interface{}{{field.name: object}}
+	}
+	return nil
+}
+
+// liftTransactionEvents returns the transaction followed by the spans and metricsets nested in it, which
+// refer to it the way intake v2 events do.
+func liftTransactionEvents(transaction map[string]interface{}) []map[string]interface{} {
+	events := []map[string]interface{}{{"transaction": transaction}}
+	spans, _ := transaction["spans"].([]interface{})
+	metricsets, _ := transaction["metricsets"].([]interface{})
+	delete(transaction, "spans")
+	delete(transaction, "metricsets")
+
+	for _, value := range spans {
+		span, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		parentID := transaction["id"]
+		if index, ok := span["parent_idx"].(json.Number); ok {
+			if i, err := index.Int64(); err == nil && i >= 0 && int(i) < len(spans) {
+				if parent, ok := spans[i].(map[string]interface{}); ok {
+					parentID = parent["id"]
+				}
+			}
+		}
+		delete(span, "parent_idx")
+		setMissing(span, "parent_id", parentID)
+		setMissing(span, "trace_id", transaction["trace_id"])
+		setMissing(span, "transaction_id", transaction["id"])
+		events = append(events, map[string]interface{}{"span": span})
+	}
+
+	for _, value := range metricsets {
+		metricset, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		expandSampleNames(metricset)
+		setMissing(metricset, "transaction", map[string]interface{}{"name": transaction["name"], "type": transaction["type"]})
+		events = append(events, map[string]interface{}{"metricset": metricset})
+	}
+	return events
+}
+
+// expandSampleNames replaces the abbreviated names of the samples of metricset.
+func expandSampleNames(metricset map[string]interface{}) {
+	samples, ok := metricset["samples"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for abbreviation, name := range compactSampleNames {
+		if sample, ok := samples[abbreviation]; ok {
+			delete(samples, abbreviation)
+			samples[name] = sample
+		}
+	}
+}
+
+// setMissing sets the field key of object to value, unless it is already set or value is nil.
+func setMissing(object map[string]interface{}, key string, value interface{}) {
+	if _, ok := object[key]; !ok && value != nil {
+		object[key] = value
+	}
+}
+
+// expandCompactAgentData converts agentData in the compact intake v3 format to uncompressed intake v2
+// agent data.
+func expandCompactAgentData(agentData AgentData) (AgentData, *intakeValidationError) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return agentData, &intakeValidationError{errors: []intakeError{{Message: fmt.Sprintf("could not decompress the payload: %v", err)}}}
+	}
+	expanded, validationErr := expandCompactEvents(data)
+	if validationErr != nil {
+		return agentData, validationErr
+	}
+	agentData.Data = expanded
+	agentData.ContentEncoding = ""
+	return agentData, nil
+}
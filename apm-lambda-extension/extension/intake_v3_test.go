@@ -0,0 +1,94 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const compactEventsBody = `{"m":{"se":{"n":"my-function","ve":"1.0.0","a":{"n":"nodejs","ve":"3.38.0"},"la":{"n":"javascript"}},"l":{"team":"apm"}}}
+{"x":{"id":"ec3cd8b5c3f04b1d","tid":"0acd456789abcdef0123456789abcdef","n":"GET /users","t":"request","d":12.5,"sm":true,"yc":{"st":2},"y":[{"id":"aaaaaaaaaaaaaaa1","n":"SELECT users","t":"db","su":"postgresql","s":1.5,"d":3,"c":{"db":{"st":"SELECT * FROM users WHERE id < 10","t":"sql"}}},{"id":"aaaaaaaaaaaaaaa2","pi":0,"n":"connect","t":"db","s":1.6,"d":0.5}],"me":[{"sa":{"xdc":{"v":1},"xds":{"v":12.5}},"y":{"t":"db","su":"postgresql"}}]}}
+{"e":{"id":"bbbbbbbbbbbbbbbb","tid":"0acd456789abcdef0123456789abcdef","pid":"ec3cd8b5c3f04b1d","xid":"ec3cd8b5c3f04b1d","ex":{"mg":"boom","t":"Error","ca":[{"mg":"cause"}],"st":[{"fn":"handler","li":42,"f":"index.js"}]}}}
+{"metricset":{"samples":{"system.cpu.total.norm.pct":{"value":0.5}}}}`
+
+const expandedEventsBody = `{"metadata":{"labels":{"team":"apm"},"service":{"agent":{"name":"nodejs","version":"3.38.0"},"language":{"name":"javascript"},"name":"my-function","version":"1.0.0"}}}
+{"transaction":{"duration":12.5,"id":"ec3cd8b5c3f04b1d","name":"GET /users","sampled":true,"span_count":{"started":2},"trace_id":"0acd456789abcdef0123456789abcdef","type":"request"}}
+{"span":{"context":{"db":{"statement":"SELECT * FROM users WHERE id < 10","type":"sql"}},"duration":3,"id":"aaaaaaaaaaaaaaa1","name":"SELECT users","parent_id":"ec3cd8b5c3f04b1d","start":1.5,"subtype":"postgresql","trace_id":"0acd456789abcdef0123456789abcdef","transaction_id":"ec3cd8b5c3f04b1d","type":"db"}}
+{"span":{"duration":0.5,"id":"aaaaaaaaaaaaaaa2","name":"connect","parent_id":"aaaaaaaaaaaaaaa1","start":1.6,"trace_id":"0acd456789abcdef0123456789abcdef","transaction_id":"ec3cd8b5c3f04b1d","type":"db"}}
+{"metricset":{"samples":{"transaction.duration.count":{"value":1},"transaction.duration.sum.us":{"value":12.5}},"span":{"subtype":"postgresql","type":"db"},"transaction":{"name":"GET /users","type":"request"}}}
+{"error":{"exception":{"cause":[{"message":"cause"}],"message":"boom","stacktrace":[{"filename":"index.js","function":"handler","lineno":42}],"type":"Error"},"id":"bbbbbbbbbbbbbbbb","parent_id":"ec3cd8b5c3f04b1d","trace_id":"0acd456789abcdef0123456789abcdef","transaction_id":"ec3cd8b5c3f04b1d"}}
+{"metricset":{"samples":{"system.cpu.total.norm.pct":{"value":0.5}}}}`
+
+func TestExpandCompactEvents(t *testing.T) {
+	data, err := expandCompactEvents([]byte(compactEventsBody))
+	require.Nil(t, err)
+	assert.Equal(t, expandedEventsBody, string(data))
+}
+
+func TestExpandCompactEventsInvalid(t *testing.T) {
+	_, err := expandCompactEvents([]byte("{\"m\":{}}\nnot json\n{\"x\":{},\"y\":{}}\n"))
+	require.NotNil(t, err)
+	require.Len(t, err.errors, 2)
+	assert.Contains(t, err.errors[0].Message, "line 2:")
+	assert.Equal(t, "not json", err.errors[0].Document)
+	assert.Equal(t, "line 3: expected a single event type, got 2 keys", err.errors[1].Message)
+}
+
+func TestHandleIntakeV3Events(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "https://example.com/"})
+	handler := handleIntakeV3Events(context.Background(), transport)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(compactEventsBody))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	req := httptest.NewRequest(http.MethodPost, "/intake/v3/events", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	agentData := <-transport.dataChannel
+	assert.Equal(t, "", agentData.ContentEncoding)
+	assert.Equal(t, expandedEventsBody, string(agentData.Data))
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/intake/v3/events", strings.NewReader("[]")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestInfoRequestIntakeVersions(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	recorder := httptest.NewRecorder()
+	handleInfoRequest(context.Background(), transport)(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "v2, v3", recorder.Header().Get(intakeVersionsHeader))
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// maxIntakeValidationErrors is the maximum number of invalid lines described in the response to the agent.
+const maxIntakeValidationErrors = 10
+
+// maxIntakeValidationDocument is the maximum size of the invalid lines quoted in the response to the agent.
+const maxIntakeValidationDocument = 256
+
+// intakeValidationError describes why agent data is not a valid intake v2 payload. It is sent to the
+// agent in the format of the errors of the APM server intake API.
+type intakeValidationError struct {
+	errors []intakeError
+}
+
+func (err *intakeValidationError) Error() string {
+	return fmt.Sprintf("invalid intake payload: %s", err.errors[0].Message)
+}
+
+// validateIntakeData checks that uncompressed, newline-delimited, agent data looks like an intake v2
+// payload: each line must be a JSON object with a single key, the event type, and the first event must be
+// the metadata. The events themselves are not checked against the schemas of the APM server.
+func validateIntakeData(data []byte) *intakeValidationError {
+	var invalid []intakeError
+	first := true
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var event map[string]json.RawMessage
+		var err error
+		if line[0] != '{' {
+			err = fmt.Errorf("expected a JSON object")
+		} else {
+			err = json.Unmarshal(line, &event)
+		}
+		if err == nil && len(event) != 1 {
+			err = fmt.Errorf("expected a single event type, got %d keys", len(event))
+		}
+		if err == nil && first {
+			if _, ok := event["metadata"]; !ok {
+				err = fmt.Errorf("the first event must be metadata")
+			}
+		}
+		first = false
+		if err != nil {
+			if len(line) > maxIntakeValidationDocument {
+				line = line[:maxIntakeValidationDocument]
+			}
+			invalid = append(invalid, intakeError{Message: fmt.Sprintf("line %d: %v", i+1, err), Document: string(line)})
+			if len(invalid) == maxIntakeValidationErrors {
+				break
+			}
+		}
+	}
+	if first {
+		invalid = append(invalid, intakeError{Message: "the payload holds no events"})
+	}
+	if len(invalid) > 0 {
+		return &intakeValidationError{errors: invalid}
+	}
+	return nil
+}
+
+// validateAgentData validates agentData when ELASTIC_APM_LAMBDA_VALIDATE_INTAKE is set, and counts the
+// rejected payloads, which are reported as a self-monitoring metric.
+func (transport *ApmServerTransport) validateAgentData(agentData AgentData) *intakeValidationError {
+	if !transport.config.validateIntake {
+		return nil
+	}
+	var validationErr *intakeValidationError
+	if data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding); err != nil {
+		validationErr = &intakeValidationError{errors: []intakeError{{Message: fmt.Sprintf("could not decompress the payload: %v", err)}}}
+	} else {
+		validationErr = validateIntakeData(data)
+	}
+	if validationErr != nil {
+		atomic.AddInt64(&transport.metrics.invalidPayloads, 1)
+	}
+	return validationErr
+}
+
+// writeIntakeValidationError responds to the agent with a 400 status code and a body describing why its
+// payload is invalid, in the format of the responses of the APM server intake API.
+func writeIntakeValidationError(w http.ResponseWriter, err *intakeValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if encodeErr := json.NewEncoder(w).Encode(intakeResponse{Errors: err.errors}); encodeErr != nil {
+		Log.Errorf("Failed to send intake validation error to APM agent: %v", encodeErr)
+	}
+}
@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIntakeData(t *testing.T) {
+	for name, test := range map[string]struct {
+		data     string
+		messages []string
+	}{
+		"valid":               {data: "{\"metadata\":{}}\n{\"transaction\":{}}\n\n{\"span\":{}}\n"},
+		"empty":               {data: "\n", messages: []string{"the payload holds no events"}},
+		"no metadata":         {data: "{\"transaction\":{}}\n", messages: []string{"line 1: the first event must be metadata"}},
+		"invalid json":        {data: "{\"metadata\":{}}\n{\"transaction\":\n", messages: []string{"line 2: unexpected end of JSON input"}},
+		"several event types": {data: "{\"metadata\":{}}\n{\"span\":{},\"error\":{}}\n", messages: []string{"line 2: expected a single event type, got 2 keys"}},
+		"not an object":       {data: "{\"metadata\":{}}\n[]\n", messages: []string{"line 2: expected a JSON object"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := validateIntakeData([]byte(test.data))
+			if test.messages == nil {
+				assert.Nil(t, err)
+				return
+			}
+			require.NotNil(t, err)
+			var messages []string
+			for _, intakeErr := range err.errors {
+				messages = append(messages, intakeErr.Message)
+			}
+			assert.Equal(t, test.messages, messages)
+		})
+	}
+}
+
+func TestValidateIntakeDataLimits(t *testing.T) {
+	data := "{\"metadata\":{}}\n" + strings.Repeat("{\"transaction\":\""+strings.Repeat("a", 500)+"\"\n", 20)
+	err := validateIntakeData([]byte(data))
+	require.NotNil(t, err)
+	assert.Len(t, err.errors, maxIntakeValidationErrors)
+	assert.Len(t, err.errors[0].Document, maxIntakeValidationDocument)
+}
+
+func TestValidateAgentData(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", validateIntake: true, selfMetricsInvocations: 1}
+	transport := InitApmServerTransport(&config)
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write([]byte("{\"metadata\":{}}\n{\"transaction\":{}}\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	assert.Nil(t, transport.validateAgentData(AgentData{Data: buf.Bytes(), ContentEncoding: "gzip"}))
+
+	validationErr := transport.validateAgentData(AgentData{Data: []byte("not gzip"), ContentEncoding: "gzip"})
+	require.NotNil(t, validationErr)
+	assert.Contains(t, validationErr.Error(), "could not decompress the payload")
+
+	transport.ReportSelfMetrics(NewMetadataContainer([]byte(`{"metadata":{}}`)))
+	samples := selfMetricsSamples(t, <-transport.dataChannel)
+	assert.Equal(t, float64(1), samples["aws.lambda.extension.invalid_payloads"])
+
+	config.validateIntake = false
+	assert.Nil(t, transport.validateAgentData(AgentData{Data: []byte("not gzip"), ContentEncoding: "gzip"}))
+}
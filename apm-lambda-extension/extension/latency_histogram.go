@@ -0,0 +1,79 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+)
+
+// latencyBucketsUs are the upper bounds, in microseconds, of the buckets of the latency histograms. The
+// last bucket of a histogram counts the latencies exceeding the last bound.
+var latencyBucketsUs = [...]int64{
+	100, 250, 500,
+	1000, 2500, 5000,
+	10000, 25000, 50000,
+	100000, 250000, 500000,
+	1000000, 2500000, 5000000,
+}
+
+// latencyHistogram counts latencies per bucket. It is updated atomically.
+type latencyHistogram [len(latencyBucketsUs) + 1]int64
+
+// observe counts latency in its bucket.
+func (h *latencyHistogram) observe(latency time.Duration) {
+	us := latency.Microseconds()
+	i := sort.Search(len(latencyBucketsUs), func(i int) bool { return us <= latencyBucketsUs[i] })
+	atomic.AddInt64(&h[i], 1)
+}
+
+// load returns a copy of the counts of the histogram.
+func (h *latencyHistogram) load() latencyHistogram {
+	var counts latencyHistogram
+	for i := range h {
+		counts[i] = atomic.LoadInt64(&h[i])
+	}
+	return counts
+}
+
+// metric returns the latencies counted since reported as a histogram metric, in microseconds, and false if
+// there are none. Each bucket is represented by its midpoint, and the last one by its lower bound.
+func (h latencyHistogram) metric(reported latencyHistogram) (model.Metric, bool) {
+	metric := model.Metric{Type: "histogram"}
+	for i := range h {
+		count := h[i] - reported[i]
+		if count <= 0 {
+			continue
+		}
+		var value float64
+		switch {
+		case i == len(latencyBucketsUs):
+			value = float64(latencyBucketsUs[i-1])
+		case i == 0:
+			value = float64(latencyBucketsUs[0]) / 2
+		default:
+			value = float64(latencyBucketsUs[i-1]+latencyBucketsUs[i]) / 2
+		}
+		metric.Values = append(metric.Values, value)
+		metric.Counts = append(metric.Counts, uint64(count))
+	}
+	return metric, len(metric.Values) > 0
+}
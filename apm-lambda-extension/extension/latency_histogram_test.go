@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/v2/model"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	_, ok := h.metric(latencyHistogram{})
+	assert.False(t, ok)
+
+	h.observe(50 * time.Microsecond)
+	h.observe(100 * time.Microsecond)
+	h.observe(3 * time.Millisecond)
+	h.observe(time.Minute)
+	metric, ok := h.load().metric(latencyHistogram{})
+	require.True(t, ok)
+	assert.Equal(t, "histogram", metric.Type)
+	assert.Equal(t, []float64{50, 3750, 5000000}, metric.Values)
+	assert.Equal(t, []uint64{2, 1, 1}, metric.Counts)
+
+	// Only the latencies observed since the previous report are reported
+	reported := h.load()
+	h.observe(3 * time.Millisecond)
+	metric, ok = h.load().metric(reported)
+	require.True(t, ok)
+	assert.Equal(t, []float64{3750}, metric.Values)
+	assert.Equal(t, []uint64{1}, metric.Counts)
+}
+
+func TestReportIntakeLatency(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", selfMetricsInvocations: 1}
+	transport := InitApmServerTransport(&config)
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+	body := `{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"transaction":{"id":"0102030405060708"}}` + "\n"
+
+	recorder := httptest.NewRecorder()
+	handleIntakeV2Events(context.Background(), transport)(recorder, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(body)))
+	require.Equal(t, http.StatusAccepted, recorder.Code)
+	agentData := <-transport.dataChannel
+	assert.False(t, agentData.receivedAt.IsZero())
+	require.NoError(t, transport.PostToApmServer(context.Background(), agentData))
+
+	transport.ReportSelfMetrics(metadataContainer)
+	require.Equal(t, 1, transport.BufferedDataCount())
+	lines := strings.Split(string((<-transport.dataChannel).Data), "\n")
+	var event struct {
+		Metricset model.Metrics `json:"metricset"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &event))
+	for _, name := range []string{"aws.lambda.extension.intake.enqueue.latency.us", "aws.lambda.extension.intake.delivery.latency.us"} {
+		metric := event.Metricset.Samples[name]
+		assert.Equal(t, "histogram", metric.Type, name)
+		assert.Equal(t, []uint64{1}, metric.Counts, name)
+	}
+}
@@ -0,0 +1,193 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The first version of the APM server accepting the faas fields.
+const (
+	faasServerMajorVersion = 7
+	faasServerMinorVersion = 16
+)
+
+// defaultLegacyStripFields are the fields introduced along with the faas fields, as <event type>.<field path>.
+var defaultLegacyStripFields = []string{
+	"transaction.faas",
+	"transaction.context.cloud.origin",
+	"transaction.context.service.origin",
+	"metricset.faas",
+}
+
+// legacyServerCompat strips the fields listed in ELASTIC_APM_LAMBDA_LEGACY_SERVER_STRIP_FIELDS from the
+// events sent to APM servers older than 7.16, which reject the documents holding them, so that the extension
+// can be rolled out before all the APM servers of an organization are upgraded.
+type legacyServerCompat struct {
+	mode LegacyServerCompat
+	// fields maps the event types to the paths of their fields to strip
+	fields map[string][][]string
+	// legacy is set once the APM server is known to be older than 7.16
+	legacy   int32
+	detected sync.Once
+	warned   sync.Once
+}
+
+// newLegacyServerCompat returns the compatibility shim for the APM servers older than 7.16, or nil if it
+// is disabled.
+func newLegacyServerCompat(config *extensionConfig) *legacyServerCompat {
+	if config.legacyServerCompat == LegacyCompatNever || config.legacyServerCompat == "" {
+		return nil
+	}
+	fields := config.legacyStripFields
+	if len(fields) == 0 {
+		fields = defaultLegacyStripFields
+	}
+	compat := &legacyServerCompat{mode: config.legacyServerCompat, fields: make(map[string][][]string)}
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		if len(path) < 2 {
+			Log.Warnf("The %s field is not of the form <event type>.<field path>, ignoring", field)
+			continue
+		}
+		compat.fields[path[0]] = append(compat.fields[path[0]], path[1:])
+	}
+	if compat.mode == LegacyCompatAlways {
+		compat.legacy = 1
+	}
+	return compat
+}
+
+// active reports whether the fields are stripped from the events. It is false on a nil shim.
+func (compat *legacyServerCompat) active() bool {
+	return compat != nil && atomic.LoadInt32(&compat.legacy) == 1
+}
+
+// eventTypes returns the types of the events holding fields to strip.
+func (compat *legacyServerCompat) eventTypes() []string {
+	eventTypes := make([]string, 0, len(compat.fields))
+	for eventType := range compat.fields {
+		eventTypes = append(eventTypes, eventType)
+	}
+	return eventTypes
+}
+
+// strip deletes the fields to strip from event, of type eventType, and reports whether any was deleted.
+func (compat *legacyServerCompat) strip(eventType string, event map[string]interface{}) bool {
+	stripped := false
+	for _, path := range compat.fields[eventType] {
+		parent := event
+		for _, name := range path[:len(path)-1] {
+			parent, _ = parent[name].(map[string]interface{})
+			if parent == nil {
+				break
+			}
+		}
+		if _, ok := parent[path[len(path)-1]]; ok {
+			delete(parent, path[len(path)-1])
+			stripped = true
+		}
+	}
+	return stripped
+}
+
+// stripLegacyFields returns the uncompressed agent data without the fields unknown to the APM server, and
+// whether any field was stripped. A warning recommending to upgrade the APM server is logged the first time.
+func (transport *ApmServerTransport) stripLegacyFields(agentData AgentData) ([]byte, bool, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, false, err
+	}
+	compat := transport.legacyCompat
+	stripped, changed := rewriteEvents(data, compat.eventTypes(), compat.strip)
+	if changed {
+		compat.warned.Do(func() {
+			Log.Warnf("The APM server does not support the faas fields, stripping them from the events: upgrade the APM server to %d.%d or later to report them",
+				faasServerMajorVersion, faasServerMinorVersion)
+		})
+	}
+	return stripped, changed, nil
+}
+
+// DetectServerVersion queries the version of the APM server in the background, once, so that the fields it
+// does not support are stripped from the events if it is older than 7.16. The events sent before its version
+// is known are left unaltered. It is a no-op unless ELASTIC_APM_LAMBDA_LEGACY_SERVER_COMPAT is set to auto.
+func (transport *ApmServerTransport) DetectServerVersion(ctx context.Context) {
+	compat := transport.legacyCompat
+	if compat == nil || compat.mode != LegacyCompatAuto || transport.recordOutput != nil {
+		return
+	}
+	compat.detected.Do(func() {
+		go transport.detectServerVersion(ctx)
+	})
+}
+
+func (transport *ApmServerTransport) detectServerVersion(ctx context.Context) {
+	endpoint := transport.endpoints.active()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.url, nil)
+	if err != nil {
+		Log.Debugf("Could not create the APM server version request: %v", err)
+		return
+	}
+	req.Header.Set("User-Agent", userAgent)
+	endpoint.credentials.setAuthorization(req)
+	resp, err := transport.client.Do(req)
+	if err != nil {
+		Log.Debugf("Could not query the version of the APM server: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&info); err != nil || info.Version == "" {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		Log.Debugf("Could not read the version of the APM server from its %d response", resp.StatusCode)
+		return
+	}
+	if isLegacyServerVersion(info.Version) {
+		Log.Infof("APM server %s does not support the faas fields, they are stripped from the events", info.Version)
+		atomic.StoreInt32(&transport.legacyCompat.legacy, 1)
+	}
+}
+
+// isLegacyServerVersion reports whether version, e.g. 7.15.2, is older than 7.16. Versions that cannot be
+// parsed are assumed recent.
+func isLegacyServerVersion(version string) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return major < faasServerMajorVersion || (major == faasServerMajorVersion && minor < faasServerMinorVersion)
+}
@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const legacyAgentData = `{"metadata":{"service":{"name":"my-service"}}}
+{"transaction":{"id":"945254c567a5417e","duration":12.5,"faas":{"coldstart":true,"execution":"abc"},"context":{"cloud":{"origin":{"provider":"aws"}},"service":{"origin":{"id":"arn"}},"tags":{"a":"b"}}}}
+{"span":{"id":"0123456789abcdef","faas":{"execution":"abc"}}}
+{"metricset":{"samples":{"aws.lambda.metrics.duration":{"value":182.5}},"faas":{"execution":"abc"}}}
+`
+
+func TestStripLegacyFields(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{legacyServerCompat: LegacyCompatAlways})
+	stripped, changed, err := transport.stripLegacyFields(AgentData{Data: []byte(legacyAgentData)})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	lines := strings.Split(string(stripped), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, `{"metadata":{"service":{"name":"my-service"}}}`, lines[0])
+	assert.JSONEq(t, `{"transaction":{"id":"945254c567a5417e","duration":12.5,"context":{"cloud":{},"service":{},"tags":{"a":"b"}}}}`, lines[1])
+	// The spans are not stripped by default
+	assert.Equal(t, `{"span":{"id":"0123456789abcdef","faas":{"execution":"abc"}}}`, lines[2])
+	assert.JSONEq(t, `{"metricset":{"samples":{"aws.lambda.metrics.duration":{"value":182.5}}}}`, lines[3])
+
+	_, changed, err = transport.stripLegacyFields(AgentData{Data: []byte(`{"metadata":{}}` + "\n" + `{"transaction":{"id":"945254c567a5417e"}}` + "\n")})
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestStripLegacyFieldsConfigured(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{
+		legacyServerCompat: LegacyCompatAlways,
+		legacyStripFields:  []string{"span.faas", "invalid"},
+	})
+	stripped, changed, err := transport.stripLegacyFields(AgentData{Data: []byte(legacyAgentData)})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	lines := strings.Split(string(stripped), "\n")
+	require.Len(t, lines, 5)
+	assert.Contains(t, lines[1], `"faas"`)
+	assert.Equal(t, `{"span":{"id":"0123456789abcdef"}}`, lines[2])
+	assert.Contains(t, lines[3], `"faas"`)
+}
+
+func TestNewLegacyServerCompat(t *testing.T) {
+	assert.Nil(t, newLegacyServerCompat(&extensionConfig{}))
+	assert.Nil(t, newLegacyServerCompat(&extensionConfig{legacyServerCompat: LegacyCompatNever}))
+	assert.True(t, newLegacyServerCompat(&extensionConfig{legacyServerCompat: LegacyCompatAlways}).active())
+	// The fields are only stripped once the APM server is found to be older than 7.16
+	assert.False(t, newLegacyServerCompat(&extensionConfig{legacyServerCompat: LegacyCompatAuto}).active())
+}
+
+func TestIsLegacyServerVersion(t *testing.T) {
+	for version, legacy := range map[string]bool{
+		"6.8.23":          true,
+		"7.15.2":          true,
+		"7.16.0":          false,
+		"7.17.9":          false,
+		"8.5.0":           false,
+		"8.10.0-SNAPSHOT": false,
+		"invalid":         false,
+		"":                false,
+	} {
+		assert.Equal(t, legacy, isLegacyServerVersion(version), version)
+	}
+}
+
+func TestDetectServerVersion(t *testing.T) {
+	for version, legacy := range map[string]bool{"7.15.2": true, "8.5.0": false} {
+		apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/", r.URL.Path)
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			w.Write([]byte(`{"build_date":"2021-11-10T00:00:00Z","build_sha":"abc","version":"` + version + `"}`))
+		}))
+		transport := InitApmServerTransport(&extensionConfig{
+			apmServerUrl:         apmServer.URL + "/",
+			apmServerSecretToken: "token",
+			legacyServerCompat:   LegacyCompatAuto,
+		})
+		transport.detectServerVersion(context.Background())
+		assert.Equal(t, legacy, transport.legacyCompat.active(), version)
+		apmServer.Close()
+	}
+}
+
+func TestDetectServerVersionUnknown(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"unauthorized"}`))
+	}))
+	defer apmServer.Close()
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", legacyServerCompat: LegacyCompatAuto})
+	transport.detectServerVersion(context.Background())
+	assert.False(t, transport.legacyCompat.active())
+}
+
+func TestPostToApmServerStripLegacyFields(t *testing.T) {
+	var received string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		data, err := GetUncompressedBytes(body, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		received = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", legacyServerCompat: LegacyCompatAlways}
+	transport := InitApmServerTransport(&config)
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(legacyAgentData)}))
+	assert.NotContains(t, received, `"coldstart"`)
+	assert.Contains(t, received, `"aws.lambda.metrics.duration"`)
+}
+
+func TestProcessEnvLegacyServerCompat(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, LegacyCompatAuto, config.legacyServerCompat)
+	assert.Empty(t, config.legacyStripFields)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_LEGACY_SERVER_COMPAT", "Always")
+	t.Setenv("ELASTIC_APM_LAMBDA_LEGACY_SERVER_STRIP_FIELDS", "transaction.faas,span.faas")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, LegacyCompatAlways, config.legacyServerCompat)
+	assert.Equal(t, []string{"transaction.faas", "span.faas"}, config.legacyStripFields)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_LEGACY_SERVER_COMPAT", "invalid")
+	assert.Equal(t, LegacyCompatAuto, ProcessEnv(new(mockSecretManager)).legacyServerCompat)
+}
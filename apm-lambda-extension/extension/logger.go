@@ -23,6 +23,7 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"strings"
+	"sync/atomic"
 )
 
 type Level uint32
@@ -34,15 +35,53 @@ type LevelLogger struct {
 
 var Log LevelLogger
 
+// LogFormat represents the format of the extension logs
+type LogFormat string
+
+const (
+	// JSONLogFormat writes the logs as ECS JSON documents, one per line
+	JSONLogFormat LogFormat = "json"
+
+	// TextLogFormat writes the logs as human-readable text, one entry per line
+	TextLogFormat LogFormat = "text"
+)
+
+// Phases of the lifecycle of the execution environment, reported in the logs.
+const (
+	InitPhase     = "init"
+	InvokePhase   = "invoke"
+	FlushPhase    = "flush"
+	ShutdownPhase = "shutdown"
+)
+
+// logFields describes the function and the current invocation. They are added to all log entries.
+type logFields struct {
+	functionName string
+	requestID    string
+	phase        string
+}
+
+// currentLogFields holds the logFields added to the log entries.
+var currentLogFields atomic.Value
+
 func init() {
+	currentLogFields.Store(logFields{})
 	// Set ECS logging config
 	Log.Config = zap.NewProductionConfig()
 	Log.Config.EncoderConfig = ecszap.NewDefaultEncoderConfig().ToZapCoreEncoderConfig()
 	// Create ECS logger
-	logger, _ := Log.Config.Build(ecszap.WrapCoreOption(), zap.AddCaller())
+	logger, _ := buildLogger()
 	Log.SugaredLogger = logger.Sugar()
 }
 
+// buildLogger builds the logger of the extension. The entries it writes are kept for the support bundles.
+func buildLogger() (*zap.Logger, error) {
+	if Log.Config.Encoding == "console" {
+		return Log.Config.Build(zap.WrapCore(newContextCore), zap.AddCaller(), zap.Hooks(recentLogs.record))
+	}
+	return Log.Config.Build(ecszap.WrapCoreOption(), zap.WrapCore(newContextCore), zap.AddCaller(), zap.Hooks(recentLogs.record))
+}
+
 // ParseLogLevel parses s as a logrus log level. If the level is off, the return flag is set to true.
 func ParseLogLevel(s string) (zapcore.Level, error) {
 	switch strings.ToLower(s) {
@@ -68,9 +107,82 @@ func ParseLogLevel(s string) (zapcore.Level, error) {
 
 func SetLogOutputPaths(paths []string) {
 	Log.Config.OutputPaths = paths
-	logger, err := Log.Config.Build(ecszap.WrapCoreOption(), zap.AddCaller())
+	logger, err := buildLogger()
 	if err != nil {
 		Log.Errorf("Could not set log path : %v", err)
 	}
 	Log.SugaredLogger = logger.Sugar()
 }
+
+// SetLogFormat changes the format of the extension logs. It must be called before the logger is used
+// concurrently.
+func SetLogFormat(format LogFormat) {
+	encoding := "json"
+	encoderConfig := ecszap.NewDefaultEncoderConfig().ToZapCoreEncoderConfig()
+	if format == TextLogFormat {
+		encoding = "console"
+		encoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	if encoding == Log.Config.Encoding {
+		return
+	}
+	Log.Config.Encoding = encoding
+	Log.Config.EncoderConfig = encoderConfig
+	logger, err := buildLogger()
+	if err != nil {
+		Log.Errorf("Could not set log format : %v", err)
+		return
+	}
+	Log.SugaredLogger = logger.Sugar()
+}
+
+// SetLogFunctionName sets the name of the function added to the log entries.
+func SetLogFunctionName(functionName string) {
+	fields := currentLogFields.Load().(logFields)
+	fields.functionName = functionName
+	currentLogFields.Store(fields)
+}
+
+// SetLogInvocation sets the request ID of the current invocation, if any, and the lifecycle phase of the
+// execution environment added to the log entries.
+func SetLogInvocation(requestID string, phase string) {
+	fields := currentLogFields.Load().(logFields)
+	fields.requestID = requestID
+	fields.phase = phase
+	currentLogFields.Store(fields)
+}
+
+// contextCore adds the current logFields to the log entries written by the wrapped core.
+type contextCore struct {
+	zapcore.Core
+}
+
+func newContextCore(core zapcore.Core) zapcore.Core {
+	return contextCore{core}
+}
+
+func (c contextCore) With(fields []zapcore.Field) zapcore.Core {
+	return contextCore{c.Core.With(fields)}
+}
+
+func (c contextCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c contextCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	current := currentLogFields.Load().(logFields)
+	contextFields := make([]zapcore.Field, 0, len(fields)+3)
+	if current.functionName != "" {
+		contextFields = append(contextFields, zap.String("faas.name", current.functionName))
+	}
+	if current.requestID != "" {
+		contextFields = append(contextFields, zap.String("faas.execution", current.requestID))
+	}
+	if current.phase != "" {
+		contextFields = append(contextFields, zap.String("faas.phase", current.phase))
+	}
+	return c.Core.Write(entry, append(contextFields, fields...))
+}
@@ -106,3 +106,38 @@ func TestLoggerSetOffLevel(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "", string(tempFileContents))
 }
+
+func TestLoggerContextFields(t *testing.T) {
+	tempFile, err := ioutil.TempFile(t.TempDir(), "tempFileLoggerTest-")
+	require.NoError(t, err)
+	defer tempFile.Close()
+
+	SetLogOutputPaths([]string{tempFile.Name()})
+	defer SetLogOutputPaths([]string{"stderr"})
+	SetLogFunctionName("my-function")
+	SetLogInvocation("8476a536-e9f4-11e8-9739-2dfe598c3fcd", InvokePhase)
+	defer currentLogFields.Store(logFields{})
+
+	Log.Infow("logger-test-context", "key", "value")
+	tempFileContents, err := ioutil.ReadFile(tempFile.Name())
+	require.NoError(t, err)
+	assert.Regexp(t, `{"log.level":"info","@timestamp":".*","log.origin":{"file.name":"extension/logger_test.go","file.line":.*},"message":"logger-test-context","faas.name":"my-function","faas.execution":"8476a536-e9f4-11e8-9739-2dfe598c3fcd","faas.phase":"invoke","key":"value","ecs.version":"1.6.0"}`, string(tempFileContents))
+}
+
+func TestLoggerTextFormat(t *testing.T) {
+	tempFile, err := ioutil.TempFile(t.TempDir(), "tempFileLoggerTest-")
+	require.NoError(t, err)
+	defer tempFile.Close()
+
+	SetLogFormat(TextLogFormat)
+	defer SetLogFormat(JSONLogFormat)
+	SetLogOutputPaths([]string{tempFile.Name()})
+	defer SetLogOutputPaths([]string{"stderr"})
+	SetLogInvocation("", FlushPhase)
+	defer currentLogFields.Store(logFields{})
+
+	Log.Infof("%s", "logger-test-text")
+	tempFileContents, err := ioutil.ReadFile(tempFile.Name())
+	require.NoError(t, err)
+	assert.Regexp(t, `^\S+\tINFO\textension/logger_test.go:\d+\tlogger-test-text\t{"faas.phase": "flush"}\n$`, string(tempFileContents))
+}
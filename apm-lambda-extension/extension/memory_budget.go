@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// MemoryBudget enforces an upper bound on the memory used by the extension process, computed as a
+// fraction of the memory allocated to the Lambda function. It gives users a guarantee that the
+// extension footprint stays predictable, at the expense of buffered agent data when the budget is exceeded.
+type MemoryBudget struct {
+	limitBytes uint64
+	violations int
+}
+
+// readMemoryUsage returns the heap memory in use by the Go runtime.
+// It is a variable so that it can be replaced in tests.
+var readMemoryUsage = func() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// NewMemoryBudget returns the memory budget derived from the configuration, or nil if the budget is
+// disabled or if the memory allocated to the function is unknown.
+func NewMemoryBudget(config *extensionConfig) *MemoryBudget {
+	if config.memoryBudgetPercent <= 0 || config.functionMemorySizeMB <= 0 {
+		return nil
+	}
+	limitBytes := uint64(config.functionMemorySizeMB) * 1024 * 1024 * uint64(config.memoryBudgetPercent) / 100
+	Log.Debugf("Extension memory budget set to %d bytes", limitBytes)
+	return &MemoryBudget{limitBytes: limitBytes}
+}
+
+// Enforce checks the memory currently used by the extension against the budget. When the budget is
+// exceeded, the buffered agent data is shed and a metricset reporting the violation is queued.
+// Enforce is a no-op on a nil budget.
+func (budget *MemoryBudget) Enforce(transport *ApmServerTransport, metadataContainer *MetadataContainer) {
+	if budget == nil {
+		return
+	}
+	used := readMemoryUsage()
+	if used <= budget.limitBytes {
+		return
+	}
+	budget.violations++
+	Log.Warnf("Extension memory usage (%d bytes) exceeds its budget (%d bytes), shedding buffered agent data", used, budget.limitBytes)
+	dropped := transport.ShedBuffers()
+	debug.FreeOSMemory()
+
+	transport.EnqueueAPMData(buildMetricset(metadataContainer, time.Now(), map[string]float64{
+		"aws.lambda.extension.memory.used":              float64(used),
+		"aws.lambda.extension.memory.budget":            float64(budget.limitBytes),
+		"aws.lambda.extension.memory.budget_violations": float64(budget.violations),
+		"aws.lambda.extension.memory.dropped_payloads":  float64(dropped),
+	}, nil))
+}
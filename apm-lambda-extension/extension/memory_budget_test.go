@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(&extensionConfig{functionMemorySizeMB: 128, memoryBudgetPercent: 10})
+	require.NotNil(t, budget)
+	assert.Equal(t, uint64(128*1024*1024/10), budget.limitBytes)
+
+	assert.Nil(t, NewMemoryBudget(&extensionConfig{functionMemorySizeMB: 128, memoryBudgetPercent: 0}))
+	assert.Nil(t, NewMemoryBudget(&extensionConfig{functionMemorySizeMB: 0, memoryBudgetPercent: 10}))
+}
+
+func TestMemoryBudgetWithinLimit(t *testing.T) {
+	mockMemoryUsage(t, 1024)
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+
+	budget := &MemoryBudget{limitBytes: 2048}
+	budget.Enforce(transport, &MetadataContainer{})
+	assert.Equal(t, 0, budget.violations)
+	assert.Equal(t, "foo", string((<-transport.dataChannel).Data))
+}
+
+func TestMemoryBudgetExceeded(t *testing.T) {
+	mockMemoryUsage(t, 4096)
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	transport.EnqueueAPMData(AgentData{Data: []byte("bar")})
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	budget := &MemoryBudget{limitBytes: 2048}
+	budget.Enforce(transport, metadataContainer)
+	assert.Equal(t, 1, budget.violations)
+
+	// The buffered agent data is replaced by the self-metric reporting the violation
+	require.Len(t, transport.dataChannel, 1)
+	lines := bytes.Split((<-transport.dataChannel).Data, []byte("\n"))
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"metadata":{}}`, string(lines[0]))
+	assert.Contains(t, string(lines[1]), `"aws.lambda.extension.memory.used":{"value":4096}`)
+	assert.Contains(t, string(lines[1]), `"aws.lambda.extension.memory.budget":{"value":2048}`)
+	assert.Contains(t, string(lines[1]), `"aws.lambda.extension.memory.budget_violations":{"value":1}`)
+	assert.Contains(t, string(lines[1]), `"aws.lambda.extension.memory.dropped_payloads":{"value":2}`)
+}
+
+func TestMemoryBudgetDisabled(t *testing.T) {
+	mockMemoryUsage(t, 4096)
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+
+	var budget *MemoryBudget
+	budget.Enforce(transport, &MetadataContainer{})
+	assert.Len(t, transport.dataChannel, 1)
+}
+
+func mockMemoryUsage(t *testing.T, usage uint64) {
+	original := readMemoryUsage
+	readMemoryUsage = func() uint64 { return usage }
+	t.Cleanup(func() { readMemoryUsage = original })
+}
@@ -0,0 +1,203 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// functionMetadata describes the function in the metadata of the agent data, when the agent omits it.
+type functionMetadata struct {
+	serviceName    string
+	serviceVersion string
+	region         string
+	accountID      string
+	// nodeName identifies the execution environment of the function, so that the concurrent environments
+	// of a function can be told apart. The log stream of the function is unique to its execution environment.
+	nodeName string
+}
+
+// metadataEnrichment holds what the extension adds to the metadata of the agent data it sends.
+type metadataEnrichment struct {
+	mu           sync.RWMutex
+	enabled      bool
+	globalLabels map[string]string
+	// labels holds the global labels and the labels set with SetMetadataLabels.
+	labels   map[string]string
+	function functionMetadata
+}
+
+func newMetadataEnrichment(config *extensionConfig) *metadataEnrichment {
+	return &metadataEnrichment{
+		enabled:      config.metadataEnrichment,
+		globalLabels: config.globalLabels,
+		labels:       config.globalLabels,
+		function: functionMetadata{
+			serviceName:    config.functionName,
+			serviceVersion: config.functionVersion,
+			region:         config.region,
+			nodeName:       config.logStreamName,
+		},
+	}
+}
+
+// active reports whether the metadata of the agent data needs to be inspected before being sent.
+func (e *metadataEnrichment) active() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.enabled || len(e.labels) > 0
+}
+
+// hasLabels reports whether labels are added to the metadata.
+func (e *metadataEnrichment) hasLabels() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.labels) > 0
+}
+
+// SetMetadataLabels sets the labels added to the metadata of all the agent data sent to the APM server,
+// in addition to the global labels. Labels already set by the agent, then the global labels, take
+// precedence.
+func (transport *ApmServerTransport) SetMetadataLabels(labels map[string]string) {
+	e := transport.enrichment
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	merged := make(map[string]string, len(labels)+len(e.globalLabels))
+	for key, value := range labels {
+		merged[key] = value
+	}
+	for key, value := range e.globalLabels {
+		merged[key] = value
+	}
+	e.labels = merged
+}
+
+// SetInvokedFunctionArn records the account ID found in the ARN of the invoked function, as it is not
+// available in the environment variables of the function.
+func (transport *ApmServerTransport) SetInvokedFunctionArn(arn string) {
+	// arn:aws:lambda:us-east-1:123456789012:function:my-function[:alias]
+	parts := strings.Split(arn, ":")
+	if len(parts) < 7 || parts[0] != "arn" || parts[4] == "" {
+		return
+	}
+	transport.enrichment.mu.Lock()
+	defer transport.enrichment.mu.Unlock()
+	transport.enrichment.function.accountID = parts[4]
+}
+
+// enrichAgentData returns the uncompressed agent data with the metadata labels and the missing function
+// metadata added, or false if the metadata was left unchanged.
+func (transport *ApmServerTransport) enrichAgentData(agentData AgentData) ([]byte, bool, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, false, err
+	}
+	e := transport.enrichment
+	e.mu.RLock()
+	labels, function := e.labels, e.function
+	if !e.enabled {
+		function = functionMetadata{}
+	}
+	e.mu.RUnlock()
+	return enrichMetadata(data, labels, function)
+}
+
+// enrichMetadata returns the uncompressed agent data with labels and the missing function metadata added
+// to its metadata, or false if the metadata was left unchanged.
+func enrichMetadata(data []byte, labels map[string]string, function functionMetadata) ([]byte, bool, error) {
+	metadataLine, events := data, []byte(nil)
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		metadataLine, events = data[:i], data[i:]
+	}
+	// Numbers are kept as is, so that the fields the extension does not change are sent unaltered
+	decoder := json.NewDecoder(bytes.NewReader(metadataLine))
+	decoder.UseNumber()
+	var line map[string]interface{}
+	if err := decoder.Decode(&line); err != nil {
+		return nil, false, err
+	}
+	metadata, ok := line["metadata"].(map[string]interface{})
+	if !ok {
+		return nil, false, errors.New("agent data does not start with metadata")
+	}
+
+	changed := false
+	for key, value := range labels {
+		if setDefault(metadata, value, "labels", key) {
+			changed = true
+		}
+	}
+	defaults := []struct {
+		value string
+		path  []string
+	}{
+		{function.serviceName, []string{"service", "name"}},
+		{function.serviceVersion, []string{"service", "version"}},
+		{function.nodeName, []string{"service", "node", "configured_name"}},
+		{"aws", []string{"cloud", "provider"}},
+		{function.region, []string{"cloud", "region"}},
+		{"lambda", []string{"cloud", "service", "name"}},
+		{function.accountID, []string{"cloud", "account", "id"}},
+	}
+	if function.serviceName != "" {
+		for _, d := range defaults {
+			if setDefault(metadata, d.value, d.path...) {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return data, false, nil
+	}
+
+	encodedLine, err := json.Marshal(line)
+	if err != nil {
+		return nil, false, err
+	}
+	return append(encodedLine, events...), true, nil
+}
+
+// setDefault sets the field of object at path to value, unless it is already set, creating the missing
+// intermediate objects. It reports whether the field was set.
+func setDefault(object map[string]interface{}, value string, path ...string) bool {
+	if value == "" {
+		return false
+	}
+	for _, key := range path[:len(path)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			if object[key] != nil {
+				// Not an object, which the APM server will reject anyway
+				return false
+			}
+			child = make(map[string]interface{})
+			object[key] = child
+		}
+		object = child
+	}
+	last := path[len(path)-1]
+	if existing, ok := object[last]; ok && existing != nil && existing != "" {
+		return false
+	}
+	object[last] = value
+	return true
+}
@@ -0,0 +1,172 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrichMetadataLabels(t *testing.T) {
+	labels := map[string]string{"team": "payments", "env": "extension"}
+
+	data, changed, err := enrichMetadata([]byte(`{"metadata":{"service":{"name":"foo"}}}`+"\n"+`{"transaction":{"id":"1"}}`+"\n"), labels, functionMetadata{})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"metadata":{"labels":{"env":"extension","team":"payments"},"service":{"name":"foo"}}}`+"\n"+`{"transaction":{"id":"1"}}`+"\n", string(data))
+
+	// Labels set by the agent take precedence
+	data, _, err = enrichMetadata([]byte(`{"metadata":{"labels":{"env":"agent","count":1}}}`), labels, functionMetadata{})
+	require.NoError(t, err)
+	assert.Equal(t, `{"metadata":{"labels":{"count":1,"env":"agent","team":"payments"}}}`, string(data))
+
+	data, _, err = enrichMetadata([]byte(`{"metadata":{"labels":null}}`), labels, functionMetadata{})
+	require.NoError(t, err)
+	assert.Equal(t, `{"metadata":{"labels":{"env":"extension","team":"payments"}}}`, string(data))
+
+	_, _, err = enrichMetadata([]byte(`{"transaction":{"id":"1"}}`), labels, functionMetadata{})
+	assert.Error(t, err)
+	_, _, err = enrichMetadata([]byte(`not json`), labels, functionMetadata{})
+	assert.Error(t, err)
+}
+
+func TestEnrichMetadataFunction(t *testing.T) {
+	function := functionMetadata{
+		serviceName:    "my-function",
+		serviceVersion: "$LATEST",
+		region:         "us-east-1",
+		accountID:      "123456789012",
+		nodeName:       "2022/10/12/[$LATEST]8d1f5f0e3a7c4b2e9f6d1c0b3a2e4f5d",
+	}
+
+	data, changed, err := enrichMetadata([]byte(`{"metadata":{"service":{"name":"checkout","agent":{"name":"nodejs"}},"process":{"pid":12345678901234567}}}`), nil, function)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.JSONEq(t, `{"metadata":{
+		"service":{"name":"checkout","version":"$LATEST","node":{"configured_name":"2022/10/12/[$LATEST]8d1f5f0e3a7c4b2e9f6d1c0b3a2e4f5d"},"agent":{"name":"nodejs"}},
+		"process":{"pid":12345678901234567},
+		"cloud":{"provider":"aws","region":"us-east-1","service":{"name":"lambda"},"account":{"id":"123456789012"}}
+	}}`, string(data))
+	assert.Contains(t, string(data), "12345678901234567")
+
+	// Complete metadata is sent unchanged
+	complete := []byte(`{"metadata":{"service":{"name":"checkout","version":"1","node":{"configured_name":"instance-1"}},"cloud":{"provider":"aws","region":"eu-west-1","service":{"name":"lambda"},"account":{"id":"1"}}}}` + "\n{}")
+	data, changed, err = enrichMetadata(complete, nil, function)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, complete, data)
+
+	// Outside of Lambda, nothing is added
+	_, changed, err = enrichMetadata([]byte(`{"metadata":{}}`), nil, functionMetadata{})
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestSetInvokedFunctionArn(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "http://localhost:8200/"})
+
+	transport.SetInvokedFunctionArn("not an arn")
+	assert.Empty(t, transport.enrichment.function.accountID)
+
+	transport.SetInvokedFunctionArn("arn:aws:lambda:us-east-1:123456789012:function:my-function:prod")
+	assert.Equal(t, "123456789012", transport.enrichment.function.accountID)
+}
+
+func TestPostToApmServerEnrichesMetadata(t *testing.T) {
+	var received []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := GetUncompressedBytes(mustReadAll(t, r), r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		received = append(received, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:       apmServer.URL + "/",
+		metadataEnrichment: true,
+		functionName:       "my-function",
+		region:             "us-east-1",
+	}
+	transport := InitApmServerTransport(&config)
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{"service":{"name":"foo"}}}` + "\n" + `{"span":{}}`)}))
+	require.Len(t, received, 1)
+	assert.Equal(t, `{"metadata":{"cloud":{"provider":"aws","region":"us-east-1","service":{"name":"lambda"}},"service":{"name":"foo"}}}`+"\n"+`{"span":{}}`, received[0])
+}
+
+func TestProcessEnvMetadataEnrichment(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("AWS_REGION", "eu-west-3")
+
+	config := ProcessEnv(nil)
+	assert.True(t, config.metadataEnrichment)
+	assert.Equal(t, "eu-west-3", config.region)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_METADATA_ENRICHMENT", "false")
+	config = ProcessEnv(nil)
+	assert.False(t, config.metadataEnrichment)
+}
+
+func TestGlobalLabels(t *testing.T) {
+	config := extensionConfig{
+		apmServerUrl: "http://localhost:8200/",
+		globalLabels: map[string]string{"team": "platform", "env": "prod"},
+	}
+	transport := InitApmServerTransport(&config)
+	assert.True(t, transport.enrichment.active())
+	assert.Equal(t, config.globalLabels, transport.enrichment.labels)
+
+	// Global labels take precedence over the labels from the function tags
+	transport.SetMetadataLabels(map[string]string{"team": "payments", "cost_center": "cc-42"})
+	assert.Equal(t, map[string]string{"team": "platform", "env": "prod", "cost_center": "cc-42"}, transport.enrichment.labels)
+}
+
+func TestProcessEnvGlobalLabels(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(nil)
+	assert.Nil(t, config.globalLabels)
+
+	t.Setenv("ELASTIC_APM_GLOBAL_LABELS", "team=platform, env = prod,invalid,=empty,team.name=a=b")
+	config = ProcessEnv(nil)
+	assert.Equal(t, map[string]string{"team": "platform", "env": "prod", "team_name": "a=b"}, config.globalLabels)
+}
+
+func TestEnrichMetadataNodeName(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	t.Setenv("AWS_LAMBDA_LOG_STREAM_NAME", "2022/10/12/[$LATEST]8d1f5f0e3a7c4b2e9f6d1c0b3a2e4f5d")
+	transport := InitApmServerTransport(ProcessEnv(new(mockSecretManager)))
+
+	// The concurrent execution environments of the function are distinguished by their log stream
+	data, changed, err := transport.enrichAgentData(AgentData{Data: []byte(`{"metadata":{"service":{"name":"my-function"}}}`)})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, string(data), `"node":{"configured_name":"2022/10/12/[$LATEST]8d1f5f0e3a7c4b2e9f6d1c0b3a2e4f5d"}`)
+
+	// The node name set by the agent, e.g. from ELASTIC_APM_SERVICE_NODE_NAME, takes precedence
+	data, _, err = transport.enrichAgentData(AgentData{Data: []byte(`{"metadata":{"service":{"name":"my-function","node":{"configured_name":"blue"}}}}`)})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"node":{"configured_name":"blue"}`)
+}
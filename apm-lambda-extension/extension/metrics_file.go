@@ -0,0 +1,104 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultMetricsFileMaxBytes is the default size from which the platform metrics file is rotated.
+const defaultMetricsFileMaxBytes = 10 * 1024 * 1024
+
+// metricsFile appends the platform metricsets to a local file, one JSON document per line, for the users
+// collecting the files of the execution environment with their own tooling, e.g. from /tmp or an EFS mount.
+// The metricsets are written as they are produced, whether the APM server is reachable or not. Once the
+// file reaches maxBytes, it is renamed with a .1 suffix, replacing the previous one, and a new file is
+// started.
+type metricsFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+}
+
+// newMetricsFile returns the platform metrics file, or nil if the export of the platform metrics to a
+// file is disabled.
+func newMetricsFile(config *extensionConfig) *metricsFile {
+	if config.metricsFilePath == "" {
+		return nil
+	}
+	maxBytes := config.metricsFileMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMetricsFileMaxBytes
+	}
+	return &metricsFile{path: config.metricsFilePath, maxBytes: maxBytes}
+}
+
+// write appends the metricsets of the agent data to the file, without the metadata.
+func (file *metricsFile) write(agentData AgentData) error {
+	var lines bytes.Buffer
+	var err error
+	forEachLine(agentData.Data, func(line []byte) {
+		if eventType(line) != "metricset" || err != nil {
+			return
+		}
+		var event map[string]json.RawMessage
+		if err = json.Unmarshal(line, &event); err != nil {
+			return
+		}
+		err = json.Compact(&lines, event["metricset"])
+		lines.WriteByte('\n')
+	})
+	if err != nil || lines.Len() == 0 {
+		return err
+	}
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if info, err := os.Stat(file.path); err == nil && info.Size() > 0 && info.Size()+int64(lines.Len()) > file.maxBytes {
+		if err := os.Rename(file.path, file.path+".1"); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(file.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// EnqueuePlatformMetrics queues the platform metrics of an invocation to be sent to the APM server, and
+// appends them to the platform metrics file, if enabled.
+func (transport *ApmServerTransport) EnqueuePlatformMetrics(agentData AgentData) {
+	if transport.metricsFile != nil {
+		if err := transport.metricsFile.write(agentData); err != nil {
+			Log.Warnf("Could not write the platform metrics to %s: %v", transport.metricsFile.path, err)
+		}
+	}
+	transport.EnqueueAPMData(agentData)
+}
@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const platformMetrics = `{"metadata":{"service":{"name":"my-function"}}}
+{"metricset":{"timestamp":1,"samples":{"faas.duration":{"value":182.43}}}}
+`
+
+func TestMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics", "platform.jsonl")
+	config := extensionConfig{apmServerUrl: "https://example.com/", metricsFilePath: path}
+	transport := InitApmServerTransport(&config)
+	require.NotNil(t, transport.metricsFile)
+
+	transport.EnqueuePlatformMetrics(AgentData{Data: []byte(platformMetrics)})
+	transport.EnqueuePlatformMetrics(AgentData{Data: []byte(`{"metadata":{}}
+{"metricset":{"timestamp":2,"samples":{"faas.billed_duration":{"value":183}}}}
+{"metricset":{"timestamp":2,"samples":{"faas.coldstart_duration":{"value":422.9}}}}
+`)})
+
+	// The metrics are still sent to the APM server
+	assert.Equal(t, 2, transport.BufferedDataCount())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"timestamp":1,"samples":{"faas.duration":{"value":182.43}}}
+{"timestamp":2,"samples":{"faas.billed_duration":{"value":183}}}
+{"timestamp":2,"samples":{"faas.coldstart_duration":{"value":422.9}}}
+`, string(data))
+}
+
+func TestMetricsFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "platform.jsonl")
+	file := newMetricsFile(&extensionConfig{metricsFilePath: path, metricsFileMaxBytes: 100})
+	line := `{"timestamp":1,"samples":{"faas.duration":{"value":182.43}}}` + "\n"
+
+	require.NoError(t, file.write(AgentData{Data: []byte(platformMetrics)}))
+	require.NoError(t, file.write(AgentData{Data: []byte(platformMetrics)}))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, line, string(data))
+	data, err = os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	assert.Equal(t, line, string(data))
+
+	// Payloads without metricsets leave the file untouched
+	require.NoError(t, file.write(AgentData{Data: []byte(`{"metadata":{}}` + "\n")}))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, line, string(data))
+}
+
+func TestMetricsFileDisabled(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/"}
+	transport := InitApmServerTransport(&config)
+	assert.Nil(t, transport.metricsFile)
+
+	transport.EnqueuePlatformMetrics(AgentData{Data: []byte(platformMetrics)})
+	assert.Equal(t, 1, transport.BufferedDataCount())
+}
+
+func TestMetricsFileWriteError(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+	config := extensionConfig{apmServerUrl: "https://example.com/", metricsFilePath: filepath.Join(dir, "file", "platform.jsonl")}
+	transport := InitApmServerTransport(&config)
+
+	// The metrics are sent to the APM server even if the file cannot be written
+	transport.EnqueuePlatformMetrics(AgentData{Data: []byte(platformMetrics)})
+	assert.Equal(t, 1, transport.BufferedDataCount())
+}
+
+func TestProcessEnvMetricsFile(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, "", config.metricsFilePath)
+	assert.Equal(t, int64(defaultMetricsFileMaxBytes), config.metricsFileMaxBytes)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_METRICS_FILE", "/tmp/metrics/platform.jsonl")
+	t.Setenv("ELASTIC_APM_LAMBDA_METRICS_FILE_MAX_BYTES", "1048576")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, "/tmp/metrics/platform.jsonl", config.metricsFilePath)
+	assert.Equal(t, int64(1048576), config.metricsFileMaxBytes)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_METRICS_FILE_MAX_BYTES", "-1")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, int64(defaultMetricsFileMaxBytes), config.metricsFileMaxBytes)
+}
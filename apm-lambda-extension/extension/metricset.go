@@ -0,0 +1,54 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// buildMetricset serializes a metricset holding the given samples and labels into agent data, prefixed by
+// the metadata of the current Lambda instance when it is known.
+func buildMetricset(metadataContainer *MetadataContainer, timestamp time.Time, samples map[string]float64, labels model.StringMap) AgentData {
+	metrics := make(map[string]model.Metric, len(samples))
+	for name, value := range samples {
+		metrics[name] = model.Metric{Value: value}
+	}
+	return buildMetricsetMetrics(metadataContainer, timestamp, metrics, labels)
+}
+
+// buildMetricsetMetrics is like buildMetricset, for metrics other than gauges and counters, e.g. histograms.
+func buildMetricsetMetrics(metadataContainer *MetadataContainer, timestamp time.Time, samples map[string]model.Metric, labels model.StringMap) AgentData {
+	metrics := model.Metrics{
+		Timestamp: model.Time(timestamp),
+		Labels:    labels,
+		Samples:   samples,
+	}
+
+	var jsonWriter fastjson.Writer
+	jsonWriter.RawString(`{"metricset":`)
+	// Marshalling model.Metrics into a fastjson.Writer never fails.
+	_ = metrics.MarshalFastJSON(&jsonWriter)
+	jsonWriter.RawString(`}`)
+
+	data := metadataContainer.AppendTo(nil)
+	data = append(data, jsonWriter.Bytes()...)
+	return AgentData{Data: data}
+}
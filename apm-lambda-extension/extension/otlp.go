@@ -0,0 +1,396 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// OTLP span kinds, as defined by the OpenTelemetry protocol.
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+	otlpSpanKindProducer = 4
+	otlpSpanKindConsumer = 5
+)
+
+// OTLP status codes, as defined by the OpenTelemetry protocol.
+const (
+	otlpStatusCodeOk    = 1
+	otlpStatusCodeError = 2
+)
+
+var otlpSpanKindNames = map[int]string{
+	otlpSpanKindInternal: "INTERNAL",
+	otlpSpanKindServer:   "SERVER",
+	otlpSpanKindClient:   "CLIENT",
+	otlpSpanKindProducer: "PRODUCER",
+	otlpSpanKindConsumer: "CONSUMER",
+}
+
+// otlpTracesRequest is the JSON encoding of an OTLP ExportTraceServiceRequest.
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	// InstrumentationLibrarySpans is the name of ScopeSpans in versions of the protocol older than 0.15.
+	InstrumentationLibrarySpans []otlpScopeSpans `json:"instrumentationLibrarySpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpUint64     `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string     `json:"stringValue"`
+	BoolValue   *bool       `json:"boolValue"`
+	IntValue    *otlpUint64 `json:"intValue"`
+	DoubleValue *float64    `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpAnyValue `json:"values"`
+	} `json:"arrayValue"`
+}
+
+// otlpUint64 decodes the 64 bits integers of the OTLP JSON encoding, which are usually sent as strings.
+type otlpUint64 uint64
+
+func (v *otlpUint64) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		// Negative integers can only be attribute values
+		signed, signedErr := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+		if signedErr != nil {
+			return err
+		}
+		value = uint64(signed)
+	}
+	*v = otlpUint64(value)
+	return nil
+}
+
+func (v otlpAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, value := range v.ArrayValue.Values {
+			values = append(values, value.value())
+		}
+		return values
+	}
+	return nil
+}
+
+func otlpAttributes(keyValues []otlpKeyValue) map[string]interface{} {
+	if len(keyValues) == 0 {
+		return nil
+	}
+	attributes := make(map[string]interface{}, len(keyValues))
+	for _, kv := range keyValues {
+		attributes[kv.Key] = kv.Value.value()
+	}
+	return attributes
+}
+
+// URL: http://server/v1/traces
+//
+// handleOTLPTraces receives spans sent by OpenTelemetry SDKs with the OTLP/HTTP protocol, using the JSON
+// encoding, and converts them to intake v2 events forwarded to the APM server.
+func handleOTLPTraces(transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		Log.Debug("Handling OTLP traces")
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			http.Error(w, "only the JSON encoding of OTLP/HTTP is supported", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var body io.Reader = r.Body
+		defer r.Body.Close()
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gzipReader.Close()
+			body = gzipReader
+		}
+
+		var request otlpTracesRequest
+		if err := json.NewDecoder(body).Decode(&request); err != nil {
+			Log.Errorf("Could not decode OTLP traces: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// All the resources are converted before any is buffered, so that a request rejected as invalid
+		// buffers nothing, and can be sent again without duplicating spans
+		payloads := make([][]byte, 0, len(request.ResourceSpans))
+		for _, resourceSpans := range request.ResourceSpans {
+			data, err := convertOTLPResourceSpans(resourceSpans)
+			if err != nil {
+				Log.Errorf("Could not convert OTLP traces: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if data != nil {
+				payloads = append(payloads, data)
+			}
+		}
+		for _, data := range payloads {
+			if err := transport.enqueueAgentData(r.Context(), AgentData{Data: data}); err != nil {
+				Log.Errorf("Could not buffer OTLP traces: %v", err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write([]byte("{}")); err != nil {
+			Log.Errorf("Failed to send OTLP response: %v", err)
+		}
+	}
+}
+
+// convertOTLPResourceSpans converts the spans of a resource to an intake v2 payload. The spans without a
+// parent, and the spans of kind SERVER and CONSUMER, become transactions. The OpenTelemetry attributes
+// and span kinds are kept, so that the APM server can derive the event types and contexts from them.
+// It returns nil if there is no span to convert.
+func convertOTLPResourceSpans(resourceSpans otlpResourceSpans) ([]byte, error) {
+	var spans []otlpSpan
+	for _, scopeSpans := range append(resourceSpans.ScopeSpans, resourceSpans.InstrumentationLibrarySpans...) {
+		spans = append(spans, scopeSpans.Spans...)
+	}
+	if len(spans) == 0 {
+		return nil, nil
+	}
+
+	var jsonWriter fastjson.Writer
+	if err := writeOTLPMetadata(&jsonWriter, otlpAttributes(resourceSpans.Resource.Attributes)); err != nil {
+		return nil, err
+	}
+
+	// Spans are attached to the closest ancestor transaction present in the same payload
+	parents := make(map[string]string, len(spans))
+	transactions := make(map[string]bool, len(spans))
+	for _, span := range spans {
+		parents[span.SpanID] = span.ParentSpanID
+		transactions[span.SpanID] = isOTLPTransaction(span)
+	}
+
+	for _, span := range spans {
+		jsonWriter.RawByte('\n')
+		if err := writeOTLPSpan(&jsonWriter, span, parents, transactions); err != nil {
+			return nil, err
+		}
+	}
+	return jsonWriter.Bytes(), nil
+}
+
+func isOTLPTransaction(span otlpSpan) bool {
+	return span.ParentSpanID == "" || span.Kind == otlpSpanKindServer || span.Kind == otlpSpanKindConsumer
+}
+
+func writeOTLPMetadata(w *fastjson.Writer, attributes map[string]interface{}) error {
+	stringAttribute := func(key, defaultValue string) string {
+		if value, ok := attributes[key].(string); ok && value != "" {
+			return value
+		}
+		return defaultValue
+	}
+	service := model.Service{
+		Name:        stringAttribute("service.name", "unknown"),
+		Version:     stringAttribute("service.version", ""),
+		Environment: stringAttribute("deployment.environment", ""),
+		Agent: &model.Agent{
+			Name:    "opentelemetry/" + stringAttribute("telemetry.sdk.language", "unknown"),
+			Version: stringAttribute("telemetry.sdk.version", "unknown"),
+		},
+	}
+	if language := stringAttribute("telemetry.sdk.language", ""); language != "" {
+		service.Language = &model.Language{Name: language}
+	}
+	w.RawString(`{"metadata":{"service":`)
+	if err := service.MarshalFastJSON(w); err != nil {
+		return err
+	}
+	w.RawString(`}}`)
+	return nil
+}
+
+func writeOTLPSpan(w *fastjson.Writer, span otlpSpan, parents map[string]string, transactions map[string]bool) error {
+	var traceID model.TraceID
+	var spanID, parentID model.SpanID
+	if err := decodeOTLPID(traceID[:], span.TraceID); err != nil {
+		return fmt.Errorf("invalid trace id: %v", err)
+	}
+	if err := decodeOTLPID(spanID[:], span.SpanID); err != nil {
+		return fmt.Errorf("invalid span id: %v", err)
+	}
+	if span.ParentSpanID != "" {
+		if err := decodeOTLPID(parentID[:], span.ParentSpanID); err != nil {
+			return fmt.Errorf("invalid parent span id: %v", err)
+		}
+	}
+
+	timestamp := model.Time(time.Unix(0, int64(span.StartTimeUnixNano)))
+	duration := float64(int64(span.EndTimeUnixNano)-int64(span.StartTimeUnixNano)) / float64(time.Millisecond)
+	otel := &model.OTel{
+		SpanKind:   otlpSpanKindNames[span.Kind],
+		Attributes: otlpAttributes(span.Attributes),
+	}
+	if otel.SpanKind == "" {
+		otel.SpanKind = "UNSPECIFIED"
+	}
+	outcome := "unknown"
+	switch span.Status.Code {
+	case otlpStatusCodeOk:
+		outcome = "success"
+	case otlpStatusCodeError:
+		outcome = "failure"
+	}
+
+	if transactions[span.SpanID] {
+		transactionType := "unknown"
+		switch span.Kind {
+		case otlpSpanKindServer:
+			transactionType = "request"
+		case otlpSpanKindConsumer:
+			transactionType = "messaging"
+		}
+		transaction := model.Transaction{
+			ID:        spanID,
+			TraceID:   traceID,
+			ParentID:  parentID,
+			Name:      span.Name,
+			Type:      transactionType,
+			Timestamp: timestamp,
+			Duration:  duration,
+			Outcome:   outcome,
+			OTel:      otel,
+		}
+		w.RawString(`{"transaction":`)
+		if err := transaction.MarshalFastJSON(w); err != nil {
+			return err
+		}
+		w.RawString(`}`)
+		return nil
+	}
+
+	spanType := "app"
+	switch span.Kind {
+	case otlpSpanKindClient:
+		spanType = "external"
+	case otlpSpanKindProducer:
+		spanType = "messaging"
+	}
+	apmSpan := model.Span{
+		ID:        spanID,
+		TraceID:   traceID,
+		ParentID:  parentID,
+		Name:      span.Name,
+		Type:      spanType,
+		Timestamp: timestamp,
+		Duration:  duration,
+		Outcome:   outcome,
+		OTel:      otel,
+	}
+	// The number of iterations is bounded, in case the parent relationships are cyclic
+	ancestor := span.ParentSpanID
+	for i := 0; ancestor != "" && i < len(parents); i++ {
+		if transactions[ancestor] {
+			if err := decodeOTLPID(apmSpan.TransactionID[:], ancestor); err != nil {
+				return fmt.Errorf("invalid parent span id: %v", err)
+			}
+			break
+		}
+		if _, ok := parents[ancestor]; !ok {
+			break
+		}
+		ancestor = parents[ancestor]
+	}
+	w.RawString(`{"span":`)
+	if err := apmSpan.MarshalFastJSON(w); err != nil {
+		return err
+	}
+	w.RawString(`}`)
+	return nil
+}
+
+// decodeOTLPID decodes a hex-encoded trace or span id into dst.
+func decodeOTLPID(dst []byte, id string) error {
+	decoded, err := hex.DecodeString(id)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(dst) {
+		return fmt.Errorf("expected %d bytes, got %d", len(dst), len(decoded))
+	}
+	copy(dst, decoded)
+	return nil
+}
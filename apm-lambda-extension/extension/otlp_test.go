@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const otlpTracesBody = `{
+	"resourceSpans": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "my-function"}},
+			{"key": "telemetry.sdk.language", "value": {"stringValue": "python"}},
+			{"key": "telemetry.sdk.version", "value": {"stringValue": "1.12.0"}}
+		]},
+		"scopeSpans": [{"spans": [
+			{
+				"traceId": "5b8efff798038103d269b633813fc60c",
+				"spanId": "eee19b7ec3c1b174",
+				"name": "GET /users",
+				"kind": 2,
+				"startTimeUnixNano": "1544712660000000000",
+				"endTimeUnixNano": "1544712661000000000",
+				"attributes": [{"key": "http.status_code", "value": {"intValue": "200"}}],
+				"status": {"code": 1}
+			},
+			{
+				"traceId": "5b8efff798038103d269b633813fc60c",
+				"spanId": "eee19b7ec3c1b175",
+				"parentSpanId": "eee19b7ec3c1b176",
+				"name": "SELECT users",
+				"kind": 3,
+				"startTimeUnixNano": 1544712660200000000,
+				"endTimeUnixNano": 1544712660500000000,
+				"attributes": [{"key": "db.system", "value": {"stringValue": "postgresql"}}],
+				"status": {"code": 2}
+			},
+			{
+				"traceId": "5b8efff798038103d269b633813fc60c",
+				"spanId": "eee19b7ec3c1b176",
+				"parentSpanId": "eee19b7ec3c1b174",
+				"name": "load users",
+				"kind": 1,
+				"startTimeUnixNano": "1544712660100000000",
+				"endTimeUnixNano": "1544712660600000000"
+			}
+		]}]
+	}]
+}`
+
+func TestHandleOTLPTraces(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/traces", strings.NewReader(otlpTracesBody))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handleOTLPTraces(transport)(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{}`, recorder.Body.String())
+
+	require.Equal(t, 1, transport.BufferedDataCount())
+	lines := strings.Split(string((<-transport.dataChannel).Data), "\n")
+	require.Len(t, lines, 4)
+	assert.JSONEq(t, `{"metadata":{"service":{"name":"my-function","agent":{"name":"opentelemetry/python","version":"1.12.0"},"language":{"name":"python"}}}}`, lines[0])
+	assert.JSONEq(t, `{"transaction":{"id":"eee19b7ec3c1b174","trace_id":"5b8efff798038103d269b633813fc60c","name":"GET /users","type":"request","timestamp":1544712660000000,"duration":1000,"span_count":{"dropped":0,"started":0},"outcome":"success","otel":{"span_kind":"SERVER","attributes":{"http.status_code":200}}}}`, lines[1])
+	assert.JSONEq(t, `{"span":{"name":"SELECT users","timestamp":1544712660200000,"duration":300,"type":"external","id":"eee19b7ec3c1b175","transaction_id":"eee19b7ec3c1b174","trace_id":"5b8efff798038103d269b633813fc60c","parent_id":"eee19b7ec3c1b176","outcome":"failure","otel":{"span_kind":"CLIENT","attributes":{"db.system":"postgresql"}}}}`, lines[2])
+	assert.JSONEq(t, `{"span":{"name":"load users","timestamp":1544712660100000,"duration":500,"type":"app","id":"eee19b7ec3c1b176","transaction_id":"eee19b7ec3c1b174","trace_id":"5b8efff798038103d269b633813fc60c","parent_id":"eee19b7ec3c1b174","outcome":"unknown","otel":{"span_kind":"INTERNAL"}}}`, lines[3])
+}
+
+func TestHandleOTLPTracesGzip(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+
+	var body bytes.Buffer
+	gw := gzip.NewWriter(&body)
+	_, err := gw.Write([]byte(otlpTracesBody))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/traces", &body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	handleOTLPTraces(transport)(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 1, transport.BufferedDataCount())
+}
+
+func TestHandleOTLPTracesInvalidRequests(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{name: "protobuf", contentType: "application/x-protobuf", body: "", status: http.StatusUnsupportedMediaType},
+		{name: "invalid json", contentType: "application/json", body: "{", status: http.StatusBadRequest},
+		{name: "invalid id", contentType: "application/json", body: `{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"zz","spanId":"eee19b7ec3c1b174"}]}]}]}`, status: http.StatusBadRequest},
+		{name: "invalid second resource", contentType: "application/json", body: `{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174"}]}]},{"scopeSpans":[{"spans":[{"traceId":"zz","spanId":"eee19b7ec3c1b174"}]}]}]}`, status: http.StatusBadRequest},
+		{name: "no spans", contentType: "application/json", body: `{"resourceSpans":[{}]}`, status: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/traces", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			recorder := httptest.NewRecorder()
+			handleOTLPTraces(transport)(recorder, req)
+			assert.Equal(t, tc.status, recorder.Code)
+			assert.Equal(t, 0, transport.BufferedDataCount())
+		})
+	}
+}
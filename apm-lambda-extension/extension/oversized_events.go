@@ -0,0 +1,243 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// defaultMaxEventSize is the default maximum size of an event accepted by the APM server, its
+// max_event_size setting.
+const defaultMaxEventSize = 300 * 1024
+
+// The fields of the events which can be truncated to fit the maximum event size, in the order in which
+// they are truncated.
+const (
+	truncateStacktrace = "stacktrace"
+	truncateBody       = "body"
+	truncateMessage    = "message"
+)
+
+var truncatableFields = []string{truncateStacktrace, truncateBody, truncateMessage}
+
+// eventTruncator truncates the fields listed in ELASTIC_APM_LAMBDA_TRUNCATE_FIELDS of the events larger
+// than the maximum event size of the APM server, e.g. the errors with a huge stack trace, so that they fit
+// rather than being rejected by the APM server. The events are left unaltered if they still do not fit.
+type eventTruncator struct {
+	maxEventSize int
+	fields       []string
+}
+
+// newEventTruncator returns the truncator of the oversized events, or nil if no field is truncated.
+func newEventTruncator(config *extensionConfig) *eventTruncator {
+	enabled := make(map[string]bool)
+	for _, field := range config.truncateFields {
+		field = strings.ToLower(field)
+		if !isTruncatableField(field) {
+			Log.Warnf("The %s field of the events cannot be truncated, ignoring", field)
+			continue
+		}
+		enabled[field] = true
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+	maxEventSize := config.maxEventSize
+	if maxEventSize <= 0 {
+		maxEventSize = defaultMaxEventSize
+	}
+	truncator := &eventTruncator{maxEventSize: maxEventSize}
+	for _, field := range truncatableFields {
+		if enabled[field] {
+			truncator.fields = append(truncator.fields, field)
+		}
+	}
+	return truncator
+}
+
+func isTruncatableField(field string) bool {
+	for _, truncatable := range truncatableFields {
+		if field == truncatable {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateAgentData returns the uncompressed agent data with its oversized events truncated, and whether
+// any event was truncated.
+func (transport *ApmServerTransport) truncateAgentData(agentData AgentData) ([]byte, bool, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, false, err
+	}
+	var out bytes.Buffer
+	changed := false
+	forEachLine(data, func(line []byte) {
+		event := bytes.TrimRight(line, "\n")
+		if len(event) <= transport.truncator.maxEventSize {
+			out.Write(line)
+			return
+		}
+		truncated, ok := transport.truncator.truncate(event)
+		if !ok {
+			Log.Warnf("Could not truncate a %s event of %d bytes to the maximum event size", eventType(event), len(event))
+			out.Write(line)
+			return
+		}
+		atomic.AddInt64(&transport.metrics.truncatedEvents, 1)
+		out.Write(truncated)
+		if len(event) != len(line) {
+			out.WriteByte('\n')
+		}
+		changed = true
+	})
+	return out.Bytes(), changed, nil
+}
+
+// truncate returns the event truncated to the maximum event size, or false if it does not fit once its
+// fields are truncated.
+func (truncator *eventTruncator) truncate(line []byte) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	// Numbers are kept as is, so that the fields the extension does not change are sent unaltered
+	decoder.UseNumber()
+	var event map[string]map[string]interface{}
+	if err := decoder.Decode(&event); err != nil {
+		return nil, false
+	}
+	size := len(line)
+	fits := func() bool {
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return false
+		}
+		line, size = encoded, len(encoded)
+		return size <= truncator.maxEventSize
+	}
+	for _, body := range event {
+		for _, field := range truncator.fields {
+			switch field {
+			case truncateStacktrace:
+				if truncateStacktraces(stacktraces(body), fits) {
+					return line, true
+				}
+			case truncateBody:
+				context, _ := body["context"].(map[string]interface{})
+				for _, key := range []string{"request", "message"} {
+					parent, _ := context[key].(map[string]interface{})
+					if truncateString(parent, "body", &size, truncator.maxEventSize, fits) {
+						return line, true
+					}
+				}
+			case truncateMessage:
+				for _, parent := range []interface{}{body["exception"], body["log"]} {
+					parent, _ := parent.(map[string]interface{})
+					if truncateString(parent, "message", &size, truncator.maxEventSize, fits) {
+						return line, true
+					}
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// stacktraces returns the objects holding the stack traces of an event: the span itself, and the exception,
+// its causes and the log of an error.
+func stacktraces(event map[string]interface{}) []map[string]interface{} {
+	holders := []map[string]interface{}{event}
+	if log, ok := event["log"].(map[string]interface{}); ok {
+		holders = append(holders, log)
+	}
+	exceptions := []interface{}{event["exception"]}
+	for len(exceptions) > 0 {
+		exception, ok := exceptions[0].(map[string]interface{})
+		exceptions = exceptions[1:]
+		if !ok {
+			continue
+		}
+		holders = append(holders, exception)
+		if causes, ok := exception["cause"].([]interface{}); ok {
+			exceptions = append(exceptions, causes...)
+		}
+	}
+	return holders
+}
+
+// truncateStacktraces halves the stack traces of holders, dropping the outermost frames, until the event
+// fits. It reports whether it fits.
+func truncateStacktraces(holders []map[string]interface{}, fits func() bool) bool {
+	for {
+		// The longest stack trace is halved first
+		var longest map[string]interface{}
+		var frames []interface{}
+		for _, holder := range holders {
+			if stacktrace, ok := holder["stacktrace"].([]interface{}); ok && len(stacktrace) > len(frames) {
+				longest, frames = holder, stacktrace
+			}
+		}
+		if len(frames) <= 1 {
+			return false
+		}
+		longest["stacktrace"] = frames[:len(frames)/2]
+		if fits() {
+			return true
+		}
+	}
+}
+
+// truncateString truncates the field key of parent, converted to a JSON string if it is structured, so that
+// the event of size bytes fits in maxSize. It reports whether the event fits.
+func truncateString(parent map[string]interface{}, key string, size *int, maxSize int, fits func() bool) bool {
+	value, ok := parent[key]
+	if !ok || value == nil {
+		return false
+	}
+	s, ok := value.(string)
+	if !ok {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return false
+		}
+		s = string(encoded)
+	}
+	for s != "" {
+		// Escaped characters take more room once encoded, so the string may need to be truncated again
+		excess := *size - maxSize
+		if excess < 1 {
+			excess = 1
+		}
+		end := len(s) - excess
+		if end < 0 {
+			end = 0
+		}
+		for end > 0 && !utf8.RuneStart(s[end]) {
+			end--
+		}
+		s = s[:end]
+		parent[key] = s
+		if fits() {
+			return true
+		}
+	}
+	return false
+}
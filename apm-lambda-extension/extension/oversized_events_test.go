@@ -0,0 +1,158 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errorWithFrames returns an error event whose exception has count stack frames.
+func errorWithFrames(count int) string {
+	frames := make([]string, count)
+	for i := range frames {
+		frames[i] = fmt.Sprintf(`{"filename":"handler.js","function":"f%d","lineno":%d}`, i, i)
+	}
+	return `{"error":{"id":"1","exception":{"message":"boom","stacktrace":[` + strings.Join(frames, ",") + `]}}}`
+}
+
+func TestTruncateStacktrace(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", truncateFields: []string{"stacktrace"}, maxEventSize: 1024}
+	transport := InitApmServerTransport(&config)
+
+	small := errorWithFrames(2)
+	data, changed, err := transport.truncateAgentData(AgentData{Data: []byte(`{"metadata":{}}` + "\n" + errorWithFrames(100) + "\n" + small + "\n")})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	lines := strings.Split(string(data), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, `{"metadata":{}}`, lines[0])
+	assert.LessOrEqual(t, len(lines[1]), 1024)
+	assert.Equal(t, small, lines[2])
+
+	// The innermost frames are kept
+	var event struct {
+		Error struct {
+			Exception struct {
+				Message    string `json:"message"`
+				Stacktrace []struct {
+					Function string `json:"function"`
+				} `json:"stacktrace"`
+			} `json:"exception"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(t, "boom", event.Error.Exception.Message)
+	require.NotEmpty(t, event.Error.Exception.Stacktrace)
+	assert.Equal(t, "f0", event.Error.Exception.Stacktrace[0].Function)
+	assert.Equal(t, int64(1), transport.metrics.truncatedEvents)
+}
+
+func TestTruncateBody(t *testing.T) {
+	truncator := newEventTruncator(&extensionConfig{truncateFields: []string{"body", "stacktrace"}, maxEventSize: 512})
+
+	body := strings.Repeat("é", 1000)
+	truncated, ok := truncator.truncate([]byte(`{"transaction":{"id":"1","context":{"request":{"method":"POST","body":"` + body + `"}}}}`))
+	require.True(t, ok)
+	assert.LessOrEqual(t, len(truncated), 512)
+	var event struct {
+		Transaction struct {
+			Context struct {
+				Request struct {
+					Method string `json:"method"`
+					Body   string `json:"body"`
+				} `json:"request"`
+			} `json:"context"`
+		} `json:"transaction"`
+	}
+	require.NoError(t, json.Unmarshal(truncated, &event))
+	assert.Equal(t, "POST", event.Transaction.Context.Request.Method)
+	assert.NotEmpty(t, event.Transaction.Context.Request.Body)
+	assert.True(t, strings.HasPrefix(body, event.Transaction.Context.Request.Body))
+
+	// Structured bodies are truncated as strings
+	truncated, ok = truncator.truncate([]byte(`{"transaction":{"id":"1","context":{"request":{"body":{"items":["` + strings.Repeat("a", 1000) + `"]}}}}}`))
+	require.True(t, ok)
+	assert.LessOrEqual(t, len(truncated), 512)
+	assert.Contains(t, string(truncated), `"body":"{\"items\":[\"aaa`)
+}
+
+func TestTruncateMessage(t *testing.T) {
+	truncator := newEventTruncator(&extensionConfig{truncateFields: []string{"message"}, maxEventSize: 256})
+	truncated, ok := truncator.truncate([]byte(`{"error":{"id":"1","log":{"message":"` + strings.Repeat("x", 1000) + `"}}}`))
+	require.True(t, ok)
+	assert.LessOrEqual(t, len(truncated), 256)
+
+	// Fields which are not configured are left unaltered
+	_, ok = truncator.truncate([]byte(`{"transaction":{"id":"1","context":{"request":{"body":"` + strings.Repeat("x", 1000) + `"}}}}`))
+	assert.False(t, ok)
+}
+
+func TestPostToApmServerTruncateOversizedEvents(t *testing.T) {
+	var received string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		data, err := GetUncompressedBytes(body, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		received = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", truncateFields: []string{"stacktrace"}, maxEventSize: 2048}
+	transport := InitApmServerTransport(&config)
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}` + "\n" + errorWithFrames(200) + "\n")}))
+	lines := strings.Split(received, "\n")
+	require.Len(t, lines, 3)
+	assert.LessOrEqual(t, len(lines[1]), 2048)
+}
+
+func TestNewEventTruncator(t *testing.T) {
+	assert.Nil(t, newEventTruncator(&extensionConfig{}))
+	assert.Nil(t, newEventTruncator(&extensionConfig{truncateFields: []string{"labels"}}))
+
+	truncator := newEventTruncator(&extensionConfig{truncateFields: []string{"Message", "stacktrace"}})
+	assert.Equal(t, []string{"stacktrace", "message"}, truncator.fields)
+	assert.Equal(t, defaultMaxEventSize, truncator.maxEventSize)
+}
+
+func TestProcessEnvTruncateFields(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Empty(t, config.truncateFields)
+	assert.Equal(t, defaultMaxEventSize, config.maxEventSize)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_TRUNCATE_FIELDS", "stacktrace, body")
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_EVENT_SIZE", "1048576")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, []string{"stacktrace", "body"}, config.truncateFields)
+	assert.Equal(t, 1048576, config.maxEventSize)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_EVENT_SIZE", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultMaxEventSize, config.maxEventSize)
+}
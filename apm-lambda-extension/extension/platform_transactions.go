@@ -0,0 +1,146 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+const (
+	platformTransactionType  = "request"
+	platformTransactionLabel = "platform_transaction"
+)
+
+// platformTransactions reports a minimal transaction for each invocation during which no agent data was
+// received, built from the platform events of the Telemetry API, so that the uninstrumented functions show in
+// the APM UI.
+type platformTransactions struct {
+	metadata        []byte
+	functionName    string
+	functionVersion string
+}
+
+// newPlatformTransactions returns the platform transactions reporter, or nil if platform transactions are
+// disabled.
+func newPlatformTransactions(config *extensionConfig) *platformTransactions {
+	if !config.platformTransactions {
+		return nil
+	}
+	return &platformTransactions{
+		metadata:        extensionMetadata(config),
+		functionName:    config.functionName,
+		functionVersion: config.functionVersion,
+	}
+}
+
+// PlatformInvocation describes an invocation, as reported by its platform.start, platform.runtimeDone and
+// platform.report events.
+type PlatformInvocation struct {
+	Start     time.Time
+	Duration  time.Duration
+	Outcome   string
+	Coldstart bool
+}
+
+// markAgentDataSeen records that agent data was received during the current invocation.
+func (transport *ApmServerTransport) markAgentDataSeen() {
+	atomic.StoreInt32(&transport.agentDataSeen, 1)
+}
+
+// TakeAgentDataSeen returns true if agent data was received since the last call.
+func (transport *ApmServerTransport) TakeAgentDataSeen() bool {
+	return atomic.SwapInt32(&transport.agentDataSeen, 0) == 1
+}
+
+// EnqueuePlatformTransaction queues a transaction describing the invocation of event, if platform transactions
+// are enabled and no agent data was received during the invocation. The transaction is attributed to the
+// service of the agent metadata when it is known, e.g. when the agent stopped reporting, and to the service
+// named by ELASTIC_APM_SERVICE_NAME otherwise.
+func (transport *ApmServerTransport) EnqueuePlatformTransaction(metadataContainer *MetadataContainer, event *NextEventResponse, invocation PlatformInvocation) {
+	platformTxs := transport.platformTxs
+	if platformTxs == nil || event == nil || event.AgentDataSeen {
+		return
+	}
+	data, err := platformTxs.build(metadataContainer, event, invocation)
+	if err != nil {
+		Log.Errorf("Could not build the platform transaction: %v", err)
+		return
+	}
+	Log.Debugf("No agent data received for invocation %s, reporting a platform transaction", event.RequestID)
+	transport.EnqueueAPMData(AgentData{Data: data})
+}
+
+func (platformTxs *platformTransactions) build(metadataContainer *MetadataContainer, event *NextEventResponse, invocation PlatformInvocation) ([]byte, error) {
+	functionVersion := event.FunctionVersion
+	if functionVersion == "" {
+		functionVersion = platformTxs.functionVersion
+	}
+	transaction := model.Transaction{
+		Name:      platformTxs.functionName,
+		Type:      platformTransactionType,
+		Timestamp: model.Time(invocation.Start),
+		Duration:  float64(invocation.Duration) / float64(time.Millisecond),
+		Result:    event.RuntimeDoneStatus,
+		Outcome:   invocation.Outcome,
+		Context: &model.Context{
+			Tags: model.IfaceMap{{Key: platformTransactionLabel, Value: true}},
+		},
+		FAAS: &model.FAAS{
+			ID:        event.InvokedFunctionArn,
+			Execution: event.RequestID,
+			Name:      platformTxs.functionName,
+			Version:   functionVersion,
+			Coldstart: invocation.Coldstart,
+			Trigger:   &model.FAASTrigger{Type: "other"},
+		},
+	}
+	// The transaction joins the X-Ray trace of the invocation, if it is sampled
+	if traceContext, ok := parseXRayTraceHeader(event.Tracing.Value); event.Tracing.Type == xrayTracingType && ok {
+		if _, err := hex.Decode(transaction.TraceID[:], []byte(traceContext.traceID)); err != nil {
+			return nil, err
+		}
+		if _, err := hex.Decode(transaction.ParentID[:], []byte(traceContext.parentID)); err != nil {
+			return nil, err
+		}
+	} else if _, err := rand.Read(transaction.TraceID[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(transaction.ID[:]); err != nil {
+		return nil, err
+	}
+
+	var jsonWriter fastjson.Writer
+	if metadata := metadataContainer.Get(); metadata != nil {
+		jsonWriter.RawBytes(metadata)
+	} else {
+		jsonWriter.RawBytes(platformTxs.metadata)
+	}
+	jsonWriter.RawString("\n")
+	jsonWriter.RawString(`{"transaction":`)
+	if err := transaction.MarshalFastJSON(&jsonWriter); err != nil {
+		return nil, err
+	}
+	jsonWriter.RawString("}\n")
+	return jsonWriter.Bytes(), nil
+}
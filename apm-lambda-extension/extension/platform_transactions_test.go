@@ -0,0 +1,161 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type platformTransaction struct {
+	Transaction struct {
+		TraceID   string  `json:"trace_id"`
+		ParentID  string  `json:"parent_id"`
+		Name      string  `json:"name"`
+		Type      string  `json:"type"`
+		Timestamp int64   `json:"timestamp"`
+		Duration  float64 `json:"duration"`
+		Result    string  `json:"result"`
+		Outcome   string  `json:"outcome"`
+		Context   struct {
+			Tags map[string]interface{} `json:"tags"`
+		} `json:"context"`
+		FAAS struct {
+			ID        string `json:"id"`
+			Execution string `json:"execution"`
+			Version   string `json:"version"`
+			Coldstart bool   `json:"coldstart"`
+		} `json:"faas"`
+	} `json:"transaction"`
+}
+
+func newPlatformInvocationEvent() *NextEventResponse {
+	return &NextEventResponse{
+		EventType:          Invoke,
+		RequestID:          "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-1:123456789012:function:my-function",
+		Tracing: Tracing{
+			Type:  xrayTracingType,
+			Value: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+		},
+		RuntimeDoneStatus: "success",
+		FunctionVersion:   "7",
+	}
+}
+
+func TestEnqueuePlatformTransaction(t *testing.T) {
+	config := extensionConfig{platformTransactions: true, serviceName: "my-service", functionName: "my-function"}
+	transport := InitApmServerTransport(&config)
+	start := time.UnixMilli(1665532800000)
+
+	transport.EnqueuePlatformTransaction(&MetadataContainer{}, newPlatformInvocationEvent(), PlatformInvocation{
+		Start:     start,
+		Duration:  182500 * time.Microsecond,
+		Outcome:   "success",
+		Coldstart: true,
+	})
+	require.Equal(t, 1, transport.BufferedDataCount())
+	lines := strings.Split(strings.TrimSpace(string((<-transport.dataChannel).Data)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"name":"my-service"`)
+	assert.Contains(t, lines[0], `"name":"apm-lambda-extension"`)
+
+	var transaction platformTransaction
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &transaction))
+	assert.Equal(t, "my-function", transaction.Transaction.Name)
+	assert.Equal(t, "request", transaction.Transaction.Type)
+	assert.Equal(t, start.UnixMicro(), transaction.Transaction.Timestamp)
+	assert.Equal(t, 182.5, transaction.Transaction.Duration)
+	assert.Equal(t, "success", transaction.Transaction.Result)
+	assert.Equal(t, "success", transaction.Transaction.Outcome)
+	assert.Equal(t, map[string]interface{}{"platform_transaction": true}, transaction.Transaction.Context.Tags)
+	assert.Equal(t, "arn:aws:lambda:us-east-1:123456789012:function:my-function", transaction.Transaction.FAAS.ID)
+	assert.Equal(t, "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa", transaction.Transaction.FAAS.Execution)
+	assert.Equal(t, "7", transaction.Transaction.FAAS.Version)
+	assert.True(t, transaction.Transaction.FAAS.Coldstart)
+	// The transaction joins the X-Ray trace of the invocation
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", transaction.Transaction.TraceID)
+	assert.Equal(t, "53995c3f42cd8ad8", transaction.Transaction.ParentID)
+}
+
+func TestEnqueuePlatformTransactionAgentMetadata(t *testing.T) {
+	config := extensionConfig{platformTransactions: true, functionName: "my-function"}
+	transport := InitApmServerTransport(&config)
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{"service":{"name":"agent"}}}`))
+
+	event := newPlatformInvocationEvent()
+	event.Tracing = Tracing{}
+	transport.EnqueuePlatformTransaction(metadataContainer, event, PlatformInvocation{Duration: time.Second, Outcome: "success"})
+	require.Equal(t, 1, transport.BufferedDataCount())
+	lines := strings.Split(strings.TrimSpace(string((<-transport.dataChannel).Data)), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, string(metadataContainer.Get()), lines[0])
+
+	var transaction platformTransaction
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &transaction))
+	assert.Len(t, transaction.Transaction.TraceID, 32)
+	assert.Empty(t, transaction.Transaction.ParentID)
+}
+
+func TestEnqueuePlatformTransactionSkipped(t *testing.T) {
+	// Disabled
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.EnqueuePlatformTransaction(&MetadataContainer{}, newPlatformInvocationEvent(), PlatformInvocation{})
+	assert.Equal(t, 0, transport.BufferedDataCount())
+
+	// Agent data was received during the invocation
+	transport = InitApmServerTransport(&extensionConfig{platformTransactions: true})
+	event := newPlatformInvocationEvent()
+	event.AgentDataSeen = true
+	transport.EnqueuePlatformTransaction(&MetadataContainer{}, event, PlatformInvocation{})
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestTakeAgentDataSeen(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	handler := handleIntakeV2Events(context.Background(), transport)
+	assert.False(t, transport.TakeAgentDataSeen())
+
+	// Flush signals are not agent data
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/intake/v2/events?flushed=true", nil))
+	assert.False(t, transport.TakeAgentDataSeen())
+
+	body := `{"metadata":{"service":{"name":"agent"}}}` + "\n"
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(body)))
+	assert.True(t, transport.TakeAgentDataSeen())
+	assert.False(t, transport.TakeAgentDataSeen())
+}
+
+func TestProcessEnvPlatformTransactions(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	assert.False(t, ProcessEnv(new(mockSecretManager)).platformTransactions)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_PLATFORM_TRANSACTIONS", "true")
+	assert.True(t, ProcessEnv(new(mockSecretManager)).platformTransactions)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_PLATFORM_TRANSACTIONS", "invalid")
+	assert.False(t, ProcessEnv(new(mockSecretManager)).platformTransactions)
+}
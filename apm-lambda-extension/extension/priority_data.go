@@ -0,0 +1,58 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+)
+
+// priorityBufferSize is the number of error documents created by the extension that are buffered apart from
+// the agent data.
+const priorityBufferSize = 10
+
+// EnqueuePriorityData queues an error document created by the extension itself, e.g. the report of a timeout
+// or of a platform fault. Such documents are buffered apart from the agent data, so that they are not dropped
+// when the buffer is full, and sent before it, each in a request of its own, so that they reach the APM server
+// even when the deadline leaves no time to send the rest. agentData is queued as agent data when the priority
+// buffer is full.
+func (transport *ApmServerTransport) EnqueuePriorityData(agentData AgentData) {
+	select {
+	case transport.priorityChannel <- agentData:
+		Log.Debug("Adding error document to the priority buffer")
+	default:
+		transport.EnqueueAPMData(agentData)
+	}
+}
+
+// sendPriorityData sends the buffered error documents created by the extension itself to the APM server.
+func (transport *ApmServerTransport) sendPriorityData(ctx context.Context) FlushResult {
+	var result FlushResult
+	for {
+		select {
+		case agentData := <-transport.priorityChannel:
+			if err := transport.PostToApmServer(ctx, agentData); err != nil {
+				Log.Errorf("Error sending error document to APM server, skipping: %v", err)
+				result.Failed++
+			} else {
+				result.Sent++
+			}
+		default:
+			return result
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityDataFlushedFirst(t *testing.T) {
+	var bodies []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(gr)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", dataBufferSize: 1})
+	transport.EnqueueAPMData(AgentData{Data: []byte(`{"metadata":{}}` + "\n" + `{"transaction":{}}`)})
+	// The priority data is not dropped although the buffer is full
+	transport.EnqueuePriorityData(AgentData{Data: []byte(`{"metadata":{}}` + "\n" + `{"error":{"id":"1"}}`)})
+	transport.EnqueuePriorityData(AgentData{Data: []byte(`{"metadata":{}}` + "\n" + `{"error":{"id":"2"}}`)})
+	assert.Equal(t, 3, transport.BufferedDataCount())
+	assert.Equal(t, int64(0), transport.droppedPayloads)
+
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	require.Len(t, bodies, 3)
+	assert.Contains(t, bodies[0], `{"error":{"id":"1"}}`)
+	assert.Contains(t, bodies[1], `{"error":{"id":"2"}}`)
+	assert.Contains(t, bodies[2], `{"transaction":{}}`)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestPriorityBufferFull(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	for i := 0; i <= priorityBufferSize; i++ {
+		transport.EnqueuePriorityData(AgentData{Data: []byte(`{"error":{}}`)})
+	}
+	assert.Len(t, transport.priorityChannel, priorityBufferSize)
+	assert.Len(t, transport.dataChannel, 1)
+}
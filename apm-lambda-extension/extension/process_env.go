@@ -18,11 +18,16 @@
 package extension
 
 import (
+	"compress/gzip"
 	"encoding/base64"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"elastic/apm-lambda-extension/buildinfo"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
@@ -30,19 +35,117 @@ import (
 )
 
 type extensionConfig struct {
-	apmServerUrl                string
-	apmServerSecretToken        string
-	apmServerApiKey             string
-	dataReceiverServerPort      string
-	SendStrategy                SendStrategy
-	dataReceiverTimeoutSeconds  int
-	DataForwarderTimeoutSeconds int
-	LogLevel                    zapcore.Level
+	apmServerUrl                   string
+	apmServerSecretToken           string
+	apmServerApiKey                string
+	secretManager                  secretManager
+	apmServerApiKeySMSecretId      string
+	apmServerSecretTokenSMSecretId string
+	apmServerFallbackUrl           string
+	apmServerFallbackApiKey        string
+	apmServerFallbackSecretToken   string
+	fallbackProbeInterval          time.Duration
+	dataReceiverServerAddress      string
+	dataReceiverServerPort         string
+	dataReceiverSocket             string
+	certExpiryWarning              time.Duration
+	SendStrategy                   SendStrategy
+	dataForwarderMode              DataForwarderMode
+	dataBufferSize                 int
+	dataBufferPolicy               BufferPolicy
+	dataReceiverTimeoutSeconds     int
+	DataForwarderTimeoutSeconds    int
+	httpClient                     httpClientConfig
+	LogLevel                       zapcore.Level
+	LogFormat                      LogFormat
+	functionMemorySizeMB           int
+	memoryBudgetPercent            int
+	StrictDelivery                 bool
+	retryRejectedEvents            bool
+	SendFunctionLogs               bool
+	slowFlushThresholdMs           int
+	slowFlushProfileDurationMs     int
+	backoff                        backoffConfig
+	compression                    compressionConfig
+	spillDir                       string
+	spillBufferMaxBytes            int64
+	batchMaxBytes                  int
+	batchMaxWaitMs                 int
+	syntheticTransactions          bool
+	flushMetricsEMF                bool
+	reportTimeouts                 bool
+	selfMetricsInvocations         int
+	debugLogSampling               int
+	serviceName                    string
+	functionName                   string
+	functionVersion                string
+	configWatchInterval            time.Duration
+	centralConfigInterval          time.Duration
+	environment                    string
+	configSSMParameter             string
+	tagsAsLabels                   []string
+	RuntimeQuirks                  RuntimeQuirks
+	ShortTimeout                   ShortTimeout
+	ExtensionName                  string
+	metadataEnrichment             bool
+	xrayLinks                      bool
+	runtimeAPIProxy                bool
+	runtimeAPIProxyPort            string
+	collectors                     []string
+	collectorsInterval             time.Duration
+	validateIntake                 bool
+	maxInFlightRequests            int
+	sanitize                       bool
+	sanitizeFieldNames             []string
+	filterEventTypes               []string
+	tailSampling                   tailSamplingConfig
+	metricsFilePath                string
+	metricsFileMaxBytes            int64
+	rateLimit                      rateLimitConfig
+	globalLabels                   map[string]string
+	region                         string
+	logStreamName                  string
+	output                         Output
+	outputStream                   string
+	truncateFields                 []string
+	maxEventSize                   int
+	dlqSQSURL                      string
+	adaptiveMaxDelay               time.Duration
+	flushOnNextMaxAge              time.Duration
+	Features                       FeatureFlags
+	retry                          retryConfig
+	atomicFlush                    bool
+	sourceMapMaxBytes              int64
+	relayIntakeErrors              bool
+	nearTimeoutRatio               float64
+	platformTransactions           bool
+	legacyServerCompat             LegacyServerCompat
+	legacyStripFields              []string
+}
+
+// backoffConfig holds the parameters of the grace period applied after a failure to send data to
+// the APM server: min(reconnectionCount, maxReconnectionCount)² × multiplier seconds, ± jitter.
+type backoffConfig struct {
+	maxReconnectionCount int
+	multiplierSeconds    float64
+	jitter               float64
 }
 
 // SendStrategy represents the type of sending strategy the extension uses
 type SendStrategy string
 
+// DataForwarderMode represents how the extension forwards the agent data to the APM server
+type DataForwarderMode string
+
+// BufferPolicy represents how the extension handles agent data received while its buffer is full
+type BufferPolicy string
+
+// Output represents where the extension sends the agent data
+type Output string
+
+// LegacyServerCompat represents when the extension strips the fields unknown to the APM servers older than 7.16
+type LegacyServerCompat string
+
 const (
 	// Background send strategy allows the extension to send remaining buffered
 	// agent data on the next function invocation
@@ -53,12 +156,81 @@ const (
 	// function is complete
 	SyncFlush SendStrategy = "syncflush"
 
+	// Adaptive send strategy decides at the end of each invocation whether
+	// to flush the remaining buffered agent data synchronously or to send it
+	// on the next function invocation
+	Adaptive SendStrategy = "adaptive"
+
+	// FlushOnNext send strategy flushes the remaining buffered agent data at
+	// the start of the next function invocation, unless it gets too old
+	FlushOnNext SendStrategy = "flushonnext"
+
+	// BufferMode reads the agent data in memory before queueing it, so that it
+	// is sent to the APM server in the background or flushed at the end of the
+	// invocation
+	BufferMode DataForwarderMode = "buffer"
+
+	// StreamMode forwards the agent data to the APM server while it is received
+	// from the agent, without holding whole payloads in memory
+	StreamMode DataForwarderMode = "stream"
+
+	// DropNewest buffer policy discards the agent data received while the
+	// buffer is full
+	DropNewest BufferPolicy = "drop_newest"
+
+	// DropOldest buffer policy discards the oldest buffered agent data to make
+	// room for the agent data received while the buffer is full
+	DropOldest BufferPolicy = "drop_oldest"
+
+	// Block buffer policy holds the agent requests until there is room in the
+	// buffer, slowing the agent down to the pace of the APM server
+	Block BufferPolicy = "block"
+
+	// Reject buffer policy responds to the agent requests received while the
+	// buffer is full with a 503 Service Unavailable status
+	Reject BufferPolicy = "reject"
+
+	// ApmServerOutput sends the agent data to the APM server
+	ApmServerOutput Output = "apm-server"
+
+	// KinesisOutput writes the agent data to a Kinesis data stream, from which
+	// a consumer forwards it to the APM server
+	KinesisOutput Output = "kinesis"
+
+	// FirehoseOutput writes the agent data to a Firehose delivery stream, from
+	// which a consumer forwards it to the APM server
+	FirehoseOutput Output = "firehose"
+
+	// LegacyCompatAuto strips the fields unknown to the APM server once it is
+	// found to be older than 7.16
+	LegacyCompatAuto LegacyServerCompat = "auto"
+
+	// LegacyCompatAlways strips the fields unknown to the APM servers older
+	// than 7.16, whatever the version of the APM server
+	LegacyCompatAlways LegacyServerCompat = "always"
+
+	// LegacyCompatNever sends the events unaltered
+	LegacyCompatNever LegacyServerCompat = "never"
+
 	defaultDataReceiverTimeoutSeconds  int = 15
 	defaultDataForwarderTimeoutSeconds int = 3
+	defaultMemoryBudgetPercent         int = 0
+	defaultSpillBufferMaxBytes         int = 10 * 1024 * 1024
+	defaultDataBufferSize              int = 100
+	defaultBatchMaxWaitMs              int = 100
+	defaultFallbackProbeInterval           = time.Minute
+	defaultSlowFlushProfileDurationMs  int = 500
 )
 
+// defaultBackoffConfig follows the APM agents transport specification, with a grace period of at most 36s.
+var defaultBackoffConfig = backoffConfig{
+	maxReconnectionCount: 6,
+	multiplierSeconds:    1,
+	jitter:               0.1,
+}
+
 func getIntFromEnv(name string) (int, error) {
-	strValue := os.Getenv(name)
+	strValue := getEnv(name)
 	value, err := strconv.Atoi(strValue)
 	if err != nil {
 		return -1, err
@@ -66,6 +238,228 @@ func getIntFromEnv(name string) (int, error) {
 	return value, nil
 }
 
+func getFloatFromEnv(name string) (float64, error) {
+	strValue := getEnv(name)
+	value, err := strconv.ParseFloat(strValue, 64)
+	if err != nil {
+		return -1, err
+	}
+	return value, nil
+}
+
+// getDurationFromEnv reads a duration such as "500ms" or "5s". A value without unit is a number of seconds.
+func getDurationFromEnv(name string) (time.Duration, error) {
+	strValue := getEnv(name)
+	if seconds, err := strconv.Atoi(strValue); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	value, err := time.ParseDuration(strValue)
+	if err != nil {
+		return -1, err
+	}
+	return value, nil
+}
+
+// getCompressionConfig reads how the agent data sent uncompressed by the agents is compressed.
+func getCompressionConfig() compressionConfig {
+	compression := defaultCompressionConfig
+	switch algorithm := Compression(strings.ToLower(getEnv("ELASTIC_APM_COMPRESSION"))); algorithm {
+	case "":
+	case GzipCompression, NoCompression:
+		compression.algorithm = algorithm
+	default:
+		Log.Warnf("Could not read ELASTIC_APM_COMPRESSION, defaulting to %s", compression.algorithm)
+	}
+	if getEnv("ELASTIC_APM_COMPRESSION_LEVEL") != "" {
+		level, err := getIntFromEnv("ELASTIC_APM_COMPRESSION_LEVEL")
+		if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+			Log.Warnf("Could not read ELASTIC_APM_COMPRESSION_LEVEL, defaulting to %d", compression.level)
+		} else {
+			compression.level = level
+		}
+	}
+	if getEnv("ELASTIC_APM_COMPRESSION_MIN_BYTES") != "" {
+		minBytes, err := getIntFromEnv("ELASTIC_APM_COMPRESSION_MIN_BYTES")
+		if err != nil || minBytes < 0 {
+			Log.Warnf("Could not read ELASTIC_APM_COMPRESSION_MIN_BYTES, defaulting to %d", compression.minBytes)
+		} else {
+			compression.minBytes = minBytes
+		}
+	}
+	return compression
+}
+
+// getShortTimeout reads how the invocations of functions with a short timeout are handled.
+func getShortTimeout() ShortTimeout {
+	shortTimeout := defaultShortTimeout
+	if getEnv("ELASTIC_APM_SHORT_TIMEOUT_THRESHOLD") != "" {
+		threshold, err := getDurationFromEnv("ELASTIC_APM_SHORT_TIMEOUT_THRESHOLD")
+		if err != nil || threshold < 0 {
+			Log.Warnf("Could not read ELASTIC_APM_SHORT_TIMEOUT_THRESHOLD, defaulting to %s", shortTimeout.Threshold)
+		} else {
+			shortTimeout.Threshold = threshold
+		}
+	}
+	switch sendStrategy := SendStrategy(strings.ToLower(getEnv("ELASTIC_APM_SHORT_TIMEOUT_SEND_STRATEGY"))); sendStrategy {
+	case "":
+	case Background, SyncFlush, Adaptive, FlushOnNext:
+		shortTimeout.SendStrategy = sendStrategy
+	default:
+		Log.Warnf("Could not read ELASTIC_APM_SHORT_TIMEOUT_SEND_STRATEGY, defaulting to %s", shortTimeout.SendStrategy)
+	}
+	return shortTimeout
+}
+
+// getTailSamplingConfig reads the policies deciding which traces are forwarded to the APM server.
+func getTailSamplingConfig() tailSamplingConfig {
+	config := defaultTailSamplingConfig
+	if getEnv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING") != "" {
+		enabled, err := strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_TAIL_SAMPLING, defaulting to false: %v", err)
+		}
+		config.enabled = enabled
+	}
+	if getEnv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_SLOW_THRESHOLD") != "" {
+		threshold, err := getDurationFromEnv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_SLOW_THRESHOLD")
+		if err != nil || threshold <= 0 {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_TAIL_SAMPLING_SLOW_THRESHOLD, defaulting to %s", config.slowThreshold)
+		} else {
+			config.slowThreshold = threshold
+		}
+	}
+	if getEnv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE") != "" {
+		rate, err := getFloatFromEnv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE")
+		if err != nil || rate < 0 || rate > 1 {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE, defaulting to %v", config.rate)
+		} else {
+			config.rate = rate
+		}
+	}
+	return config
+}
+
+func getRateLimitConfig() rateLimitConfig {
+	var config rateLimitConfig
+	if getEnv("ELASTIC_APM_LAMBDA_MAX_BYTES_PER_INVOCATION") != "" {
+		maxBytes, err := getIntFromEnv("ELASTIC_APM_LAMBDA_MAX_BYTES_PER_INVOCATION")
+		if err != nil || maxBytes < 0 {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_MAX_BYTES_PER_INVOCATION, defaulting to 0")
+		} else {
+			config.maxBytesPerInvocation = int64(maxBytes)
+		}
+	}
+	if getEnv("ELASTIC_APM_LAMBDA_MAX_EVENTS_PER_SECOND") != "" {
+		rate, err := getFloatFromEnv("ELASTIC_APM_LAMBDA_MAX_EVENTS_PER_SECOND")
+		if err != nil || rate < 0 {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_MAX_EVENTS_PER_SECOND, defaulting to 0")
+		} else {
+			config.maxEventsPerSecond = rate
+		}
+	}
+	return config
+}
+
+// getListFromEnv returns the non-empty items of a comma-separated configuration variable.
+func getListFromEnv(name string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getLabelsFromEnv returns the labels of a configuration variable holding comma-separated key=value pairs.
+// Invalid pairs are skipped.
+func getLabelsFromEnv(name string) map[string]string {
+	var labels map[string]string
+	for _, pair := range getListFromEnv(name) {
+		key, value := pair, ""
+		if i := strings.IndexByte(pair, '='); i >= 0 {
+			key, value = strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		}
+		if key == "" || key == pair {
+			Log.Warnf("Could not read label %q of %s, it must be formatted as key=value", pair, name)
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[labelKeyReplacer.Replace(key)] = value
+	}
+	return labels
+}
+
+// getHTTPClientConfig reads the settings of the HTTP client sending data to the APM server. The settings
+// that are not set, or invalid, are left to zero, so that the defaults of the client apply.
+func getHTTPClientConfig() httpClientConfig {
+	var config httpClientConfig
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"ELASTIC_APM_SERVER_TIMEOUT", &config.timeout},
+		{"ELASTIC_APM_SERVER_DIAL_TIMEOUT", &config.dialTimeout},
+		{"ELASTIC_APM_SERVER_TLS_HANDSHAKE_TIMEOUT", &config.tlsHandshakeTimeout},
+		{"ELASTIC_APM_SERVER_IDLE_CONNECTION_TIMEOUT", &config.idleConnTimeout},
+		{"ELASTIC_APM_SERVER_KEEP_ALIVE", &config.keepAlive},
+		{"ELASTIC_APM_SERVER_DNS_CACHE_TTL", &config.dnsCacheTTL},
+	}
+	for _, d := range durations {
+		if getEnv(d.name) == "" {
+			continue
+		}
+		value, err := getDurationFromEnv(d.name)
+		if err != nil || value <= 0 {
+			Log.Warnf("Could not read %s, using the default value", d.name)
+			continue
+		}
+		*d.value = value
+	}
+	if getEnv("ELASTIC_APM_SERVER_MAX_IDLE_CONNECTIONS") != "" {
+		maxIdleConns, err := getIntFromEnv("ELASTIC_APM_SERVER_MAX_IDLE_CONNECTIONS")
+		if err != nil || maxIdleConns <= 0 {
+			Log.Warnf("Could not read ELASTIC_APM_SERVER_MAX_IDLE_CONNECTIONS, using the default value")
+		} else {
+			config.maxIdleConns = maxIdleConns
+		}
+	}
+	tls := tlsSettings{
+		clientCert: getEnv("ELASTIC_APM_SERVER_CLIENT_CERT"),
+		clientKey:  getEnv("ELASTIC_APM_SERVER_CLIENT_KEY"),
+		// ELASTIC_APM_SERVER_CA_CERT_FILE is the name used by the APM agents
+		caCert: getEnv("ELASTIC_APM_SERVER_CA_CERT_FILE"),
+	}
+	if tls.caCert == "" {
+		tls.caCert = getEnv("ELASTIC_APM_SERVER_CA_CERT")
+	}
+	if getEnv("ELASTIC_APM_VERIFY_SERVER_CERT") != "" {
+		verifyServerCert, err := strconv.ParseBool(getEnv("ELASTIC_APM_VERIFY_SERVER_CERT"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_VERIFY_SERVER_CERT, defaulting to true: %v", err)
+		} else {
+			tls.skipVerify = !verifyServerCert
+		}
+	}
+	tlsConfig, err := newTLSConfig(tls)
+	if err != nil {
+		Log.Errorf("Could not configure TLS for the APM server connections, using the default settings: %v", err)
+	} else {
+		config.tlsConfig = tlsConfig
+	}
+	if getEnv("ELASTIC_APM_PROXY_URL") != "" {
+		proxyURL, err := parseProxyURL(getEnv("ELASTIC_APM_PROXY_URL"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_PROXY_URL, using the proxy of the environment: %v", err)
+		} else {
+			config.proxyURL = proxyURL
+		}
+	}
+	return config
+}
+
 type secretManager interface {
 	GetSecretValue(*secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error)
 }
@@ -110,13 +504,109 @@ func ProcessEnv(manager secretManager) *extensionConfig {
 		Log.Warnf("Could not read ELASTIC_APM_DATA_FORWARDER_TIMEOUT_SECONDS, defaulting to %d: %v", dataForwarderTimeoutSeconds, err)
 	}
 
+	// AWS_LAMBDA_FUNCTION_MEMORY_SIZE is automatically set by AWS, and is only missing outside of Lambda.
+	functionMemorySizeMB, err := getIntFromEnv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")
+	if err != nil {
+		functionMemorySizeMB = 0
+		Log.Debugf("Could not read AWS_LAMBDA_FUNCTION_MEMORY_SIZE, the extension memory budget is disabled: %v", err)
+	}
+
+	memoryBudgetPercent := defaultMemoryBudgetPercent
+	if getEnv("ELASTIC_APM_MEMORY_BUDGET_PERCENT") != "" {
+		memoryBudgetPercent, err = getIntFromEnv("ELASTIC_APM_MEMORY_BUDGET_PERCENT")
+		if err != nil || memoryBudgetPercent < 0 || memoryBudgetPercent > 100 {
+			memoryBudgetPercent = defaultMemoryBudgetPercent
+			Log.Warnf("Could not read ELASTIC_APM_MEMORY_BUDGET_PERCENT, defaulting to %d", memoryBudgetPercent)
+		}
+	}
+
+	backoff := defaultBackoffConfig
+	if getEnv("ELASTIC_APM_BACKOFF_MAX_RECONNECTION_COUNT") != "" {
+		backoff.maxReconnectionCount, err = getIntFromEnv("ELASTIC_APM_BACKOFF_MAX_RECONNECTION_COUNT")
+		if err != nil || backoff.maxReconnectionCount < 0 {
+			backoff.maxReconnectionCount = defaultBackoffConfig.maxReconnectionCount
+			Log.Warnf("Could not read ELASTIC_APM_BACKOFF_MAX_RECONNECTION_COUNT, defaulting to %d", backoff.maxReconnectionCount)
+		}
+	}
+	if getEnv("ELASTIC_APM_BACKOFF_MULTIPLIER_SECONDS") != "" {
+		backoff.multiplierSeconds, err = getFloatFromEnv("ELASTIC_APM_BACKOFF_MULTIPLIER_SECONDS")
+		if err != nil || backoff.multiplierSeconds < 0 {
+			backoff.multiplierSeconds = defaultBackoffConfig.multiplierSeconds
+			Log.Warnf("Could not read ELASTIC_APM_BACKOFF_MULTIPLIER_SECONDS, defaulting to %v", backoff.multiplierSeconds)
+		}
+	}
+	if getEnv("ELASTIC_APM_BACKOFF_JITTER") != "" {
+		backoff.jitter, err = getFloatFromEnv("ELASTIC_APM_BACKOFF_JITTER")
+		if err != nil || backoff.jitter < 0 || backoff.jitter > 1 {
+			backoff.jitter = defaultBackoffConfig.jitter
+			Log.Warnf("Could not read ELASTIC_APM_BACKOFF_JITTER, defaulting to %v", backoff.jitter)
+		}
+	}
+
+	spillBufferMaxBytes := defaultSpillBufferMaxBytes
+	if getEnv("ELASTIC_APM_SPILL_BUFFER_MAX_BYTES") != "" {
+		spillBufferMaxBytes, err = getIntFromEnv("ELASTIC_APM_SPILL_BUFFER_MAX_BYTES")
+		if err != nil || spillBufferMaxBytes < 0 {
+			spillBufferMaxBytes = defaultSpillBufferMaxBytes
+			Log.Warnf("Could not read ELASTIC_APM_SPILL_BUFFER_MAX_BYTES, defaulting to %d", spillBufferMaxBytes)
+		}
+	}
+
+	retry := defaultRetryConfig
+	if getEnv("ELASTIC_APM_LAMBDA_MAX_RETRIES") != "" {
+		retry.maxRetries, err = getIntFromEnv("ELASTIC_APM_LAMBDA_MAX_RETRIES")
+		if err != nil || retry.maxRetries < 0 {
+			retry.maxRetries = defaultRetryConfig.maxRetries
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_MAX_RETRIES, defaulting to %d", retry.maxRetries)
+		}
+	}
+	if getEnv("ELASTIC_APM_LAMBDA_RETRY_INITIAL_DELAY") != "" {
+		retry.initialDelay, err = getDurationFromEnv("ELASTIC_APM_LAMBDA_RETRY_INITIAL_DELAY")
+		if err != nil || retry.initialDelay <= 0 {
+			retry.initialDelay = defaultRetryConfig.initialDelay
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_RETRY_INITIAL_DELAY, defaulting to %s", retry.initialDelay)
+		}
+	}
+
+	batchMaxBytes := 0
+	if getEnv("ELASTIC_APM_BATCH_MAX_BYTES") != "" {
+		batchMaxBytes, err = getIntFromEnv("ELASTIC_APM_BATCH_MAX_BYTES")
+		if err != nil || batchMaxBytes < 0 {
+			batchMaxBytes = 0
+			Log.Warnf("Could not read ELASTIC_APM_BATCH_MAX_BYTES, batching is disabled")
+		}
+	}
+
+	batchMaxWaitMs := defaultBatchMaxWaitMs
+	if getEnv("ELASTIC_APM_BATCH_MAX_WAIT_MS") != "" {
+		batchMaxWaitMs, err = getIntFromEnv("ELASTIC_APM_BATCH_MAX_WAIT_MS")
+		if err != nil || batchMaxWaitMs < 0 {
+			batchMaxWaitMs = defaultBatchMaxWaitMs
+			Log.Warnf("Could not read ELASTIC_APM_BATCH_MAX_WAIT_MS, defaulting to %d", batchMaxWaitMs)
+		}
+	}
+
 	// add trailing slash to server name if missing
-	normalizedApmLambdaServer := os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER")
+	normalizedApmLambdaServer := getEnv("ELASTIC_APM_LAMBDA_APM_SERVER")
 	if normalizedApmLambdaServer != "" && normalizedApmLambdaServer[len(normalizedApmLambdaServer)-1:] != "/" {
 		normalizedApmLambdaServer = normalizedApmLambdaServer + "/"
 	}
 
-	logLevel, err := ParseLogLevel(strings.ToLower(os.Getenv("ELASTIC_APM_LOG_LEVEL")))
+	apmServerFallbackUrl := getEnv("ELASTIC_APM_LAMBDA_APM_SERVER_FALLBACK")
+	if apmServerFallbackUrl != "" && !strings.HasSuffix(apmServerFallbackUrl, "/") {
+		apmServerFallbackUrl = apmServerFallbackUrl + "/"
+	}
+
+	fallbackProbeInterval := defaultFallbackProbeInterval
+	if getEnv("ELASTIC_APM_FALLBACK_PROBE_INTERVAL") != "" {
+		fallbackProbeInterval, err = getDurationFromEnv("ELASTIC_APM_FALLBACK_PROBE_INTERVAL")
+		if err != nil || fallbackProbeInterval <= 0 {
+			fallbackProbeInterval = defaultFallbackProbeInterval
+			Log.Warnf("Could not read ELASTIC_APM_FALLBACK_PROBE_INTERVAL, defaulting to %s", fallbackProbeInterval)
+		}
+	}
+
+	logLevel, err := ParseLogLevel(strings.ToLower(getEnv("ELASTIC_APM_LOG_LEVEL")))
 	if err != nil {
 		logLevel = zapcore.InfoLevel
 		Log.Warnf("Could not read ELASTIC_APM_LOG_LEVEL, defaulting to %s", logLevel)
@@ -124,13 +614,361 @@ func ProcessEnv(manager secretManager) *extensionConfig {
 
 	// Get the send strategy, convert to lowercase
 	normalizedSendStrategy := SyncFlush
-	sendStrategy := strings.ToLower(os.Getenv("ELASTIC_APM_SEND_STRATEGY"))
-	if sendStrategy == string(Background) {
-		normalizedSendStrategy = Background
+	sendStrategy := strings.ToLower(getEnv("ELASTIC_APM_SEND_STRATEGY"))
+	switch SendStrategy(sendStrategy) {
+	case Background, Adaptive, FlushOnNext:
+		normalizedSendStrategy = SendStrategy(sendStrategy)
+	}
+
+	flushOnNextMaxAge := defaultFlushOnNextMaxAge
+	if getEnv("ELASTIC_APM_FLUSH_ON_NEXT_MAX_AGE") != "" {
+		flushOnNextMaxAge, err = getDurationFromEnv("ELASTIC_APM_FLUSH_ON_NEXT_MAX_AGE")
+		if err != nil || flushOnNextMaxAge <= 0 {
+			flushOnNextMaxAge = defaultFlushOnNextMaxAge
+			Log.Warnf("Could not read ELASTIC_APM_FLUSH_ON_NEXT_MAX_AGE, defaulting to %s", flushOnNextMaxAge)
+		}
 	}
 
-	apmServerApiKey := os.Getenv("ELASTIC_APM_API_KEY")
-	apmServerApiKeySMSecretId := os.Getenv("ELASTIC_APM_SECRETS_MANAGER_API_KEY_ID")
+	adaptiveMaxDelay := defaultAdaptiveMaxDelay
+	if getEnv("ELASTIC_APM_ADAPTIVE_MAX_DELAY") != "" {
+		adaptiveMaxDelay, err = getDurationFromEnv("ELASTIC_APM_ADAPTIVE_MAX_DELAY")
+		if err != nil || adaptiveMaxDelay <= 0 {
+			adaptiveMaxDelay = defaultAdaptiveMaxDelay
+			Log.Warnf("Could not read ELASTIC_APM_ADAPTIVE_MAX_DELAY, defaulting to %s", adaptiveMaxDelay)
+		}
+	}
+
+	dataForwarderMode := BufferMode
+	if mode := strings.ToLower(getEnv("ELASTIC_APM_DATA_FORWARDER_MODE")); mode != "" {
+		switch DataForwarderMode(mode) {
+		case BufferMode, StreamMode:
+			dataForwarderMode = DataForwarderMode(mode)
+		default:
+			Log.Warnf("Could not read ELASTIC_APM_DATA_FORWARDER_MODE, defaulting to %s", dataForwarderMode)
+		}
+	}
+
+	output := ApmServerOutput
+	if value := strings.ToLower(getEnv("ELASTIC_APM_LAMBDA_OUTPUT")); value != "" {
+		switch Output(value) {
+		case ApmServerOutput, KinesisOutput, FirehoseOutput:
+			output = Output(value)
+		default:
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_OUTPUT, defaulting to %s", output)
+		}
+	}
+	outputStream := getEnv("ELASTIC_APM_LAMBDA_OUTPUT_STREAM")
+	if output != ApmServerOutput && outputStream == "" {
+		Log.Warnf("ELASTIC_APM_LAMBDA_OUTPUT_STREAM not specified, sending the agent data to the APM server")
+		output = ApmServerOutput
+	}
+
+	dataBufferSize := defaultDataBufferSize
+	if getEnv("ELASTIC_APM_DATA_BUFFER_SIZE") != "" {
+		dataBufferSize, err = getIntFromEnv("ELASTIC_APM_DATA_BUFFER_SIZE")
+		if err != nil || dataBufferSize <= 0 {
+			dataBufferSize = defaultDataBufferSize
+			Log.Warnf("Could not read ELASTIC_APM_DATA_BUFFER_SIZE, defaulting to %d", dataBufferSize)
+		}
+	}
+
+	dataBufferPolicy := DropNewest
+	if policy := strings.ToLower(getEnv("ELASTIC_APM_DATA_BUFFER_POLICY")); policy != "" {
+		switch BufferPolicy(policy) {
+		case DropNewest, DropOldest, Block, Reject:
+			dataBufferPolicy = BufferPolicy(policy)
+		default:
+			Log.Warnf("Could not read ELASTIC_APM_DATA_BUFFER_POLICY, defaulting to %s", dataBufferPolicy)
+		}
+	}
+
+	strictDelivery := false
+	if getEnv("ELASTIC_APM_STRICT_DELIVERY") != "" {
+		strictDelivery, err = strconv.ParseBool(getEnv("ELASTIC_APM_STRICT_DELIVERY"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_STRICT_DELIVERY, defaulting to false: %v", err)
+		}
+	}
+
+	atomicFlush := false
+	if getEnv("ELASTIC_APM_LAMBDA_ATOMIC_FLUSH") != "" {
+		atomicFlush, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_ATOMIC_FLUSH"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_ATOMIC_FLUSH, defaulting to false: %v", err)
+		}
+	}
+
+	nearTimeoutRatio := defaultNearTimeoutRatio
+	if getEnv("ELASTIC_APM_LAMBDA_NEAR_TIMEOUT_RATIO") != "" {
+		nearTimeoutRatio, err = getFloatFromEnv("ELASTIC_APM_LAMBDA_NEAR_TIMEOUT_RATIO")
+		if err != nil || nearTimeoutRatio < 0 || nearTimeoutRatio > 1 {
+			nearTimeoutRatio = defaultNearTimeoutRatio
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_NEAR_TIMEOUT_RATIO, defaulting to %v", nearTimeoutRatio)
+		}
+	}
+
+	legacyServerCompat := LegacyCompatAuto
+	if value := strings.ToLower(getEnv("ELASTIC_APM_LAMBDA_LEGACY_SERVER_COMPAT")); value != "" {
+		switch LegacyServerCompat(value) {
+		case LegacyCompatAuto, LegacyCompatAlways, LegacyCompatNever:
+			legacyServerCompat = LegacyServerCompat(value)
+		default:
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_LEGACY_SERVER_COMPAT, defaulting to %s", legacyServerCompat)
+		}
+	}
+
+	platformTransactions := false
+	if getEnv("ELASTIC_APM_LAMBDA_PLATFORM_TRANSACTIONS") != "" {
+		platformTransactions, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_PLATFORM_TRANSACTIONS"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_PLATFORM_TRANSACTIONS, defaulting to false: %v", err)
+		}
+	}
+
+	relayIntakeErrors := false
+	if getEnv("ELASTIC_APM_LAMBDA_RELAY_INTAKE_ERRORS") != "" {
+		relayIntakeErrors, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_RELAY_INTAKE_ERRORS"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_RELAY_INTAKE_ERRORS, defaulting to false: %v", err)
+		}
+	}
+
+	sourceMapMaxBytes := defaultSourceMapMaxBytes
+	if getEnv("ELASTIC_APM_LAMBDA_SOURCE_MAP_MAX_BYTES") != "" {
+		sourceMapMaxBytes, err = getIntFromEnv("ELASTIC_APM_LAMBDA_SOURCE_MAP_MAX_BYTES")
+		if err != nil || sourceMapMaxBytes <= 0 {
+			sourceMapMaxBytes = defaultSourceMapMaxBytes
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_SOURCE_MAP_MAX_BYTES, defaulting to %d", sourceMapMaxBytes)
+		}
+	}
+
+	reportTimeouts := true
+	if getEnv("ELASTIC_APM_LAMBDA_REPORT_TIMEOUTS") != "" {
+		reportTimeouts, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_REPORT_TIMEOUTS"))
+		if err != nil {
+			reportTimeouts = true
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_REPORT_TIMEOUTS, defaulting to true: %v", err)
+		}
+	}
+
+	selfMetricsInvocations := 0
+	if getEnv("ELASTIC_APM_LAMBDA_SELF_METRICS_INVOCATIONS") != "" {
+		selfMetricsInvocations, err = getIntFromEnv("ELASTIC_APM_LAMBDA_SELF_METRICS_INVOCATIONS")
+		if err != nil || selfMetricsInvocations < 0 {
+			selfMetricsInvocations = 0
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_SELF_METRICS_INVOCATIONS, self-monitoring metrics are disabled")
+		}
+	}
+
+	debugLogSampling := 0
+	if getEnv("ELASTIC_APM_LAMBDA_DEBUG_LOG_SAMPLING") != "" {
+		debugLogSampling, err = getIntFromEnv("ELASTIC_APM_LAMBDA_DEBUG_LOG_SAMPLING")
+		if err != nil || debugLogSampling < 0 {
+			debugLogSampling = 0
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_DEBUG_LOG_SAMPLING, debug log sampling is disabled")
+		}
+	}
+
+	retryRejectedEvents := false
+	if getEnv("ELASTIC_APM_RETRY_REJECTED_EVENTS") != "" {
+		retryRejectedEvents, err = strconv.ParseBool(getEnv("ELASTIC_APM_RETRY_REJECTED_EVENTS"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_RETRY_REJECTED_EVENTS, defaulting to false: %v", err)
+		}
+	}
+
+	syntheticTransactions := false
+	if getEnv("ELASTIC_APM_SYNTHETIC_TRANSACTIONS") != "" {
+		syntheticTransactions, err = strconv.ParseBool(getEnv("ELASTIC_APM_SYNTHETIC_TRANSACTIONS"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_SYNTHETIC_TRANSACTIONS, defaulting to false: %v", err)
+		}
+	}
+
+	flushMetricsEMF := false
+	if getEnv("ELASTIC_APM_LAMBDA_FLUSH_METRICS_EMF") != "" {
+		flushMetricsEMF, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_FLUSH_METRICS_EMF"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_FLUSH_METRICS_EMF, defaulting to false: %v", err)
+		}
+	}
+
+	var configWatchInterval time.Duration
+	if getEnv("ELASTIC_APM_CONFIG_WATCH_INTERVAL") != "" {
+		configWatchInterval, err = getDurationFromEnv("ELASTIC_APM_CONFIG_WATCH_INTERVAL")
+		if err != nil || configWatchInterval < 0 {
+			configWatchInterval = 0
+			Log.Warnf("Could not read ELASTIC_APM_CONFIG_WATCH_INTERVAL, defaulting to %s", configWatchInterval)
+		}
+	}
+
+	certExpiryWarning := defaultCertExpiryWarning
+	if getEnv("ELASTIC_APM_SERVER_CERT_EXPIRY_WARNING") != "" {
+		certExpiryWarning, err = getDurationFromEnv("ELASTIC_APM_SERVER_CERT_EXPIRY_WARNING")
+		if err != nil || certExpiryWarning < 0 {
+			certExpiryWarning = defaultCertExpiryWarning
+			Log.Warnf("Could not read ELASTIC_APM_SERVER_CERT_EXPIRY_WARNING, defaulting to %s", certExpiryWarning)
+		}
+	}
+
+	var centralConfigInterval time.Duration
+	if getEnv("ELASTIC_APM_CENTRAL_CONFIG_POLL_INTERVAL") != "" {
+		centralConfigInterval, err = getDurationFromEnv("ELASTIC_APM_CENTRAL_CONFIG_POLL_INTERVAL")
+		if err != nil || centralConfigInterval < 0 {
+			centralConfigInterval = 0
+			Log.Warnf("Could not read ELASTIC_APM_CENTRAL_CONFIG_POLL_INTERVAL, defaulting to %s", centralConfigInterval)
+		}
+	}
+
+	runtimeQuirks := DetectRuntimeQuirks()
+	if getEnv("ELASTIC_APM_FLUSH_DEADLINE_MARGIN") != "" {
+		deadlineMargin, err := getDurationFromEnv("ELASTIC_APM_FLUSH_DEADLINE_MARGIN")
+		if err != nil || deadlineMargin < 0 {
+			Log.Warnf("Could not read ELASTIC_APM_FLUSH_DEADLINE_MARGIN, defaulting to %s", runtimeQuirks.DeadlineMargin)
+		} else {
+			runtimeQuirks.DeadlineMargin = deadlineMargin
+		}
+	}
+	if getEnv("ELASTIC_APM_AGENT_DONE_WAIT") != "" {
+		agentDoneWait, err := getDurationFromEnv("ELASTIC_APM_AGENT_DONE_WAIT")
+		if err != nil || agentDoneWait < 0 {
+			Log.Warnf("Could not read ELASTIC_APM_AGENT_DONE_WAIT, defaulting to %s", runtimeQuirks.AgentDoneWait)
+		} else {
+			runtimeQuirks.AgentDoneWait = agentDoneWait
+		}
+	}
+
+	logFormat := JSONLogFormat
+	if getEnv("ELASTIC_APM_LOG_FORMAT") != "" {
+		switch format := LogFormat(strings.ToLower(getEnv("ELASTIC_APM_LOG_FORMAT"))); format {
+		case JSONLogFormat, TextLogFormat:
+			logFormat = format
+		default:
+			Log.Warnf("Could not read ELASTIC_APM_LOG_FORMAT, defaulting to %s", logFormat)
+		}
+	}
+
+	metadataEnrichment := true
+	if getEnv("ELASTIC_APM_LAMBDA_METADATA_ENRICHMENT") != "" {
+		metadataEnrichment, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_METADATA_ENRICHMENT"))
+		if err != nil {
+			metadataEnrichment = true
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_METADATA_ENRICHMENT, defaulting to true: %v", err)
+		}
+	}
+
+	var xrayLinks bool
+	if getEnv("ELASTIC_APM_LAMBDA_XRAY_LINKS") != "" {
+		xrayLinks, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_XRAY_LINKS"))
+		if err != nil {
+			xrayLinks = false
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_XRAY_LINKS, defaulting to false: %v", err)
+		}
+	}
+
+	var runtimeAPIProxy bool
+	if getEnv("ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY") != "" {
+		runtimeAPIProxy, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY"))
+		if err != nil {
+			runtimeAPIProxy = false
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY, defaulting to false: %v", err)
+		}
+	}
+	runtimeAPIProxyPort := getEnv("ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY_PORT")
+	if runtimeAPIProxyPort == "" {
+		runtimeAPIProxyPort = defaultRuntimeAPIProxyPort
+	}
+
+	collectorsInterval := defaultCollectorsInterval
+	if getEnv("ELASTIC_APM_LAMBDA_COLLECTORS_INTERVAL") != "" {
+		collectorsInterval, err = getDurationFromEnv("ELASTIC_APM_LAMBDA_COLLECTORS_INTERVAL")
+		if err != nil || collectorsInterval <= 0 {
+			collectorsInterval = defaultCollectorsInterval
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_COLLECTORS_INTERVAL, defaulting to %s", collectorsInterval)
+		}
+	}
+
+	var validateIntake bool
+	if getEnv("ELASTIC_APM_LAMBDA_VALIDATE_INTAKE") != "" {
+		validateIntake, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_VALIDATE_INTAKE"))
+		if err != nil {
+			validateIntake = false
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_VALIDATE_INTAKE, defaulting to false: %v", err)
+		}
+	}
+
+	maxInFlightRequests := defaultMaxInFlightRequests
+	if getEnv("ELASTIC_APM_MAX_IN_FLIGHT_REQUESTS") != "" {
+		maxInFlightRequests, err = getIntFromEnv("ELASTIC_APM_MAX_IN_FLIGHT_REQUESTS")
+		if err != nil || maxInFlightRequests < 1 {
+			maxInFlightRequests = defaultMaxInFlightRequests
+			Log.Warnf("Could not read ELASTIC_APM_MAX_IN_FLIGHT_REQUESTS, defaulting to %d", maxInFlightRequests)
+		}
+	}
+
+	var sanitize bool
+	if getEnv("ELASTIC_APM_LAMBDA_SANITIZE") != "" {
+		sanitize, err = strconv.ParseBool(getEnv("ELASTIC_APM_LAMBDA_SANITIZE"))
+		if err != nil {
+			sanitize = false
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_SANITIZE, defaulting to false: %v", err)
+		}
+	}
+
+	metricsFileMaxBytes := defaultMetricsFileMaxBytes
+	if getEnv("ELASTIC_APM_LAMBDA_METRICS_FILE_MAX_BYTES") != "" {
+		metricsFileMaxBytes, err = getIntFromEnv("ELASTIC_APM_LAMBDA_METRICS_FILE_MAX_BYTES")
+		if err != nil || metricsFileMaxBytes <= 0 {
+			metricsFileMaxBytes = defaultMetricsFileMaxBytes
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_METRICS_FILE_MAX_BYTES, defaulting to %d", metricsFileMaxBytes)
+		}
+	}
+
+	maxEventSize := defaultMaxEventSize
+	if getEnv("ELASTIC_APM_LAMBDA_MAX_EVENT_SIZE") != "" {
+		maxEventSize, err = getIntFromEnv("ELASTIC_APM_LAMBDA_MAX_EVENT_SIZE")
+		if err != nil || maxEventSize <= 0 {
+			maxEventSize = defaultMaxEventSize
+			Log.Warnf("Could not read ELASTIC_APM_LAMBDA_MAX_EVENT_SIZE, defaulting to %d", maxEventSize)
+		}
+	}
+
+	// AWS_LAMBDA_FUNCTION_NAME, AWS_LAMBDA_FUNCTION_VERSION, AWS_LAMBDA_LOG_STREAM_NAME and AWS_REGION are
+	// automatically set by AWS.
+	functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	serviceName := getEnv("ELASTIC_APM_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = functionName
+	}
+
+	sendFunctionLogs := false
+	if getEnv("ELASTIC_APM_SEND_FUNCTION_LOGS") != "" {
+		sendFunctionLogs, err = strconv.ParseBool(getEnv("ELASTIC_APM_SEND_FUNCTION_LOGS"))
+		if err != nil {
+			Log.Warnf("Could not read ELASTIC_APM_SEND_FUNCTION_LOGS, defaulting to false: %v", err)
+		}
+	}
+
+	slowFlushThresholdMs := 0
+	if getEnv("ELASTIC_APM_SLOW_FLUSH_THRESHOLD_MS") != "" {
+		slowFlushThresholdMs, err = getIntFromEnv("ELASTIC_APM_SLOW_FLUSH_THRESHOLD_MS")
+		if err != nil || slowFlushThresholdMs < 0 {
+			slowFlushThresholdMs = 0
+			Log.Warnf("Could not read ELASTIC_APM_SLOW_FLUSH_THRESHOLD_MS, slow flush profiling is disabled")
+		}
+	}
+
+	slowFlushProfileDurationMs := defaultSlowFlushProfileDurationMs
+	if getEnv("ELASTIC_APM_SLOW_FLUSH_PROFILE_DURATION_MS") != "" {
+		slowFlushProfileDurationMs, err = getIntFromEnv("ELASTIC_APM_SLOW_FLUSH_PROFILE_DURATION_MS")
+		if err != nil || slowFlushProfileDurationMs <= 0 {
+			slowFlushProfileDurationMs = defaultSlowFlushProfileDurationMs
+			Log.Warnf("Could not read ELASTIC_APM_SLOW_FLUSH_PROFILE_DURATION_MS, defaulting to %d", slowFlushProfileDurationMs)
+		}
+	}
+
+	apmServerApiKey := getEnv("ELASTIC_APM_API_KEY")
+	apmServerApiKeySMSecretId := getEnv("ELASTIC_APM_SECRETS_MANAGER_API_KEY_ID")
 	if apmServerApiKeySMSecretId != "" {
 		result, err := getSecret(manager, apmServerApiKeySMSecretId)
 		if err != nil {
@@ -140,8 +978,8 @@ func ProcessEnv(manager secretManager) *extensionConfig {
 		apmServerApiKey = result
 	}
 
-	apmServerSecretToken := os.Getenv("ELASTIC_APM_SECRET_TOKEN")
-	apmServerSecretTokenSMSecretId := os.Getenv("ELASTIC_APM_SECRETS_MANAGER_SECRET_TOKEN_ID")
+	apmServerSecretToken := getEnv("ELASTIC_APM_SECRET_TOKEN")
+	apmServerSecretTokenSMSecretId := getEnv("ELASTIC_APM_SECRETS_MANAGER_SECRET_TOKEN_ID")
 	if apmServerSecretTokenSMSecretId != "" {
 		result, err := getSecret(manager, apmServerSecretTokenSMSecretId)
 		if err != nil {
@@ -152,20 +990,100 @@ func ProcessEnv(manager secretManager) *extensionConfig {
 	}
 
 	config := &extensionConfig{
-		apmServerUrl:                normalizedApmLambdaServer,
-		apmServerSecretToken:        apmServerSecretToken,
-		apmServerApiKey:             apmServerApiKey,
-		dataReceiverServerPort:      fmt.Sprintf(":%s", os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT")),
-		SendStrategy:                normalizedSendStrategy,
-		dataReceiverTimeoutSeconds:  dataReceiverTimeoutSeconds,
-		DataForwarderTimeoutSeconds: dataForwarderTimeoutSeconds,
-		LogLevel:                    logLevel,
+		apmServerUrl:                   normalizedApmLambdaServer,
+		apmServerFallbackUrl:           apmServerFallbackUrl,
+		apmServerFallbackApiKey:        getEnv("ELASTIC_APM_FALLBACK_API_KEY"),
+		apmServerFallbackSecretToken:   getEnv("ELASTIC_APM_FALLBACK_SECRET_TOKEN"),
+		fallbackProbeInterval:          fallbackProbeInterval,
+		apmServerSecretToken:           apmServerSecretToken,
+		apmServerApiKey:                apmServerApiKey,
+		secretManager:                  manager,
+		apmServerApiKeySMSecretId:      apmServerApiKeySMSecretId,
+		apmServerSecretTokenSMSecretId: apmServerSecretTokenSMSecretId,
+		dataReceiverServerAddress:      getDataReceiverServerAddress(),
+		dataReceiverServerPort:         fmt.Sprintf(":%s", getEnv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT")),
+		dataReceiverSocket:             getEnv("ELASTIC_APM_DATA_RECEIVER_SOCKET"),
+		certExpiryWarning:              certExpiryWarning,
+		SendStrategy:                   normalizedSendStrategy,
+		dataForwarderMode:              dataForwarderMode,
+		dataBufferSize:                 dataBufferSize,
+		dataBufferPolicy:               dataBufferPolicy,
+		dataReceiverTimeoutSeconds:     dataReceiverTimeoutSeconds,
+		DataForwarderTimeoutSeconds:    dataForwarderTimeoutSeconds,
+		httpClient:                     getHTTPClientConfig(),
+		LogLevel:                       logLevel,
+		LogFormat:                      logFormat,
+		functionMemorySizeMB:           functionMemorySizeMB,
+		memoryBudgetPercent:            memoryBudgetPercent,
+		StrictDelivery:                 strictDelivery,
+		retryRejectedEvents:            retryRejectedEvents,
+		SendFunctionLogs:               sendFunctionLogs,
+		slowFlushThresholdMs:           slowFlushThresholdMs,
+		slowFlushProfileDurationMs:     slowFlushProfileDurationMs,
+		backoff:                        backoff,
+		compression:                    getCompressionConfig(),
+		spillDir:                       filepath.Join(os.TempDir(), "elastic-apm-lambda-extension"),
+		spillBufferMaxBytes:            int64(spillBufferMaxBytes),
+		batchMaxBytes:                  batchMaxBytes,
+		batchMaxWaitMs:                 batchMaxWaitMs,
+		syntheticTransactions:          syntheticTransactions,
+		flushMetricsEMF:                flushMetricsEMF,
+		reportTimeouts:                 reportTimeouts,
+		selfMetricsInvocations:         selfMetricsInvocations,
+		debugLogSampling:               debugLogSampling,
+		serviceName:                    serviceName,
+		functionName:                   functionName,
+		functionVersion:                os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+		configWatchInterval:            configWatchInterval,
+		centralConfigInterval:          centralConfigInterval,
+		environment:                    getEnv("ELASTIC_APM_ENVIRONMENT"),
+		configSSMParameter:             getEnv("ELASTIC_APM_CONFIG_SSM_PARAMETER"),
+		tagsAsLabels:                   getListFromEnv("ELASTIC_APM_LAMBDA_TAGS_AS_LABELS"),
+		RuntimeQuirks:                  runtimeQuirks,
+		ShortTimeout:                   getShortTimeout(),
+		ExtensionName:                  getEnv("ELASTIC_APM_LAMBDA_EXTENSION_NAME"),
+		metadataEnrichment:             metadataEnrichment,
+		xrayLinks:                      xrayLinks,
+		runtimeAPIProxy:                runtimeAPIProxy,
+		runtimeAPIProxyPort:            runtimeAPIProxyPort,
+		collectors:                     getListFromEnv("ELASTIC_APM_LAMBDA_COLLECTORS"),
+		collectorsInterval:             collectorsInterval,
+		validateIntake:                 validateIntake,
+		maxInFlightRequests:            maxInFlightRequests,
+		sanitize:                       sanitize,
+		sanitizeFieldNames:             getListFromEnv("ELASTIC_APM_SANITIZE_FIELD_NAMES"),
+		filterEventTypes:               getListFromEnv("ELASTIC_APM_FILTER_EVENT_TYPES"),
+		tailSampling:                   getTailSamplingConfig(),
+		metricsFilePath:                getEnv("ELASTIC_APM_LAMBDA_METRICS_FILE"),
+		metricsFileMaxBytes:            int64(metricsFileMaxBytes),
+		rateLimit:                      getRateLimitConfig(),
+		globalLabels:                   getLabelsFromEnv("ELASTIC_APM_GLOBAL_LABELS"),
+		region:                         os.Getenv("AWS_REGION"),
+		logStreamName:                  os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME"),
+		output:                         output,
+		outputStream:                   outputStream,
+		truncateFields:                 getListFromEnv("ELASTIC_APM_LAMBDA_TRUNCATE_FIELDS"),
+		maxEventSize:                   maxEventSize,
+		dlqSQSURL:                      getEnv("ELASTIC_APM_DLQ_SQS_URL"),
+		adaptiveMaxDelay:               adaptiveMaxDelay,
+		flushOnNextMaxAge:              flushOnNextMaxAge,
+		Features:                       getFeatureFlags(buildinfo.Channel()),
+		retry:                          retry,
+		atomicFlush:                    atomicFlush,
+		sourceMapMaxBytes:              int64(sourceMapMaxBytes),
+		relayIntakeErrors:              relayIntakeErrors,
+		nearTimeoutRatio:               nearTimeoutRatio,
+		platformTransactions:           platformTransactions,
+		legacyServerCompat:             legacyServerCompat,
+		legacyStripFields:              getListFromEnv("ELASTIC_APM_LAMBDA_LEGACY_SERVER_STRIP_FIELDS"),
 	}
+	config.applyFeatureFlags()
 
 	if config.dataReceiverServerPort == ":" {
 		config.dataReceiverServerPort = ":8200"
 	}
-	if config.apmServerUrl == "" {
+	// The APM server is reached by the consumer of the stream with the other outputs
+	if config.apmServerUrl == "" && config.output == ApmServerOutput {
 		Log.Fatal("please set ELASTIC_APM_LAMBDA_APM_SERVER, exiting")
 	}
 	if config.apmServerSecretToken == "" && config.apmServerApiKey == "" {
@@ -174,3 +1092,18 @@ func ProcessEnv(manager secretManager) *extensionConfig {
 
 	return config
 }
+
+// dataReceiverListenAddress returns the address on which the extension listens for the data of the agents.
+func (config *extensionConfig) dataReceiverListenAddress() string {
+	return config.dataReceiverServerAddress + config.dataReceiverServerPort
+}
+
+// getDataReceiverServerAddress returns the host on which the extension listens for the data of the agents,
+// which is empty to listen on all the interfaces. IPv6 addresses are enclosed in brackets.
+func getDataReceiverServerAddress() string {
+	address := getEnv("ELASTIC_APM_DATA_RECEIVER_SERVER_ADDRESS")
+	if strings.Contains(address, ":") && !strings.HasPrefix(address, "[") {
+		return "[" + address + "]"
+	}
+	return address
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/stretchr/testify/assert"
@@ -233,3 +234,300 @@ func (s *mockSecretManager) GetSecretValue(input *secretsmanager.GetSecretValueI
 		return nil, fmt.Errorf("unrecognized secret input value %s", s)
 	}
 }
+
+func TestProcessEnvMemoryBudget(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", "512")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 512, config.functionMemorySizeMB)
+	assert.Equal(t, 0, config.memoryBudgetPercent)
+
+	t.Setenv("ELASTIC_APM_MEMORY_BUDGET_PERCENT", "25")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 25, config.memoryBudgetPercent)
+
+	t.Setenv("ELASTIC_APM_MEMORY_BUDGET_PERCENT", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 0, config.memoryBudgetPercent)
+
+	t.Setenv("ELASTIC_APM_MEMORY_BUDGET_PERCENT", "150")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 0, config.memoryBudgetPercent)
+}
+
+func TestProcessEnvStrictDelivery(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.StrictDelivery)
+
+	t.Setenv("ELASTIC_APM_STRICT_DELIVERY", "true")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.StrictDelivery)
+
+	t.Setenv("ELASTIC_APM_STRICT_DELIVERY", "invalid")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.StrictDelivery)
+}
+
+func TestProcessEnvAtomicFlush(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.atomicFlush)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_ATOMIC_FLUSH", "true")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.atomicFlush)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_ATOMIC_FLUSH", "invalid")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.atomicFlush)
+}
+
+func TestProcessEnvBackoff(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultBackoffConfig, config.backoff)
+
+	t.Setenv("ELASTIC_APM_BACKOFF_MAX_RECONNECTION_COUNT", "2")
+	t.Setenv("ELASTIC_APM_BACKOFF_MULTIPLIER_SECONDS", "0.5")
+	t.Setenv("ELASTIC_APM_BACKOFF_JITTER", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, backoffConfig{maxReconnectionCount: 2, multiplierSeconds: 0.5, jitter: 0}, config.backoff)
+
+	t.Setenv("ELASTIC_APM_BACKOFF_MAX_RECONNECTION_COUNT", "-1")
+	t.Setenv("ELASTIC_APM_BACKOFF_MULTIPLIER_SECONDS", "invalid")
+	t.Setenv("ELASTIC_APM_BACKOFF_JITTER", "2")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultBackoffConfig, config.backoff)
+}
+
+func TestProcessEnvRetry(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultRetryConfig, config.retry)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_RETRIES", "0")
+	t.Setenv("ELASTIC_APM_LAMBDA_RETRY_INITIAL_DELAY", "50ms")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, retryConfig{maxRetries: 0, initialDelay: 50 * time.Millisecond}, config.retry)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_RETRIES", "-1")
+	t.Setenv("ELASTIC_APM_LAMBDA_RETRY_INITIAL_DELAY", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultRetryConfig, config.retry)
+}
+
+func TestProcessEnvSpillBuffer(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("TMPDIR", "/tmp")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, int64(defaultSpillBufferMaxBytes), config.spillBufferMaxBytes)
+	assert.Equal(t, "/tmp/elastic-apm-lambda-extension", config.spillDir)
+
+	t.Setenv("ELASTIC_APM_SPILL_BUFFER_MAX_BYTES", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, int64(0), config.spillBufferMaxBytes)
+
+	t.Setenv("ELASTIC_APM_SPILL_BUFFER_MAX_BYTES", "invalid")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, int64(defaultSpillBufferMaxBytes), config.spillBufferMaxBytes)
+}
+
+func TestProcessEnvSendFunctionLogs(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.SendFunctionLogs)
+
+	t.Setenv("ELASTIC_APM_SEND_FUNCTION_LOGS", "true")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.SendFunctionLogs)
+}
+
+func TestProcessEnvDataForwarderMode(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, BufferMode, config.dataForwarderMode)
+
+	t.Setenv("ELASTIC_APM_DATA_FORWARDER_MODE", "Stream")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, StreamMode, config.dataForwarderMode)
+
+	t.Setenv("ELASTIC_APM_DATA_FORWARDER_MODE", "invalid")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, BufferMode, config.dataForwarderMode)
+}
+
+func TestProcessEnvDataBuffer(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultDataBufferSize, config.dataBufferSize)
+	assert.Equal(t, DropNewest, config.dataBufferPolicy)
+
+	t.Setenv("ELASTIC_APM_DATA_BUFFER_SIZE", "500")
+	t.Setenv("ELASTIC_APM_DATA_BUFFER_POLICY", "REJECT")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 500, config.dataBufferSize)
+	assert.Equal(t, Reject, config.dataBufferPolicy)
+
+	t.Setenv("ELASTIC_APM_DATA_BUFFER_SIZE", "0")
+	t.Setenv("ELASTIC_APM_DATA_BUFFER_POLICY", "invalid")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultDataBufferSize, config.dataBufferSize)
+	assert.Equal(t, DropNewest, config.dataBufferPolicy)
+}
+
+func TestProcessEnvBatching(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 0, config.batchMaxBytes)
+	assert.Equal(t, defaultBatchMaxWaitMs, config.batchMaxWaitMs)
+
+	t.Setenv("ELASTIC_APM_BATCH_MAX_BYTES", "1048576")
+	t.Setenv("ELASTIC_APM_BATCH_MAX_WAIT_MS", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 1048576, config.batchMaxBytes)
+	assert.Equal(t, 0, config.batchMaxWaitMs)
+
+	t.Setenv("ELASTIC_APM_BATCH_MAX_BYTES", "-1")
+	t.Setenv("ELASTIC_APM_BATCH_MAX_WAIT_MS", "invalid")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 0, config.batchMaxBytes)
+	assert.Equal(t, defaultBatchMaxWaitMs, config.batchMaxWaitMs)
+}
+
+func TestProcessEnvSyntheticTransactions(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	t.Setenv("AWS_LAMBDA_FUNCTION_VERSION", "3")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.syntheticTransactions)
+	assert.Equal(t, "my-function", config.serviceName)
+	assert.Equal(t, "my-function", config.functionName)
+	assert.Equal(t, "3", config.functionVersion)
+
+	t.Setenv("ELASTIC_APM_SYNTHETIC_TRANSACTIONS", "true")
+	t.Setenv("ELASTIC_APM_SERVICE_NAME", "my-service")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.syntheticTransactions)
+	assert.Equal(t, "my-service", config.serviceName)
+}
+
+func TestProcessEnvHTTPClient(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, httpClientConfig{}, config.httpClient)
+
+	t.Setenv("ELASTIC_APM_SERVER_TIMEOUT", "1500ms")
+	t.Setenv("ELASTIC_APM_SERVER_DIAL_TIMEOUT", "2")
+	t.Setenv("ELASTIC_APM_SERVER_TLS_HANDSHAKE_TIMEOUT", "3s")
+	t.Setenv("ELASTIC_APM_SERVER_IDLE_CONNECTION_TIMEOUT", "1m")
+	t.Setenv("ELASTIC_APM_SERVER_KEEP_ALIVE", "15s")
+	t.Setenv("ELASTIC_APM_SERVER_MAX_IDLE_CONNECTIONS", "8")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, httpClientConfig{
+		timeout:             1500 * time.Millisecond,
+		dialTimeout:         2 * time.Second,
+		tlsHandshakeTimeout: 3 * time.Second,
+		maxIdleConns:        8,
+		idleConnTimeout:     time.Minute,
+		keepAlive:           15 * time.Second,
+	}, config.httpClient)
+
+	t.Setenv("ELASTIC_APM_SERVER_TIMEOUT", "invalid")
+	t.Setenv("ELASTIC_APM_SERVER_DIAL_TIMEOUT", "-1s")
+	t.Setenv("ELASTIC_APM_SERVER_MAX_IDLE_CONNECTIONS", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, time.Duration(0), config.httpClient.timeout)
+	assert.Equal(t, time.Duration(0), config.httpClient.dialTimeout)
+	assert.Equal(t, 0, config.httpClient.maxIdleConns)
+}
+
+func TestProcessEnvFallback(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Empty(t, config.apmServerFallbackUrl)
+	assert.Equal(t, defaultFallbackProbeInterval, config.fallbackProbeInterval)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER_FALLBACK", "https://fallback.example.com")
+	t.Setenv("ELASTIC_APM_FALLBACK_API_KEY", "fallback-key")
+	t.Setenv("ELASTIC_APM_FALLBACK_PROBE_INTERVAL", "30s")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, "https://fallback.example.com/", config.apmServerFallbackUrl)
+	assert.Equal(t, "fallback-key", config.apmServerFallbackApiKey)
+	assert.Equal(t, 30*time.Second, config.fallbackProbeInterval)
+}
+
+func TestProcessEnvConfigWatch(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("ELASTIC_APM_SECRET_TOKEN", "foo")
+
+	config := ProcessEnv(nil)
+	assert.Equal(t, time.Duration(0), config.configWatchInterval)
+	assert.Equal(t, "", config.configSSMParameter)
+
+	t.Setenv("ELASTIC_APM_CONFIG_WATCH_INTERVAL", "10m")
+	t.Setenv("ELASTIC_APM_CONFIG_SSM_PARAMETER", "/lambda/apm")
+	config = ProcessEnv(nil)
+	assert.Equal(t, 10*time.Minute, config.configWatchInterval)
+	assert.Equal(t, "/lambda/apm", config.configSSMParameter)
+
+	t.Setenv("ELASTIC_APM_CONFIG_WATCH_INTERVAL", "-1")
+	config = ProcessEnv(nil)
+	assert.Equal(t, time.Duration(0), config.configWatchInterval)
+}
+
+func TestProcessEnvTagsAsLabels(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(nil)
+	assert.Empty(t, config.tagsAsLabels)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_TAGS_AS_LABELS", "team, cost-center,,")
+	config = ProcessEnv(nil)
+	assert.Equal(t, []string{"team", "cost-center"}, config.tagsAsLabels)
+}
+
+func TestProcessEnvLogFormat(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(nil)
+	assert.Equal(t, JSONLogFormat, config.LogFormat)
+
+	t.Setenv("ELASTIC_APM_LOG_FORMAT", "TEXT")
+	config = ProcessEnv(nil)
+	assert.Equal(t, TextLogFormat, config.LogFormat)
+
+	t.Setenv("ELASTIC_APM_LOG_FORMAT", "xml")
+	config = ProcessEnv(nil)
+	assert.Equal(t, JSONLogFormat, config.LogFormat)
+}
+
+func TestProcessEnvDataReceiverServerAddress(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", "")
+
+	config := ProcessEnv(nil)
+	assert.Equal(t, ":8200", config.dataReceiverListenAddress())
+
+	t.Setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_ADDRESS", "127.0.0.1")
+	t.Setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", "8201")
+	config = ProcessEnv(nil)
+	assert.Equal(t, "127.0.0.1:8201", config.dataReceiverListenAddress())
+
+	t.Setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_ADDRESS", "::1")
+	config = ProcessEnv(nil)
+	assert.Equal(t, "[::1]:8201", config.dataReceiverListenAddress())
+}
@@ -25,12 +25,72 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
+// MetadataContainer holds the metadata of the APM agent, extracted from the first agent data payload of the
+// execution environment. It is set by the goroutine forwarding the agent data while the goroutines processing
+// the Lambda logs read it, so it is only accessed through its methods. The zero value holds no metadata.
 type MetadataContainer struct {
-	Metadata []byte
+	metadata []byte
+	mu       sync.RWMutex
+}
+
+// NewMetadataContainer returns a container holding a copy of metadata.
+func NewMetadataContainer(metadata []byte) *MetadataContainer {
+	c := &MetadataContainer{}
+	c.Set(metadata)
+	return c
+}
+
+// Known reports whether the metadata is known.
+func (c *MetadataContainer) Known() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.metadata != nil
+}
+
+// Get returns a copy of the metadata, or nil if it is not known yet.
+func (c *MetadataContainer) Get() []byte {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.metadata == nil {
+		return nil
+	}
+	return append([]byte(nil), c.metadata...)
+}
+
+// Set replaces the metadata with a copy of metadata, so that the buffer it was extracted from can be reused.
+func (c *MetadataContainer) Set(metadata []byte) {
+	if metadata != nil {
+		metadata = append([]byte(nil), metadata...)
+	}
+	c.mu.Lock()
+	c.metadata = metadata
+	c.mu.Unlock()
+}
+
+// AppendTo appends the metadata followed by a newline to data, if the metadata is known, and returns the
+// extended buffer.
+func (c *MetadataContainer) AppendTo(data []byte) []byte {
+	if c == nil {
+		return data
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.metadata == nil {
+		return data
+	}
+	data = append(data, c.metadata...)
+	return append(data, '\n')
 }
 
 // ProcessMetadata return a byte array containing the Metadata marshaled in JSON
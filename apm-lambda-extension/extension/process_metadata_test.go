@@ -18,6 +18,8 @@
 package extension
 
 import (
+	"bytes"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -47,3 +49,90 @@ func Test_processMetadata(t *testing.T) {
 
 	assert.JSONEq(t, string(desiredMetadata), string(extractedMetadata))
 }
+
+func TestMetadataContainerCopies(t *testing.T) {
+	var container MetadataContainer
+	assert.False(t, container.Known())
+	assert.Nil(t, container.Get())
+	assert.Equal(t, []byte("data"), container.AppendTo([]byte("data")))
+
+	metadata := []byte(`{"metadata":{}}`)
+	container.Set(metadata)
+	metadata[2] = 'X'
+	assert.True(t, container.Known())
+	assert.Equal(t, `{"metadata":{}}`, string(container.Get()))
+
+	got := container.Get()
+	got[2] = 'X'
+	assert.Equal(t, `{"metadata":{}}`, string(container.Get()))
+	assert.Equal(t, "{\"metadata\":{}}\n", string(container.AppendTo(nil)))
+}
+
+func TestNewMetadataContainer(t *testing.T) {
+	metadata := []byte(`{"metadata":{}}`)
+	container := NewMetadataContainer(metadata)
+	metadata[2] = 'X'
+	assert.Equal(t, `{"metadata":{}}`, string(container.Get()))
+	assert.False(t, NewMetadataContainer(nil).Known())
+}
+
+func TestMetadataContainerNil(t *testing.T) {
+	var container *MetadataContainer
+	assert.False(t, container.Known())
+	assert.Nil(t, container.Get())
+	assert.Equal(t, []byte("data"), container.AppendTo([]byte("data")))
+}
+
+func TestMetadataContainerConcurrentAccess(t *testing.T) {
+	first := []byte(`{"metadata":{"service":{"name":"first"}}}`)
+	second := []byte(`{"metadata":{"service":{"name":"second-service-with-a-longer-name"}}}`)
+	container := &MetadataContainer{}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 0, len(second))
+			for j := 0; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Reuse the same buffer to check that Set does not retain it.
+				buf = append(buf[:0], first...)
+				if j%2 == 1 {
+					buf = append(buf[:0], second...)
+				}
+				container.Set(buf)
+			}
+		}()
+	}
+
+	isValid := func(data []byte) bool {
+		return bytes.Equal(data, first) || bytes.Equal(data, second)
+	}
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for j := 0; j < 1000; j++ {
+				if data := container.Get(); data != nil && !isValid(data) {
+					t.Errorf("torn metadata read: %s", data)
+					return
+				}
+				data := container.AppendTo([]byte("prefix"))
+				if len(data) > len("prefix") && !isValid(bytes.TrimSuffix(data[len("prefix"):], []byte("\n"))) {
+					t.Errorf("torn metadata append: %s", data)
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(done)
+	wg.Wait()
+}
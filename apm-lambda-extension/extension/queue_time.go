@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// triggerEvent holds the fields of the invocation events which tell when the trigger of the invocation
+// originated, before it was queued or scheduled by the Lambda service.
+type triggerEvent struct {
+	Records []struct {
+		// SQS
+		Attributes struct {
+			SentTimestamp string `json:"SentTimestamp"`
+		} `json:"attributes"`
+		// Kinesis
+		Kinesis struct {
+			ApproximateArrivalTimestamp float64 `json:"approximateArrivalTimestamp"`
+		} `json:"kinesis"`
+		// SNS
+		SNS struct {
+			Timestamp time.Time `json:"Timestamp"`
+		} `json:"Sns"`
+	} `json:"Records"`
+	// API Gateway REST API (requestTimeEpoch) and HTTP API (timeEpoch)
+	RequestContext struct {
+		RequestTimeEpoch int64 `json:"requestTimeEpoch"`
+		TimeEpoch        int64 `json:"timeEpoch"`
+	} `json:"requestContext"`
+}
+
+// triggerTime returns the time at which the trigger of an invocation originated, e.g. when its SQS message
+// was sent or its API Gateway request was received, or false if the event does not tell. For batches of
+// records, the time of the oldest record is returned.
+func triggerTime(event []byte) (time.Time, bool) {
+	var trigger triggerEvent
+	if err := json.Unmarshal(event, &trigger); err != nil {
+		return time.Time{}, false
+	}
+	var oldest time.Time
+	observe := func(t time.Time) {
+		if !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	for _, record := range trigger.Records {
+		if ms, err := strconv.ParseInt(record.Attributes.SentTimestamp, 10, 64); err == nil && ms > 0 {
+			observe(time.UnixMilli(ms))
+		}
+		if seconds := record.Kinesis.ApproximateArrivalTimestamp; seconds > 0 {
+			observe(time.UnixMilli(int64(seconds * 1e3)))
+		}
+		observe(record.SNS.Timestamp)
+	}
+	if ms := trigger.RequestContext.RequestTimeEpoch; ms > 0 {
+		observe(time.UnixMilli(ms))
+	}
+	if ms := trigger.RequestContext.TimeEpoch; ms > 0 {
+		observe(time.UnixMilli(ms))
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// queueTime returns the time the trigger of an invocation waited before the function received its event
+// at start, or false if it is unknown. Negative durations, caused by skewed clocks, are ignored.
+func queueTime(event []byte, start time.Time) (time.Duration, bool) {
+	trigger, ok := triggerTime(event)
+	if !ok || trigger.After(start) {
+		return 0, false
+	}
+	return start.Sub(trigger), true
+}
+
+// InvocationQueueTime returns the time the trigger of the invocation requestID waited before the runtime
+// received its event, as captured by the proxy of the Runtime API, or false if it is unknown.
+func (transport *ApmServerTransport) InvocationQueueTime(requestID string) (time.Duration, bool) {
+	if transport.invocations == nil {
+		return 0, false
+	}
+	payload, ok := transport.invocations.lookup(requestID)
+	return payload.queueTime, ok && payload.hasQueueTime
+}
@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTriggerTime(t *testing.T) {
+	for name, test := range map[string]struct {
+		event   string
+		trigger time.Time
+	}{
+		"sqs": {
+			event:   `{"Records":[{"messageId":"1","attributes":{"SentTimestamp":"1665532800500"}},{"messageId":"2","attributes":{"SentTimestamp":"1665532800100"}}]}`,
+			trigger: time.UnixMilli(1665532800100),
+		},
+		"kinesis": {
+			event:   `{"Records":[{"kinesis":{"approximateArrivalTimestamp":1665532800.25}}]}`,
+			trigger: time.UnixMilli(1665532800250),
+		},
+		"sns": {
+			event:   `{"Records":[{"Sns":{"Timestamp":"2022-10-12T00:00:00.125Z"}}]}`,
+			trigger: time.Date(2022, 10, 12, 0, 0, 0, 125e6, time.UTC),
+		},
+		"api gateway rest api": {
+			event:   `{"resource":"/","requestContext":{"requestTimeEpoch":1665532800300}}`,
+			trigger: time.UnixMilli(1665532800300),
+		},
+		"api gateway http api": {
+			event:   `{"version":"2.0","requestContext":{"timeEpoch":1665532800400}}`,
+			trigger: time.UnixMilli(1665532800400),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			trigger, ok := triggerTime([]byte(test.event))
+			require.True(t, ok)
+			assert.True(t, test.trigger.Equal(trigger), trigger)
+		})
+	}
+
+	for _, event := range []string{`{"key":"value"}`, `"text"`, `{"Records":[{"eventSource":"aws:s3"}]}`, `not json`} {
+		_, ok := triggerTime([]byte(event))
+		assert.False(t, ok, event)
+	}
+}
+
+func TestQueueTime(t *testing.T) {
+	event := []byte(`{"Records":[{"attributes":{"SentTimestamp":"1665532800000"}}]}`)
+	queued, ok := queueTime(event, time.UnixMilli(1665532801500))
+	require.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, queued)
+
+	// Skewed clocks
+	_, ok = queueTime(event, time.UnixMilli(1665532799000))
+	assert.False(t, ok)
+}
+
+func TestInvocationQueueTime(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "https://example.com/"})
+	_, ok := transport.InvocationQueueTime("req-1")
+	assert.False(t, ok)
+
+	payloads := &invocationPayloads{}
+	sent := time.Now().Add(-2 * time.Second).UnixMilli()
+	payloads.recordEvent("req-1", []byte(`{"Records":[{"attributes":{"SentTimestamp":"`+strconv.FormatInt(sent, 10)+`"}}]}`))
+	payloads.recordEvent("req-2", []byte(`{"key":"value"}`))
+	transport.SetRuntimeAPIProxy(&RuntimeAPIProxy{payloads: payloads})
+
+	queued, ok := transport.InvocationQueueTime("req-1")
+	require.True(t, ok)
+	assert.GreaterOrEqual(t, queued, 2*time.Second)
+	_, ok = transport.InvocationQueueTime("req-2")
+	assert.False(t, ok)
+	_, ok = transport.InvocationQueueTime("req-3")
+	assert.False(t, ok)
+}
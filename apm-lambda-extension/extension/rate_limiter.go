@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimitConfig holds the limits of the agent data sent to the APM server, protecting an APM server
+// shared by many functions from a runaway fleet of execution environments.
+type rateLimitConfig struct {
+	// maxBytesPerInvocation is the maximum size of the events sent for an invocation, before compression
+	maxBytesPerInvocation int64
+	// maxEventsPerSecond is the maximum rate of the events sent, smoothed by a burst of one second
+	maxEventsPerSecond float64
+}
+
+// rateLimiter drops the agent events exceeding the limits of rateLimitConfig before they are sent to the
+// APM server. The metadata and the metricsets, including the metrics reported by the extension itself,
+// are never dropped, as they are needed to make sense of the function whatever its volume of events.
+type rateLimiter struct {
+	config rateLimitConfig
+	mu     sync.Mutex
+	// invocationBytes is the size of the events sent since the start of the invocation
+	invocationBytes int64
+	// tokens is the number of events that can be sent right away, refilled at maxEventsPerSecond
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns the limiter of the agent data sent to the APM server, or nil if no limit is set.
+func newRateLimiter(config *extensionConfig) *rateLimiter {
+	if config.rateLimit.maxBytesPerInvocation <= 0 && config.rateLimit.maxEventsPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{config: config.rateLimit, tokens: rateLimitBurst(config.rateLimit.maxEventsPerSecond)}
+}
+
+// rateLimitBurst returns the number of events that can be sent at once, after a second without events.
+func rateLimitBurst(eventsPerSecond float64) float64 {
+	if eventsPerSecond < 1 {
+		return 1
+	}
+	return eventsPerSecond
+}
+
+// allow reports whether an event of size bytes can be sent at now, and accounts for it if so.
+func (limiter *rateLimiter) allow(size int, now time.Time) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if max := limiter.config.maxBytesPerInvocation; max > 0 && limiter.invocationBytes+int64(size) > max {
+		return false
+	}
+	if rate := limiter.config.maxEventsPerSecond; rate > 0 {
+		if !limiter.last.IsZero() {
+			limiter.tokens += now.Sub(limiter.last).Seconds() * rate
+			if limiter.tokens > rateLimitBurst(rate) {
+				limiter.tokens = rateLimitBurst(rate)
+			}
+		}
+		limiter.last = now
+		if limiter.tokens < 1 {
+			return false
+		}
+		limiter.tokens--
+	}
+	limiter.invocationBytes += int64(size)
+	return true
+}
+
+// StartInvocation resets the size of the events sent for an invocation, when the invocation starts.
+func (transport *ApmServerTransport) StartInvocation() {
+	if transport.rateLimiter == nil {
+		return
+	}
+	transport.rateLimiter.mu.Lock()
+	defer transport.rateLimiter.mu.Unlock()
+	transport.rateLimiter.invocationBytes = 0
+}
+
+// rateLimitAgentData returns the uncompressed agent data without the events exceeding the limits, whether
+// any event was dropped, and whether any event is left to be sent.
+func (transport *ApmServerTransport) rateLimitAgentData(agentData AgentData) ([]byte, bool, bool, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, false, false, err
+	}
+	now := time.Now()
+	limited := make([]byte, 0, len(data))
+	var droppedEvents, droppedBytes, sentEvents int64
+	forEachLine(data, func(line []byte) {
+		switch eventType(line) {
+		case "metadata":
+		case "metricset":
+			sentEvents++
+		default:
+			if len(bytes.TrimSpace(line)) == 0 {
+				return
+			}
+			if !transport.rateLimiter.allow(len(line), now) {
+				droppedEvents++
+				droppedBytes += int64(len(line))
+				return
+			}
+			sentEvents++
+		}
+		limited = append(limited, line...)
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			limited = append(limited, '\n')
+		}
+	})
+	if droppedEvents == 0 {
+		return data, false, true, nil
+	}
+	Log.Debugf("Rate limit of the agent data reached, dropping %d events", droppedEvents)
+	atomic.AddInt64(&transport.metrics.rateLimitedEvents, droppedEvents)
+	atomic.AddInt64(&transport.metrics.rateLimitedBytes, droppedBytes)
+	return limited, true, sentEvents > 0, nil
+}
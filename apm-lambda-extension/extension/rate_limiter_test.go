@@ -0,0 +1,180 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterEventsPerSecond(t *testing.T) {
+	limiter := newRateLimiter(&extensionConfig{rateLimit: rateLimitConfig{maxEventsPerSecond: 2}})
+	now := time.Now()
+
+	// A burst of one second of events is allowed
+	assert.True(t, limiter.allow(10, now))
+	assert.True(t, limiter.allow(10, now))
+	assert.False(t, limiter.allow(10, now))
+
+	assert.False(t, limiter.allow(10, now.Add(100*time.Millisecond)))
+	assert.True(t, limiter.allow(10, now.Add(600*time.Millisecond)))
+	assert.False(t, limiter.allow(10, now.Add(600*time.Millisecond)))
+
+	// The burst does not grow beyond one second of events
+	later := now.Add(time.Minute)
+	assert.True(t, limiter.allow(10, later))
+	assert.True(t, limiter.allow(10, later))
+	assert.False(t, limiter.allow(10, later))
+}
+
+func TestRateLimiterBytesPerInvocation(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", rateLimit: rateLimitConfig{maxBytesPerInvocation: 25}}
+	transport := InitApmServerTransport(&config)
+	now := time.Now()
+
+	assert.True(t, transport.rateLimiter.allow(10, now))
+	assert.True(t, transport.rateLimiter.allow(10, now))
+	assert.False(t, transport.rateLimiter.allow(10, now))
+	assert.True(t, transport.rateLimiter.allow(5, now))
+
+	transport.StartInvocation()
+	assert.True(t, transport.rateLimiter.allow(20, now))
+}
+
+func TestRateLimitAgentData(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", rateLimit: rateLimitConfig{maxEventsPerSecond: 1}}
+	transport := InitApmServerTransport(&config)
+
+	data, changed, hasEvents, err := transport.rateLimitAgentData(AgentData{Data: []byte(`{"metadata":{}}
+{"transaction":{"id":"a"}}
+{"span":{"id":"b"}}
+{"metricset":{"samples":{}}}
+{"error":{"id":"c"}}`)})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, hasEvents)
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"id":"a"}}
+{"metricset":{"samples":{}}}
+`, string(data))
+	assert.Equal(t, int64(2), transport.metrics.rateLimitedEvents)
+	assert.Equal(t, int64(len(`{"span":{"id":"b"}}`+"\n")+len(`{"error":{"id":"c"}}`)), transport.metrics.rateLimitedBytes)
+
+	_, changed, hasEvents, err = transport.rateLimitAgentData(AgentData{Data: []byte(`{"metadata":{}}
+{"span":{"id":"d"}}
+`)})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, hasEvents)
+}
+
+func TestPostToApmServerRateLimit(t *testing.T) {
+	var requests []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body, err := GetUncompressedBytes(data, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		requests = append(requests, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", rateLimit: rateLimitConfig{maxBytesPerInvocation: 64}}
+	transport := InitApmServerTransport(&config)
+	payload := AgentData{Data: []byte(`{"metadata":{}}
+{"transaction":{"id":"0123456789abcdef"}}
+`)}
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), payload))
+	// Payloads without events left are not sent
+	require.NoError(t, transport.PostToApmServer(context.Background(), payload))
+	require.Len(t, requests, 1)
+	assert.Equal(t, string(payload.Data), requests[0])
+
+	transport.StartInvocation()
+	require.NoError(t, transport.PostToApmServer(context.Background(), payload))
+	assert.Len(t, requests, 2)
+}
+
+func TestPostToApmServerRateLimitEnriched(t *testing.T) {
+	var requests []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body, err := GetUncompressedBytes(data, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		requests = append(requests, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	// The metadata enrichment applies to the rate limited agent data
+	config := extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		rateLimit:    rateLimitConfig{maxBytesPerInvocation: 64},
+		globalLabels: map[string]string{"team": "payments"},
+	}
+	transport := InitApmServerTransport(&config)
+	payload := AgentData{Data: []byte(`{"metadata":{}}
+{"transaction":{"id":"0123456789abcdef"}}
+{"transaction":{"id":"fedcba9876543210"}}
+`)}
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), payload))
+	require.Len(t, requests, 1)
+	lines := strings.Split(requests[0], "\n")
+	require.Len(t, lines, 3)
+	assert.JSONEq(t, `{"metadata":{"labels":{"team":"payments"}}}`, lines[0])
+	assert.Equal(t, `{"transaction":{"id":"0123456789abcdef"}}`, lines[1])
+}
+
+func TestReportSelfMetricsRateLimit(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", selfMetricsInvocations: 1, rateLimit: rateLimitConfig{maxEventsPerSecond: 1}}
+	transport := InitApmServerTransport(&config)
+	_, _, _, err := transport.rateLimitAgentData(AgentData{Data: []byte(strings.Repeat(`{"span":{}}`+"\n", 3))})
+	require.NoError(t, err)
+
+	transport.ReportSelfMetrics(NewMetadataContainer([]byte(`{"metadata":{}}`)))
+	samples := selfMetricsSamples(t, <-transport.dataChannel)
+	assert.Equal(t, float64(2), samples["aws.lambda.extension.rate_limited.events"])
+	assert.Equal(t, float64(24), samples["aws.lambda.extension.rate_limited.bytes"])
+}
+
+func TestProcessEnvRateLimit(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, rateLimitConfig{}, config.rateLimit)
+	assert.Nil(t, InitApmServerTransport(config).rateLimiter)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_BYTES_PER_INVOCATION", "1048576")
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_EVENTS_PER_SECOND", "0.5")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, rateLimitConfig{maxBytesPerInvocation: 1048576, maxEventsPerSecond: 0.5}, config.rateLimit)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_BYTES_PER_INVOCATION", "-1")
+	t.Setenv("ELASTIC_APM_LAMBDA_MAX_EVENTS_PER_SECOND", "fast")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, rateLimitConfig{}, config.rateLimit)
+}
@@ -0,0 +1,157 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	// maxKinesisRecordBytes is the maximum size of the data and partition key of a Kinesis record.
+	maxKinesisRecordBytes = 1024 * 1024
+	// maxFirehoseRecordBytes is the maximum size of the data of a Firehose record.
+	maxFirehoseRecordBytes = 1000 * 1024
+)
+
+// kinesisPutter is the subset of the Kinesis Data Streams API used to write the agent data.
+type kinesisPutter interface {
+	PutRecordWithContext(aws.Context, *kinesis.PutRecordInput, ...request.Option) (*kinesis.PutRecordOutput, error)
+}
+
+// firehosePutter is the subset of the Firehose API used to write the agent data.
+type firehosePutter interface {
+	PutRecordWithContext(aws.Context, *firehose.PutRecordInput, ...request.Option) (*firehose.PutRecordOutput, error)
+}
+
+// RecordOutput writes the agent data to a Kinesis data stream or a Firehose delivery stream rather than
+// sending it to the APM server, so that a consumer outside of the function forwards it to the APM server.
+// Each record holds a gzip-compressed intake v2 payload, starting with its metadata.
+type RecordOutput struct {
+	output         Output
+	stream         string
+	maxRecordBytes int
+	put            func(ctx context.Context, data []byte) error
+}
+
+// NewRecordOutput returns the output writing the agent data to the stream configured by
+// ELASTIC_APM_LAMBDA_OUTPUT_STREAM, or nil if the agent data is sent to the APM server.
+func NewRecordOutput(config *extensionConfig, kinesisClient kinesisPutter, firehoseClient firehosePutter) *RecordOutput {
+	output := &RecordOutput{output: config.output, stream: config.outputStream}
+	switch config.output {
+	case KinesisOutput:
+		// The records of an execution environment are kept in order, while the execution environments
+		// of the function are spread across the shards
+		partitionKey := config.logStreamName
+		if partitionKey == "" {
+			partitionKey = config.functionName
+		}
+		if partitionKey == "" {
+			partitionKey = "apm-lambda-extension"
+		}
+		output.maxRecordBytes = maxKinesisRecordBytes - len(partitionKey)
+		output.put = func(ctx context.Context, data []byte) error {
+			_, err := kinesisClient.PutRecordWithContext(ctx, &kinesis.PutRecordInput{
+				StreamName:   aws.String(config.outputStream),
+				PartitionKey: aws.String(partitionKey),
+				Data:         data,
+			})
+			return err
+		}
+	case FirehoseOutput:
+		output.maxRecordBytes = maxFirehoseRecordBytes
+		output.put = func(ctx context.Context, data []byte) error {
+			_, err := firehoseClient.PutRecordWithContext(ctx, &firehose.PutRecordInput{
+				DeliveryStreamName: aws.String(config.outputStream),
+				Record:             &firehose.Record{Data: data},
+			})
+			return err
+		}
+	default:
+		return nil
+	}
+	return output
+}
+
+// SetRecordOutput sets the output to which the agent data is written rather than sent to the APM server.
+func (transport *ApmServerTransport) SetRecordOutput(output *RecordOutput) {
+	if output != nil {
+		transport.recordOutput = output
+	}
+}
+
+// writeRecord writes the processed agent data, whose encoding is given, to the record output. As the APM
+// server is not reached, undelivered agent data is handled as if the APM server failed.
+func (transport *ApmServerTransport) writeRecord(ctx context.Context, agentData AgentData, body []byte, encoding string) error {
+	output := transport.recordOutput
+	data, err := gzipRecord(body, encoding)
+	if err != nil {
+		return fmt.Errorf("failed to compress the %s record: %v", output.output, err)
+	}
+	if len(data) > output.maxRecordBytes {
+		// The record would be rejected however many times it is written
+		atomic.AddInt64(&transport.droppedPayloads, 1)
+		return fmt.Errorf("dropping agent data of %d bytes, larger than the maximum %s record size", len(data), output.output)
+	}
+
+	Log.Debugf("Writing agent data to %s stream %s", output.output, output.stream)
+	start := time.Now()
+	err = output.put(ctx, data)
+	if err != nil {
+		transport.metrics.recordRequest(time.Since(start), 0)
+		retained := transport.handleDeliveryFailure(agentData)
+		transport.SetApmServerTransportState(ctx, Failing)
+		return &deliveryError{err: fmt.Errorf("failed to write to %s stream %s: %v", output.output, output.stream, err), retained: retained}
+	}
+	transport.metrics.recordRequest(time.Since(start), len(data))
+	transport.SetApmServerTransportState(ctx, Healthy)
+	return nil
+}
+
+// gzipRecord returns the agent data compressed with gzip, whatever its encoding, so that the consumers of
+// the records can forward them as they are.
+func gzipRecord(body []byte, encoding string) ([]byte, error) {
+	if encoding == "gzip" {
+		return body, nil
+	}
+	data, err := GetUncompressedBytes(body, encoding)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
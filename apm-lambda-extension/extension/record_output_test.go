@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockKinesis struct {
+	records []*kinesis.PutRecordInput
+	err     error
+}
+
+func (m *mockKinesis) PutRecordWithContext(_ aws.Context, input *kinesis.PutRecordInput, _ ...request.Option) (*kinesis.PutRecordOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.records = append(m.records, input)
+	return &kinesis.PutRecordOutput{}, nil
+}
+
+type mockFirehose struct {
+	records []*firehose.PutRecordInput
+}
+
+func (m *mockFirehose) PutRecordWithContext(_ aws.Context, input *firehose.PutRecordInput, _ ...request.Option) (*firehose.PutRecordOutput, error) {
+	m.records = append(m.records, input)
+	return &firehose.PutRecordOutput{}, nil
+}
+
+func TestRecordOutputKinesis(t *testing.T) {
+	config := extensionConfig{output: KinesisOutput, outputStream: "apm-data", logStreamName: "2022/10/12/[$LATEST]8d1f5f0e"}
+	kinesisClient := &mockKinesis{}
+	transport := InitApmServerTransport(&config)
+	transport.SetRecordOutput(NewRecordOutput(&config, kinesisClient, &mockFirehose{}))
+
+	payload := `{"metadata":{}}` + "\n" + `{"transaction":{"id":"1"}}` + "\n"
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(payload)}))
+	require.Len(t, kinesisClient.records, 1)
+	record := kinesisClient.records[0]
+	assert.Equal(t, "apm-data", *record.StreamName)
+	assert.Equal(t, "2022/10/12/[$LATEST]8d1f5f0e", *record.PartitionKey)
+	data, err := GetUncompressedBytes(record.Data, "gzip")
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(data))
+	assert.Equal(t, Healthy, transport.currentStatus())
+
+	// Agent data compressed with deflate is written with gzip
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	_, err = zw.Write([]byte(payload))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: deflated.Bytes(), ContentEncoding: "deflate"}))
+	require.Len(t, kinesisClient.records, 2)
+	data, err = GetUncompressedBytes(kinesisClient.records[1].Data, "gzip")
+	require.NoError(t, err)
+	assert.Equal(t, payload, string(data))
+}
+
+func TestRecordOutputFirehose(t *testing.T) {
+	config := extensionConfig{output: FirehoseOutput, outputStream: "apm-delivery"}
+	firehoseClient := &mockFirehose{}
+	transport := InitApmServerTransport(&config)
+	transport.SetRecordOutput(NewRecordOutput(&config, &mockKinesis{}, firehoseClient))
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}`)}))
+	require.Len(t, firehoseClient.records, 1)
+	assert.Equal(t, "apm-delivery", *firehoseClient.records[0].DeliveryStreamName)
+	data, err := GetUncompressedBytes(firehoseClient.records[0].Record.Data, "gzip")
+	require.NoError(t, err)
+	assert.Equal(t, `{"metadata":{}}`, string(data))
+}
+
+func TestRecordOutputFailure(t *testing.T) {
+	config := extensionConfig{output: KinesisOutput, outputStream: "apm-data"}
+	kinesisClient := &mockKinesis{err: errors.New("ProvisionedThroughputExceededException")}
+	transport := InitApmServerTransport(&config)
+	transport.SetRecordOutput(NewRecordOutput(&config, kinesisClient, &mockFirehose{}))
+
+	err := transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}`)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to write to kinesis stream apm-data")
+	assert.Equal(t, Failing, transport.currentStatus())
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+}
+
+func TestRecordOutputOversized(t *testing.T) {
+	config := extensionConfig{output: FirehoseOutput, outputStream: "apm-delivery"}
+	firehoseClient := &mockFirehose{}
+	transport := InitApmServerTransport(&config)
+	output := NewRecordOutput(&config, &mockKinesis{}, firehoseClient)
+	output.maxRecordBytes = 16
+	transport.SetRecordOutput(output)
+
+	err := transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}`)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "larger than the maximum firehose record size")
+	assert.Empty(t, firehoseClient.records)
+	assert.Equal(t, int64(1), transport.droppedPayloads)
+	assert.Equal(t, Healthy, transport.currentStatus())
+}
+
+func TestNewRecordOutput(t *testing.T) {
+	assert.Nil(t, NewRecordOutput(&extensionConfig{output: ApmServerOutput}, &mockKinesis{}, &mockFirehose{}))
+
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.SetRecordOutput(nil)
+	assert.Nil(t, transport.recordOutput)
+}
+
+func TestProcessEnvOutput(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, ApmServerOutput, config.output)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_OUTPUT", "Kinesis")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, ApmServerOutput, config.output, "the stream is required")
+
+	t.Setenv("ELASTIC_APM_LAMBDA_OUTPUT_STREAM", "apm-data")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, KinesisOutput, config.output)
+	assert.Equal(t, "apm-data", config.outputStream)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_OUTPUT", "sqs")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, ApmServerOutput, config.output)
+}
@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ExtensionsDir is the directory in which Lambda looks for the external extensions shipped in layers.
+const ExtensionsDir = "/opt/extensions"
+
+// DiagnoseRegisterError returns a targeted explanation of the failure to register the extension as
+// extensionName, when the extensions found in dir make the cause likely, or an empty string otherwise.
+//
+// Lambda only accepts the registration of an external extension under the file name of its executable
+// in dir, so that renaming the binary, or starting it through a wrapper script, breaks the registration.
+func DiagnoseRegisterError(err error, extensionName string, dir string) string {
+	var registerErr *RegisterError
+	if !errors.As(err, &registerErr) || registerErr.StatusCode >= http.StatusInternalServerError {
+		// The extension could not reach the Extensions API, or the error is on the Lambda side
+		return ""
+	}
+	entries, readErr := os.ReadDir(dir)
+	if readErr != nil {
+		return fmt.Sprintf("%s could not be read (%v): the extension must be deployed in a layer, as %s/%s", dir, readErr, dir, extensionName)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == extensionName {
+			return ""
+		}
+		names = append(names, entry.Name())
+	}
+	return fmt.Sprintf("The extension registered as %q, but %s contains [%s]. Lambda requires the extension name "+
+		"to match the file name of the extension executable: restore the original file name, or set "+
+		"ELASTIC_APM_LAMBDA_EXTENSION_NAME to the file name when the extension is started by a wrapper script",
+		extensionName, dir, strings.Join(names, ", "))
+}
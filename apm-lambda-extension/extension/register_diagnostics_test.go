@@ -0,0 +1,61 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnoseRegisterError(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "apm-lambda-extension"), nil, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other-extension"), nil, 0755))
+	forbidden := &RegisterError{StatusCode: http.StatusForbidden}
+
+	diagnostic := DiagnoseRegisterError(forbidden, "apm-extension-v2", dir)
+	assert.Contains(t, diagnostic, `registered as "apm-extension-v2"`)
+	assert.Contains(t, diagnostic, "[apm-lambda-extension, other-extension]")
+	assert.Contains(t, diagnostic, "ELASTIC_APM_LAMBDA_EXTENSION_NAME")
+
+	// The name matches a file, the cause is elsewhere
+	assert.Empty(t, DiagnoseRegisterError(forbidden, "apm-lambda-extension", dir))
+
+	assert.Contains(t, DiagnoseRegisterError(forbidden, "apm-lambda-extension", filepath.Join(dir, "missing")), "must be deployed in a layer")
+
+	// Errors unrelated to the extension name
+	assert.Empty(t, DiagnoseRegisterError(errors.New("connection refused"), "apm-extension-v2", dir))
+	assert.Empty(t, DiagnoseRegisterError(&RegisterError{StatusCode: http.StatusInternalServerError}, "apm-extension-v2", dir))
+}
+
+func TestProcessEnvExtensionName(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(nil)
+	assert.Empty(t, config.ExtensionName)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_EXTENSION_NAME", "elastic-apm")
+	config = ProcessEnv(nil)
+	assert.Equal(t, "elastic-apm", config.ExtensionName)
+}
@@ -0,0 +1,74 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// defaultMaxInFlightRequests is the default maximum number of concurrent requests sending agent data to
+// the APM server.
+const defaultMaxInFlightRequests = 8
+
+// requestLimiter caps the number of concurrent requests sending agent data to the APM server, which
+// happen when the agent data is sent in the background or streamed while a flush is in progress. The
+// requests beyond the cap wait for a request to complete, so that the sockets of the execution
+// environment are not exhausted.
+type requestLimiter struct {
+	slots    chan struct{}
+	inFlight int64
+	queued   int64
+}
+
+func newRequestLimiter(maxInFlight int) *requestLimiter {
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMaxInFlightRequests
+	}
+	return &requestLimiter{slots: make(chan struct{}, maxInFlight)}
+}
+
+// acquire waits until a request can be sent, or ctx is done. Each successful call must be followed by
+// a call to release once the response is read.
+func (limiter *requestLimiter) acquire(ctx context.Context) error {
+	select {
+	case limiter.slots <- struct{}{}:
+	default:
+		Log.Debug("Maximum number of in-flight requests to the APM server reached, waiting")
+		atomic.AddInt64(&limiter.queued, 1)
+		defer atomic.AddInt64(&limiter.queued, -1)
+		select {
+		case limiter.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	atomic.AddInt64(&limiter.inFlight, 1)
+	return nil
+}
+
+func (limiter *requestLimiter) release() {
+	atomic.AddInt64(&limiter.inFlight, -1)
+	<-limiter.slots
+}
+
+// InFlightRequests returns the number of requests sending agent data to the APM server, and the number
+// of requests waiting to be sent because the maximum number of in-flight requests is reached.
+func (transport *ApmServerTransport) InFlightRequests() (inFlight int64, queued int64) {
+	return atomic.LoadInt64(&transport.requests.inFlight), atomic.LoadInt64(&transport.requests.queued)
+}
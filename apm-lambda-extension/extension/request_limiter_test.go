@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	limiter := newRequestLimiter(1)
+	require.NoError(t, limiter.acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, limiter.acquire(ctx), context.DeadlineExceeded)
+	assert.Equal(t, int64(0), limiter.queued)
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- limiter.acquire(context.Background())
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&limiter.queued) == 1
+	}, time.Second, time.Millisecond)
+	limiter.release()
+	require.NoError(t, <-acquired)
+	assert.Equal(t, int64(1), limiter.inFlight)
+	assert.Equal(t, int64(0), limiter.queued)
+}
+
+func TestPostToApmServerMaxInFlightRequests(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	unblock := make(chan struct{})
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		<-unblock
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", maxInFlightRequests: 2}
+	transport := InitApmServerTransport(&config)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}`)}))
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		inFlightRequests, queuedRequests := transport.InFlightRequests()
+		return inFlight == 2 && inFlightRequests == 2 && queuedRequests == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int64(2), transport.DebugVars().Transport.InFlightRequests)
+	assert.Equal(t, int64(3), transport.DebugVars().Transport.QueuedRequests)
+
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, 2, maxInFlight)
+	inFlightRequests, queuedRequests := transport.InFlightRequests()
+	assert.Equal(t, int64(0), inFlightRequests)
+	assert.Equal(t, int64(0), queuedRequests)
+}
+
+func TestProcessEnvMaxInFlightRequests(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultMaxInFlightRequests, config.maxInFlightRequests)
+
+	t.Setenv("ELASTIC_APM_MAX_IN_FLIGHT_REQUESTS", "2")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 2, config.maxInFlightRequests)
+
+	t.Setenv("ELASTIC_APM_MAX_IN_FLIGHT_REQUESTS", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultMaxInFlightRequests, config.maxInFlightRequests)
+}
@@ -0,0 +1,119 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// deliveryError is returned when agent data could not be delivered, and tells whether the agent data was
+// buffered again or persisted, so that it is delivered later, rather than dropped.
+type deliveryError struct {
+	err      error
+	retained bool
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deliveryError) Unwrap() error {
+	return e.err
+}
+
+// agentDataRetained reports whether err tells that the agent data which could not be delivered was buffered
+// again or persisted.
+func agentDataRetained(err error) bool {
+	var deliveryErr *deliveryError
+	return errors.As(err, &deliveryErr) && deliveryErr.retained
+}
+
+// isIntakeResponse reports whether respBody describes the events the APM server accepted and rejected, in
+// which case the response is handled per event, whatever its status code.
+func isIntakeResponse(respBody []byte) bool {
+	var response intakeResponse
+	if json.Unmarshal(respBody, &response) != nil {
+		return false
+	}
+	return response.Accepted > 0 || len(response.Errors) > 0
+}
+
+// isServerError reports whether a response means that the APM server, or a proxy in front of it, is
+// unable to process requests, so that the transport enters the Failing state as if the APM server were
+// unreachable. Responses describing the events the APM server could not process are handled per event.
+func isServerError(statusCode int, respBody []byte) bool {
+	return statusCode >= http.StatusInternalServerError && !isIntakeResponse(respBody)
+}
+
+// isClientError reports whether a response means that the APM server refused the request itself, e.g.
+// because of its credentials or its size, so that sending it again would fail the same way.
+func isClientError(statusCode int, respBody []byte) bool {
+	return statusCode >= http.StatusBadRequest && statusCode < http.StatusInternalServerError && !isIntakeResponse(respBody)
+}
+
+// clientErrorDiagnostic returns an actionable description of a client error response of the APM server.
+func clientErrorDiagnostic(statusCode int) string {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return "the APM server rejected the credentials, check ELASTIC_APM_SECRET_TOKEN or ELASTIC_APM_API_KEY"
+	case http.StatusForbidden:
+		return "the credentials are not allowed to send events, check the privileges of the API key set with ELASTIC_APM_API_KEY"
+	case http.StatusNotFound:
+		return "the intake endpoint was not found, check ELASTIC_APM_LAMBDA_APM_SERVER"
+	case http.StatusRequestEntityTooLarge:
+		return "the payload is larger than the APM server accepts, lower ELASTIC_APM_BATCH_MAX_BYTES or raise the limits of the APM server"
+	case http.StatusBadRequest:
+		return "the APM server could not decode the payload"
+	default:
+		return "the APM server refused the payload"
+	}
+}
+
+// quarantine handles agent data refused by the APM server with a client error: sending it again would fail
+// the same way, so it is sent to the dead-letter queue, if any, to be replayed once the cause is fixed,
+// rather than persisted to the spill buffer. The transport stays healthy, as the APM server is reachable.
+func (transport *ApmServerTransport) quarantine(statusCode int, respBody []byte, agentData AgentData) error {
+	diagnostic := clientErrorDiagnostic(statusCode)
+	Log.Errorf("APM server refused the agent data with status %d, %s: %s", statusCode, diagnostic, truncateForLog(respBody))
+	atomic.AddInt64(&transport.deliveryFailures, 1)
+	atomic.AddInt64(&transport.metrics.clientErrors, 1)
+	if agentData.Data == nil {
+		// Streamed agent data cannot be sent again
+		Log.Warn("Dropping the streamed agent data refused by the APM server")
+	} else if transport.deadLetters == nil {
+		Log.Warn("Dropping the agent data refused by the APM server")
+	} else {
+		transport.sendToDeadLetterQueue(agentData)
+	}
+	return fmt.Errorf("APM server refused the agent data with status %d: %s", statusCode, diagnostic)
+}
+
+// maxLoggedResponseBody is the maximum size of the response bodies of the APM server included in the logs.
+const maxLoggedResponseBody = 512
+
+// truncateForLog returns respBody as a string of at most maxLoggedResponseBody bytes.
+func truncateForLog(respBody []byte) string {
+	if len(respBody) > maxLoggedResponseBody {
+		return string(respBody[:maxLoggedResponseBody]) + "..."
+	}
+	return string(respBody)
+}
@@ -0,0 +1,90 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseErrorClassification(t *testing.T) {
+	intakeBody := []byte(`{"accepted":1,"errors":[{"message":"queue is full"}]}`)
+
+	assert.True(t, isServerError(http.StatusInternalServerError, nil))
+	assert.True(t, isServerError(http.StatusBadGateway, []byte("<html>Bad Gateway</html>")))
+	assert.False(t, isServerError(http.StatusServiceUnavailable, intakeBody))
+	assert.False(t, isServerError(http.StatusBadRequest, nil))
+
+	assert.True(t, isClientError(http.StatusUnauthorized, []byte(`{"error":"authentication failed"}`)))
+	assert.True(t, isClientError(http.StatusRequestEntityTooLarge, nil))
+	assert.False(t, isClientError(http.StatusBadRequest, []byte(`{"accepted":0,"errors":[{"message":"invalid event"}]}`)))
+	assert.False(t, isClientError(http.StatusAccepted, nil))
+	assert.False(t, isClientError(http.StatusInternalServerError, nil))
+
+	assert.Contains(t, clientErrorDiagnostic(http.StatusUnauthorized), "ELASTIC_APM_SECRET_TOKEN")
+	assert.Contains(t, clientErrorDiagnostic(http.StatusNotFound), "ELASTIC_APM_LAMBDA_APM_SERVER")
+}
+
+func TestClientErrorQuarantine(t *testing.T) {
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"forbidden request: endpoint is disabled"}`))
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		dlqSQSURL:    "https://sqs.us-east-1.amazonaws.com/123456789012/apm-dlq",
+		spillDir:     t.TempDir(),
+	}
+	client := &mockSQS{}
+	transport := InitApmServerTransport(&config)
+	transport.SetDeadLetterQueue(NewDeadLetterQueue(&config, client))
+
+	err := transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 403")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, Healthy, transport.currentStatus())
+	assert.Equal(t, -1, transport.reconnectionCount)
+	assert.Len(t, client.messages, 1)
+	assert.Equal(t, 1, transport.TakeDeliveryFailures())
+	assert.Equal(t, int64(1), transport.metrics.clientErrors)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestServerErrorFailing(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	require.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, Failing, transport.currentStatus())
+	assert.Equal(t, 0, transport.reconnectionCount)
+	assert.Equal(t, int64(0), transport.metrics.clientErrors)
+}
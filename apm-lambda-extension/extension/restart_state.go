@@ -0,0 +1,209 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	stateDirName       = "state"
+	stateFileName      = "state.json"
+	checkpointDirName  = "checkpoint"
+	stateFileTempName  = "state.json.tmp"
+	restoredStateLimit = time.Hour
+)
+
+// persistedState is the in-flight state of the extension, saved after each invocation so that the
+// extension resumes where it left off if its process is restarted within the same execution environment.
+// The agent data buffered at the time is checkpointed next to it, using the spill buffer format.
+type persistedState struct {
+	SavedAt           time.Time                    `json:"saved_at"`
+	Metadata          []byte                       `json:"metadata,omitempty"`
+	Status            ApmServerTransportStatusType `json:"status"`
+	ReconnectionCount int                          `json:"reconnection_count"`
+	GracePeriodEnd    time.Time                    `json:"grace_period_end"`
+}
+
+// stateDir returns the directory the state is persisted to, or an empty string if persisting the state
+// is disabled, which is the case when the spill buffer is.
+func (transport *ApmServerTransport) stateDir() string {
+	if transport.spillBuffer == nil {
+		return ""
+	}
+	return filepath.Join(transport.config.spillDir, stateDirName)
+}
+
+// SaveState persists the metadata, the state of the connection to the APM server, and the buffered agent
+// data. It is meant to be called between invocations, and does nothing if persisting the state is disabled.
+func (transport *ApmServerTransport) SaveState(metadataContainer *MetadataContainer) {
+	dir := transport.stateDir()
+	if dir == "" {
+		return
+	}
+	state := persistedState{
+		SavedAt:           time.Now(),
+		Metadata:          metadataContainer.Get(),
+		Status:            transport.currentStatus(),
+		ReconnectionCount: transport.reconnectionCount,
+		GracePeriodEnd:    time.Unix(0, atomic.LoadInt64(&transport.gracePeriodEnd)),
+	}
+	if err := transport.checkpointBufferedData(filepath.Join(dir, checkpointDirName)); err != nil {
+		Log.Warnf("Could not checkpoint the buffered agent data: %v", err)
+	}
+	content, err := json.Marshal(state)
+	if err == nil {
+		// The state file is replaced atomically, so that a crash while saving it leaves the previous one
+		tempPath := filepath.Join(dir, stateFileTempName)
+		if err = ioutil.WriteFile(tempPath, content, 0600); err == nil {
+			err = os.Rename(tempPath, filepath.Join(dir, stateFileName))
+		}
+	}
+	if err != nil {
+		Log.Warnf("Could not persist the extension state: %v", err)
+	}
+}
+
+// checkpointBufferedData replaces the data checkpointed in dir with the agent data currently buffered,
+// which stays buffered.
+func (transport *ApmServerTransport) checkpointBufferedData(dir string) error {
+	transport.checkpointMutex.Lock()
+	defer transport.checkpointMutex.Unlock()
+	atomic.StoreInt32(&transport.checkpointed, 0)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	checkpoint, err := NewSpillBuffer(dir, transport.config.spillBufferMaxBytes)
+	if err != nil {
+		return err
+	}
+	spilled := 0
+	spill := func(agentData AgentData) {
+		if err == nil {
+			if err = checkpoint.Spill(agentData); err == nil {
+				spilled++
+			}
+		}
+	}
+	transport.rotateBuffer(transport.priorityChannel, spill, transport.EnqueuePriorityData)
+	transport.rotateBuffer(transport.dataChannel, spill, func(agentData AgentData) { transport.EnqueueAPMData(agentData) })
+	for _, agentData := range transport.atomicFlush.pending() {
+		spill(agentData)
+	}
+	if err == nil && spilled > 0 {
+		atomic.StoreInt32(&transport.checkpointed, 1)
+	}
+	return err
+}
+
+// rotateBuffer calls visit with each agent data buffered in channel, in order. Each agent data is put back
+// right after it was taken out, so that the buffer is not drained and its policy does not apply to the agent
+// data received meanwhile. The agent data whose place was taken meanwhile is persisted to the spill buffer,
+// or queued with enqueue if it cannot be.
+func (transport *ApmServerTransport) rotateBuffer(channel chan AgentData, visit func(AgentData), enqueue func(AgentData)) {
+	for i := len(channel); i > 0; i-- {
+		var agentData AgentData
+		select {
+		case agentData = <-channel:
+		default:
+			return
+		}
+		visit(agentData)
+		select {
+		case channel <- agentData:
+		default:
+			if err := transport.spillBuffer.Spill(agentData); err != nil {
+				enqueue(agentData)
+			}
+		}
+	}
+}
+
+// refreshCheckpoint rewrites the checkpointed agent data from the agent data still buffered once agent
+// data was sent, so that the agent data already delivered is not sent again after a restart, while the
+// agent data not delivered yet is still restored.
+func (transport *ApmServerTransport) refreshCheckpoint() {
+	if atomic.LoadInt32(&transport.checkpointed) == 0 {
+		return
+	}
+	if err := transport.checkpointBufferedData(filepath.Join(transport.stateDir(), checkpointDirName)); err != nil {
+		Log.Warnf("Could not checkpoint the buffered agent data: %v", err)
+	}
+}
+
+// RestoreState restores the state persisted by a previous process of the extension in the same execution
+// environment, if any, and reports whether it did. The checkpointed agent data is buffered again.
+func (transport *ApmServerTransport) RestoreState(ctx context.Context, metadataContainer *MetadataContainer) bool {
+	dir := transport.stateDir()
+	if dir == "" {
+		return false
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, stateFileName))
+	if os.IsNotExist(err) {
+		return false
+	}
+	var state persistedState
+	if err == nil {
+		err = json.Unmarshal(content, &state)
+	}
+	if err != nil {
+		Log.Warnf("Could not read the persisted extension state, starting afresh: %v", err)
+		return false
+	}
+	if time.Since(state.SavedAt) > restoredStateLimit {
+		Log.Infof("Ignoring the extension state persisted at %s", state.SavedAt)
+		return false
+	}
+	Log.Warnf("The extension restarted within the execution environment, restoring the state saved at %s", state.SavedAt)
+
+	if len(state.Metadata) > 0 {
+		metadataContainer.Set(state.Metadata)
+		atomic.StoreInt32(&transport.metadataExtracted, 1)
+	}
+	if state.Status == Failing && time.Now().Before(state.GracePeriodEnd) {
+		// Resume the backoff, the reconnection count being incremented when entering the grace period
+		transport.reconnectionCount = state.ReconnectionCount - 1
+		transport.SetApmServerTransportState(ctx, Failing)
+	} else if state.ReconnectionCount >= 0 {
+		transport.reconnectionCount = state.ReconnectionCount
+	}
+
+	checkpoint, err := NewSpillBuffer(filepath.Join(dir, checkpointDirName), transport.config.spillBufferMaxBytes)
+	if err == nil {
+		var restored int
+		restored, err = checkpoint.Replay(func(agentData AgentData) bool {
+			select {
+			case transport.dataChannel <- agentData:
+				return true
+			default:
+				return false
+			}
+		})
+		Log.Infof("Restored %d buffered agent data payloads", restored)
+	}
+	if err != nil {
+		Log.Warnf("Could not restore the buffered agent data: %v", err)
+	}
+	return true
+}
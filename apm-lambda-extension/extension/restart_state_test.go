@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPersistentTransport(t *testing.T, dir string) *ApmServerTransport {
+	config := extensionConfig{
+		apmServerUrl:        "http://localhost:8200/",
+		spillDir:            dir,
+		spillBufferMaxBytes: 1024 * 1024,
+	}
+	return InitApmServerTransport(&config)
+}
+
+func TestRestoreStateAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	transport := newPersistentTransport(t, dir)
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+	transport.EnqueueAPMData(AgentData{Data: []byte("first")})
+	transport.EnqueueAPMData(AgentData{Data: []byte("second"), ContentEncoding: "gzip"})
+
+	transport.SaveState(metadataContainer)
+	// The buffered data stays buffered
+	assert.Equal(t, 2, transport.BufferedDataCount())
+
+	restarted := newPersistentTransport(t, dir)
+	restoredContainer := MetadataContainer{}
+	require.True(t, restarted.RestoreState(context.Background(), &restoredContainer))
+	assert.Equal(t, metadataContainer.Get(), restoredContainer.Get())
+	assert.Equal(t, int32(1), restarted.metadataExtracted)
+	assert.Equal(t, Healthy, restarted.currentStatus())
+	require.Equal(t, 2, restarted.BufferedDataCount())
+	assert.Equal(t, AgentData{Data: []byte("first"), ContentEncoding: ""}, <-restarted.dataChannel)
+	assert.Equal(t, AgentData{Data: []byte("second"), ContentEncoding: "gzip"}, <-restarted.dataChannel)
+}
+
+func TestRestoreStateAfterSend(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+	dir := t.TempDir()
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:        apmServer.URL + "/",
+		spillDir:            dir,
+		spillBufferMaxBytes: 1024 * 1024,
+	})
+	transport.EnqueueAPMData(AgentData{Data: []byte("first")})
+	transport.EnqueueAPMData(AgentData{Data: []byte("second")})
+	transport.SaveState(&MetadataContainer{})
+
+	// The checkpointed data that was delivered is not restored, unlike the data still buffered
+	require.NoError(t, transport.PostToApmServer(context.Background(), <-transport.dataChannel))
+	restarted := newPersistentTransport(t, dir)
+	require.True(t, restarted.RestoreState(context.Background(), &MetadataContainer{}))
+	require.Equal(t, 1, restarted.BufferedDataCount())
+	assert.Equal(t, "second", string((<-restarted.dataChannel).Data))
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), <-transport.dataChannel))
+	restarted = newPersistentTransport(t, dir)
+	require.True(t, restarted.RestoreState(context.Background(), &MetadataContainer{}))
+	assert.Equal(t, 0, restarted.BufferedDataCount())
+}
+
+func TestSaveStateFullBuffer(t *testing.T) {
+	transport := newPersistentTransport(t, t.TempDir())
+	for i := 0; i < cap(transport.dataChannel); i++ {
+		transport.EnqueueAPMData(AgentData{Data: []byte(strconv.Itoa(i))})
+	}
+
+	transport.SaveState(&MetadataContainer{})
+	assert.Zero(t, transport.droppedPayloads)
+	for i := 0; i < cap(transport.dataChannel); i++ {
+		assert.Equal(t, strconv.Itoa(i), string((<-transport.dataChannel).Data))
+	}
+}
+
+func TestRestoreStateResumesBackoff(t *testing.T) {
+	dir := t.TempDir()
+	transport := newPersistentTransport(t, dir)
+	transport.setStatus(Failing)
+	transport.reconnectionCount = 3
+	transport.gracePeriodEnd = time.Now().Add(time.Minute).UnixNano()
+	transport.SaveState(&MetadataContainer{})
+
+	restarted := newPersistentTransport(t, dir)
+	restarted.backoff.jitter = 0
+	require.True(t, restarted.RestoreState(context.Background(), &MetadataContainer{}))
+	assert.Equal(t, Failing, restarted.currentStatus())
+	assert.Equal(t, 3, restarted.reconnectionCount)
+	assert.Equal(t, 0, restarted.BufferedDataCount())
+}
+
+func TestRestoreStateFreshEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	transport := newPersistentTransport(t, dir)
+	assert.False(t, transport.RestoreState(context.Background(), &MetadataContainer{}))
+
+	// A corrupted state is ignored
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, stateDirName), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, stateDirName, stateFileName), []byte("{"), 0600))
+	assert.False(t, transport.RestoreState(context.Background(), &MetadataContainer{}))
+
+	// Without spill buffer, the state is not persisted
+	disabled := InitApmServerTransport(&extensionConfig{apmServerUrl: "http://localhost:8200/", spillDir: dir})
+	disabled.SaveState(&MetadataContainer{})
+	assert.False(t, disabled.RestoreState(context.Background(), &MetadataContainer{}))
+}
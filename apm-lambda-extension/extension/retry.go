@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// retryConfig holds the parameters of the retries of the requests to the APM server failing transiently
+// during an invocation: the nth retry is delayed by initialDelay × 2ⁿ⁻¹, capped to maxRetryDelay, of which up
+// to half is jitter.
+type retryConfig struct {
+	maxRetries   int
+	initialDelay time.Duration
+}
+
+// maxRetryDelay caps the delay before a retry, so that the retries stay within a single invocation.
+const maxRetryDelay = 2 * time.Second
+
+var defaultRetryConfig = retryConfig{
+	maxRetries:   2,
+	initialDelay: 100 * time.Millisecond,
+}
+
+// delay returns the jittered delay before the retry following attempt failed attempts.
+func (config retryConfig) delay(attempt int) time.Duration {
+	delay := config.initialDelay << uint(attempt)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// SetInvocationDeadline records the deadline of the current invocation, beyond which the requests failing
+// transiently are not retried. A zero deadline removes the limit.
+func (transport *ApmServerTransport) SetInvocationDeadline(deadline time.Time) {
+	var unixNano int64
+	if !deadline.IsZero() {
+		unixNano = deadline.UnixNano()
+	}
+	atomic.StoreInt64(&transport.invocationDeadline, unixNano)
+}
+
+// retryTransientFailures sends req again while it fails transiently, at most maxRetries times, and returns the
+// outcome of the last attempt. A retry is only attempted when its delay ends before the deadline of ctx and
+// of the invocation, so that the transient failures of the APM server do not delay the end of the invocation.
+func (transport *ApmServerTransport) retryTransientFailures(ctx context.Context, req *http.Request, resp *http.Response, err error) (*http.Response, error) {
+	retry := transport.config.retry
+	for attempt := 0; attempt < retry.maxRetries && isTransientFailure(resp, err); attempt++ {
+		delay := retry.delay(attempt)
+		if !transport.canRetryWithin(ctx, delay) {
+			Log.Debugf("No time left to retry posting to APM server before the deadline")
+			break
+		}
+		retryReq, replayErr := replayRequest(req)
+		if replayErr != nil {
+			break
+		}
+		Log.Infof("Transient failure posting to APM server, retrying in %s (%d/%d)", delay, attempt+1, retry.maxRetries)
+		select {
+		case <-transport.clock.After(delay):
+		case <-ctx.Done():
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		atomic.AddInt64(&transport.retriedRequests, 1)
+		resp, err = transport.client.Do(retryReq)
+	}
+	return resp, err
+}
+
+// canRetryWithin reports whether a retry delayed by delay starts before the deadline of ctx and of the
+// invocation, if any.
+func (transport *ApmServerTransport) canRetryWithin(ctx context.Context, delay time.Duration) bool {
+	retryAt := transport.clock.Now().Add(delay)
+	if deadline, ok := ctx.Deadline(); ok && !retryAt.Before(deadline) {
+		return false
+	}
+	if deadline := atomic.LoadInt64(&transport.invocationDeadline); deadline != 0 && !retryAt.Before(time.Unix(0, deadline)) {
+		return false
+	}
+	return true
+}
+
+// isTransientFailure reports whether a request may succeed if sent again: it failed with a network error, or
+// with a 502, 503 or 504 status without a Retry-After header while no event was accepted, so that the retry
+// cannot duplicate events. The body of resp is read, and replaced so that it can be read again.
+func isTransientFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return false
+	}
+	if resp.Header.Get("Retry-After") != "" {
+		// The APM server throttles the extension, the agent data is sent again once it asked to
+		return false
+	}
+	body, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		return true
+	}
+	var response intakeResponse
+	if json.Unmarshal(body, &response) != nil {
+		return true
+	}
+	return response.Accepted == 0
+}
@@ -0,0 +1,135 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+	config := retryConfig{maxRetries: 10, initialDelay: 100 * time.Millisecond}
+	for attempt, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		delay := config.delay(attempt)
+		assert.GreaterOrEqual(t, delay, expected/2)
+		assert.LessOrEqual(t, delay, expected)
+	}
+	assert.LessOrEqual(t, config.delay(40), maxRetryDelay)
+	assert.GreaterOrEqual(t, config.delay(40), maxRetryDelay/2)
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		retry:        retryConfig{maxRetries: 2, initialDelay: time.Millisecond},
+	})
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, int64(2), transport.DebugVars().Buffer.RetriedRequests)
+	assert.Equal(t, Healthy, transport.currentStatus())
+}
+
+func TestRetryTransientFailuresBounded(t *testing.T) {
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		retry:        retryConfig{maxRetries: 2, initialDelay: time.Millisecond},
+	})
+	require.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, Failing, transport.currentStatus())
+}
+
+func TestRetryTransientFailuresSkipsPartiallyAccepted(t *testing.T) {
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"accepted":1,"errors":[{"message":"queue is full"}]}`))
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		retry:        retryConfig{maxRetries: 2, initialDelay: time.Millisecond},
+	})
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestRetryTransientFailuresHonorsDeadline(t *testing.T) {
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		retry:        retryConfig{maxRetries: 2, initialDelay: time.Second},
+	})
+	transport.SetInvocationDeadline(time.Now().Add(100 * time.Millisecond))
+	require.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	transport = InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		retry:        retryConfig{maxRetries: 2, initialDelay: time.Second},
+	})
+	require.Error(t, transport.PostToApmServer(ctx, AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestRetryTransientFailuresNetworkError(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		retry:        retryConfig{maxRetries: 2, initialDelay: time.Millisecond},
+	})
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int64(2), transport.DebugVars().Buffer.RetriedRequests)
+	assert.Equal(t, Failing, transport.currentStatus())
+}
@@ -19,16 +19,38 @@ package extension
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"time"
 )
 
 type AgentData struct {
 	Data            []byte
 	ContentEncoding string
+	// retried is set on the events sent again after the APM server could not process them
+	retried bool
+	// agentUserAgent is the User-Agent of the agent that sent the data, if any
+	agentUserAgent string
+	// receivedAt is the time the extension received the data from the agent, if it did
+	receivedAt time.Time
+}
+
+// maxAgentUserAgentBytes caps the size of the User-Agent of the agents forwarded to the APM server.
+const maxAgentUserAgentBytes = 256
+
+// agentUserAgent returns the User-Agent of the agent sending r, truncated to maxAgentUserAgentBytes.
+func agentUserAgent(r *http.Request) string {
+	ua := r.Header.Get("User-Agent")
+	if len(ua) > maxAgentUserAgentBytes {
+		ua = ua[:maxAgentUserAgentBytes]
+	}
+	return ua
 }
 
 // URL: http://server/
@@ -36,24 +58,27 @@ func handleInfoRequest(ctx context.Context, apmServerTransport *ApmServerTranspo
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		Log.Debug("Handling APM server Info Request")
+		w.Header().Set(intakeVersionsHeader, intakeVersions)
+
+		// Agents poll the server URL to check the health of the APM server. While it is known to be
+		// unreachable, answer on its behalf, so that the agents back off instead of waiting for a timeout.
+		if apmServerTransport.backingOff() {
+			writeUnavailable(w, apmServerTransport.remainingGracePeriod(apmServerTransport.clock.Now()))
+			return
+		}
 
 		// Init reverse proxy
-		parsedApmServerUrl, err := url.Parse(apmServerTransport.config.apmServerUrl)
+		parsedApmServerUrl, err := url.Parse(apmServerTransport.endpoints.active().url)
 		if err != nil {
 			Log.Errorf("could not parse APM server URL: %v", err)
 			return
 		}
 
-		reverseProxy := httputil.NewSingleHostReverseProxy(parsedApmServerUrl)
-
-		reverseProxyTimeout := time.Duration(apmServerTransport.config.DataForwarderTimeoutSeconds) * time.Second
-		customTransport := http.DefaultTransport.(*http.Transport).Clone()
-		customTransport.ResponseHeaderTimeout = reverseProxyTimeout
-		reverseProxy.Transport = customTransport
-
+		reverseProxy := newApmServerProxy(apmServerTransport, parsedApmServerUrl)
 		reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 			apmServerTransport.SetApmServerTransportState(ctx, Failing)
 			Log.Errorf("Error querying version from the APM server: %v", err)
+			writeJSONError(w, http.StatusBadGateway, "APM server unreachable: "+err.Error())
 		}
 
 		// Process request (the Golang doc suggests removing any pre-existing X-Forwarded-For header coming
@@ -71,34 +96,135 @@ func handleInfoRequest(ctx context.Context, apmServerTransport *ApmServerTranspo
 	}
 }
 
+// newApmServerProxy returns a reverse proxy to target sharing the settings of the client sending data to
+// the APM server.
+func newApmServerProxy(apmServerTransport *ApmServerTransport, target *url.URL) *httputil.ReverseProxy {
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	customTransport := apmServerTransport.client.Transport.(*http.Transport).Clone()
+	customTransport.ResponseHeaderTimeout = apmServerTransport.client.Timeout
+	reverseProxy.Transport = customTransport
+	return reverseProxy
+}
+
+// writeUnavailable responds that the APM server is unavailable, and that the agent should retry once the
+// grace period of the transport is over.
+func writeUnavailable(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeJSONError(w, http.StatusServiceUnavailable, "APM server unavailable, the extension is backing off")
+}
+
+// writeJSONError responds with an error formatted like those of the APM server.
+func writeJSONError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	body, _ := json.Marshal(map[string]string{"error": message})
+	if _, err := w.Write(body); err != nil {
+		Log.Errorf("Failed to write the error response: %v", err)
+	}
+}
+
 // URL: http://server/intake/v2/events
-func handleIntakeV2Events(transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+func handleIntakeV2Events(ctx context.Context, transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return handleIntakeEvents(ctx, transport, false)
+}
+
+// URL: http://server/intake/v3/events
+//
+// handleIntakeV3Events receives agent data in the compact intake v3 format, and converts it to the intake
+// v2 format before processing it like the agent data received by the intake v2 endpoint.
+func handleIntakeV3Events(ctx context.Context, transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return handleIntakeEvents(ctx, transport, true)
+}
+
+// handleIntakeEvents handles the agent data received by the intake endpoints, compact if it is in the
+// intake v3 format.
+func handleIntakeEvents(ctx context.Context, transport *ApmServerTransport, compact bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		Log.Debug("Handling APM Data Intake")
-		rawBytes, err := ioutil.ReadAll(r.Body)
+		receivedAt := time.Now()
 		defer r.Body.Close()
-		if err != nil {
+		var enqueueErr error
+		var validationErr *intakeValidationError
+		var rejectedErr *intakeRejectedError
+		// Requests without a body, e.g. flush signals, are never streamed, nor are compact events which
+		// must be converted first
+		if r.ContentLength != 0 && !compact && transport.shouldStream() {
+			transport.markAgentDataSeen()
+			if err := transport.StreamToApmServer(ctx, r.Body, r.Header.Get("Content-Encoding"), agentUserAgent(r)); errors.As(err, &rejectedErr) {
+				Log.Warnf("Relaying the rejection of the agent data: %v", err)
+			} else if err != nil {
+				Log.Errorf("Could not stream agent data to the APM server: %v", err)
+			} else {
+				transport.metrics.deliveryLatency.observe(time.Since(receivedAt))
+			}
+		} else if rawBytes, err := ioutil.ReadAll(r.Body); err != nil {
 			Log.Errorf("Could not read agent intake request body: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
-		}
-
-		if len(rawBytes) > 0 {
+		} else if len(rawBytes) > 0 {
+			transport.markAgentDataSeen()
 			agentData := AgentData{
 				Data:            rawBytes,
 				ContentEncoding: r.Header.Get("Content-Encoding"),
+				agentUserAgent:  agentUserAgent(r),
+			}
+			if compact {
+				agentData, validationErr = expandCompactAgentData(agentData)
+			}
+			if validationErr == nil {
+				validationErr = transport.validateAgentData(agentData)
 			}
+			if validationErr != nil {
+				Log.Warnf("Rejecting agent data: %v", validationErr)
+			} else {
+				agentData = transport.linkXRayTrace(transport.transcodeDeflate(agentData))
+				agentData.receivedAt = receivedAt
+				if transport.tailSampler.hold(agentData) {
+					Log.Debug("Holding agent data for tail sampling")
+				} else if enqueueErr = transport.enqueueAgentData(r.Context(), agentData); enqueueErr != nil {
+					Log.Errorf("Could not buffer agent data: %v", enqueueErr)
+				} else {
+					transport.metrics.enqueueLatency.observe(time.Since(receivedAt))
+				}
+			}
+		}
 
-			transport.EnqueueAPMData(agentData)
+		// Agents of functions processing batches can announce how many flushes to expect during the
+		// invocation, so that the invocation is not considered done after the first one.
+		if expected := r.URL.Query().Get("expected_flushes"); expected != "" {
+			count, err := strconv.Atoi(expected)
+			if err != nil || count < 1 {
+				Log.Warnf("Invalid expected_flushes query parameter: %s", expected)
+			} else {
+				transport.expectFlushes(count)
+			}
 		}
 
 		if len(r.URL.Query()["flushed"]) > 0 && r.URL.Query()["flushed"][0] == "true" {
-			transport.AgentDoneSignal <- struct{}{}
+			transport.signalAgentDone()
 		}
 
+		// The flush signals are handled even if the agent data was not buffered, so that the
+		// invocation does not wait for the agent.
+		if validationErr != nil {
+			writeIntakeValidationError(w, validationErr)
+			return
+		}
+		if rejectedErr != nil {
+			rejectedErr.write(w)
+			return
+		}
+		if enqueueErr != nil {
+			http.Error(w, enqueueErr.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusAccepted)
-		if _, err = w.Write([]byte("ok")); err != nil {
+		if _, err := w.Write([]byte("ok")); err != nil {
 			Log.Errorf("Failed to send intake response to APM agent : %v", err)
 		}
 	}
@@ -0,0 +1,249 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRuntimeAPIProxyPort is the port on which the Runtime API is proxied, unless configured otherwise.
+	defaultRuntimeAPIProxyPort = "9009"
+	// maxCapturedPayloadBytes caps the size of the captured invocation events and responses.
+	maxCapturedPayloadBytes = 8 * 1024
+	// maxCapturedInvocations is the number of invocations whose payloads are kept, so that the transactions
+	// sent after the next invocation started can still be enriched.
+	maxCapturedInvocations = 4
+
+	runtimeAPIInvocationPath = "/2018-06-01/runtime/invocation/"
+	runtimeAPINextPath       = runtimeAPIInvocationPath + "next"
+	requestIDHeader          = "Lambda-Runtime-Aws-Request-Id"
+)
+
+// invocationPayload holds the event and the response of an invocation, truncated to maxCapturedPayloadBytes,
+// and the time its trigger waited before the runtime received the event, if known.
+type invocationPayload struct {
+	requestID    string
+	event        string
+	response     string
+	queueTime    time.Duration
+	hasQueueTime bool
+}
+
+// invocationPayloads holds the payloads of the last invocations.
+type invocationPayloads struct {
+	mu       sync.Mutex
+	payloads []*invocationPayload
+}
+
+func (p *invocationPayloads) get(requestID string) *invocationPayload {
+	for _, payload := range p.payloads {
+		if payload.requestID == requestID {
+			return payload
+		}
+	}
+	return nil
+}
+
+func (p *invocationPayloads) recordEvent(requestID string, event []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.payloads) == maxCapturedInvocations {
+		p.payloads = p.payloads[1:]
+	}
+	payload := &invocationPayload{requestID: requestID, event: truncatePayload(event)}
+	payload.queueTime, payload.hasQueueTime = queueTime(event, time.Now())
+	p.payloads = append(p.payloads, payload)
+}
+
+func (p *invocationPayloads) recordResponse(requestID string, response []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if payload := p.get(requestID); payload != nil {
+		payload.response = truncatePayload(response)
+	}
+}
+
+// lookup returns a copy of the payloads of the invocation requestID, or false if they were not captured.
+func (p *invocationPayloads) lookup(requestID string) (invocationPayload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if payload := p.get(requestID); payload != nil {
+		return *payload, true
+	}
+	return invocationPayload{}, false
+}
+
+func truncatePayload(payload []byte) string {
+	if len(payload) > maxCapturedPayloadBytes {
+		payload = payload[:maxCapturedPayloadBytes]
+	}
+	return string(payload)
+}
+
+// RuntimeAPIProxy proxies the Runtime API for the runtime of the function, and captures the event and the
+// response of the invocations, which are added to the transactions of the function. The runtime uses the
+// proxy once the AWS_LAMBDA_RUNTIME_API environment variable of the function is set to its address, by the
+// wrapper script set as AWS_LAMBDA_EXEC_WRAPPER.
+type RuntimeAPIProxy struct {
+	server   *http.Server
+	payloads *invocationPayloads
+}
+
+// StartRuntimeAPIProxy starts proxying the Runtime API, or returns nil if the proxy is not enabled. It must be
+// started before the extension registers, as the runtime is initialized once all the extensions registered.
+func StartRuntimeAPIProxy(config *extensionConfig, runtimeAPI string) (*RuntimeAPIProxy, error) {
+	if !config.runtimeAPIProxy {
+		return nil, nil
+	}
+	target, err := url.Parse("http://" + runtimeAPI)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &RuntimeAPIProxy{payloads: &invocationPayloads{}}
+	// The runtime long polls the next invocation, so the responses have no timeout. The Runtime API is
+	// local to the execution environment, and never reached through the proxy of the environment, if any.
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	proxyTransport := http.DefaultTransport.(*http.Transport).Clone()
+	proxyTransport.Proxy = nil
+	reverseProxy.Transport = proxyTransport
+	reverseProxy.ModifyResponse = proxy.captureEvent
+	proxy.server = &http.Server{
+		Addr:    net.JoinHostPort("127.0.0.1", config.runtimeAPIProxyPort),
+		Handler: proxy.handler(reverseProxy),
+	}
+	ln, err := net.Listen("tcp", proxy.server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	// The port may have been chosen by the system
+	proxy.server.Addr = ln.Addr().String()
+	go func() {
+		Log.Infof("Extension proxying the Runtime API on %s", ln.Addr())
+		if err := proxy.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			Log.Errorf("Error upon Runtime API proxy start : %v", err)
+		}
+	}()
+	return proxy, nil
+}
+
+// Close stops proxying the Runtime API.
+func (proxy *RuntimeAPIProxy) Close() error {
+	if proxy == nil {
+		return nil
+	}
+	return proxy.server.Close()
+}
+
+// handler captures the responses of the invocations posted by the runtime, before forwarding them.
+func (proxy *RuntimeAPIProxy) handler(reverseProxy *httputil.ReverseProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestID, ok := invocationResponseRequestID(r); ok {
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				Log.Errorf("Could not read the invocation response: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			proxy.payloads.recordResponse(requestID, body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		reverseProxy.ServeHTTP(w, r)
+	}
+}
+
+// captureEvent captures the event of the invocations received by the runtime.
+func (proxy *RuntimeAPIProxy) captureEvent(resp *http.Response) error {
+	if resp.Request.URL.Path != runtimeAPINextPath || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	proxy.payloads.recordEvent(resp.Header.Get(requestIDHeader), body)
+	return nil
+}
+
+// invocationResponseRequestID returns the request ID of the invocation whose response is posted by r, or
+// false if r does not post the response of an invocation.
+func invocationResponseRequestID(r *http.Request) (string, bool) {
+	path := r.URL.Path
+	if r.Method != http.MethodPost || !strings.HasPrefix(path, runtimeAPIInvocationPath) || !strings.HasSuffix(path, "/response") {
+		return "", false
+	}
+	requestID := strings.TrimSuffix(strings.TrimPrefix(path, runtimeAPIInvocationPath), "/response")
+	return requestID, requestID != "" && !strings.Contains(requestID, "/")
+}
+
+// SetRuntimeAPIProxy sets the proxy of the Runtime API whose captured invocation payloads are added to the
+// transactions.
+func (transport *ApmServerTransport) SetRuntimeAPIProxy(proxy *RuntimeAPIProxy) {
+	if proxy != nil {
+		transport.invocations = proxy.payloads
+	}
+}
+
+// addInvocationPayloads returns the uncompressed agent data with the captured event and response of their
+// invocation added to the custom context of its transactions, or false if no transaction was enriched.
+func (transport *ApmServerTransport) addInvocationPayloads(agentData AgentData) ([]byte, bool, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, false, err
+	}
+	enriched, changed := addInvocationPayloads(data, transport.invocations)
+	return enriched, changed, nil
+}
+
+func addInvocationPayloads(data []byte, payloads *invocationPayloads) ([]byte, bool) {
+	return rewriteTransactions(data, func(transaction map[string]interface{}) bool {
+		faas, _ := transaction["faas"].(map[string]interface{})
+		requestID, _ := faas["execution"].(string)
+		payload, ok := payloads.lookup(requestID)
+		return ok && setInvocationPayload(transaction, payload)
+	})
+}
+
+// setInvocationPayload adds the event and the response of payload to the custom context of transaction,
+// unless already set. It reports whether transaction was changed.
+func setInvocationPayload(transaction map[string]interface{}, payload invocationPayload) bool {
+	changed := false
+	for _, field := range []struct {
+		key   string
+		value string
+	}{
+		{"lambda_event", payload.event},
+		{"lambda_response", payload.response},
+	} {
+		if setDefault(transaction, field.value, "context", "custom", field.key) {
+			changed = true
+		}
+	}
+	return changed
+}
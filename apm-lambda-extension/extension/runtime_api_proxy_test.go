@@ -0,0 +1,140 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuntimeAPIProxy(t *testing.T) {
+	var response string
+	runtimeAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2018-06-01/runtime/invocation/next":
+			w.Header().Set("Lambda-Runtime-Aws-Request-Id", "req-1")
+			_, _ = w.Write([]byte(`{"key":"value"}`))
+		case "/2018-06-01/runtime/invocation/req-1/response":
+			body, _ := ioutil.ReadAll(r.Body)
+			response = string(body)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer runtimeAPI.Close()
+
+	config := extensionConfig{runtimeAPIProxy: true, runtimeAPIProxyPort: "0"}
+	proxy, err := StartRuntimeAPIProxy(&config, strings.TrimPrefix(runtimeAPI.URL, "http://"))
+	require.NoError(t, err)
+	defer proxy.Close()
+	proxyURL := "http://" + proxy.server.Addr
+
+	// The runtime receives the event and the response reaches the Runtime API, as without the proxy
+	resp, err := http.Get(proxyURL + "/2018-06-01/runtime/invocation/next")
+	require.NoError(t, err)
+	event, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, `{"key":"value"}`, string(event))
+	assert.Equal(t, "req-1", resp.Header.Get("Lambda-Runtime-Aws-Request-Id"))
+
+	resp, err = http.Post(proxyURL+"/2018-06-01/runtime/invocation/req-1/response", "application/json", strings.NewReader(`"ok"`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, `"ok"`, response)
+
+	resp, err = http.Post(proxyURL+"/2018-06-01/runtime/init/error", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	payload, ok := proxy.payloads.lookup("req-1")
+	require.True(t, ok)
+	assert.Equal(t, invocationPayload{requestID: "req-1", event: `{"key":"value"}`, response: `"ok"`}, payload)
+}
+
+func TestRuntimeAPIProxyDisabled(t *testing.T) {
+	proxy, err := StartRuntimeAPIProxy(&extensionConfig{}, "localhost:9001")
+	assert.NoError(t, err)
+	assert.Nil(t, proxy)
+	assert.NoError(t, proxy.Close())
+}
+
+func TestInvocationPayloadsEviction(t *testing.T) {
+	payloads := &invocationPayloads{}
+	payloads.recordEvent("req-0", []byte(strings.Repeat("a", maxCapturedPayloadBytes+1)))
+	payload, ok := payloads.lookup("req-0")
+	require.True(t, ok)
+	assert.Len(t, payload.event, maxCapturedPayloadBytes)
+
+	for i := 1; i <= maxCapturedInvocations; i++ {
+		payloads.recordEvent("req-"+string(rune('0'+i)), []byte("{}"))
+	}
+	_, ok = payloads.lookup("req-0")
+	assert.False(t, ok)
+	_, ok = payloads.lookup("req-1")
+	assert.True(t, ok)
+}
+
+func TestPostToApmServerInvocationPayloads(t *testing.T) {
+	var received string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		data, err := GetUncompressedBytes(body, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		received = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/"})
+	payloads := &invocationPayloads{}
+	payloads.recordEvent("req-1", []byte(`{"key":"value"}`))
+	payloads.recordResponse("req-1", []byte(`"ok"`))
+	transport.SetRuntimeAPIProxy(&RuntimeAPIProxy{payloads: payloads})
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}
+{"transaction":{"id":"1","faas":{"execution":"req-1"}}}
+{"transaction":{"id":"2","faas":{"execution":"req-2"}}}
+`)}))
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"context":{"custom":{"lambda_event":"{\"key\":\"value\"}","lambda_response":"\"ok\""}},"faas":{"execution":"req-1"},"id":"1"}}
+{"transaction":{"id":"2","faas":{"execution":"req-2"}}}
+`, received)
+}
+
+func TestProcessEnvRuntimeAPIProxy(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.runtimeAPIProxy)
+	assert.Equal(t, "9009", config.runtimeAPIProxyPort)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY", "true")
+	t.Setenv("ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY_PORT", "9010")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.runtimeAPIProxy)
+	assert.Equal(t, "9010", config.runtimeAPIProxyPort)
+}
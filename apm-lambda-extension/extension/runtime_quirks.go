@@ -0,0 +1,80 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// executionEnvPrefix starts the value of AWS_EXECUTION_ENV for the runtimes managed by AWS, e.g.
+// AWS_Lambda_nodejs16.x. The variable is not set for custom runtimes.
+const executionEnvPrefix = "AWS_Lambda_"
+
+// RuntimeQuirks adapts the way the extension waits for the end of an invocation to the Lambda runtime
+// and to the behavior of its APM agent.
+type RuntimeQuirks struct {
+	// Runtime is the runtime the quirks apply to, or "default".
+	Runtime string
+	// DeadlineMargin is the time interval before the function deadline at which the extension stops
+	// waiting for the end of the invocation, in order to leave room for a last flush attempt.
+	DeadlineMargin time.Duration
+	// AgentDoneWait is how long the extension keeps waiting for the agent to signal that it flushed
+	// its data, once the runtime reported the end of the invocation.
+	AgentDoneWait time.Duration
+}
+
+// defaultRuntimeQuirks apply to the runtimes missing from runtimeQuirksTable, and to custom runtimes.
+var defaultRuntimeQuirks = RuntimeQuirks{
+	Runtime:        "default",
+	DeadlineMargin: 100 * time.Millisecond,
+}
+
+// runtimeQuirksTable holds the quirks of each runtime, keyed by the prefix of the runtime identifier
+// found in AWS_EXECUTION_ENV. Add an entry here when an agent needs a different flush behavior.
+var runtimeQuirksTable = []RuntimeQuirks{
+	// The Node.js agent signals that it flushed its data before the handler response is returned,
+	// including for streamed responses, so that there is no need to wait for it after runtimeDone.
+	{Runtime: "nodejs", DeadlineMargin: 100 * time.Millisecond},
+	// With gevent, the Python agent flushes from a greenlet that may only run once the handler
+	// returned, after the runtime reported the end of the invocation.
+	{Runtime: "python", DeadlineMargin: 100 * time.Millisecond, AgentDoneWait: 100 * time.Millisecond},
+	// The Java agent flushes after the handler returned, and its first flushes are slower, notably
+	// after a SnapStart restore, while the JIT compiler warms up.
+	{Runtime: "java", DeadlineMargin: 200 * time.Millisecond, AgentDoneWait: 200 * time.Millisecond},
+}
+
+// DetectRuntimeQuirks returns the quirks of the runtime of the function, as identified by the
+// AWS_EXECUTION_ENV environment variable.
+func DetectRuntimeQuirks() RuntimeQuirks {
+	return runtimeQuirksFor(os.Getenv("AWS_EXECUTION_ENV"))
+}
+
+func runtimeQuirksFor(executionEnv string) RuntimeQuirks {
+	if !strings.HasPrefix(executionEnv, executionEnvPrefix) {
+		return defaultRuntimeQuirks
+	}
+	runtime := strings.TrimPrefix(executionEnv, executionEnvPrefix)
+	for _, quirks := range runtimeQuirksTable {
+		if strings.HasPrefix(runtime, quirks.Runtime) {
+			return quirks
+		}
+	}
+	return defaultRuntimeQuirks
+}
@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeQuirksFor(t *testing.T) {
+	tests := []struct {
+		executionEnv string
+		runtime      string
+	}{
+		{executionEnv: "AWS_Lambda_nodejs16.x", runtime: "nodejs"},
+		{executionEnv: "AWS_Lambda_python3.9", runtime: "python"},
+		{executionEnv: "AWS_Lambda_java11", runtime: "java"},
+		{executionEnv: "AWS_Lambda_dotnet6", runtime: "default"},
+		{executionEnv: "", runtime: "default"},
+		{executionEnv: "nodejs16.x", runtime: "default"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.executionEnv, func(t *testing.T) {
+			assert.Equal(t, tc.runtime, runtimeQuirksFor(tc.executionEnv).Runtime)
+		})
+	}
+}
+
+func TestProcessEnvRuntimeQuirks(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	t.Setenv("AWS_EXECUTION_ENV", "AWS_Lambda_java11")
+
+	config := ProcessEnv(nil)
+	assert.Equal(t, "java", config.RuntimeQuirks.Runtime)
+	assert.Equal(t, 200*time.Millisecond, config.RuntimeQuirks.DeadlineMargin)
+	assert.Equal(t, 200*time.Millisecond, config.RuntimeQuirks.AgentDoneWait)
+
+	t.Setenv("ELASTIC_APM_FLUSH_DEADLINE_MARGIN", "300ms")
+	t.Setenv("ELASTIC_APM_AGENT_DONE_WAIT", "0")
+	config = ProcessEnv(nil)
+	assert.Equal(t, 300*time.Millisecond, config.RuntimeQuirks.DeadlineMargin)
+	assert.Equal(t, time.Duration(0), config.RuntimeQuirks.AgentDoneWait)
+
+	t.Setenv("ELASTIC_APM_FLUSH_DEADLINE_MARGIN", "-1s")
+	t.Setenv("ELASTIC_APM_AGENT_DONE_WAIT", "soon")
+	config = ProcessEnv(nil)
+	assert.Equal(t, 200*time.Millisecond, config.RuntimeQuirks.DeadlineMargin)
+	assert.Equal(t, 200*time.Millisecond, config.RuntimeQuirks.AgentDoneWait)
+}
@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultSanitizeFieldNames are the default patterns of the APM agents, plus the Cookie header, which the
+// agents send as parsed cookies.
+var defaultSanitizeFieldNames = []string{
+	"password", "passwd", "pwd", "secret", "*key", "*token*", "*session*", "*credit*", "*card*", "*auth*",
+	"*principal*", "set-cookie", "cookie",
+}
+
+// fieldSanitizer redacts the values of the HTTP headers, cookies, and request body fields of the agent
+// events whose names match the ELASTIC_APM_SANITIZE_FIELD_NAMES patterns, so that they are scrubbed
+// whatever the configuration of the agent.
+type fieldSanitizer struct {
+	pattern *regexp.Regexp
+}
+
+// newFieldSanitizer returns the sanitizer of the agent events, or nil if the sanitization is disabled.
+// The patterns are matched case-insensitively, and * matches any number of characters.
+func newFieldSanitizer(config *extensionConfig) *fieldSanitizer {
+	if !config.sanitize {
+		return nil
+	}
+	names := config.sanitizeFieldNames
+	if len(names) == 0 {
+		names = defaultSanitizeFieldNames
+	}
+	patterns := make([]string, len(names))
+	for i, name := range names {
+		parts := strings.Split(name, "*")
+		for j, part := range parts {
+			parts[j] = regexp.QuoteMeta(part)
+		}
+		patterns[i] = strings.Join(parts, ".*")
+	}
+	return &fieldSanitizer{pattern: regexp.MustCompile(`(?i)^(?:` + strings.Join(patterns, "|") + `)$`)}
+}
+
+// sanitizeAgentData returns the uncompressed agent data with the sensitive fields of its events redacted,
+// and whether any field was redacted.
+func (transport *ApmServerTransport) sanitizeAgentData(agentData AgentData) ([]byte, bool, error) {
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		return nil, false, err
+	}
+	sanitized, changed := rewriteEvents(data, []string{"transaction", "span", "error"}, func(_ string, event map[string]interface{}) bool {
+		return transport.sanitizer.sanitizeEvent(event)
+	})
+	return sanitized, changed, nil
+}
+
+// sanitizeEvent redacts the sensitive fields of the context of event, and reports whether any was redacted.
+func (sanitizer *fieldSanitizer) sanitizeEvent(event map[string]interface{}) bool {
+	context, _ := event["context"].(map[string]interface{})
+	request, _ := context["request"].(map[string]interface{})
+	response, _ := context["response"].(map[string]interface{})
+	message, _ := context["message"].(map[string]interface{})
+	changed := false
+	for _, fields := range []interface{}{request["headers"], request["cookies"], request["body"], response["headers"], message["headers"]} {
+		if sanitizer.sanitize(fields) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// sanitize redacts the values of the fields of v matching the patterns, in nested objects and arrays too,
+// and reports whether any was redacted.
+func (sanitizer *fieldSanitizer) sanitize(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sanitizer.pattern.MatchString(key) {
+				if value != redacted {
+					v[key] = redacted
+					changed = true
+				}
+			} else if sanitizer.sanitize(value) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if sanitizer.sanitize(value) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,102 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFieldSanitizer(t *testing.T) {
+	assert.Nil(t, newFieldSanitizer(&extensionConfig{}))
+
+	sanitizer := newFieldSanitizer(&extensionConfig{sanitize: true})
+	for _, name := range []string{"Authorization", "Cookie", "set-cookie", "X-Api-Key", "access_token", "PASSWORD", "sessionid"} {
+		assert.True(t, sanitizer.pattern.MatchString(name), name)
+	}
+	for _, name := range []string{"Content-Type", "passwords", "keyboard", "user"} {
+		assert.False(t, sanitizer.pattern.MatchString(name), name)
+	}
+
+	sanitizer = newFieldSanitizer(&extensionConfig{sanitize: true, sanitizeFieldNames: []string{"ssn", "x-*.id"}})
+	assert.True(t, sanitizer.pattern.MatchString("SSN"))
+	assert.True(t, sanitizer.pattern.MatchString("x-tenant.id"))
+	assert.False(t, sanitizer.pattern.MatchString("x-tenant-id"))
+	assert.False(t, sanitizer.pattern.MatchString("Authorization"))
+}
+
+func TestSanitizeAgentData(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "https://example.com/", sanitize: true})
+	data := `{"metadata":{"service":{"name":"foo"}}}
+{"transaction":{"id":"1","duration":1.50,"context":{"request":{"headers":{"Authorization":"Bearer abc","Content-Type":"application/json"},"cookies":{"sessionid":"123","theme":"dark"},"body":{"user":"joe","password":"hunter2","card":{"number":"4111"},"items":[{"secret":"s"}]}},"response":{"headers":{"Set-Cookie":"a=b"}}}}}
+{"span":{"id":"2","context":{"message":{"headers":{"x-api-key":"k"}}}}}
+{"error":{"id":"3","transaction":{"sampled":true},"context":{"request":{"headers":{"Cookie":"a=b"}}}}}
+{"span":{"id":"4","context":{"db":{"statement":"SELECT password FROM users"}}}}
+`
+	sanitized, changed, err := transport.sanitizeAgentData(AgentData{Data: []byte(data)})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"metadata":{"service":{"name":"foo"}}}
+{"transaction":{"context":{"request":{"body":{"card":"[REDACTED]","items":[{"secret":"[REDACTED]"}],"password":"[REDACTED]","user":"joe"},"cookies":{"sessionid":"[REDACTED]","theme":"dark"},"headers":{"Authorization":"[REDACTED]","Content-Type":"application/json"}},"response":{"headers":{"Set-Cookie":"[REDACTED]"}}},"duration":1.50,"id":"1"}}
+{"span":{"context":{"message":{"headers":{"x-api-key":"[REDACTED]"}}},"id":"2"}}
+{"error":{"context":{"request":{"headers":{"Cookie":"[REDACTED]"}}},"id":"3","transaction":{"sampled":true}}}
+{"span":{"id":"4","context":{"db":{"statement":"SELECT password FROM users"}}}}
+`, string(sanitized))
+
+	_, changed, err = transport.sanitizeAgentData(AgentData{Data: sanitized})
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestPostToApmServerSanitized(t *testing.T) {
+	var body []byte
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, err = GetUncompressedBytes(data, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", sanitize: true, dataForwarderMode: StreamMode}
+	transport := InitApmServerTransport(&config)
+	assert.False(t, transport.shouldStream())
+	data := `{"metadata":{}}` + "\n" + `{"transaction":{"context":{"request":{"headers":{"Authorization":"Bearer abc"}}}}}` + "\n"
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte(data)}))
+	assert.Equal(t, `{"metadata":{}}`+"\n"+`{"transaction":{"context":{"request":{"headers":{"Authorization":"[REDACTED]"}}}}}`+"\n", string(body))
+}
+
+func TestProcessEnvSanitize(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.sanitize)
+	assert.Empty(t, config.sanitizeFieldNames)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_SANITIZE", "true")
+	t.Setenv("ELASTIC_APM_SANITIZE_FIELD_NAMES", "password, *token*")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.sanitize)
+	assert.Equal(t, []string{"password", "*token*"}, config.sanitizeFieldNames)
+}
@@ -0,0 +1,166 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+)
+
+// selfMetrics is the registry of the self-monitoring metrics of the extension. The counters are updated
+// atomically, as they are incremented from the agent data and forwarding goroutines.
+type selfMetrics struct {
+	invocations       int64
+	forwardedBytes    int64
+	requests          int64
+	requestLatencyUs  int64
+	maxLatencyUs      int64
+	stateChanges      int64
+	flushTimeouts     int64
+	droppedPayloads   int64
+	invalidPayloads   int64
+	rateLimitedEvents int64
+	rateLimitedBytes  int64
+	truncatedEvents   int64
+	throttled         int64
+	clientErrors      int64
+	// enqueueLatency is the time from the receipt of agent data to its buffering, and deliveryLatency the
+	// time from its receipt to its delivery to the APM server
+	enqueueLatency  latencyHistogram
+	deliveryLatency latencyHistogram
+
+	// reported holds the counters at the time of the last report, as the metrics are shipped as deltas
+	reported selfMetricsCounters
+}
+
+// selfMetricsCounters is a snapshot of the cumulative counters of selfMetrics.
+type selfMetricsCounters struct {
+	invocations       int64
+	forwardedBytes    int64
+	requests          int64
+	requestLatencyUs  int64
+	stateChanges      int64
+	flushTimeouts     int64
+	droppedPayloads   int64
+	invalidPayloads   int64
+	rateLimitedEvents int64
+	rateLimitedBytes  int64
+	truncatedEvents   int64
+	throttled         int64
+	clientErrors      int64
+	enqueueLatency    latencyHistogram
+	deliveryLatency   latencyHistogram
+	// deadLetteredPayloads is read from the dead-letter queue rather than counted by selfMetrics
+	deadLetteredPayloads int64
+}
+
+// recordRequest records a request to the APM server that lasted latency, and the size of the data it
+// forwarded, if it succeeded.
+func (metrics *selfMetrics) recordRequest(latency time.Duration, forwardedBytes int) {
+	latencyUs := latency.Microseconds()
+	atomic.AddInt64(&metrics.requests, 1)
+	atomic.AddInt64(&metrics.requestLatencyUs, latencyUs)
+	atomic.AddInt64(&metrics.forwardedBytes, int64(forwardedBytes))
+	for {
+		max := atomic.LoadInt64(&metrics.maxLatencyUs)
+		if latencyUs <= max || atomic.CompareAndSwapInt64(&metrics.maxLatencyUs, max, latencyUs) {
+			return
+		}
+	}
+}
+
+func (metrics *selfMetrics) counters(droppedPayloads int64) selfMetricsCounters {
+	return selfMetricsCounters{
+		invocations:       atomic.LoadInt64(&metrics.invocations),
+		forwardedBytes:    atomic.LoadInt64(&metrics.forwardedBytes),
+		requests:          atomic.LoadInt64(&metrics.requests),
+		requestLatencyUs:  atomic.LoadInt64(&metrics.requestLatencyUs),
+		stateChanges:      atomic.LoadInt64(&metrics.stateChanges),
+		flushTimeouts:     atomic.LoadInt64(&metrics.flushTimeouts),
+		droppedPayloads:   droppedPayloads,
+		invalidPayloads:   atomic.LoadInt64(&metrics.invalidPayloads),
+		rateLimitedEvents: atomic.LoadInt64(&metrics.rateLimitedEvents),
+		rateLimitedBytes:  atomic.LoadInt64(&metrics.rateLimitedBytes),
+		truncatedEvents:   atomic.LoadInt64(&metrics.truncatedEvents),
+		throttled:         atomic.LoadInt64(&metrics.throttled),
+		clientErrors:      atomic.LoadInt64(&metrics.clientErrors),
+		enqueueLatency:    metrics.enqueueLatency.load(),
+		deliveryLatency:   metrics.deliveryLatency.load(),
+	}
+}
+
+// RecordFlushTimeout records that the flush deadline of an invocation was reached before the agent and
+// the runtime signaled the end of the invocation.
+func (transport *ApmServerTransport) RecordFlushTimeout() {
+	atomic.AddInt64(&transport.metrics.flushTimeouts, 1)
+}
+
+// ReportSelfMetrics counts an invocation handled by the extension, and queues a metricset holding the
+// self-monitoring metrics of the extension every ELASTIC_APM_LAMBDA_SELF_METRICS_INVOCATIONS invocations.
+// The counters are reported as deltas since the previous report. If the metricset cannot be queued, they
+// are included in the next report.
+func (transport *ApmServerTransport) ReportSelfMetrics(metadataContainer *MetadataContainer) {
+	invocations := atomic.AddInt64(&transport.metrics.invocations, 1)
+	interval := int64(transport.config.selfMetricsInvocations)
+	if interval <= 0 || invocations-transport.metrics.reported.invocations < interval {
+		return
+	}
+
+	total := transport.metrics.counters(atomic.LoadInt64(&transport.droppedPayloads) + atomic.LoadInt64(&transport.rejectedPayloads))
+	total.deadLetteredPayloads = transport.DeadLetteredPayloads()
+	reported := transport.metrics.reported
+	inFlight, queued := transport.InFlightRequests()
+	samples := map[string]float64{
+		"aws.lambda.extension.invocations":             float64(total.invocations - reported.invocations),
+		"aws.lambda.extension.forwarded.bytes":         float64(total.forwardedBytes - reported.forwardedBytes),
+		"aws.lambda.extension.requests.count":          float64(total.requests - reported.requests),
+		"aws.lambda.extension.requests.latency.sum.us": float64(total.requestLatencyUs - reported.requestLatencyUs),
+		"aws.lambda.extension.requests.latency.max.us": float64(atomic.LoadInt64(&transport.metrics.maxLatencyUs)),
+		"aws.lambda.extension.transport.state_changes": float64(total.stateChanges - reported.stateChanges),
+		"aws.lambda.extension.dropped_payloads":        float64(total.droppedPayloads - reported.droppedPayloads),
+		"aws.lambda.extension.flush.timeouts":          float64(total.flushTimeouts - reported.flushTimeouts),
+		"aws.lambda.extension.invalid_payloads":        float64(total.invalidPayloads - reported.invalidPayloads),
+		"aws.lambda.extension.requests.in_flight":      float64(inFlight),
+		"aws.lambda.extension.requests.queued":         float64(queued),
+		"aws.lambda.extension.rate_limited.events":     float64(total.rateLimitedEvents - reported.rateLimitedEvents),
+		"aws.lambda.extension.rate_limited.bytes":      float64(total.rateLimitedBytes - reported.rateLimitedBytes),
+		"aws.lambda.extension.truncated_events":        float64(total.truncatedEvents - reported.truncatedEvents),
+		"aws.lambda.extension.dead_lettered_payloads":  float64(total.deadLetteredPayloads - reported.deadLetteredPayloads),
+		"aws.lambda.extension.throttled":               float64(total.throttled - reported.throttled),
+		"aws.lambda.extension.client_errors":           float64(total.clientErrors - reported.clientErrors),
+	}
+	metrics := make(map[string]model.Metric, len(samples)+2)
+	for name, value := range samples {
+		metrics[name] = model.Metric{Value: value}
+	}
+	if metric, ok := total.enqueueLatency.metric(reported.enqueueLatency); ok {
+		metrics["aws.lambda.extension.intake.enqueue.latency.us"] = metric
+	}
+	if metric, ok := total.deliveryLatency.metric(reported.deliveryLatency); ok {
+		metrics["aws.lambda.extension.intake.delivery.latency.us"] = metric
+	}
+	select {
+	case transport.dataChannel <- buildMetricsetMetrics(metadataContainer, time.Now(), metrics, nil):
+		transport.metrics.reported = total
+		atomic.StoreInt64(&transport.metrics.maxLatencyUs, 0)
+	default:
+		Log.Debug("Channel full: self-monitoring metrics will be reported later")
+	}
+}
@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// selfMetricsSamples returns the samples of the self-monitoring metricset in agentData.
+func selfMetricsSamples(t *testing.T, agentData AgentData) map[string]float64 {
+	lines := strings.Split(string(agentData.Data), "\n")
+	var event struct {
+		Metricset struct {
+			Samples map[string]struct {
+				Value float64 `json:"value"`
+			} `json:"samples"`
+		} `json:"metricset"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &event))
+	samples := make(map[string]float64)
+	for name, sample := range event.Metricset.Samples {
+		samples[name] = sample.Value
+	}
+	return samples
+}
+
+func TestReportSelfMetrics(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	config := extensionConfig{apmServerUrl: apmServer.URL + "/", selfMetricsInvocations: 2}
+	transport := InitApmServerTransport(&config)
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	require.NoError(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("data"), ContentEncoding: "gzip"}))
+	transport.RecordFlushTimeout()
+	transport.setStatus(Pending)
+	transport.SetApmServerTransportState(context.Background(), Healthy)
+	transport.droppedPayloads = 3
+
+	transport.ReportSelfMetrics(metadataContainer)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	transport.ReportSelfMetrics(metadataContainer)
+	require.Equal(t, 1, transport.BufferedDataCount())
+
+	agentData := <-transport.dataChannel
+	assert.True(t, strings.HasPrefix(string(agentData.Data), `{"metadata":{}}`))
+	samples := selfMetricsSamples(t, agentData)
+	assert.Equal(t, float64(2), samples["aws.lambda.extension.invocations"])
+	assert.Equal(t, float64(4), samples["aws.lambda.extension.forwarded.bytes"])
+	assert.Equal(t, float64(1), samples["aws.lambda.extension.requests.count"])
+	assert.Equal(t, samples["aws.lambda.extension.requests.latency.sum.us"], samples["aws.lambda.extension.requests.latency.max.us"])
+	assert.Equal(t, float64(1), samples["aws.lambda.extension.transport.state_changes"])
+	assert.Equal(t, float64(3), samples["aws.lambda.extension.dropped_payloads"])
+	assert.Equal(t, float64(1), samples["aws.lambda.extension.flush.timeouts"])
+
+	// The next report holds the deltas since the previous one
+	transport.ReportSelfMetrics(metadataContainer)
+	transport.ReportSelfMetrics(metadataContainer)
+	require.Equal(t, 1, transport.BufferedDataCount())
+	samples = selfMetricsSamples(t, <-transport.dataChannel)
+	assert.Equal(t, float64(2), samples["aws.lambda.extension.invocations"])
+	assert.Equal(t, float64(0), samples["aws.lambda.extension.requests.count"])
+	assert.Equal(t, float64(0), samples["aws.lambda.extension.requests.latency.max.us"])
+	assert.Equal(t, float64(0), samples["aws.lambda.extension.dropped_payloads"])
+}
+
+func TestReportSelfMetricsDisabled(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	for i := 0; i < 10; i++ {
+		transport.ReportSelfMetrics(&MetadataContainer{})
+	}
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestRecordRequestLatency(t *testing.T) {
+	var metrics selfMetrics
+	metrics.recordRequest(2*time.Millisecond, 10)
+	metrics.recordRequest(time.Millisecond, 0)
+	assert.Equal(t, int64(2), metrics.requests)
+	assert.Equal(t, int64(3000), metrics.requestLatencyUs)
+	assert.Equal(t, int64(2000), metrics.maxLatencyUs)
+	assert.Equal(t, int64(10), metrics.forwardedBytes)
+}
+
+func TestProcessEnvSelfMetrics(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 0, config.selfMetricsInvocations)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_SELF_METRICS_INVOCATIONS", "10")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 10, config.selfMetricsInvocations)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_SELF_METRICS_INVOCATIONS", "-1")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, 0, config.selfMetricsInvocations)
+}
@@ -0,0 +1,70 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"time"
+)
+
+// shortTimeoutDeadlineMargin is the margin before the deadline of the invocations of functions with a short
+// timeout, when their data is carried over to the next invocation: as there is no last flush to leave room
+// for, the extension only needs the time to hand the data off to the background forwarding.
+const shortTimeoutDeadlineMargin = 10 * time.Millisecond
+
+// ShortTimeout adapts the way the extension ends the invocations of functions with a short timeout, for which
+// the deadline margin consumes a large share of the budget, and flushing at the end of the invocation rarely
+// succeeds.
+type ShortTimeout struct {
+	// Threshold is the timeout at or under which the invocations are handled as short, or 0 to disable
+	// the special handling.
+	Threshold time.Duration
+	// SendStrategy is the send strategy applied to the short invocations. With the background strategy,
+	// their data is handed off immediately, and carried over to the next invocation.
+	SendStrategy SendStrategy
+}
+
+var defaultShortTimeout = ShortTimeout{
+	Threshold:    time.Second,
+	SendStrategy: Background,
+}
+
+// InvocationTimeout derives the timeout of the function from the deadline of the invocation described by
+// event, received at event.Timestamp. Lambda timeouts are whole numbers of seconds, so the time remaining
+// until the deadline is rounded up.
+func InvocationTimeout(event *NextEventResponse) time.Duration {
+	remaining := time.UnixMilli(event.DeadlineMs).Sub(event.Timestamp)
+	if remaining <= 0 {
+		return 0
+	}
+	return (remaining + time.Second - 1).Truncate(time.Second)
+}
+
+// Apply sets the send strategy of the invocation described by event, to sendStrategy or to the strategy of
+// short invocations, and returns the deadline margin to apply to the invocation instead of margin.
+func (shortTimeout ShortTimeout) Apply(event *NextEventResponse, sendStrategy SendStrategy, margin time.Duration) time.Duration {
+	event.SendStrategy = sendStrategy
+	if shortTimeout.Threshold <= 0 || InvocationTimeout(event) > shortTimeout.Threshold {
+		return margin
+	}
+	Log.Debugf("Short function timeout, applying the %s send strategy", shortTimeout.SendStrategy)
+	event.SendStrategy = shortTimeout.SendStrategy
+	if event.SendStrategy == Background && margin > shortTimeoutDeadlineMargin {
+		return shortTimeoutDeadlineMargin
+	}
+	return margin
+}
@@ -0,0 +1,79 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEventWithTimeout(remaining time.Duration) *NextEventResponse {
+	now := time.Now()
+	return &NextEventResponse{Timestamp: now, DeadlineMs: now.Add(remaining).UnixMilli()}
+}
+
+func TestInvocationTimeout(t *testing.T) {
+	assert.Equal(t, time.Second, InvocationTimeout(newEventWithTimeout(990*time.Millisecond)))
+	assert.Equal(t, 3*time.Second, InvocationTimeout(newEventWithTimeout(2950*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), InvocationTimeout(newEventWithTimeout(-time.Second)))
+}
+
+func TestShortTimeoutApply(t *testing.T) {
+	shortTimeout := defaultShortTimeout
+
+	// Functions with a longer timeout keep the configured behavior
+	event := newEventWithTimeout(2950 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, shortTimeout.Apply(event, SyncFlush, 100*time.Millisecond))
+	assert.Equal(t, SyncFlush, event.SendStrategy)
+
+	// Data of short invocations is handed off right away, and carried over to the next invocation
+	event = newEventWithTimeout(990 * time.Millisecond)
+	assert.Equal(t, shortTimeoutDeadlineMargin, shortTimeout.Apply(event, SyncFlush, 100*time.Millisecond))
+	assert.Equal(t, Background, event.SendStrategy)
+
+	// Short invocations can still be flushed at their end
+	shortTimeout.SendStrategy = SyncFlush
+	event = newEventWithTimeout(990 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, shortTimeout.Apply(event, Background, 100*time.Millisecond))
+	assert.Equal(t, SyncFlush, event.SendStrategy)
+
+	// The special handling can be disabled
+	shortTimeout = ShortTimeout{}
+	event = newEventWithTimeout(990 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, shortTimeout.Apply(event, SyncFlush, 100*time.Millisecond))
+	assert.Equal(t, SyncFlush, event.SendStrategy)
+}
+
+func TestProcessEnvShortTimeout(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultShortTimeout, config.ShortTimeout)
+
+	t.Setenv("ELASTIC_APM_SHORT_TIMEOUT_THRESHOLD", "2s")
+	t.Setenv("ELASTIC_APM_SHORT_TIMEOUT_SEND_STRATEGY", "SyncFlush")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, ShortTimeout{Threshold: 2 * time.Second, SendStrategy: SyncFlush}, config.ShortTimeout)
+
+	t.Setenv("ELASTIC_APM_SHORT_TIMEOUT_THRESHOLD", "0")
+	t.Setenv("ELASTIC_APM_SHORT_TIMEOUT_SEND_STRATEGY", "invalid")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, ShortTimeout{SendStrategy: Background}, config.ShortTimeout)
+}
@@ -0,0 +1,43 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+)
+
+// ReportShutdown queues a last metricset when the execution environment shuts down, labelled with the reason
+// of the shutdown, and holding the number of log events drained and of agent data payloads still buffered.
+// The metricset is not queued if the buffer is full, as the buffered data takes precedence.
+func (transport *ApmServerTransport) ReportShutdown(metadataContainer *MetadataContainer, event *NextEventResponse, drainedLogEvents int) {
+	reason := event.ShutdownReason
+	if reason == "" {
+		reason = "unknown"
+	}
+	metricset := buildMetricset(metadataContainer, time.Now(), map[string]float64{
+		"aws.lambda.extension.shutdown.log_events":        float64(drainedLogEvents),
+		"aws.lambda.extension.shutdown.buffered_payloads": float64(transport.BufferedDataCount()),
+	}, model.StringMap{{Key: "shutdown_reason", Value: reason}})
+	select {
+	case transport.dataChannel <- metricset:
+	default:
+		Log.Debug("Channel full: the shutdown metricset is dropped")
+	}
+}
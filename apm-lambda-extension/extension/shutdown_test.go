@@ -0,0 +1,45 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportShutdown(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "https://example.com/"})
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{}}`))
+	transport.EnqueueAPMData(AgentData{Data: []byte("data")})
+
+	transport.ReportShutdown(metadataContainer, &NextEventResponse{EventType: Shutdown, ShutdownReason: "spindown"}, 3)
+	require.Equal(t, 2, transport.BufferedDataCount())
+	<-transport.dataChannel
+	agentData := <-transport.dataChannel
+	assert.Contains(t, string(agentData.Data), `"tags":{"shutdown_reason":"spindown"}`)
+	samples := selfMetricsSamples(t, agentData)
+	assert.Equal(t, float64(3), samples["aws.lambda.extension.shutdown.log_events"])
+	assert.Equal(t, float64(1), samples["aws.lambda.extension.shutdown.buffered_payloads"])
+
+	// The reason is not always known
+	transport.ReportShutdown(metadataContainer, &NextEventResponse{EventType: Shutdown}, 0)
+	agentData = <-transport.dataChannel
+	assert.Contains(t, string(agentData.Data), `"shutdown_reason":"unknown"`)
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+// defaultSourceMapMaxBytes is the default maximum size of the source map uploads forwarded to the APM server.
+const defaultSourceMapMaxBytes = 30 * 1024 * 1024
+
+var errSourceMapTooLarge = errors.New("source map upload too large")
+
+// sourceMapBody limits the size of the source map uploads read by the proxy, and records whether an upload
+// exceeded it, so that the agent gets a 413 status rather than the error of the APM server connection.
+type sourceMapBody struct {
+	io.ReadCloser
+	maxBytes int64
+	read     int64
+	exceeded int32
+}
+
+func (b *sourceMapBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.maxBytes {
+		atomic.StoreInt32(&b.exceeded, 1)
+		return n, errSourceMapTooLarge
+	}
+	return n, err
+}
+
+// URL: http://server/assets/v1/sourcemaps
+// handleSourceMaps forwards the source map uploads of the agents to the APM server untouched, along with the
+// credentials of the extension, so that the functions using the extension as their only egress path can
+// still upload them.
+func handleSourceMaps(ctx context.Context, transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		Log.Debug("Handling source map upload")
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "only POST requests are supported")
+			return
+		}
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			writeJSONError(w, http.StatusUnsupportedMediaType, "source maps must be uploaded as multipart/form-data")
+			return
+		}
+		maxBytes := transport.config.sourceMapMaxBytes
+		if r.ContentLength > maxBytes {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "source map upload larger than "+strconv.FormatInt(maxBytes, 10)+" bytes")
+			return
+		}
+		if transport.backingOff() {
+			writeUnavailable(w, transport.remainingGracePeriod(transport.clock.Now()))
+			return
+		}
+
+		endpoint := transport.endpoints.active()
+		parsedApmServerUrl, err := url.Parse(endpoint.url)
+		if err != nil {
+			Log.Errorf("could not parse APM server URL: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "invalid APM server URL")
+			return
+		}
+
+		body := &sourceMapBody{ReadCloser: r.Body, maxBytes: maxBytes}
+		reverseProxy := newApmServerProxy(transport, parsedApmServerUrl)
+		reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if atomic.LoadInt32(&body.exceeded) == 1 {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, "source map upload larger than "+strconv.FormatInt(maxBytes, 10)+" bytes")
+				return
+			}
+			if r.Context().Err() == nil {
+				transport.SetApmServerTransportState(ctx, Failing)
+			}
+			Log.Errorf("Error forwarding the source map upload to the APM server: %v", err)
+			writeJSONError(w, http.StatusBadGateway, "APM server unreachable: "+err.Error())
+		}
+
+		r.Body = body
+		r.Header.Del("X-Forwarded-For")
+		// The agents running in the function usually do not hold the credentials of the APM server
+		if r.Header.Get("Authorization") == "" {
+			endpoint.credentials.setAuthorization(r)
+		}
+		r.URL.Host = parsedApmServerUrl.Host
+		r.URL.Scheme = parsedApmServerUrl.Scheme
+		r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
+		r.Host = parsedApmServerUrl.Host
+		reverseProxy.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,175 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sourceMapUpload struct {
+	path          string
+	contentType   string
+	authorization string
+	body          []byte
+}
+
+func newSourceMapServer(t *testing.T, uploads chan<- sourceMapUpload) *httptest.Server {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			// The upload was aborted by the extension, e.g. because it exceeds the size limit
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploads <- sourceMapUpload{
+			path:          r.URL.Path,
+			contentType:   r.Header.Get("Content-Type"),
+			authorization: r.Header.Get("Authorization"),
+			body:          body,
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+	return apmServer
+}
+
+func newSourceMapRequest(t *testing.T, size int) (contentType string, body []byte) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	require.NoError(t, writer.WriteField("service_name", "foo"))
+	require.NoError(t, writer.WriteField("service_version", "1.0.0"))
+	require.NoError(t, writer.WriteField("bundle_filepath", "/var/task/index.js"))
+	part, err := writer.CreateFormFile("sourcemap", "index.js.map")
+	require.NoError(t, err)
+	_, err = part.Write(bytes.Repeat([]byte("a"), size))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return writer.FormDataContentType(), buf.Bytes()
+}
+
+func TestHandleSourceMaps(t *testing.T) {
+	uploads := make(chan sourceMapUpload, 1)
+	apmServer := newSourceMapServer(t, uploads)
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl:         apmServer.URL + "/",
+		apmServerSecretToken: "token",
+		sourceMapMaxBytes:    defaultSourceMapMaxBytes,
+	})
+	handler := handleSourceMaps(context.Background(), transport)
+
+	contentType, body := newSourceMapRequest(t, 1024)
+	req := httptest.NewRequest(http.MethodPost, "/assets/v1/sourcemaps", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	upload := <-uploads
+	assert.Equal(t, "/assets/v1/sourcemaps", upload.path)
+	assert.Equal(t, contentType, upload.contentType)
+	assert.Equal(t, "Bearer token", upload.authorization)
+	assert.Equal(t, body, upload.body)
+
+	// The credentials of the agent take precedence
+	req = httptest.NewRequest(http.MethodPost, "/assets/v1/sourcemaps", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "ApiKey agent")
+	handler(httptest.NewRecorder(), req)
+	assert.Equal(t, "ApiKey agent", (<-uploads).authorization)
+}
+
+func TestHandleSourceMapsInvalidRequests(t *testing.T) {
+	uploads := make(chan sourceMapUpload, 1)
+	apmServer := newSourceMapServer(t, uploads)
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", sourceMapMaxBytes: 2048})
+	handler := handleSourceMaps(context.Background(), transport)
+	contentType, body := newSourceMapRequest(t, 4096)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/assets/v1/sourcemaps", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/assets/v1/sourcemaps", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	handler(rec, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	// Uploads larger than the limit are rejected, whether their size is known upfront or not
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/assets/v1/sourcemaps", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	handler(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/assets/v1/sourcemaps", bytes.NewReader(body))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", contentType)
+	handler(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	assert.Empty(t, uploads)
+	assert.Equal(t, Healthy, transport.currentStatus())
+}
+
+func TestHandleSourceMapsUnreachableApmServer(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", sourceMapMaxBytes: defaultSourceMapMaxBytes})
+	handler := handleSourceMaps(context.Background(), transport)
+	contentType, body := newSourceMapRequest(t, 16)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/assets/v1/sourcemaps", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	handler(rec, req)
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, Failing, transport.currentStatus())
+
+	// The agent backs off along with the extension
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/assets/v1/sourcemaps", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	handler(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+}
+
+func TestProcessEnvSourceMapMaxBytes(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, int64(defaultSourceMapMaxBytes), config.sourceMapMaxBytes)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_SOURCE_MAP_MAX_BYTES", "1048576")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, int64(1048576), config.sourceMapMaxBytes)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_SOURCE_MAP_MAX_BYTES", "0")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, int64(defaultSourceMapMaxBytes), config.sourceMapMaxBytes)
+}
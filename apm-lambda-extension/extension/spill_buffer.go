@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spillFileExtension = ".apm"
+
+// SpillBuffer persists the agent data that could not be delivered to the APM server to a directory,
+// typically under /tmp, so that it can be replayed during a later invocation of the same execution
+// environment. The total size of the persisted data is bounded: data exceeding the bound is dropped.
+type SpillBuffer struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	seq      int
+}
+
+// NewSpillBuffer returns a spill buffer persisting data to dir, or nil if maxBytes is not positive.
+// Data left in dir by a previous instance of the extension is accounted for and replayed.
+func NewSpillBuffer(dir string, maxBytes int64) (*SpillBuffer, error) {
+	if maxBytes <= 0 || dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	buffer := &SpillBuffer{dir: dir, maxBytes: maxBytes}
+	files, err := buffer.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		buffer.size += file.Size()
+	}
+	return buffer, nil
+}
+
+// Spill persists agentData. It returns an error if the data could not be written, or if persisting it
+// would exceed the size bound of the buffer.
+func (buffer *SpillBuffer) Spill(agentData AgentData) error {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	// The file starts with the content encoding of the data, on its own line
+	content := make([]byte, 0, len(agentData.ContentEncoding)+1+len(agentData.Data))
+	content = append(content, agentData.ContentEncoding...)
+	content = append(content, '\n')
+	content = append(content, agentData.Data...)
+
+	if buffer.size+int64(len(content)) > buffer.maxBytes {
+		return fmt.Errorf("spill buffer full (%d/%d bytes)", buffer.size, buffer.maxBytes)
+	}
+
+	// File names are ordered by creation time, so that the data is replayed in the order it was spilled
+	buffer.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), buffer.seq, spillFileExtension)
+	if err := ioutil.WriteFile(filepath.Join(buffer.dir, name), content, 0600); err != nil {
+		return err
+	}
+	buffer.size += int64(len(content))
+	return nil
+}
+
+// Replay reads the persisted data, oldest first, and passes it to enqueue. The data is removed from
+// the buffer once accepted by enqueue; replay stops at the first data that enqueue rejects.
+// It returns the number of replayed payloads.
+func (buffer *SpillBuffer) Replay(enqueue func(AgentData) bool) (int, error) {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	files, err := buffer.files()
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, file := range files {
+		path := filepath.Join(buffer.dir, file.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return replayed, err
+		}
+		agentData, err := decodeSpilledData(content)
+		if err != nil {
+			Log.Warnf("Discarding corrupted spilled data %s: %v", file.Name(), err)
+		} else if !enqueue(agentData) {
+			return replayed, nil
+		} else {
+			replayed++
+		}
+		if err := os.Remove(path); err != nil {
+			return replayed, err
+		}
+		buffer.size -= file.Size()
+	}
+	return replayed, nil
+}
+
+// Size returns the number of bytes currently persisted.
+func (buffer *SpillBuffer) Size() int64 {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	return buffer.size
+}
+
+// files returns the spilled data files, sorted from oldest to newest.
+func (buffer *SpillBuffer) files() ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(buffer.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := entries[:0]
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spillFileExtension) {
+			files = append(files, entry)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+func decodeSpilledData(content []byte) (AgentData, error) {
+	idx := bytes.IndexByte(content, '\n')
+	if idx < 0 {
+		return AgentData{}, errors.New("missing content encoding header")
+	}
+	return AgentData{ContentEncoding: string(content[:idx]), Data: content[idx+1:]}, nil
+}
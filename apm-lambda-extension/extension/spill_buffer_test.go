@@ -0,0 +1,126 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillBufferDisabled(t *testing.T) {
+	buffer, err := NewSpillBuffer(t.TempDir(), 0)
+	require.NoError(t, err)
+	assert.Nil(t, buffer)
+}
+
+func TestSpillBufferReplayOrder(t *testing.T) {
+	dir := t.TempDir()
+	buffer, err := NewSpillBuffer(dir, 1024)
+	require.NoError(t, err)
+
+	require.NoError(t, buffer.Spill(AgentData{Data: []byte("first")}))
+	require.NoError(t, buffer.Spill(AgentData{Data: []byte("second"), ContentEncoding: "gzip"}))
+	assert.Equal(t, int64(len("\nfirst")+len("gzip\nsecond")), buffer.Size())
+
+	// The data is still available to a new instance of the buffer, e.g. after a restart of the extension
+	buffer, err = NewSpillBuffer(dir, 1024)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("\nfirst")+len("gzip\nsecond")), buffer.Size())
+
+	var replayed []AgentData
+	count, err := buffer.Replay(func(agentData AgentData) bool {
+		replayed = append(replayed, agentData)
+		return true
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, []AgentData{
+		{Data: []byte("first")},
+		{Data: []byte("second"), ContentEncoding: "gzip"},
+	}, replayed)
+	assert.Equal(t, int64(0), buffer.Size())
+}
+
+func TestSpillBufferReplayStopsWhenRejected(t *testing.T) {
+	buffer, err := NewSpillBuffer(t.TempDir(), 1024)
+	require.NoError(t, err)
+	require.NoError(t, buffer.Spill(AgentData{Data: []byte("first")}))
+	require.NoError(t, buffer.Spill(AgentData{Data: []byte("second")}))
+
+	count, err := buffer.Replay(func(agentData AgentData) bool {
+		return string(agentData.Data) == "first"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, int64(len("\nsecond")), buffer.Size())
+}
+
+func TestSpillBufferBounded(t *testing.T) {
+	buffer, err := NewSpillBuffer(t.TempDir(), 10)
+	require.NoError(t, err)
+
+	require.NoError(t, buffer.Spill(AgentData{Data: []byte("12345")}))
+	assert.Error(t, buffer.Spill(AgentData{Data: []byte("12345")}))
+	assert.Equal(t, int64(6), buffer.Size())
+}
+
+func TestSpillBufferCorruptedData(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "0-corrupted"+spillFileExtension), []byte("no header"), 0600))
+	buffer, err := NewSpillBuffer(dir, 1024)
+	require.NoError(t, err)
+
+	count, err := buffer.Replay(func(agentData AgentData) bool { return true })
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, int64(0), buffer.Size())
+}
+
+func TestTransportSpillsUndeliveredData(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apmServer.Close()
+
+	config := extensionConfig{
+		apmServerUrl:        apmServer.URL + "/",
+		spillDir:            t.TempDir(),
+		spillBufferMaxBytes: 1024,
+	}
+	transport := InitApmServerTransport(&config)
+	require.NotNil(t, transport.spillBuffer)
+
+	transport.reconnectionCount = 0
+	assert.Error(t, transport.PostToApmServer(context.Background(), AgentData{Data: []byte("foo")}))
+	assert.Equal(t, int64(len("\nfoo")), transport.spillBuffer.Size())
+
+	// The data is not replayed until the transport is healthy again
+	transport.ReplaySpilledData()
+	assert.Equal(t, 0, transport.BufferedDataCount())
+
+	transport.setStatus(Healthy)
+	transport.ReplaySpilledData()
+	assert.Equal(t, 1, transport.BufferedDataCount())
+	assert.Equal(t, AgentData{Data: []byte("foo")}, <-transport.dataChannel)
+	assert.Equal(t, int64(0), transport.spillBuffer.Size())
+}
@@ -0,0 +1,219 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"elastic/apm-lambda-extension/buildinfo"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// maxRecentLogs is the number of log entries of the extension kept for the support bundles.
+const maxRecentLogs = 500
+
+// supportBundlePrefix is the prefix of the names of the support bundle archives.
+const supportBundlePrefix = "elastic-apm-lambda-extension-support-"
+
+// secretVariableMarkers are the parts of the names of the environment variables whose values are redacted
+// from the support bundles.
+var secretVariableMarkers = []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "AUTH"}
+
+// logHistory keeps the last log entries of the extension, whatever the output of the logs.
+type logHistory struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+var recentLogs logHistory
+
+// record is a zap hook keeping entry, once its level was checked.
+func (h *logHistory) record(entry zapcore.Entry) error {
+	line := fmt.Sprintf("%s\t%s\t%s", entry.Time.UTC().Format(time.RFC3339Nano), entry.Level.CapitalString(), entry.Message)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) >= maxRecentLogs {
+		h.entries = h.entries[1:]
+	}
+	h.entries = append(h.entries, line)
+	return nil
+}
+
+func (h *logHistory) lines() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string{}, h.entries...)
+}
+
+// SupportVersion describes the build of the extension and the execution environment it runs in.
+type SupportVersion struct {
+	Version      string `json:"version"`
+	Commit       string `json:"commit"`
+	GoVersion    string `json:"go_version"`
+	Architecture string `json:"architecture"`
+	ExecutionEnv string `json:"execution_env,omitempty"`
+}
+
+// WriteSupportBundle gathers the version of the extension, its effective configuration and environment with
+// the credentials redacted, its state, the state persisted across restarts, and its recent logs into a
+// tar.gz archive created in dir, and returns the path of the archive.
+func (transport *ApmServerTransport) WriteSupportBundle(dir string, now time.Time) (string, error) {
+	files := make(map[string][]byte)
+	vars := transport.DebugVars()
+	for name, content := range map[string]interface{}{
+		"version.json": SupportVersion{
+			Version:      buildinfo.Version(),
+			Commit:       buildinfo.Commit(),
+			GoVersion:    runtime.Version(),
+			Architecture: runtime.GOARCH,
+			ExecutionEnv: os.Getenv("AWS_EXECUTION_ENV"),
+		},
+		"config.json":      vars.Config,
+		"environment.json": redactedEnvironment(os.Environ()),
+		"state.json":       vars,
+		"health.json":      transport.Health(),
+	} {
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("could not marshal %s: %v", name, err)
+		}
+		files[name] = data
+	}
+	files["logs.txt"] = []byte(strings.Join(recentLogs.lines(), "\n") + "\n")
+	// The files persisted across restarts are added as is, as they do not hold credentials
+	persisted := []string{filepath.Join(transport.config.spillDir, configSnapshotFileName)}
+	if stateDir := transport.stateDir(); stateDir != "" {
+		persisted = append(persisted, filepath.Join(stateDir, stateFileName))
+	}
+	for _, path := range persisted {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			files["persisted/"+filepath.Base(path)] = data
+		}
+	}
+
+	archive, err := buildSupportBundle(files, now)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, supportBundlePrefix+now.UTC().Format("20060102T150405Z")+".tar.gz")
+	if err := ioutil.WriteFile(path, archive, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// buildSupportBundle returns a tar.gz archive holding files, sorted by name.
+func buildSupportBundle(files map[string][]byte, now time.Time) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name])), ModTime: now}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tarWriter.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// redactedEnvironment returns the variables of environ relevant to the configuration, like the configuration
+// snapshots, with the values of the secret ones and the passwords of URLs redacted.
+func redactedEnvironment(environ []string) map[string]string {
+	variables := make(map[string]string)
+	for _, kv := range environ {
+		name, value := kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		if !strings.HasPrefix(name, envPrefix) && !configSnapshotVariables[name] {
+			continue
+		}
+		variables[name] = redactedValue(name, value)
+	}
+	return variables
+}
+
+func redactedValue(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, marker := range secretVariableMarkers {
+		if strings.Contains(name, marker) {
+			return redacted
+		}
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
+
+// URL: http://server/debug/support-bundle
+//
+// handleSupportBundle writes a support bundle to the temporary directory, and responds with its path. The path
+// is also logged, so that it can be found in the logs of the function.
+func handleSupportBundle(transport *ApmServerTransport) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		path, err := transport.WriteSupportBundle(os.TempDir(), time.Now())
+		if err != nil {
+			Log.Errorf("Could not write the support bundle: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Log.Infof("Support bundle written to %s", path)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{"path": path}); err != nil {
+			Log.Errorf("Failed to send the support bundle path: %v", err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/rand"
+	"time"
+
+	"elastic/apm-lambda-extension/buildinfo"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+const (
+	syntheticAgentName       = "apm-lambda-extension"
+	syntheticTransactionName = "Synthetic invocation"
+	syntheticTransactionType = "synthetic"
+	syntheticLabel           = "synthetic"
+)
+
+// SyntheticTransactions reports a synthetic transaction for each function invocation, without any APM agent.
+// It lets users validate that data flows from the extension to the APM server and Kibana before instrumenting
+// their function. The transactions are of type "synthetic", and labeled with synthetic=true.
+type SyntheticTransactions struct {
+	metadata        []byte
+	functionName    string
+	functionVersion string
+	coldstart       bool
+}
+
+// NewSyntheticTransactions returns the synthetic transactions reporter, or nil if synthetic transactions
+// are disabled.
+func NewSyntheticTransactions(config *extensionConfig) *SyntheticTransactions {
+	if !config.syntheticTransactions {
+		return nil
+	}
+	Log.Warn("Synthetic transactions are enabled, a synthetic transaction is reported for each invocation")
+	return &SyntheticTransactions{
+		metadata:        extensionMetadata(config),
+		functionName:    config.functionName,
+		functionVersion: config.functionVersion,
+		coldstart:       true,
+	}
+}
+
+// extensionMetadata returns the metadata of the events reported by the extension itself when no agent
+// metadata is available, attributing them to the service named by ELASTIC_APM_SERVICE_NAME, or after the
+// function.
+func extensionMetadata(config *extensionConfig) []byte {
+	serviceName := config.serviceName
+	if serviceName == "" {
+		serviceName = "unknown"
+	}
+	service := model.Service{
+		Name: serviceName,
+		Agent: &model.Agent{
+			Name:    syntheticAgentName,
+			Version: buildinfo.Version(),
+		},
+	}
+	var jsonWriter fastjson.Writer
+	jsonWriter.RawString(`{"metadata":{"service":`)
+	// Marshalling model.Service into a fastjson.Writer never fails.
+	_ = service.MarshalFastJSON(&jsonWriter)
+	jsonWriter.RawString(`}}`)
+	return jsonWriter.Bytes()
+}
+
+// Enqueue queues a synthetic transaction spanning the invocation described by event, from its start to end.
+// Enqueue is a no-op on a nil reporter, and for events other than invocations.
+func (synthetic *SyntheticTransactions) Enqueue(transport *ApmServerTransport, event *NextEventResponse, end time.Time) {
+	if synthetic == nil || event == nil || event.EventType != Invoke {
+		return
+	}
+	data, err := synthetic.build(event, end)
+	if err != nil {
+		Log.Errorf("Could not build the synthetic transaction: %v", err)
+		return
+	}
+	synthetic.coldstart = false
+	transport.EnqueueAPMData(AgentData{Data: data})
+}
+
+func (synthetic *SyntheticTransactions) build(event *NextEventResponse, end time.Time) ([]byte, error) {
+	transaction := model.Transaction{
+		Name:      syntheticTransactionName,
+		Type:      syntheticTransactionType,
+		Timestamp: model.Time(event.Timestamp),
+		Duration:  float64(end.Sub(event.Timestamp)) / float64(time.Millisecond),
+		Result:    "success",
+		Outcome:   "success",
+		Context: &model.Context{
+			Tags: model.IfaceMap{{Key: syntheticLabel, Value: true}},
+		},
+		FAAS: &model.FAAS{
+			ID:        event.InvokedFunctionArn,
+			Execution: event.RequestID,
+			Name:      synthetic.functionName,
+			Version:   synthetic.functionVersion,
+			Coldstart: synthetic.coldstart,
+			Trigger:   &model.FAASTrigger{Type: "other"},
+		},
+	}
+	if _, err := rand.Read(transaction.TraceID[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(transaction.ID[:]); err != nil {
+		return nil, err
+	}
+
+	var jsonWriter fastjson.Writer
+	jsonWriter.RawBytes(synthetic.metadata)
+	jsonWriter.RawString("\n")
+	jsonWriter.RawString(`{"transaction":`)
+	if err := transaction.MarshalFastJSON(&jsonWriter); err != nil {
+		return nil, err
+	}
+	jsonWriter.RawString("}\n")
+	return jsonWriter.Bytes(), nil
+}
@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"elastic/apm-lambda-extension/buildinfo"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyntheticTransactionsDisabled(t *testing.T) {
+	synthetic := NewSyntheticTransactions(&extensionConfig{})
+	assert.Nil(t, synthetic)
+
+	transport := InitApmServerTransport(&extensionConfig{})
+	synthetic.Enqueue(transport, &NextEventResponse{EventType: Invoke}, time.Now())
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestSyntheticTransactions(t *testing.T) {
+	synthetic := NewSyntheticTransactions(&extensionConfig{
+		syntheticTransactions: true,
+		serviceName:           "my-service",
+		functionName:          "my-function",
+		functionVersion:       "$LATEST",
+	})
+	require.NotNil(t, synthetic)
+	transport := InitApmServerTransport(&extensionConfig{})
+
+	start := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	event := &NextEventResponse{
+		Timestamp:          start,
+		EventType:          Invoke,
+		RequestID:          "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:my-function",
+	}
+	synthetic.Enqueue(transport, event, start.Add(250*time.Millisecond))
+	synthetic.Enqueue(transport, &NextEventResponse{EventType: Shutdown}, start)
+	synthetic.Enqueue(transport, event, start.Add(time.Second))
+	require.Equal(t, 2, transport.BufferedDataCount())
+
+	type syntheticPayload struct {
+		Metadata struct {
+			Service struct {
+				Name  string
+				Agent struct{ Name, Version string }
+			}
+		}
+		Transaction struct {
+			ID, Name, Type, Outcome string
+			TraceID                 string `json:"trace_id"`
+			Timestamp               int64
+			Duration                float64
+			Context                 struct{ Tags map[string]interface{} }
+			FAAS                    struct {
+				ID, Execution, Name, Version string
+				Coldstart                    bool
+			}
+		}
+	}
+	parse := func(data []byte) syntheticPayload {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		require.Len(t, lines, 2)
+		var payload syntheticPayload
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &payload))
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &payload))
+		return payload
+	}
+
+	first := parse((<-transport.dataChannel).Data)
+	assert.Equal(t, "my-service", first.Metadata.Service.Name)
+	assert.Equal(t, "apm-lambda-extension", first.Metadata.Service.Agent.Name)
+	assert.Equal(t, buildinfo.Version(), first.Metadata.Service.Agent.Version)
+	assert.Equal(t, "Synthetic invocation", first.Transaction.Name)
+	assert.Equal(t, "synthetic", first.Transaction.Type)
+	assert.Equal(t, "success", first.Transaction.Outcome)
+	assert.Len(t, first.Transaction.ID, 16)
+	assert.Len(t, first.Transaction.TraceID, 32)
+	assert.Equal(t, start.UnixNano()/1000, first.Transaction.Timestamp)
+	assert.Equal(t, float64(250), first.Transaction.Duration)
+	assert.Equal(t, map[string]interface{}{"synthetic": true}, first.Transaction.Context.Tags)
+	assert.Equal(t, event.InvokedFunctionArn, first.Transaction.FAAS.ID)
+	assert.Equal(t, event.RequestID, first.Transaction.FAAS.Execution)
+	assert.Equal(t, "my-function", first.Transaction.FAAS.Name)
+	assert.Equal(t, "$LATEST", first.Transaction.FAAS.Version)
+	assert.True(t, first.Transaction.FAAS.Coldstart)
+
+	second := parse((<-transport.dataChannel).Data)
+	assert.False(t, second.Transaction.FAAS.Coldstart)
+	assert.NotEqual(t, first.Transaction.TraceID, second.Transaction.TraceID)
+}
@@ -0,0 +1,218 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTailSamplingHeldBytes is the maximum size of the agent data held until the end of an invocation. The
+// agent data received beyond it is forwarded without being sampled, so that the memory of the execution
+// environment is not exhausted.
+const maxTailSamplingHeldBytes = 32 * 1024 * 1024
+
+// tailSamplingConfig holds the policies deciding which traces are forwarded to the APM server.
+type tailSamplingConfig struct {
+	enabled bool
+	// slowThreshold is the duration from which a transaction is slow, and its trace is forwarded
+	slowThreshold time.Duration
+	// rate is the fraction of the other traces that are forwarded
+	rate float64
+}
+
+var defaultTailSamplingConfig = tailSamplingConfig{
+	slowThreshold: time.Second,
+}
+
+// tailSampler holds the agent data received during an invocation, and only forwards the traces that are
+// slow or errored at its end, along with a fraction of the other traces. The events that are not part of a
+// trace, e.g. the metricsets, are always forwarded.
+type tailSampler struct {
+	config        tailSamplingConfig
+	mu            sync.Mutex
+	held          []AgentData
+	heldBytes     int
+	overflowed    bool
+	droppedTraces int64
+}
+
+// newTailSampler returns the tail sampler of the agent data, or nil if tail sampling is disabled.
+func newTailSampler(config *extensionConfig) *tailSampler {
+	if !config.tailSampling.enabled {
+		return nil
+	}
+	return &tailSampler{config: config.tailSampling}
+}
+
+// hold keeps agentData until the end of the invocation, and reports whether it did. The agent data is
+// not held if tail sampling is disabled, or if too much agent data is already held.
+func (sampler *tailSampler) hold(agentData AgentData) bool {
+	if sampler == nil {
+		return false
+	}
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	if sampler.heldBytes+len(agentData.Data) > maxTailSamplingHeldBytes {
+		if !sampler.overflowed {
+			Log.Warn("Too much agent data held for tail sampling, forwarding the rest of the invocation data unsampled")
+			sampler.overflowed = true
+		}
+		return false
+	}
+	sampler.held = append(sampler.held, agentData)
+	sampler.heldBytes += len(agentData.Data)
+	return true
+}
+
+// release returns the agent data held since the previous call.
+func (sampler *tailSampler) release() []AgentData {
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	held := sampler.held
+	sampler.held, sampler.heldBytes, sampler.overflowed = nil, 0, false
+	return held
+}
+
+// sampledEvent holds the fields of an agent event the sampling decision is based on.
+type sampledEvent struct {
+	TraceID  string  `json:"trace_id"`
+	Duration float64 `json:"duration"`
+	Outcome  string  `json:"outcome"`
+}
+
+// ApplyTailSampling decides which of the traces held during the invocation are forwarded, and queues their
+// events to be sent to the APM server. It is called at the end of each invocation.
+func (transport *ApmServerTransport) ApplyTailSampling() {
+	sampler := transport.tailSampler
+	if sampler == nil {
+		return
+	}
+	held := sampler.release()
+	if len(held) == 0 {
+		return
+	}
+
+	payloads := make([][]byte, len(held))
+	keep := make(map[string]bool)
+	for i, agentData := range held {
+		data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+		if err != nil {
+			Log.Warnf("Could not decompress the agent data to sample, forwarding it unsampled: %v", err)
+			transport.EnqueueAPMData(agentData)
+			continue
+		}
+		payloads[i] = data
+		forEachLine(data, func(line []byte) {
+			if typ, event := parseSampledEvent(line); event.TraceID != "" {
+				keep[event.TraceID] = keep[event.TraceID] || sampler.isInteresting(typ, event)
+			}
+		})
+	}
+	for traceID, kept := range keep {
+		if !kept && !sampler.sampledByRate(traceID) {
+			atomic.AddInt64(&sampler.droppedTraces, 1)
+			continue
+		}
+		keep[traceID] = true
+	}
+
+	for i, data := range payloads {
+		if data == nil {
+			continue
+		}
+		var out bytes.Buffer
+		events := 0
+		forEachLine(data, func(line []byte) {
+			typ, event := parseSampledEvent(line)
+			if event.TraceID != "" && !keep[event.TraceID] {
+				return
+			}
+			if typ != "metadata" {
+				events++
+			}
+			out.Write(line)
+		})
+		if events > 0 {
+			transport.EnqueueAPMData(AgentData{Data: out.Bytes(), agentUserAgent: held[i].agentUserAgent})
+		}
+	}
+}
+
+// SampledOutTraces returns the number of traces dropped by tail sampling.
+func (transport *ApmServerTransport) SampledOutTraces() int64 {
+	if transport.tailSampler == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&transport.tailSampler.droppedTraces)
+}
+
+// isInteresting reports whether the event makes its trace worth forwarding: errors, failed transactions
+// and spans, and slow transactions.
+func (sampler *tailSampler) isInteresting(eventType string, event sampledEvent) bool {
+	switch eventType {
+	case "error":
+		return true
+	case "transaction":
+		slow := time.Duration(event.Duration*float64(time.Millisecond)) >= sampler.config.slowThreshold
+		return slow || event.Outcome == "failure"
+	case "span":
+		return event.Outcome == "failure"
+	}
+	return false
+}
+
+// sampledByRate reports whether the trace is part of the fraction of the traces forwarded regardless of
+// the policies. The decision only depends on the trace id, so that it is consistent across the services.
+func (sampler *tailSampler) sampledByRate(traceID string) bool {
+	if sampler.config.rate <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(traceID))
+	return float64(h.Sum32())/(math.MaxUint32+1) < sampler.config.rate
+}
+
+// parseSampledEvent returns the type of the event held by an ndjson line of agent data, and the fields the
+// sampling decision is based on. The trace id is empty if the line cannot be parsed.
+func parseSampledEvent(line []byte) (string, sampledEvent) {
+	typ := eventType(line)
+	var event map[string]sampledEvent
+	if typ == "" || typ == "metadata" || json.Unmarshal(line, &event) != nil {
+		return typ, sampledEvent{}
+	}
+	return typ, event[typ]
+}
+
+// forEachLine calls f with each line of data, including its trailing newline, if any.
+func forEachLine(data []byte, f func(line []byte)) {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			data = nil
+		}
+		f(line)
+	}
+}
@@ -0,0 +1,144 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTailSampling(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", tailSampling: tailSamplingConfig{enabled: true, slowThreshold: time.Second}}
+	transport := InitApmServerTransport(&config)
+
+	// The events of a trace may be sent in several payloads
+	require.True(t, transport.tailSampler.hold(AgentData{Data: []byte(`{"metadata":{}}
+{"transaction":{"id":"a","trace_id":"fast","duration":12.5,"outcome":"success"}}
+{"transaction":{"id":"b","trace_id":"slow","duration":1500,"outcome":"success"}}
+{"span":{"id":"c","trace_id":"errored","duration":1,"outcome":"success"}}
+{"metricset":{"samples":{}}}
+`), agentUserAgent: "apm-agent-nodejs/3.38.0"}))
+	require.True(t, transport.tailSampler.hold(AgentData{Data: []byte(`{"metadata":{}}
+{"span":{"id":"d","trace_id":"fast","duration":1,"outcome":"success"}}
+{"error":{"id":"e","trace_id":"errored","transaction":{"sampled":true}}}
+{"transaction":{"id":"f","trace_id":"failed","duration":1,"outcome":"failure"}}
+{"span":{"id":"g","trace_id":"failed-span","duration":1,"outcome":"failure"}}
+`)}))
+	require.True(t, transport.tailSampler.hold(AgentData{Data: []byte(`{"metadata":{}}
+{"span":{"id":"h","trace_id":"fast","duration":1,"outcome":"success"}}
+`)}))
+	assert.Equal(t, 0, transport.BufferedDataCount())
+
+	transport.ApplyTailSampling()
+	require.Equal(t, 2, transport.BufferedDataCount())
+	agentData := <-transport.dataChannel
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"id":"b","trace_id":"slow","duration":1500,"outcome":"success"}}
+{"span":{"id":"c","trace_id":"errored","duration":1,"outcome":"success"}}
+{"metricset":{"samples":{}}}
+`, string(agentData.Data))
+	assert.Equal(t, "apm-agent-nodejs/3.38.0", agentData.agentUserAgent)
+	agentData = <-transport.dataChannel
+	assert.Equal(t, `{"metadata":{}}
+{"error":{"id":"e","trace_id":"errored","transaction":{"sampled":true}}}
+{"transaction":{"id":"f","trace_id":"failed","duration":1,"outcome":"failure"}}
+{"span":{"id":"g","trace_id":"failed-span","duration":1,"outcome":"failure"}}
+`, string(agentData.Data))
+	assert.Equal(t, int64(1), transport.SampledOutTraces())
+
+	// The held agent data is released once
+	transport.ApplyTailSampling()
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestTailSamplingRate(t *testing.T) {
+	sampler := tailSampler{config: tailSamplingConfig{rate: 0.25}}
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		traceID := fmt.Sprintf("%032x", i)
+		if sampler.sampledByRate(traceID) {
+			sampled++
+		}
+		// The decision is consistent for a given trace
+		assert.Equal(t, sampler.sampledByRate(traceID), sampler.sampledByRate(traceID))
+	}
+	assert.InDelta(t, 2500, sampled, 250)
+
+	sampler.config.rate = 0
+	assert.False(t, sampler.sampledByRate("0123456789abcdef0123456789abcdef"))
+	sampler.config.rate = 1
+	assert.True(t, sampler.sampledByRate("0123456789abcdef0123456789abcdef"))
+}
+
+func TestTailSamplingDisabled(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: "https://example.com/"})
+	assert.Nil(t, transport.tailSampler)
+	assert.False(t, transport.tailSampler.hold(AgentData{Data: []byte(`{"metadata":{}}`)}))
+	transport.ApplyTailSampling()
+	assert.Equal(t, int64(0), transport.SampledOutTraces())
+}
+
+func TestTailSamplingHeldBytes(t *testing.T) {
+	sampler := newTailSampler(&extensionConfig{tailSampling: tailSamplingConfig{enabled: true}})
+	require.True(t, sampler.hold(AgentData{Data: make([]byte, maxTailSamplingHeldBytes)}))
+	assert.False(t, sampler.hold(AgentData{Data: []byte(`{"metadata":{}}`)}))
+	assert.Len(t, sampler.release(), 1)
+	assert.True(t, sampler.hold(AgentData{Data: []byte(`{"metadata":{}}`)}))
+}
+
+func TestIntakeTailSampling(t *testing.T) {
+	config := extensionConfig{apmServerUrl: "https://example.com/", tailSampling: tailSamplingConfig{enabled: true, slowThreshold: time.Second}, dataForwarderMode: StreamMode}
+	transport := InitApmServerTransport(&config)
+	assert.False(t, transport.shouldStream())
+	handler := handleIntakeV2Events(context.Background(), transport)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/intake/v2/events", strings.NewReader(`{"metadata":{}}
+{"transaction":{"id":"a","trace_id":"fast","duration":12.5}}
+`)))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	transport.ApplyTailSampling()
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	assert.Equal(t, int64(1), transport.DebugVars().Buffer.SampledOutTraces)
+}
+
+func TestProcessEnvTailSampling(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	config := ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, defaultTailSamplingConfig, config.tailSampling)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING", "true")
+	t.Setenv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_SLOW_THRESHOLD", "250ms")
+	t.Setenv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE", "0.1")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, tailSamplingConfig{enabled: true, slowThreshold: 250 * time.Millisecond, rate: 0.1}, config.tailSampling)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_SLOW_THRESHOLD", "0")
+	t.Setenv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING_RATE", "2")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.Equal(t, tailSamplingConfig{enabled: true, slowThreshold: time.Second}, config.tailSampling)
+}
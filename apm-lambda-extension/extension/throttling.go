@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errThrottled is returned when agent data is not sent because the APM server throttles the extension. The
+// agent data is buffered again rather than being counted as undelivered.
+var errThrottled = errors.New("APM server throttled the extension")
+
+const (
+	// defaultRetryAfter is how long the transport is throttled after a 429 response without a valid
+	// Retry-After header.
+	defaultRetryAfter = time.Second
+	// maxRetryAfter caps how long the transport is throttled, so that a misconfigured proxy cannot pause
+	// the forwarding of the agent data indefinitely.
+	maxRetryAfter = time.Minute
+)
+
+// throttledResponse reports whether the APM server asked the extension to slow down, with a 429 response,
+// or with a 503 response holding a Retry-After header, and how long the extension should wait before
+// sending data again.
+func throttledResponse(resp *http.Response, now time.Time) (time.Duration, bool) {
+	retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		if !ok {
+			retryAfter = defaultRetryAfter
+		}
+	case resp.StatusCode == http.StatusServiceUnavailable && ok:
+	default:
+		return 0, false
+	}
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+	return retryAfter, true
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if retryAfter := date.Sub(now); retryAfter > 0 {
+		return retryAfter, true
+	}
+	return 0, true
+}
+
+// throttle pauses the forwarding of the agent data for retryAfter, which is buffered meanwhile. Unlike
+// a failure, throttling does not increase the grace period of the backoff: the transport is set to
+// Pending once retryAfter elapsed.
+func (transport *ApmServerTransport) throttle(ctx context.Context, retryAfter time.Duration) {
+	transport.Lock()
+	transport.setStatus(Throttled)
+	transport.debug.recordTransition(Throttled)
+	atomic.AddInt64(&transport.metrics.stateChanges, 1)
+	atomic.AddInt64(&transport.metrics.throttled, 1)
+	Log.Infof("APM server throttled the extension, pausing for %s", retryAfter)
+	atomic.StoreInt64(&transport.gracePeriodEnd, transport.clock.Now().Add(retryAfter).UnixNano())
+	throttleOver := transport.clock.After(retryAfter)
+	go func() {
+		select {
+		case <-throttleOver:
+			Log.Debug("Throttling over - timer timed out")
+		case <-ctx.Done():
+			Log.Debug("Throttling over - context done")
+		}
+		transport.setStatus(Pending)
+		transport.debug.recordTransition(Pending)
+		atomic.AddInt64(&transport.metrics.stateChanges, 1)
+		Log.Debugf("APM server Transport status set to %s", Pending)
+		transport.Unlock()
+	}()
+}
+
+// backingOff reports whether the transport waits before sending data to the APM server, because the APM
+// server is unreachable or throttles the extension.
+func (transport *ApmServerTransport) backingOff() bool {
+	status := transport.currentStatus()
+	return status == Failing || status == Throttled
+}
@@ -0,0 +1,148 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"5":                             5 * time.Second,
+		" 0 ":                           0,
+		"Wed, 12 Oct 2022 00:00:30 GMT": 30 * time.Second,
+		"Tue, 11 Oct 2022 00:00:00 GMT": 0,
+	} {
+		retryAfter, ok := parseRetryAfter(value, now)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, retryAfter, value)
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		_, ok := parseRetryAfter(value, now)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestThrottledResponse(t *testing.T) {
+	now := time.Now()
+	response := func(statusCode int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	retryAfter, ok := throttledResponse(response(http.StatusTooManyRequests, "3"), now)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, retryAfter)
+	retryAfter, ok = throttledResponse(response(http.StatusTooManyRequests, ""), now)
+	assert.True(t, ok)
+	assert.Equal(t, defaultRetryAfter, retryAfter)
+	retryAfter, ok = throttledResponse(response(http.StatusServiceUnavailable, "3600"), now)
+	assert.True(t, ok)
+	assert.Equal(t, maxRetryAfter, retryAfter)
+
+	_, ok = throttledResponse(response(http.StatusServiceUnavailable, ""), now)
+	assert.False(t, ok)
+	_, ok = throttledResponse(response(http.StatusAccepted, "3"), now)
+	assert.False(t, ok)
+}
+
+func TestThrottling(t *testing.T) {
+	var throttled int32 = 1
+	var requests int32
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&throttled) == 1 {
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+
+	clock := newManualClock()
+	transport := InitApmServerTransport(&extensionConfig{
+		apmServerUrl: apmServer.URL + "/",
+		retry:        retryConfig{maxRetries: 2, initialDelay: time.Millisecond},
+	})
+	transport.clock = clock
+
+	// The agent data is buffered again, without counting it as a failure
+	transport.EnqueueAPMData(AgentData{Data: []byte("foo")})
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, Throttled, transport.currentStatus())
+	assert.Equal(t, 1, transport.BufferedDataCount())
+	assert.Equal(t, 0, transport.TakeDeliveryFailures())
+	assert.Equal(t, 10*time.Second, transport.remainingGracePeriod(clock.Now()))
+	assert.Equal(t, Throttled, transport.Health().Status)
+
+	// Nothing is sent while throttled
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&throttled, 0)
+	clock.Advance(10 * time.Second)
+	require.Eventually(t, func() bool {
+		transport.Lock()
+		defer transport.Unlock()
+		return transport.currentStatus() == Pending
+	}, time.Second, time.Millisecond)
+	transport.FlushAPMData(context.Background(), FlushInfo{})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, Healthy, transport.currentStatus())
+	assert.Equal(t, 0, transport.BufferedDataCount())
+	assert.Equal(t, -1, transport.reconnectionCount)
+}
+
+func TestThrottlingPartiallyAccepted(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"accepted":1,"errors":[{"message":"queue is full"}]}`))
+	}))
+	defer apmServer.Close()
+
+	transport := InitApmServerTransport(&extensionConfig{apmServerUrl: apmServer.URL + "/", retryRejectedEvents: true})
+	transport.clock = newManualClock()
+	err := transport.PostToApmServer(context.Background(), AgentData{Data: []byte(`{"metadata":{}}
+{"transaction":{"id":"1"}}
+{"transaction":{"id":"2"}}
+`)})
+	assert.ErrorIs(t, err, errThrottled)
+	assert.Equal(t, Throttled, transport.currentStatus())
+
+	// Only the events which were not accepted are buffered again
+	require.Equal(t, 1, transport.BufferedDataCount())
+	agentData := <-transport.dataChannel
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"id":"2"}}
+`, string(agentData.Data))
+}
@@ -0,0 +1,169 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+const (
+	// defaultNearTimeoutRatio is the fraction of the timeout above which an invocation is close to timing out
+	defaultNearTimeoutRatio = 0.9
+
+	timeoutTransactionType = "request"
+	timeoutExceptionType   = "Timeout"
+	timeoutShutdownReason  = "timeout"
+)
+
+// TimeoutDetector reports the invocations that timed out as failed transactions, along with an APM error, so
+// that timeouts show in the APM UI although the APM agent could not report them.
+//
+// An invocation is suspected to have timed out when neither the agent nor the runtime reported its end before
+// the flush deadline. The timeout is reported once the invocation is over for sure, on the next event: the next
+// invocation, or the shutdown of the execution environment. A shutdown caused by a timeout confirms that the
+// last invocation timed out, even if it was not suspected.
+type TimeoutDetector struct {
+	metadata        []byte
+	functionName    string
+	functionVersion string
+	// last is the last invocation, and suspected is set if it is suspected to have timed out
+	last          *NextEventResponse
+	lastColdstart bool
+	suspected     bool
+	invocations   int
+}
+
+// NewTimeoutDetector returns the timeout detector, or nil if reporting timeouts is disabled.
+func NewTimeoutDetector(config *extensionConfig) *TimeoutDetector {
+	if !config.reportTimeouts {
+		return nil
+	}
+	return &TimeoutDetector{
+		metadata:        extensionMetadata(config),
+		functionName:    config.functionName,
+		functionVersion: config.functionVersion,
+	}
+}
+
+// Observe reports the previous invocation if it timed out, now that event was received, and keeps track of
+// event if it is an invocation. Observe is a no-op on a nil detector.
+func (detector *TimeoutDetector) Observe(transport *ApmServerTransport, metadataContainer *MetadataContainer, event *NextEventResponse) {
+	if detector == nil || event == nil {
+		return
+	}
+	if detector.last != nil && (detector.suspected || event.ShutdownReason == timeoutShutdownReason) {
+		data, err := detector.build(metadataContainer, detector.last, detector.lastColdstart)
+		if err != nil {
+			Log.Errorf("Could not build the timeout report: %v", err)
+		} else {
+			Log.Warnf("Invocation %s timed out", detector.last.RequestID)
+			transport.EnqueuePriorityData(AgentData{Data: data})
+		}
+	}
+	detector.last, detector.suspected = nil, false
+	if event.EventType != Invoke {
+		return
+	}
+	detector.invocations++
+	detector.last = event
+	detector.lastColdstart = detector.invocations == 1
+	detector.suspected = event.FlushDeadlineReached &&
+		(event.RuntimeDoneStatus == "" || event.RuntimeDoneStatus == timeoutShutdownReason)
+}
+
+// build serializes a failed transaction spanning the invocation up to its deadline, and the timeout error.
+func (detector *TimeoutDetector) build(metadataContainer *MetadataContainer, event *NextEventResponse, coldstart bool) ([]byte, error) {
+	deadline := time.UnixMilli(event.DeadlineMs)
+	duration := deadline.Sub(event.Timestamp)
+	if duration < 0 {
+		duration = 0
+	}
+	transaction := model.Transaction{
+		Name:      detector.functionName,
+		Type:      timeoutTransactionType,
+		Timestamp: model.Time(event.Timestamp),
+		Duration:  float64(duration) / float64(time.Millisecond),
+		Result:    "timeout",
+		Outcome:   "failure",
+		FAAS: &model.FAAS{
+			ID:        event.InvokedFunctionArn,
+			Execution: event.RequestID,
+			Name:      detector.functionName,
+			Version:   detector.functionVersion,
+			Coldstart: coldstart,
+			Trigger:   &model.FAASTrigger{Type: "other"},
+		},
+	}
+	if _, err := rand.Read(transaction.TraceID[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(transaction.ID[:]); err != nil {
+		return nil, err
+	}
+	sampled := true
+	errorEvent := model.Error{
+		Timestamp:     model.Time(deadline),
+		TraceID:       transaction.TraceID,
+		ParentID:      transaction.ID,
+		TransactionID: transaction.ID,
+		Culprit:       detector.functionName,
+		Exception: model.Exception{
+			Message: fmt.Sprintf("Function timed out after %s", duration.Round(time.Millisecond)),
+			Type:    timeoutExceptionType,
+			Handled: false,
+		},
+		Transaction: model.ErrorTransaction{
+			Sampled: &sampled,
+			Type:    transaction.Type,
+			Name:    transaction.Name,
+		},
+	}
+	if _, err := rand.Read(errorEvent.ID[:]); err != nil {
+		return nil, err
+	}
+
+	var jsonWriter fastjson.Writer
+	if metadata := metadataContainer.Get(); metadata != nil {
+		jsonWriter.RawBytes(metadata)
+	} else {
+		jsonWriter.RawBytes(detector.metadata)
+	}
+	jsonWriter.RawString("\n")
+	jsonWriter.RawString(`{"transaction":`)
+	if err := transaction.MarshalFastJSON(&jsonWriter); err != nil {
+		return nil, err
+	}
+	jsonWriter.RawString("}\n")
+	jsonWriter.RawString(`{"error":`)
+	if err := errorEvent.MarshalFastJSON(&jsonWriter); err != nil {
+		return nil, err
+	}
+	jsonWriter.RawString("}\n")
+	return jsonWriter.Bytes(), nil
+}
+
+// NearTimeoutRatio returns the fraction of the timeout of the function above which the duration of an
+// invocation is reported as close to the timeout, or 0 if it is not reported.
+func (transport *ApmServerTransport) NearTimeoutRatio() float64 {
+	return transport.config.nearTimeoutRatio
+}
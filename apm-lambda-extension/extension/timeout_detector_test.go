@@ -0,0 +1,163 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type timeoutReport struct {
+	Transaction struct {
+		ID       string  `json:"id"`
+		TraceID  string  `json:"trace_id"`
+		Name     string  `json:"name"`
+		Duration float64 `json:"duration"`
+		Result   string  `json:"result"`
+		Outcome  string  `json:"outcome"`
+		FAAS     struct {
+			Execution string `json:"execution"`
+			Coldstart bool   `json:"coldstart"`
+		} `json:"faas"`
+	} `json:"transaction"`
+	Error struct {
+		TraceID       string `json:"trace_id"`
+		TransactionID string `json:"transaction_id"`
+		Exception     struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Handled bool   `json:"handled"`
+		} `json:"exception"`
+	} `json:"error"`
+}
+
+func newTimedOutEvent(requestID string, start time.Time) *NextEventResponse {
+	return &NextEventResponse{
+		EventType:            Invoke,
+		RequestID:            requestID,
+		Timestamp:            start,
+		DeadlineMs:           start.Add(3 * time.Second).UnixMilli(),
+		FlushDeadlineReached: true,
+	}
+}
+
+func TestTimeoutDetectorReportsOnNextInvocation(t *testing.T) {
+	config := extensionConfig{reportTimeouts: true, functionName: "my-function"}
+	transport := InitApmServerTransport(&config)
+	detector := NewTimeoutDetector(&config)
+	metadataContainer := NewMetadataContainer([]byte(`{"metadata":{"service":{"name":"agent"}}}`))
+
+	start := time.UnixMilli(time.Now().UnixMilli())
+	detector.Observe(transport, metadataContainer, newTimedOutEvent("timed-out", start))
+	assert.Equal(t, 0, transport.BufferedDataCount())
+
+	detector.Observe(transport, metadataContainer, &NextEventResponse{EventType: Invoke, RequestID: "next"})
+	require.Equal(t, 1, transport.BufferedDataCount())
+	lines := strings.Split(strings.TrimSpace(string((<-transport.priorityChannel).Data)), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, string(metadataContainer.Get()), lines[0])
+
+	var transaction, errorEvent timeoutReport
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &transaction))
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &errorEvent))
+	assert.Equal(t, "my-function", transaction.Transaction.Name)
+	assert.Equal(t, float64(3000), transaction.Transaction.Duration)
+	assert.Equal(t, "timeout", transaction.Transaction.Result)
+	assert.Equal(t, "failure", transaction.Transaction.Outcome)
+	assert.Equal(t, "timed-out", transaction.Transaction.FAAS.Execution)
+	assert.True(t, transaction.Transaction.FAAS.Coldstart)
+	assert.Equal(t, transaction.Transaction.TraceID, errorEvent.Error.TraceID)
+	assert.Equal(t, transaction.Transaction.ID, errorEvent.Error.TransactionID)
+	assert.Equal(t, "Timeout", errorEvent.Error.Exception.Type)
+	assert.Equal(t, "Function timed out after 3s", errorEvent.Error.Exception.Message)
+	assert.False(t, errorEvent.Error.Exception.Handled)
+
+	// The next invocation completed
+	detector.Observe(transport, metadataContainer, &NextEventResponse{EventType: Shutdown})
+	assert.Equal(t, 0, transport.BufferedDataCount())
+}
+
+func TestTimeoutDetectorRuntimeDone(t *testing.T) {
+	config := extensionConfig{reportTimeouts: true}
+	transport := InitApmServerTransport(&config)
+	detector := NewTimeoutDetector(&config)
+
+	// The runtime reported the end of the invocation after the flush deadline
+	event := newTimedOutEvent("completed", time.Now())
+	event.RuntimeDoneStatus = "success"
+	detector.Observe(transport, nil, event)
+	detector.Observe(transport, nil, &NextEventResponse{EventType: Shutdown})
+	assert.Equal(t, 0, transport.BufferedDataCount())
+
+	event = newTimedOutEvent("timed-out", time.Now())
+	event.RuntimeDoneStatus = "timeout"
+	detector.Observe(transport, nil, event)
+	detector.Observe(transport, nil, &NextEventResponse{EventType: Shutdown})
+	require.Equal(t, 1, transport.BufferedDataCount())
+
+	// Without agent metadata, the report is attributed to the extension
+	data := string((<-transport.priorityChannel).Data)
+	assert.True(t, strings.HasPrefix(data, `{"metadata":{"service":{"agent":{"name":"apm-lambda-extension"`))
+	assert.Contains(t, data, `"coldstart":false`)
+}
+
+func TestTimeoutDetectorShutdownReason(t *testing.T) {
+	config := extensionConfig{reportTimeouts: true}
+	transport := InitApmServerTransport(&config)
+	detector := NewTimeoutDetector(&config)
+
+	event := newTimedOutEvent("timed-out", time.Now())
+	event.FlushDeadlineReached = false
+	detector.Observe(transport, nil, event)
+	detector.Observe(transport, nil, &NextEventResponse{EventType: Shutdown, ShutdownReason: "timeout"})
+	assert.Equal(t, 1, transport.BufferedDataCount())
+}
+
+func TestTimeoutDetectorDisabled(t *testing.T) {
+	detector := NewTimeoutDetector(&extensionConfig{})
+	assert.Nil(t, detector)
+	// Observing events with a nil detector is a no-op
+	detector.Observe(nil, nil, newTimedOutEvent("timed-out", time.Now()))
+}
+
+func TestProcessEnvReportTimeouts(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+
+	config := ProcessEnv(new(mockSecretManager))
+	assert.True(t, config.reportTimeouts)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_REPORT_TIMEOUTS", "false")
+	config = ProcessEnv(new(mockSecretManager))
+	assert.False(t, config.reportTimeouts)
+}
+
+func TestProcessEnvNearTimeoutRatio(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	assert.Equal(t, defaultNearTimeoutRatio, ProcessEnv(new(mockSecretManager)).nearTimeoutRatio)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_NEAR_TIMEOUT_RATIO", "0.75")
+	assert.Equal(t, 0.75, ProcessEnv(new(mockSecretManager)).nearTimeoutRatio)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_NEAR_TIMEOUT_RATIO", "1.5")
+	assert.Equal(t, defaultNearTimeoutRatio, ProcessEnv(new(mockSecretManager)).nearTimeoutRatio)
+}
@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// pemPrefix starts the PEM encoded certificates and keys set directly in configuration variables,
+// rather than as the path of a file.
+const pemPrefix = "-----BEGIN"
+
+// tlsSettings holds the certificates and key used to connect to the APM server, each being either
+// PEM encoded data or the path of a PEM file, and whether the certificate of the APM server is verified.
+type tlsSettings struct {
+	clientCert string
+	clientKey  string
+	caCert     string
+	skipVerify bool
+}
+
+// newTLSConfig returns the TLS configuration of the connections to the APM server, or nil if the
+// defaults of the HTTP client apply.
+func newTLSConfig(settings tlsSettings) (*tls.Config, error) {
+	if settings == (tlsSettings{}) {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if settings.skipVerify {
+		Log.Warn("The certificate of the APM server is not verified, the connections are open to man-in-the-middle attacks")
+		config.InsecureSkipVerify = true
+	}
+
+	if (settings.clientCert == "") != (settings.clientKey == "") {
+		return nil, errors.New("the client certificate and key must be set together")
+	}
+	if settings.clientCert != "" {
+		certPEM, err := readPEM(settings.clientCert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the client certificate: %v", err)
+		}
+		keyPEM, err := readPEM(settings.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the client key: %v", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if settings.caCert != "" {
+		caPEM, err := readPEM(settings.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the CA certificate: %v", err)
+		}
+		// The CA certificate is trusted in addition to the system ones, so that a fallback APM
+		// server with a publicly trusted certificate can still be reached.
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no certificate found in the CA certificate")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// readPEM returns value if it is PEM encoded data, or the content of the file it is the path of.
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), pemPrefix) {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
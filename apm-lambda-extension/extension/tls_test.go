@@ -0,0 +1,227 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a certificate and its private key, both PEM encoded.
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPEM  string
+	keyPEM   string
+	keyPair  tls.Certificate
+	template *x509.Certificate
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed CA certificate if parent is nil.
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signerTemplate, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerTemplate, signerKey = parent.template, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerTemplate, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	c := &testCertificate{
+		cert:     cert,
+		key:      key,
+		certPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		template: template,
+	}
+	c.keyPair, err = tls.X509KeyPair([]byte(c.certPEM), []byte(c.keyPEM))
+	require.NoError(t, err)
+	return c
+}
+
+// newMutualTLSServer starts an APM server only accepting clients with a certificate signed by ca.
+func newMutualTLSServer(t *testing.T, ca *testCertificate) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "apm-server", ca).keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewTLSConfigDefault(t *testing.T) {
+	config, err := newTLSConfig(tlsSettings{})
+	require.NoError(t, err)
+	assert.Nil(t, config)
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	client := newTestCertificate(t, "client", ca)
+
+	_, err := newTLSConfig(tlsSettings{clientCert: client.certPEM})
+	assert.Error(t, err)
+	_, err = newTLSConfig(tlsSettings{clientCert: client.certPEM, clientKey: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+	_, err = newTLSConfig(tlsSettings{clientCert: client.certPEM, clientKey: ca.keyPEM})
+	assert.Error(t, err)
+	_, err = newTLSConfig(tlsSettings{caCert: "-----BEGIN CERTIFICATE-----\nnot a certificate\n-----END CERTIFICATE-----\n"})
+	assert.Error(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	client := newTestCertificate(t, "client", ca)
+	server := newMutualTLSServer(t, ca)
+
+	// The certificates and key are read from files, or used as is when PEM encoded
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	require.NoError(t, os.WriteFile(certFile, []byte(client.certPEM), 0600))
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte(ca.certPEM), 0600))
+
+	tlsConfig, err := newTLSConfig(tlsSettings{clientCert: certFile, clientKey: client.keyPEM, caCert: caFile})
+	require.NoError(t, err)
+	httpClient := newApmServerHTTPClient(&extensionConfig{
+		DataForwarderTimeoutSeconds: 3,
+		httpClient:                  httpClientConfig{tlsConfig: tlsConfig},
+	})
+	resp, err := httpClient.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Without a client certificate, the server rejects the connection
+	tlsConfig, err = newTLSConfig(tlsSettings{caCert: ca.certPEM})
+	require.NoError(t, err)
+	httpClient = newApmServerHTTPClient(&extensionConfig{
+		DataForwarderTimeoutSeconds: 3,
+		httpClient:                  httpClientConfig{tlsConfig: tlsConfig},
+	})
+	_, err = httpClient.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestProcessEnvTLS(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	ca := newTestCertificate(t, "ca", nil)
+	client := newTestCertificate(t, "client", ca)
+
+	config := ProcessEnv(nil)
+	assert.Nil(t, config.httpClient.tlsConfig)
+
+	t.Setenv("ELASTIC_APM_SERVER_CLIENT_CERT", client.certPEM)
+	t.Setenv("ELASTIC_APM_SERVER_CLIENT_KEY", client.keyPEM)
+	t.Setenv("ELASTIC_APM_SERVER_CA_CERT", ca.certPEM)
+	config = ProcessEnv(nil)
+	require.NotNil(t, config.httpClient.tlsConfig)
+	assert.Len(t, config.httpClient.tlsConfig.Certificates, 1)
+	assert.NotNil(t, config.httpClient.tlsConfig.RootCAs)
+
+	// Invalid settings are reported, and the defaults used
+	t.Setenv("ELASTIC_APM_SERVER_CLIENT_KEY", "")
+	config = ProcessEnv(nil)
+	assert.Nil(t, config.httpClient.tlsConfig)
+}
+
+func TestSkipServerCertVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	// The certificate of the test server is self-signed
+	httpClient := newApmServerHTTPClient(&extensionConfig{DataForwarderTimeoutSeconds: 3})
+	_, err := httpClient.Get(server.URL)
+	assert.Error(t, err)
+
+	tlsConfig, err := newTLSConfig(tlsSettings{skipVerify: true})
+	require.NoError(t, err)
+	httpClient = newApmServerHTTPClient(&extensionConfig{
+		DataForwarderTimeoutSeconds: 3,
+		httpClient:                  httpClientConfig{tlsConfig: tlsConfig},
+	})
+	resp, err := httpClient.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+}
+
+func TestProcessEnvServerCertVerification(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	ca := newTestCertificate(t, "ca", nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte(ca.certPEM), 0600))
+
+	t.Setenv("ELASTIC_APM_SERVER_CA_CERT_FILE", caFile)
+	config := ProcessEnv(nil)
+	require.NotNil(t, config.httpClient.tlsConfig)
+	assert.NotNil(t, config.httpClient.tlsConfig.RootCAs)
+	assert.False(t, config.httpClient.tlsConfig.InsecureSkipVerify)
+
+	t.Setenv("ELASTIC_APM_SERVER_CA_CERT_FILE", "")
+	t.Setenv("ELASTIC_APM_VERIFY_SERVER_CERT", "false")
+	config = ProcessEnv(nil)
+	require.NotNil(t, config.httpClient.tlsConfig)
+	assert.True(t, config.httpClient.tlsConfig.InsecureSkipVerify)
+
+	t.Setenv("ELASTIC_APM_VERIFY_SERVER_CERT", "true")
+	config = ProcessEnv(nil)
+	assert.Nil(t, config.httpClient.tlsConfig)
+}
@@ -0,0 +1,190 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// manualClock is a clock whose time only advances when told to, firing the timers which are due.
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []manualTimer
+}
+
+type manualTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := manualTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	return timer.c
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// settle waits until the transport is out of a grace period which is over. The transport is locked during
+// the whole grace period, and unlocked once its status is set to Pending.
+func settle(transport *ApmServerTransport) {
+	transport.Lock()
+	defer transport.Unlock()
+}
+
+// transportStep is a step of the simulation of the transport state machine: the status is set, or the
+// clock is advanced, then the state of the transport is checked.
+type transportStep struct {
+	set     ApmServerTransportStatusType
+	advance time.Duration
+
+	status             ApmServerTransportStatusType
+	reconnectionCount  int
+	remainingGraceTime time.Duration
+}
+
+// TestTransportStateMachine documents the transitions of the state of the transport:
+//
+//   - Healthy is the initial status, with a reconnection count of -1. Setting it resets the reconnection
+//     count to -1, and ends the backoff.
+//   - Failing increments the reconnection count and starts a grace period of
+//     min(reconnectionCount, maxReconnectionCount)² × multiplier seconds, during which no data is sent. The
+//     first failure after the transport was healthy thus has no grace period.
+//   - Pending is reached once the grace period is over, and cannot be set explicitly. The next request
+//     to the APM server sets the status to Healthy if it succeeds, or to Failing again otherwise, with a
+//     longer grace period.
+//   - Any other status is ignored.
+func TestTransportStateMachine(t *testing.T) {
+	for name, steps := range map[string][]transportStep{
+		"initial state": {
+			{status: Healthy, reconnectionCount: -1},
+		},
+		"first failure": {
+			{set: Failing, status: Pending, reconnectionCount: 0},
+		},
+		"grace periods grow with the reconnection count": {
+			{set: Failing, status: Pending, reconnectionCount: 0},
+			{set: Failing, status: Failing, reconnectionCount: 1, remainingGraceTime: time.Second},
+			{advance: 999 * time.Millisecond, status: Failing, reconnectionCount: 1, remainingGraceTime: time.Millisecond},
+			{advance: time.Millisecond, status: Pending, reconnectionCount: 1},
+			{set: Failing, status: Failing, reconnectionCount: 2, remainingGraceTime: 4 * time.Second},
+			{advance: 4 * time.Second, status: Pending, reconnectionCount: 2},
+			{set: Failing, status: Failing, reconnectionCount: 3, remainingGraceTime: 9 * time.Second},
+			{advance: 9 * time.Second, status: Pending, reconnectionCount: 3},
+		},
+		"grace periods are capped by the maximum reconnection count": {
+			{set: Failing, status: Pending, reconnectionCount: 0},
+			{set: Failing, status: Failing, reconnectionCount: 1, remainingGraceTime: time.Second},
+			{advance: time.Second, status: Pending, reconnectionCount: 1},
+			{set: Failing, status: Failing, reconnectionCount: 2, remainingGraceTime: 4 * time.Second},
+			{advance: 4 * time.Second, status: Pending, reconnectionCount: 2},
+			{set: Failing, status: Failing, reconnectionCount: 3, remainingGraceTime: 9 * time.Second},
+			{advance: 9 * time.Second, status: Pending, reconnectionCount: 3},
+			{set: Failing, status: Failing, reconnectionCount: 4, remainingGraceTime: 9 * time.Second},
+			{advance: 9 * time.Second, status: Pending, reconnectionCount: 4},
+		},
+		"recovery resets the reconnection count": {
+			{set: Failing, status: Pending, reconnectionCount: 0},
+			{set: Failing, status: Failing, reconnectionCount: 1, remainingGraceTime: time.Second},
+			{advance: time.Second, status: Pending, reconnectionCount: 1},
+			{set: Healthy, status: Healthy, reconnectionCount: -1},
+			{set: Failing, status: Pending, reconnectionCount: 0},
+		},
+		"pending cannot be set": {
+			{set: Pending, status: Healthy, reconnectionCount: -1},
+			{set: Failing, status: Pending, reconnectionCount: 0},
+			{set: Failing, status: Failing, reconnectionCount: 1, remainingGraceTime: time.Second},
+			{advance: time.Second, status: Pending, reconnectionCount: 1},
+			{set: Pending, status: Pending, reconnectionCount: 1},
+		},
+		"invalid statuses are ignored": {
+			{set: "Invalid", status: Healthy, reconnectionCount: -1},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clock := newManualClock()
+			transport := InitApmServerTransport(&extensionConfig{
+				backoff: backoffConfig{maxReconnectionCount: 3, multiplierSeconds: 1},
+			})
+			transport.clock = clock
+			for i, step := range steps {
+				if step.set != "" {
+					transport.SetApmServerTransportState(context.Background(), step.set)
+				}
+				clock.Advance(step.advance)
+				if step.status != Failing {
+					settle(transport)
+				}
+				assert.Equal(t, step.status, transport.currentStatus(), "step %d", i)
+				assert.Equal(t, step.reconnectionCount, transport.reconnectionCount, "step %d", i)
+				assert.Equal(t, step.remainingGraceTime, transport.remainingGracePeriod(clock.Now()), "step %d", i)
+			}
+		})
+	}
+}
+
+func TestTransportStateMachineContextDone(t *testing.T) {
+	clock := newManualClock()
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.clock = clock
+	transport.reconnectionCount = 0
+
+	// The grace period ends early when the context of the failed request is done, e.g. on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	transport.SetApmServerTransportState(ctx, Failing)
+	assert.Equal(t, Failing, transport.currentStatus())
+	cancel()
+	settle(transport)
+	assert.Equal(t, Pending, transport.currentStatus())
+	assert.Equal(t, 1, transport.reconnectionCount)
+}
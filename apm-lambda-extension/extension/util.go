@@ -18,6 +18,7 @@
 package extension
 
 import (
+	"bytes"
 	"encoding/json"
 )
 
@@ -29,3 +30,72 @@ func PrettyPrint(v interface{}) string {
 	}
 	return string(data)
 }
+
+// rewriteTransactions returns the uncompressed agent data with its transactions changed by rewrite, which
+// reports whether it changed the transaction, or false if no transaction was changed. The other lines are
+// left unaltered.
+func rewriteTransactions(data []byte, rewrite func(transaction map[string]interface{}) bool) ([]byte, bool) {
+	return rewriteEvents(data, []string{"transaction"}, func(_ string, transaction map[string]interface{}) bool {
+		return rewrite(transaction)
+	})
+}
+
+// rewriteEvents returns the uncompressed agent data with its events of eventTypes changed by rewrite, which
+// reports whether it changed the event, or false if no event was changed. The other lines are left
+// unaltered.
+func rewriteEvents(data []byte, eventTypes []string, rewrite func(eventType string, event map[string]interface{}) bool) ([]byte, bool) {
+	var out bytes.Buffer
+	changed := false
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i+1], data[i+1:]
+		} else {
+			data = nil
+		}
+		if !mayHoldEventTypes(line, eventTypes) {
+			out.Write(line)
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		// Numbers are kept as is, so that the fields the extension does not change are sent unaltered
+		decoder.UseNumber()
+		var event map[string]map[string]interface{}
+		if err := decoder.Decode(&event); err != nil || !rewriteEvent(event, eventTypes, rewrite) {
+			out.Write(line)
+			continue
+		}
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			out.Write(line)
+			continue
+		}
+		out.Write(encoded)
+		if bytes.HasSuffix(line, []byte("\n")) {
+			out.WriteByte('\n')
+		}
+		changed = true
+	}
+	return out.Bytes(), changed
+}
+
+// mayHoldEventTypes reports whether line may hold an event of one of eventTypes, without decoding it.
+func mayHoldEventTypes(line []byte, eventTypes []string) bool {
+	for _, eventType := range eventTypes {
+		if bytes.Contains(line, []byte(`"`+eventType+`"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteEvent applies rewrite to the decoded event, if it is of one of eventTypes, and reports whether
+// it changed the event.
+func rewriteEvent(event map[string]map[string]interface{}, eventTypes []string, rewrite func(eventType string, event map[string]interface{}) bool) bool {
+	for _, eventType := range eventTypes {
+		if event[eventType] != nil {
+			return rewrite(eventType, event[eventType])
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"strings"
+	"sync"
+)
+
+// xrayTracingType is the type of the tracing header of the invocations.
+const xrayTracingType = "X-Amzn-Trace-Id"
+
+// xrayTraceContext is the X-Ray trace context of an invocation, converted to the W3C format used by the
+// APM agents.
+type xrayTraceContext struct {
+	requestID string
+	traceID   string
+	parentID  string
+}
+
+// parseXRayTraceHeader parses the value of a X-Amzn-Trace-Id header, e.g.
+// Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1. It returns false if the
+// trace is not sampled, as it is then not recorded by X-Ray, or if the header is not valid.
+func parseXRayTraceHeader(value string) (xrayTraceContext, bool) {
+	var traceContext xrayTraceContext
+	sampled := false
+	for _, field := range strings.Split(value, ";") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "Root":
+			// The version, the epoch time and the unique identifier of the trace, which together form
+			// a W3C trace ID
+			root := strings.Split(parts[1], "-")
+			if len(root) != 3 || root[0] != "1" {
+				return xrayTraceContext{}, false
+			}
+			traceContext.traceID = root[1] + root[2]
+		case "Parent":
+			traceContext.parentID = parts[1]
+		case "Sampled":
+			sampled = parts[1] == "1"
+		}
+	}
+	if !sampled || !isHex(traceContext.traceID, 32) || !isHex(traceContext.parentID, 16) {
+		return xrayTraceContext{}, false
+	}
+	return traceContext, true
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// xrayLinks links the transactions of the agent data to the X-Ray trace of the invocation.
+type xrayLinks struct {
+	enabled bool
+	mu      sync.RWMutex
+	current *xrayTraceContext
+}
+
+// SetTraceContext records the X-Ray trace context of the invocation starting, to which the transactions
+// received until the next invocation are linked.
+func (transport *ApmServerTransport) SetTraceContext(requestID string, tracing Tracing) {
+	l := transport.xrayLinks
+	if !l.enabled {
+		return
+	}
+	var current *xrayTraceContext
+	if tracing.Type == xrayTracingType {
+		if traceContext, ok := parseXRayTraceHeader(tracing.Value); ok {
+			traceContext.requestID = requestID
+			current = &traceContext
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current = current
+}
+
+// linkXRayTrace returns the agent data with a link to the X-Ray trace of the invocation added to its
+// transactions. The agent data is returned unchanged when it cannot be parsed, or when no transaction needs
+// to be linked.
+func (transport *ApmServerTransport) linkXRayTrace(agentData AgentData) AgentData {
+	l := transport.xrayLinks
+	if !l.enabled {
+		return agentData
+	}
+	l.mu.RLock()
+	current := l.current
+	l.mu.RUnlock()
+	if current == nil {
+		return agentData
+	}
+	data, err := GetUncompressedBytes(agentData.Data, agentData.ContentEncoding)
+	if err != nil {
+		Log.Debugf("Could not decompress the agent data to link it to the X-Ray trace: %v", err)
+		return agentData
+	}
+	linked, changed := addXRayLinks(data, *current)
+	if !changed {
+		return agentData
+	}
+	agentData.Data, agentData.ContentEncoding = linked, ""
+	return agentData
+}
+
+// addXRayLinks adds a span link to the X-Ray trace to the transactions of data that belong to the
+// invocation of traceContext, and are not already part of the X-Ray trace. It reports whether a
+// transaction was linked.
+func addXRayLinks(data []byte, traceContext xrayTraceContext) ([]byte, bool) {
+	return rewriteTransactions(data, func(transaction map[string]interface{}) bool {
+		if !needsXRayLink(transaction, traceContext) {
+			return false
+		}
+		links, _ := transaction["links"].([]interface{})
+		transaction["links"] = append(links, map[string]interface{}{"trace_id": traceContext.traceID, "span_id": traceContext.parentID})
+		return true
+	})
+}
+
+// needsXRayLink reports whether transaction belongs to the invocation of traceContext, and is not already
+// part of, or linked to, its X-Ray trace.
+func needsXRayLink(transaction map[string]interface{}, traceContext xrayTraceContext) bool {
+	if transaction["trace_id"] == traceContext.traceID {
+		return false
+	}
+	// The agents record the request ID of the invocation, which tells apart the transactions received
+	// late from a previous invocation
+	if faas, ok := transaction["faas"].(map[string]interface{}); ok {
+		if execution, ok := faas["execution"].(string); ok && execution != "" && execution != traceContext.requestID {
+			return false
+		}
+	}
+	links, _ := transaction["links"].([]interface{})
+	for _, existing := range links {
+		if existing, ok := existing.(map[string]interface{}); ok && existing["trace_id"] == traceContext.traceID {
+			return false
+		}
+	}
+	return true
+}
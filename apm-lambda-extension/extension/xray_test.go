@@ -0,0 +1,87 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package extension
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseXRayTraceHeader(t *testing.T) {
+	traceContext, ok := parseXRayTraceHeader("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	require.True(t, ok)
+	assert.Equal(t, xrayTraceContext{traceID: "5759e988bd862e3fe1be46a994272793", parentID: "53995c3f42cd8ad8"}, traceContext)
+
+	for _, value := range []string{
+		"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0",
+		"Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1",
+		"Root=2-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1",
+		"Root=1-5759e988-bd862e3f;Parent=53995c3f42cd8ad8;Sampled=1",
+		"",
+	} {
+		_, ok := parseXRayTraceHeader(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestLinkXRayTrace(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{xrayLinks: true})
+	agentData := AgentData{Data: []byte(`{"metadata":{}}
+{"transaction":{"id":"1","trace_id":"0af7651916cd43dd8448eb211c80319c","duration":1.5,"faas":{"execution":"req-1"}}}
+{"span":{"id":"2","transaction_id":"1","trace_id":"0af7651916cd43dd8448eb211c80319c"}}
+{"transaction":{"id":"3","trace_id":"5759e988bd862e3fe1be46a994272793"}}
+{"transaction":{"id":"4","trace_id":"0af7651916cd43dd8448eb211c80319c","faas":{"execution":"req-0"}}}
+`)}
+
+	// Nothing is linked before the first invocation
+	assert.Equal(t, agentData, transport.linkXRayTrace(agentData))
+
+	transport.SetTraceContext("req-1", Tracing{Type: "X-Amzn-Trace-Id", Value: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"})
+	linked := transport.linkXRayTrace(agentData)
+	assert.Equal(t, `{"metadata":{}}
+{"transaction":{"duration":1.5,"faas":{"execution":"req-1"},"id":"1","links":[{"span_id":"53995c3f42cd8ad8","trace_id":"5759e988bd862e3fe1be46a994272793"}],"trace_id":"0af7651916cd43dd8448eb211c80319c"}}
+{"span":{"id":"2","transaction_id":"1","trace_id":"0af7651916cd43dd8448eb211c80319c"}}
+{"transaction":{"id":"3","trace_id":"5759e988bd862e3fe1be46a994272793"}}
+{"transaction":{"id":"4","trace_id":"0af7651916cd43dd8448eb211c80319c","faas":{"execution":"req-0"}}}
+`, string(linked.Data))
+	assert.Empty(t, linked.ContentEncoding)
+
+	// Transactions are linked once
+	assert.Equal(t, linked, transport.linkXRayTrace(linked))
+
+	// Unsampled traces are not linked
+	transport.SetTraceContext("req-2", Tracing{Type: "X-Amzn-Trace-Id", Value: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0"})
+	assert.Equal(t, agentData, transport.linkXRayTrace(agentData))
+}
+
+func TestLinkXRayTraceDisabled(t *testing.T) {
+	transport := InitApmServerTransport(&extensionConfig{})
+	transport.SetTraceContext("req-1", Tracing{Type: "X-Amzn-Trace-Id", Value: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1"})
+	agentData := AgentData{Data: []byte(`{"transaction":{"id":"1","trace_id":"0af7651916cd43dd8448eb211c80319c"}}`)}
+	assert.Equal(t, agentData, transport.linkXRayTrace(agentData))
+}
+
+func TestProcessEnvXRayLinks(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	assert.False(t, ProcessEnv(new(mockSecretManager)).xrayLinks)
+
+	t.Setenv("ELASTIC_APM_LAMBDA_XRAY_LINKS", "true")
+	assert.True(t, ProcessEnv(new(mockSecretManager)).xrayLinks)
+}
@@ -0,0 +1,55 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build failpoints
+// +build failpoints
+
+package failpoint
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Enabled reports whether the failpoints are evaluated by this build.
+const Enabled = true
+
+var (
+	mu     sync.Mutex
+	spec   string
+	active *set
+)
+
+// Inject performs the action configured for the failpoint name. It returns an error for the error action,
+// and nil otherwise. The configuration is parsed again when the environment variable changes, so that the
+// tests of a package can each configure their failpoints.
+func Inject(name string) error {
+	mu.Lock()
+	if current := os.Getenv(EnvVar); active == nil || current != spec {
+		parsed, err := parse(current)
+		if err != nil {
+			mu.Unlock()
+			// A test relying on a misconfigured failpoint would pass for the wrong reasons
+			panic(fmt.Sprintf("invalid %s: %v", EnvVar, err))
+		}
+		spec, active = current, parsed
+	}
+	s := active
+	mu.Unlock()
+	return s.eval(name)
+}
@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package failpoint injects failures at specific points of the extension, so that the resilience tests can
+// check that the extension degrades gracefully, as documented. The failpoints are only evaluated by the
+// builds with the failpoints tag, and are configured by the ELASTIC_APM_LAMBDA_FAILPOINTS environment
+// variable, a comma-separated list of name=action pairs, e.g.
+//
+//	ELASTIC_APM_LAMBDA_FAILPOINTS=register=error,post=2*error,flush=delay(3s)
+//
+// The action is one of error, which makes the failpoint return an error, panic, or delay(duration), which
+// makes it sleep for duration. An action prefixed with N* is only performed by the N first evaluations of the
+// failpoint.
+package failpoint
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvVar is the environment variable configuring the failpoints.
+const EnvVar = "ELASTIC_APM_LAMBDA_FAILPOINTS"
+
+// The failpoints of the extension.
+const (
+	// Register fails the registration with the Extensions API.
+	Register = "register"
+	// Subscribe fails the subscription to the Telemetry API or the Logs API.
+	Subscribe = "subscribe"
+	// Post fails the requests to the APM server, as if it was unreachable.
+	Post = "post"
+	// Flush fails the flushes of the buffered data to the APM server.
+	Flush = "flush"
+)
+
+// Error is the error returned by a failpoint.
+type Error struct {
+	Name string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("failure injected by the %s failpoint", e.Name)
+}
+
+type actionType int
+
+const (
+	errorAction actionType = iota
+	panicAction
+	delayAction
+)
+
+type action struct {
+	actionType actionType
+	delay      time.Duration
+	// remaining is the number of evaluations left performing the action, or -1 if it is not limited.
+	remaining int
+}
+
+// set holds the actions of the failpoints, by name.
+type set struct {
+	mu      sync.Mutex
+	actions map[string]*action
+}
+
+// parse parses the failpoints configured by spec.
+func parse(spec string) (*set, error) {
+	s := &set{actions: make(map[string]*action)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q must be formatted as name=action", entry)
+		}
+		a, err := parseAction(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid action of the %s failpoint: %v", parts[0], err)
+		}
+		s.actions[parts[0]] = a
+	}
+	return s, nil
+}
+
+func parseAction(value string) (*action, error) {
+	a := &action{remaining: -1}
+	if i := strings.Index(value, "*"); i >= 0 {
+		count, err := strconv.Atoi(value[:i])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("%q is not a valid count", value[:i])
+		}
+		a.remaining = count
+		value = value[i+1:]
+	}
+	switch {
+	case value == "error":
+		a.actionType = errorAction
+	case value == "panic":
+		a.actionType = panicAction
+	case strings.HasPrefix(value, "delay(") && strings.HasSuffix(value, ")"):
+		delay, err := time.ParseDuration(value[len("delay(") : len(value)-1])
+		if err != nil {
+			return nil, err
+		}
+		a.actionType = delayAction
+		a.delay = delay
+	default:
+		return nil, fmt.Errorf("unknown action %q", value)
+	}
+	return a, nil
+}
+
+// eval performs the action of the failpoint name, if any.
+func (s *set) eval(name string) error {
+	s.mu.Lock()
+	a, ok := s.actions[name]
+	if !ok || a.remaining == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	if a.remaining > 0 {
+		a.remaining--
+	}
+	actionType, delay := a.actionType, a.delay
+	s.mu.Unlock()
+
+	switch actionType {
+	case panicAction:
+		panic(&Error{Name: name})
+	case delayAction:
+		time.Sleep(delay)
+		return nil
+	default:
+		return &Error{Name: name}
+	}
+}
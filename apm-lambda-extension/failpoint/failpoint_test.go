@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package failpoint
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	s, err := parse("register=error, post=2*error,flush=delay(10ms),subscribe=panic")
+	require.NoError(t, err)
+	assert.Equal(t, &action{actionType: errorAction, remaining: -1}, s.actions[Register])
+	assert.Equal(t, &action{actionType: errorAction, remaining: 2}, s.actions[Post])
+	assert.Equal(t, &action{actionType: delayAction, delay: 10 * time.Millisecond, remaining: -1}, s.actions[Flush])
+	assert.Equal(t, &action{actionType: panicAction, remaining: -1}, s.actions[Subscribe])
+
+	s, err = parse("")
+	require.NoError(t, err)
+	assert.Empty(t, s.actions)
+
+	for _, spec := range []string{"register", "=error", "post=fail", "post=0*error", "flush=delay(soon)"} {
+		_, err := parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestEval(t *testing.T) {
+	s, err := parse("register=error,post=2*error,flush=delay(10ms),subscribe=panic")
+	require.NoError(t, err)
+
+	var failpointErr *Error
+	assert.ErrorAs(t, s.eval(Register), &failpointErr)
+	assert.Equal(t, Register, failpointErr.Name)
+	assert.Error(t, s.eval(Register))
+
+	// The count limits the evaluations performing the action
+	assert.Error(t, s.eval(Post))
+	assert.Error(t, s.eval(Post))
+	assert.NoError(t, s.eval(Post))
+
+	start := time.Now()
+	assert.NoError(t, s.eval(Flush))
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	assert.Panics(t, func() { _ = s.eval(Subscribe) })
+	assert.NoError(t, s.eval("unknown"))
+}
@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// configFlags are the command-line flags mirroring the environment variables configuring the extension,
+// for local runs. A flag set on the command line takes precedence over the environment variable.
+var configFlags = []struct {
+	name  string
+	env   string
+	usage string
+}{
+	{"runtime-api", "AWS_LAMBDA_RUNTIME_API", "address of the Lambda Runtime API"},
+	{"apm-server", "ELASTIC_APM_LAMBDA_APM_SERVER", "URL of the APM server"},
+	{"apm-server-fallback", "ELASTIC_APM_LAMBDA_APM_SERVER_FALLBACK", "URL of the fallback APM server"},
+	{"secret-token", "ELASTIC_APM_SECRET_TOKEN", "secret token of the APM server"},
+	{"api-key", "ELASTIC_APM_API_KEY", "API key of the APM server"},
+	{"address", "ELASTIC_APM_DATA_RECEIVER_SERVER_ADDRESS", "address receiving the agent data"},
+	{"port", "ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", "port receiving the agent data"},
+	{"send-strategy", "ELASTIC_APM_SEND_STRATEGY", "send strategy: syncflush or background"},
+	{"data-forwarder-mode", "ELASTIC_APM_DATA_FORWARDER_MODE", "data forwarder mode: buffer or stream"},
+	{"log-level", "ELASTIC_APM_LOG_LEVEL", "log level of the extension"},
+	{"log-format", "ELASTIC_APM_LOG_FORMAT", "log format of the extension: json or text"},
+	{"extension-name", "ELASTIC_APM_LAMBDA_EXTENSION_NAME", "name registered with the Extensions API"},
+}
+
+// envFlag collects the KEY=VALUE pairs of the repeatable -env flag.
+type envFlag []string
+
+func (f *envFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *envFlag) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%q must be formatted as KEY=VALUE", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// applyFlags parses the command-line arguments, and sets the environment variables mirrored by the flags
+// that are set. Any other variable can be set with -env KEY=VALUE.
+func applyFlags(args []string, output io.Writer) error {
+	flags := flag.NewFlagSet(extensionName, flag.ContinueOnError)
+	flags.SetOutput(output)
+	values := make(map[string]*string, len(configFlags))
+	for _, configFlag := range configFlags {
+		values[configFlag.name] = flags.String(configFlag.name, "", fmt.Sprintf("%s (%s)", configFlag.usage, configFlag.env))
+	}
+	var env envFlag
+	flags.Var(&env, "env", "environment variable to set, as KEY=VALUE (repeatable)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	for _, pair := range env {
+		i := strings.IndexByte(pair, '=')
+		if err := os.Setenv(pair[:i], pair[i+1:]); err != nil {
+			return err
+		}
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, configFlag := range configFlags {
+			if configFlag.name == f.Name && err == nil {
+				err = os.Setenv(configFlag.env, *values[f.Name])
+			}
+		}
+	})
+	return err
+}
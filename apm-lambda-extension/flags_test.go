@@ -0,0 +1,55 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyFlags(t *testing.T) {
+	// Restore the environment variables set by the flags once the test is over
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "http://env.example.com/")
+	t.Setenv("ELASTIC_APM_LOG_LEVEL", "info")
+	t.Setenv("ELASTIC_APM_SEND_STRATEGY", "syncflush")
+	t.Setenv("ELASTIC_APM_BATCH_MAX_BYTES", "")
+
+	err := applyFlags([]string{
+		"-apm-server", "http://flag.example.com/",
+		"-log-level=debug",
+		"-env", "ELASTIC_APM_BATCH_MAX_BYTES=1024",
+	}, ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "http://flag.example.com/", os.Getenv("ELASTIC_APM_LAMBDA_APM_SERVER"))
+	assert.Equal(t, "debug", os.Getenv("ELASTIC_APM_LOG_LEVEL"))
+	assert.Equal(t, "1024", os.Getenv("ELASTIC_APM_BATCH_MAX_BYTES"))
+	// Flags that are not set leave the environment untouched
+	assert.Equal(t, "syncflush", os.Getenv("ELASTIC_APM_SEND_STRATEGY"))
+}
+
+func TestApplyFlagsInvalid(t *testing.T) {
+	assert.Error(t, applyFlags([]string{"-unknown"}, ioutil.Discard))
+	assert.Error(t, applyFlags([]string{"-env", "NOT_A_PAIR"}, ioutil.Discard))
+	assert.Error(t, applyFlags([]string{"extra"}, ioutil.Discard))
+	assert.ErrorIs(t, applyFlags([]string{"-h"}, ioutil.Discard), flag.ErrHelp)
+}
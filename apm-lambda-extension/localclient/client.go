@@ -0,0 +1,318 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package localclient is a client of the endpoints served by the APM Lambda Extension to the function
+// process: the intake endpoint, the health check and the debug endpoints. It lets custom in-function
+// tooling written in Go send agent data to the extension, signal the end of the agent flushes and check
+// the state of the extension, without depending on the extension itself.
+package localclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultURL is the URL the extension listens on by default.
+const DefaultURL = "http://localhost:8200"
+
+// maxErrorBody is the maximum size of the response body read when a request fails.
+const maxErrorBody = 64 * 1024
+
+// Status is the state of the connection of the extension to the APM server.
+type Status string
+
+const (
+	// Healthy means that the last request to the APM server succeeded.
+	Healthy Status = "Healthy"
+	// Failing means that the APM server is unreachable, and that the extension is waiting before retrying.
+	Failing Status = "Failing"
+	// Throttled means that the APM server asked the extension to slow down, and that the extension is waiting
+	// before sending data again.
+	Throttled Status = "Throttled"
+	// Pending means that the extension is about to retry sending data to the APM server.
+	Pending Status = "Pending"
+)
+
+// FlushStatus holds the times of the last flush of the agent data buffered by the extension, and of the last
+// data successfully sent to the APM server. The times are nil until the matching event happens.
+type FlushStatus struct {
+	LastFlushStart *time.Time `json:"last_flush_start,omitempty"`
+	LastFlushEnd   *time.Time `json:"last_flush_end,omitempty"`
+	LastSent       *time.Time `json:"last_sent,omitempty"`
+}
+
+// Health is the summary of the state of the extension served on /healthcheck.
+type Health struct {
+	Version           string `json:"version"`
+	Status            Status `json:"status"`
+	ReconnectionCount int    `json:"reconnection_count"`
+	BufferedPayloads  int    `json:"buffered_payloads"`
+	FlushStatus
+}
+
+// EchoResponse describes agent data as parsed by the extension, without it being sent to the APM server.
+type EchoResponse struct {
+	ContentEncoding   string         `json:"content_encoding,omitempty"`
+	Bytes             int            `json:"bytes"`
+	UncompressedBytes int            `json:"uncompressed_bytes"`
+	Events            map[string]int `json:"events"`
+	InvalidLines      int            `json:"invalid_lines"`
+	Errors            []EchoError    `json:"errors,omitempty"`
+}
+
+// EchoError describes a line of agent data that is not a valid intake v2 event.
+type EchoError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// DebugVars is the snapshot of the effective state of the extension served on /debug/vars. The
+// configuration is left untyped, as its settings depend on the version of the extension.
+type DebugVars struct {
+	Version      string                 `json:"version"`
+	Commit       string                 `json:"commit"`
+	Config       map[string]interface{} `json:"config"`
+	Transport    DebugTransport         `json:"transport"`
+	Buffer       DebugBuffer            `json:"buffer"`
+	Flushes      FlushStatus            `json:"flushes"`
+	RecentErrors []DebugSample          `json:"recent_errors"`
+}
+
+// DebugTransport describes the current and recent states of the connection to the APM server.
+type DebugTransport struct {
+	Status            Status        `json:"status"`
+	ActiveApmServer   string        `json:"active_apm_server"`
+	ReconnectionCount int           `json:"reconnection_count"`
+	InFlightRequests  int64         `json:"in_flight_requests"`
+	QueuedRequests    int64         `json:"queued_requests"`
+	Transitions       []DebugSample `json:"transitions"`
+}
+
+// DebugBuffer describes the agent data waiting to be sent to the APM server.
+type DebugBuffer struct {
+	BufferedPayloads int   `json:"buffered_payloads"`
+	Capacity         int   `json:"capacity"`
+	DroppedPayloads  int64 `json:"dropped_payloads"`
+	RejectedPayloads int64 `json:"rejected_payloads"`
+	SpilledBytes     int64 `json:"spilled_bytes"`
+	DeliveryFailures int64 `json:"delivery_failures"`
+	RejectedEvents   int64 `json:"rejected_events"`
+	RetriedEvents    int64 `json:"retried_events"`
+	FilteredEvents   int64 `json:"filtered_events"`
+	SampledOutTraces int64 `json:"sampled_out_traces"`
+}
+
+// DebugSample is a timestamped transport state transition, or error.
+type DebugSample struct {
+	Status  Status    `json:"status,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// IntakeError is an error reported by the intake endpoint, e.g. when a payload is rejected by the
+// validation of the extension. Document is the invalid line, if the error is specific to one.
+type IntakeError struct {
+	Message  string `json:"message"`
+	Document string `json:"document,omitempty"`
+}
+
+// StatusError is returned when the extension responds with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	// Body is the body of the response, truncated to 64KB
+	Body string
+	// Errors are the errors reported by the intake endpoint, if any
+	Errors []IntakeError
+}
+
+func (err *StatusError) Error() string {
+	if len(err.Errors) > 0 {
+		return fmt.Sprintf("extension responded with status %d: %s", err.StatusCode, err.Errors[0].Message)
+	}
+	return fmt.Sprintf("extension responded with status %d: %s", err.StatusCode, strings.TrimSpace(err.Body))
+}
+
+// SendOptions are the options of a request to the intake endpoint.
+type SendOptions struct {
+	// ContentEncoding is the encoding of the payload, e.g. gzip, if it is compressed
+	ContentEncoding string
+	// Flushed signals that the agent flushed all its data for the current invocation
+	Flushed bool
+	// ExpectedFlushes is the number of flushes the agent performs during the current invocation, if more
+	// than one, e.g. one per record of a batch processed by the function
+	ExpectedFlushes int
+}
+
+// Client is a client of the endpoints of the extension. The zero value is not usable: use New.
+type Client struct {
+	baseURL string
+	// HTTPClient is the client sending the requests to the extension
+	HTTPClient *http.Client
+	// UserAgent identifies the agent sending data through the client to the APM server
+	UserAgent string
+}
+
+// New returns a client of the extension listening on baseURL, e.g. DefaultURL.
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extension URL: %v", err)
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("invalid extension URL %q: expected http://host:port", baseURL)
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{},
+	}, nil
+}
+
+// SendEvents sends an intake v2 payload, i.e. newline-delimited JSON events preceded by the metadata, to
+// the extension, which forwards it to the APM server.
+func (c *Client) SendEvents(ctx context.Context, payload io.Reader, opts SendOptions) error {
+	query := url.Values{}
+	if opts.Flushed {
+		query.Set("flushed", "true")
+	}
+	if opts.ExpectedFlushes > 0 {
+		query.Set("expected_flushes", strconv.Itoa(opts.ExpectedFlushes))
+	}
+	path := "/intake/v2/events"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	if payload == nil {
+		payload = http.NoBody
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if opts.ContentEncoding != "" {
+		req.Header.Set("Content-Encoding", opts.ContentEncoding)
+	}
+	return c.do(req, nil, http.StatusAccepted)
+}
+
+// Flush signals the extension that the agent flushed all its data for the current invocation, so that the
+// extension can send the buffered data to the APM server without waiting for the end of the invocation.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.SendEvents(ctx, nil, SendOptions{Flushed: true})
+}
+
+// Health returns the summary of the state of the extension. The status code of the health check is 503
+// while the APM server is unreachable, which is reported as a Failing status rather than an error.
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	var health Health
+	req, err := c.newRequest(ctx, http.MethodGet, "/healthcheck", nil)
+	if err != nil {
+		return health, err
+	}
+	err = c.do(req, &health, http.StatusOK, http.StatusServiceUnavailable)
+	return health, err
+}
+
+// FlushStatus returns the times of the last flush of the extension, and of the last data sent to the
+// APM server.
+func (c *Client) FlushStatus(ctx context.Context) (FlushStatus, error) {
+	health, err := c.Health(ctx)
+	return health.FlushStatus, err
+}
+
+// DebugVars returns the snapshot of the effective state of the extension, meant to be attached to bug
+// reports.
+func (c *Client) DebugVars(ctx context.Context) (DebugVars, error) {
+	var vars DebugVars
+	req, err := c.newRequest(ctx, http.MethodGet, "/debug/vars", nil)
+	if err != nil {
+		return vars, err
+	}
+	err = c.do(req, &vars, http.StatusOK)
+	return vars, err
+}
+
+// Echo sends an intake v2 payload to the extension, which parses it the way it parses the agent data
+// but does not send it to the APM server.
+func (c *Client) Echo(ctx context.Context, payload []byte, contentEncoding string) (EchoResponse, error) {
+	var response EchoResponse
+	req, err := c.newRequest(ctx, http.MethodPost, "/debug/echo", bytes.NewReader(payload))
+	if err != nil {
+		return response, err
+	}
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	err = c.do(req, &response, http.StatusOK)
+	return response, err
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return req, nil
+}
+
+// do sends req, and decodes the response body into v, if not nil, when the status code is one of
+// statusCodes. A *StatusError is returned for any other status code.
+func (c *Client) do(req *http.Request, v interface{}, statusCodes ...int) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, statusCode := range statusCodes {
+		if resp.StatusCode != statusCode {
+			continue
+		}
+		if v == nil {
+			_, err = io.Copy(ioutil.Discard, resp.Body)
+			return err
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("could not decode the response of the extension: %v", err)
+		}
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return err
+	}
+	statusErr := &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	var intakeResponse struct {
+		Errors []IntakeError `json:"errors"`
+	}
+	if json.Unmarshal(body, &intakeResponse) == nil {
+		statusErr.Errors = intakeResponse.Errors
+	}
+	return statusErr
+}
@@ -0,0 +1,133 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package localclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	client, err := New(DefaultURL + "/")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultURL, client.baseURL)
+
+	for _, baseURL := range []string{"", "localhost:8200", "https://localhost:8200", "http://"} {
+		_, err := New(baseURL)
+		assert.Error(t, err, baseURL)
+	}
+}
+
+// TestClient checks the client against the endpoints of the extension, so that the types of the client
+// stay in sync with the responses of the extension.
+func TestClient(t *testing.T) {
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer apmServer.Close()
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", apmServer.URL)
+	t.Setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", "8205")
+	t.Setenv("ELASTIC_APM_LAMBDA_VALIDATE_INTAKE", "true")
+	transport := extension.InitApmServerTransport(extension.ProcessEnv(nil))
+	server, err := extension.StartHttpServer(context.Background(), transport)
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := New("http://localhost:8205")
+	require.NoError(t, err)
+	client.UserAgent = "custom-tool/1.0"
+	ctx := context.Background()
+
+	health, err := client.Health(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Healthy, health.Status)
+	assert.NotEmpty(t, health.Version)
+	assert.Nil(t, health.LastFlushStart)
+
+	payload := "{\"metadata\":{}}\n{\"transaction\":{}}\n"
+	require.NoError(t, client.SendEvents(ctx, strings.NewReader(payload), SendOptions{}))
+	health, err = client.Health(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, health.BufferedPayloads)
+
+	err = client.SendEvents(ctx, strings.NewReader("{\"transaction\":{}}\n"), SendOptions{})
+	require.IsType(t, &StatusError{}, err)
+	statusErr := err.(*StatusError)
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+	assert.Equal(t, []IntakeError{{Message: "line 1: the first event must be metadata", Document: "{\"transaction\":{}}"}}, statusErr.Errors)
+	assert.EqualError(t, err, "extension responded with status 400: line 1: the first event must be metadata")
+
+	echo, err := client.Echo(ctx, []byte(payload), "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"metadata": 1, "transaction": 1}, echo.Events)
+
+	vars, err := client.DebugVars(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, health.Version, vars.Version)
+	assert.Equal(t, apmServer.URL+"/", vars.Transport.ActiveApmServer)
+	assert.Equal(t, 1, vars.Buffer.BufferedPayloads)
+	assert.Equal(t, ":8205", vars.Config["data_receiver_server_port"])
+}
+
+func TestClientFlush(t *testing.T) {
+	var query, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	client, err := New(server.URL)
+	require.NoError(t, err)
+
+	require.NoError(t, client.Flush(context.Background()))
+	assert.Equal(t, "flushed=true", query)
+	assert.Empty(t, body)
+
+	require.NoError(t, client.SendEvents(context.Background(), strings.NewReader("{}"), SendOptions{ExpectedFlushes: 3}))
+	assert.Equal(t, "expected_flushes=3", query)
+	assert.Equal(t, "{}", body)
+}
+
+func TestClientHealthFailing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"version":"1.1.0","status":"Failing","reconnection_count":2,"buffered_payloads":5}`))
+	}))
+	defer server.Close()
+	client, err := New(server.URL)
+	require.NoError(t, err)
+
+	health, err := client.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Failing, health.Status)
+	assert.Equal(t, 2, health.ReconnectionCount)
+
+	_, err = client.DebugVars(context.Background())
+	assert.EqualError(t, err, `extension responded with status 503: {"version":"1.1.0","status":"Failing","reconnection_count":2,"buffered_payloads":5}`)
+}
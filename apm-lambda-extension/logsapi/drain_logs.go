@@ -0,0 +1,59 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"time"
+
+	"elastic/apm-lambda-extension/extension"
+)
+
+// DrainLogs processes the events still sent by the Logs API when the execution environment shuts down, such as
+// the platform.report event of the last invocation, which is otherwise only processed during the next invocation.
+// It returns the number of processed events once no event was received for idleWait, or once ctx is done.
+func DrainLogs(
+	ctx context.Context,
+	shutdownEvent *extension.NextEventResponse,
+	apmServerTransport *extension.ApmServerTransport,
+	logsTransport *LogsTransport,
+	metadataContainer *extension.MetadataContainer,
+	prevEvent *extension.NextEventResponse,
+	idleWait time.Duration,
+) int {
+	idle := time.NewTimer(idleWait)
+	defer idle.Stop()
+	var drained int
+	for {
+		select {
+		case logEvent := <-logsTransport.logsChannel:
+			processLogEvent(ctx, logEvent, shutdownEvent, apmServerTransport, metadataContainer, prevEvent)
+			drained++
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(idleWait)
+		case <-idle.C:
+			extension.Log.Debugf("Drained %d log events", drained)
+			return drained
+		case <-ctx.Done():
+			extension.Log.Warnf("Shutdown deadline reached while draining log events, %d events drained", drained)
+			return drained
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainLogs(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	apmServerTransport := extension.InitApmServerTransport(extension.ProcessEnv(nil))
+	logsTransport := InitLogsTransport("localhost")
+	metadataContainer := extension.NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	timestamp := time.Now()
+	prevEvent := extension.NextEventResponse{
+		Timestamp:  timestamp,
+		EventType:  extension.Invoke,
+		DeadlineMs: timestamp.UnixMilli() + 5000,
+		RequestID:  "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+	}
+	shutdownEvent := extension.NextEventResponse{EventType: extension.Shutdown, ShutdownReason: "spindown"}
+
+	// The report of the last invocation is still pending when the execution environment shuts down
+	logsTransport.logsChannel <- LogEvent{
+		Time: timestamp,
+		Type: Report,
+		Record: LogEventRecord{
+			RequestId: prevEvent.RequestID,
+			Metrics:   PlatformMetrics{DurationMs: 182.43, BilledDurationMs: 183, MemorySizeMB: 128, MaxMemoryUsedMB: 76},
+		},
+	}
+	logsTransport.logsChannel <- LogEvent{Time: timestamp, Type: RuntimeDone, Record: LogEventRecord{RequestId: "another-request"}}
+
+	start := time.Now()
+	drained := DrainLogs(context.Background(), &shutdownEvent, apmServerTransport, logsTransport, metadataContainer, &prevEvent, 50*time.Millisecond)
+	assert.Equal(t, 2, drained)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 1, apmServerTransport.BufferedDataCount())
+}
+
+func TestDrainLogsDeadline(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	apmServerTransport := extension.InitApmServerTransport(extension.ProcessEnv(nil))
+	logsTransport := InitLogsTransport("localhost")
+	shutdownEvent := extension.NextEventResponse{EventType: extension.Shutdown}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, 0, DrainLogs(ctx, &shutdownEvent, apmServerTransport, logsTransport, &extension.MetadataContainer{}, nil, time.Minute))
+	assert.Less(t, time.Since(start), time.Minute)
+}
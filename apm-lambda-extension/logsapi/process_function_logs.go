@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"strings"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// maxFunctionLogBytes is the maximum size of a function log line forwarded to the APM server.
+const maxFunctionLogBytes = 8192
+
+// functionLogLevels maps the levels written by the Lambda runtimes to ECS log levels.
+var functionLogLevels = map[string]string{
+	"TRACE":    "trace",
+	"DEBUG":    "debug",
+	"INFO":     "info",
+	"WARN":     "warn",
+	"WARNING":  "warn",
+	"ERROR":    "error",
+	"FATAL":    "fatal",
+	"CRITICAL": "fatal",
+}
+
+// ProcessFunctionLog converts a line written by the function to stdout or stderr into an ECS log event,
+// attributed to the current invocation, prefixed by the metadata when available.
+//
+// Lines following the format of the managed runtimes ("<timestamp>\t<request id>\t<level>\t<message>")
+// are parsed to extract the log level and the message. Other lines are forwarded as is.
+func ProcessFunctionLog(metadataContainer *extension.MetadataContainer, currentEvent *extension.NextEventResponse, logEvent LogEvent) (extension.AgentData, error) {
+	message := strings.TrimRight(logEvent.StringRecord, "\r\n")
+	level := ""
+	if fields := strings.SplitN(message, "\t", 4); len(fields) == 4 && fields[1] == currentEvent.RequestID {
+		if ecsLevel, ok := functionLogLevels[strings.ToUpper(fields[2])]; ok {
+			level = ecsLevel
+			message = fields[3]
+		}
+	}
+
+	var jsonWriter fastjson.Writer
+	jsonWriter.RawString(`{"log":{"@timestamp":`)
+	if err := model.Time(logEvent.Time).MarshalFastJSON(&jsonWriter); err != nil {
+		return extension.AgentData{}, err
+	}
+	jsonWriter.RawString(`,"message":`)
+	jsonWriter.String(truncateRecord(message, maxFunctionLogBytes))
+	if level != "" {
+		jsonWriter.RawString(`,"log.level":`)
+		jsonWriter.String(level)
+	}
+	jsonWriter.RawString(`,"faas":{"execution":`)
+	jsonWriter.String(currentEvent.RequestID)
+	if currentEvent.InvokedFunctionArn != "" {
+		jsonWriter.RawString(`,"id":`)
+		jsonWriter.String(currentEvent.InvokedFunctionArn)
+	}
+	jsonWriter.RawString(`}}}`)
+
+	data := metadataContainer.AppendTo(nil)
+	data = append(data, jsonWriter.Bytes()...)
+	return extension.AgentData{Data: data}, nil
+}
@@ -0,0 +1,80 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessFunctionLog(t *testing.T) {
+	timestamp := time.Date(2022, 8, 2, 12, 1, 23, 0, time.UTC)
+	event := extension.NextEventResponse{
+		RequestID:          "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+	}
+
+	tests := []struct {
+		name     string
+		record   string
+		expected string
+	}{
+		{
+			name:     "runtime format",
+			record:   "2022-08-02T12:01:23.000Z\t8476a536-e9f4-11e8-9739-2dfe598c3fcd\tWARN\tSomething happened\n",
+			expected: `{"log":{"@timestamp":1659441683000000,"message":"Something happened","log.level":"warn","faas":{"execution":"8476a536-e9f4-11e8-9739-2dfe598c3fcd","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`,
+		},
+		{
+			name:     "raw line",
+			record:   "Hello\tworld\n",
+			expected: `{"log":{"@timestamp":1659441683000000,"message":"Hello\tworld","faas":{"execution":"8476a536-e9f4-11e8-9739-2dfe598c3fcd","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`,
+		},
+		{
+			name:     "other request id",
+			record:   "2022-08-02T12:01:23.000Z\tanother-request\tINFO\tSomething happened",
+			expected: `{"log":{"@timestamp":1659441683000000,"message":"2022-08-02T12:01:23.000Z\tanother-request\tINFO\tSomething happened","faas":{"execution":"8476a536-e9f4-11e8-9739-2dfe598c3fcd","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logEvent := LogEvent{Time: timestamp, Type: SubEventType(Function), StringRecord: tc.record}
+			agentData, err := ProcessFunctionLog(&extension.MetadataContainer{}, &event, logEvent)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(agentData.Data))
+		})
+	}
+}
+
+func TestProcessFunctionLogMetadata(t *testing.T) {
+	mc := extension.NewMetadataContainer([]byte(`{"metadata":{}}`))
+	event := extension.NextEventResponse{RequestID: "8476a536-e9f4-11e8-9739-2dfe598c3fcd"}
+	logEvent := LogEvent{Time: time.Now(), Type: SubEventType(Function), StringRecord: strings.Repeat("a", 2*maxFunctionLogBytes)}
+
+	agentData, err := ProcessFunctionLog(mc, &event, logEvent)
+	require.NoError(t, err)
+	lines := strings.Split(string(agentData.Data), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, `{"metadata":{}}`, lines[0])
+	assert.Less(t, len(lines[1]), maxFunctionLogBytes+200)
+}
@@ -20,6 +20,9 @@ package logsapi
 import (
 	"context"
 	"math"
+	"regexp"
+	"strings"
+	"time"
 
 	"elastic/apm-lambda-extension/extension"
 
@@ -33,6 +36,16 @@ type PlatformMetrics struct {
 	MemorySizeMB     int32   `json:"memorySizeMB"`
 	MaxMemoryUsedMB  int32   `json:"maxMemoryUsedMB"`
 	InitDurationMs   float32 `json:"initDurationMs"`
+	// ProducedBytes is only reported in platform.runtimeDone events
+	ProducedBytes int64 `json:"producedBytes"`
+}
+
+// PlatformSpan is a phase of the invocation, as reported in platform.runtimeDone events
+// (e.g. responseLatency and responseDuration).
+type PlatformSpan struct {
+	Name       string    `json:"name"`
+	Start      time.Time `json:"start"`
+	DurationMs float32   `json:"durationMs"`
 }
 
 type MetricsContainer struct {
@@ -63,7 +76,9 @@ func (mc MetricsContainer) MarshalFastJSON(json *fastjson.Writer) error {
 	return nil
 }
 
-func ProcessPlatformReport(ctx context.Context, metadataContainer *extension.MetadataContainer, functionData *extension.NextEventResponse, platformReport LogEvent) (extension.AgentData, error) {
+// ProcessPlatformReport converts a platform.report event into a metricset. When nearTimeoutRatio is set, the
+// invocations whose duration exceeds this fraction of the timeout are reported as close to timing out.
+func ProcessPlatformReport(ctx context.Context, metadataContainer *extension.MetadataContainer, functionData *extension.NextEventResponse, platformReport LogEvent, nearTimeoutRatio float64) (extension.AgentData, error) {
 	var metricsData []byte
 	metricsContainer := MetricsContainer{
 		Metrics: &model.Metrics{},
@@ -75,10 +90,16 @@ func ProcessPlatformReport(ctx context.Context, metadataContainer *extension.Met
 	// Timestamp
 	metricsContainer.Metrics.Timestamp = model.Time(platformReport.Time)
 
+	// Labels
+	if functionData.RuntimeDoneStatus != "" {
+		metricsContainer.Metrics.Labels = model.StringMap{{Key: "runtime_done_status", Value: functionData.RuntimeDoneStatus}}
+	}
+
 	// FaaS Fields
 	metricsContainer.Metrics.FAAS = &model.FAAS{
 		Execution: platformReport.Record.RequestId,
 		ID:        functionData.InvokedFunctionArn,
+		Version:   functionData.FunctionVersion,
 		Coldstart: platformReportMetrics.InitDurationMs > 0,
 	}
 
@@ -91,21 +112,121 @@ func ProcessPlatformReport(ctx context.Context, metadataContainer *extension.Met
 	metricsContainer.Add("aws.lambda.metrics.duration", float64(platformReportMetrics.DurationMs))               // Unit : Milliseconds
 	metricsContainer.Add("aws.lambda.metrics.billed_duration", float64(platformReportMetrics.BilledDurationMs))  // Unit : Milliseconds
 	metricsContainer.Add("aws.lambda.metrics.coldstart_duration", float64(platformReportMetrics.InitDurationMs)) // Unit : Milliseconds
+	// Reported whenever the status is known, so that error rates can be computed from the number of samples.
+	// An invocation whose platform.runtimeDone event was not received is neither counted as failed nor as successful.
+	if isErrorStatus(functionData.RuntimeDoneStatus) {
+		metricsContainer.Add("aws.lambda.metrics.errors", 1) // Unit : Count
+	} else if functionData.RuntimeDoneStatus != "" {
+		metricsContainer.Add("aws.lambda.metrics.errors", 0) // Unit : Count
+	}
 	// In AWS Lambda, the Timeout is configured as an integer number of seconds. We use this assumption to derive the Timeout from
 	// - The epoch corresponding to the end of the current invocation (its "deadline")
 	// - The epoch corresponding to the start of the current invocation
 	// - The multiplication / division then rounds the value to obtain a number of ms that can be expressed a multiple of 1000 (see initial assumption)
-	metricsContainer.Add("aws.lambda.metrics.timeout", math.Ceil(float64(functionData.DeadlineMs-functionData.Timestamp.UnixMilli())/1e3)*1e3) // Unit : Milliseconds
+	timeoutMs := math.Ceil(float64(functionData.DeadlineMs-functionData.Timestamp.UnixMilli())/1e3) * 1e3
+	metricsContainer.Add("aws.lambda.metrics.timeout", timeoutMs) // Unit : Milliseconds
+
+	// Derived Metrics
+	if platformReportMetrics.MemorySizeMB > 0 {
+		metricsContainer.Add("aws.lambda.metrics.memory_utilization", float64(platformReportMetrics.MaxMemoryUsedMB)/float64(platformReportMetrics.MemorySizeMB)) // Unit : Ratio
+		metricsContainer.Add("aws.lambda.metrics.memory_headroom_mb", float64(platformReportMetrics.MemorySizeMB-platformReportMetrics.MaxMemoryUsedMB))          // Unit : Megabytes
+	}
+	metricsContainer.Add("aws.lambda.metrics.billed_duration_overhead", float64(platformReportMetrics.BilledDurationMs)-float64(platformReportMetrics.DurationMs)) // Unit : Milliseconds
+	// Always reported, like errors, so that the rate of invocations close to the timeout can be computed
+	if nearTimeoutRatio > 0 && timeoutMs > 0 {
+		if float64(platformReportMetrics.DurationMs) >= nearTimeoutRatio*timeoutMs {
+			metricsContainer.Add("aws.lambda.metrics.near_timeout", 1) // Unit : Boolean
+		} else {
+			metricsContainer.Add("aws.lambda.metrics.near_timeout", 0) // Unit : Boolean
+		}
+	}
+	// Only known for the triggers telling when they originated, through the Runtime API proxy
+	if functionData.QueueTime > 0 {
+		metricsContainer.Add("aws.lambda.metrics.queue_time", float64(functionData.QueueTime)/float64(time.Millisecond)) // Unit : Milliseconds
+	}
 
 	var jsonWriter fastjson.Writer
 	if err := metricsContainer.MarshalFastJSON(&jsonWriter); err != nil {
 		return extension.AgentData{Data: metricsData}, nil
 	}
 
-	if metadataContainer.Metadata != nil {
-		metricsData = append(metadataContainer.Metadata, []byte("\n")...)
+	metricsData = metadataContainer.AppendTo(metricsData)
+
+	metricsData = append(metricsData, jsonWriter.Bytes()...)
+	return extension.AgentData{Data: metricsData}, nil
+}
+
+// isErrorStatus returns true if the status of a platform.runtimeDone event indicates that the function
+// invocation did not complete successfully.
+func isErrorStatus(status string) bool {
+	switch status {
+	case "error", "failure", "timeout":
+		return true
+	}
+	return false
+}
+
+// runtimeDoneOutcome returns the outcome of an invocation, as defined by the APM data model, from the status
+// of its platform.runtimeDone event.
+func runtimeDoneOutcome(status string) string {
+	if status == "success" {
+		return "success"
+	}
+	if isErrorStatus(status) {
+		return "failure"
+	}
+	return "unknown"
+}
+
+// hasRuntimeMetrics returns true if the record holds the metrics and spans of newer platform.runtimeDone schemas.
+func (record LogEventRecord) hasRuntimeMetrics() bool {
+	return record.Metrics.DurationMs > 0 || record.Metrics.ProducedBytes > 0 || len(record.Spans) > 0
+}
+
+var camelCaseBoundary = regexp.MustCompile("([a-z0-9])([A-Z])")
+
+// ProcessRuntimeDone converts the metrics and spans of a platform.runtimeDone event into a metricset, so that
+// they are forwarded as soon as the event is received instead of waiting for the next platform.report event.
+// The event is received during the next invocation when the agent reported the end of the invocation first.
+func ProcessRuntimeDone(ctx context.Context, metadataContainer *extension.MetadataContainer, functionData *extension.NextEventResponse, runtimeDone LogEvent, coldstart bool) (extension.AgentData, error) {
+	var metricsData []byte
+	metricsContainer := MetricsContainer{
+		Metrics: &model.Metrics{},
+	}
+	record := runtimeDone.Record
+
+	metricsContainer.Metrics.Timestamp = model.Time(runtimeDone.Time)
+	metricsContainer.Metrics.FAAS = &model.FAAS{
+		Execution: record.RequestId,
+		ID:        functionData.InvokedFunctionArn,
+		Version:   functionData.FunctionVersion,
+		Coldstart: coldstart,
+	}
+	// The outcome of the invocation is annotated, so that the runtime metrics can be broken down by outcome
+	// without waiting for the platform.report event. The labels are sorted lexicographically.
+	metricsContainer.Metrics.Labels = model.StringMap{{Key: "outcome", Value: runtimeDoneOutcome(record.Status)}}
+	if record.Status != "" {
+		metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: "runtime_done_status", Value: record.Status})
+	}
+	if record.ErrorType != "" {
+		metricsContainer.Metrics.Labels = append(metricsContainer.Metrics.Labels, model.StringMapItem{Key: "runtime_error_type", Value: record.ErrorType})
+	}
+
+	metricsContainer.Add("aws.lambda.metrics.runtime_duration", float64(record.Metrics.DurationMs))  // Unit : Milliseconds
+	metricsContainer.Add("aws.lambda.metrics.produced_bytes", float64(record.Metrics.ProducedBytes)) // Unit : Bytes
+	// Spans are reported as durations, e.g. responseLatency becomes aws.lambda.metrics.response_latency
+	for _, span := range record.Spans {
+		name := strings.ToLower(camelCaseBoundary.ReplaceAllString(span.Name, "${1}_${2}"))
+		metricsContainer.Add("aws.lambda.metrics."+name, float64(span.DurationMs)) // Unit : Milliseconds
 	}
 
+	var jsonWriter fastjson.Writer
+	if err := metricsContainer.MarshalFastJSON(&jsonWriter); err != nil {
+		return extension.AgentData{}, err
+	}
+
+	metricsData = metadataContainer.AppendTo(metricsData)
+
 	metricsData = append(metricsData, jsonWriter.Bytes()...)
 	return extension.AgentData{Data: metricsData}, nil
 }
@@ -25,6 +25,7 @@ import (
 	"testing"
 	"time"
 
+	"elastic/apm-lambda-extension/buildinfo"
 	"elastic/apm-lambda-extension/extension"
 
 	"github.com/stretchr/testify/assert"
@@ -33,9 +34,7 @@ import (
 
 func Test_processPlatformReportColdstart(t *testing.T) {
 
-	mc := extension.MetadataContainer{
-		Metadata: []byte(fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, extension.Version)),
-	}
+	mc := extension.NewMetadataContainer([]byte(fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, buildinfo.Version())))
 
 	timestamp := time.Now()
 
@@ -72,11 +71,11 @@ func Test_processPlatformReportColdstart(t *testing.T) {
 		},
 	}
 
-	desiredOutputMetadata := fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, extension.Version)
+	desiredOutputMetadata := fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, buildinfo.Version())
 
-	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"aws.lambda.metrics.coldstart_duration":{"value":422.9700012207031},"aws.lambda.metrics.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"aws.lambda.metrics.duration":{"value":182.42999267578125},"aws.lambda.metrics.billed_duration":{"value":183}},"timestamp":%d,"faas":{"coldstart":true,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, timestamp.UnixNano()/1e3)
+	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"aws.lambda.metrics.coldstart_duration":{"value":422.9700012207031},"aws.lambda.metrics.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"aws.lambda.metrics.duration":{"value":182.42999267578125},"aws.lambda.metrics.billed_duration":{"value":183},"aws.lambda.metrics.memory_utilization":{"value":0.59375},"aws.lambda.metrics.memory_headroom_mb":{"value":52},"aws.lambda.metrics.billed_duration_overhead":{"value":0.57000732421875},"aws.lambda.metrics.near_timeout":{"value":0}},"timestamp":%d,"faas":{"coldstart":true,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, timestamp.UnixNano()/1e3)
 
-	rawBytes, err := ProcessPlatformReport(context.Background(), &mc, &event, logEvent)
+	rawBytes, err := ProcessPlatformReport(context.Background(), mc, &event, logEvent, 0.9)
 	require.NoError(t, err)
 
 	requestBytes, err := extension.GetUncompressedBytes(rawBytes.Data, "")
@@ -93,9 +92,7 @@ func Test_processPlatformReportColdstart(t *testing.T) {
 
 func Test_processPlatformReportNoColdstart(t *testing.T) {
 
-	mc := extension.MetadataContainer{
-		Metadata: []byte(fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, extension.Version)),
-	}
+	mc := extension.NewMetadataContainer([]byte(fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, buildinfo.Version())))
 
 	timestamp := time.Now()
 
@@ -132,11 +129,11 @@ func Test_processPlatformReportNoColdstart(t *testing.T) {
 		},
 	}
 
-	desiredOutputMetadata := fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, extension.Version)
+	desiredOutputMetadata := fmt.Sprintf(`{"metadata":{"service":{"agent":{"name":"apm-lambda-extension","version":"%s"},"framework":{"name":"AWS Lambda","version":""},"language":{"name":"python","version":"3.9.8"},"runtime":{"name":"","version":""},"node":{}},"user":{},"process":{"pid":0},"system":{"container":{"id":""},"kubernetes":{"node":{},"pod":{}}},"cloud":{"provider":"","instance":{},"machine":{},"account":{},"project":{},"service":{}}}}`, buildinfo.Version())
 
-	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"aws.lambda.metrics.coldstart_duration":{"value":0},"aws.lambda.metrics.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"aws.lambda.metrics.duration":{"value":182.42999267578125},"aws.lambda.metrics.billed_duration":{"value":183}},"timestamp":%d,"faas":{"coldstart":false,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, timestamp.UnixNano()/1e3)
+	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"aws.lambda.metrics.coldstart_duration":{"value":0},"aws.lambda.metrics.timeout":{"value":5000},"system.memory.total":{"value":1.34217728e+08},"system.memory.actual.free":{"value":5.4525952e+07},"aws.lambda.metrics.duration":{"value":182.42999267578125},"aws.lambda.metrics.billed_duration":{"value":183},"aws.lambda.metrics.memory_utilization":{"value":0.59375},"aws.lambda.metrics.memory_headroom_mb":{"value":52},"aws.lambda.metrics.billed_duration_overhead":{"value":0.57000732421875},"aws.lambda.metrics.near_timeout":{"value":0}},"timestamp":%d,"faas":{"coldstart":false,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, timestamp.UnixNano()/1e3)
 
-	rawBytes, err := ProcessPlatformReport(context.Background(), &mc, &event, logEvent)
+	rawBytes, err := ProcessPlatformReport(context.Background(), mc, &event, logEvent, 0.9)
 	require.NoError(t, err)
 
 	requestBytes, err := extension.GetUncompressedBytes(rawBytes.Data, "")
@@ -150,3 +147,212 @@ func Test_processPlatformReportNoColdstart(t *testing.T) {
 	assert.JSONEq(t, desiredOutputMetadata, processingResult[0])
 	assert.JSONEq(t, desiredOutputMetrics, processingResult[1])
 }
+
+func Test_processPlatformReportRuntimeDoneError(t *testing.T) {
+	timestamp := time.Now()
+
+	logEvent := LogEvent{
+		Time: timestamp,
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestId: "6f7f0961f83442118a7af6fe80b88d56",
+			Metrics: PlatformMetrics{
+				DurationMs:       182.43,
+				BilledDurationMs: 183,
+				MemorySizeMB:     128,
+				MaxMemoryUsedMB:  76,
+			},
+		},
+	}
+
+	event := extension.NextEventResponse{
+		Timestamp:          timestamp,
+		EventType:          extension.Invoke,
+		DeadlineMs:         timestamp.UnixNano()/1e6 + 4584, // Milliseconds
+		RequestID:          "6f7f0961f83442118a7af6fe80b88d56",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+		RuntimeDoneStatus:  "error",
+	}
+
+	rawBytes, err := ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0.9)
+	require.NoError(t, err)
+
+	out := string(rawBytes.Data)
+	assert.Contains(t, out, `"aws.lambda.metrics.errors":{"value":1}`)
+	assert.Contains(t, out, `"tags":{"runtime_done_status":"error"}`)
+
+	event.RuntimeDoneStatus = "success"
+	rawBytes, err = ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0.9)
+	require.NoError(t, err)
+
+	out = string(rawBytes.Data)
+	assert.Contains(t, out, `"aws.lambda.metrics.errors":{"value":0}`)
+	assert.Contains(t, out, `"tags":{"runtime_done_status":"success"}`)
+	// Without runtimeDone event, the outcome of the invocation is unknown
+	event.RuntimeDoneStatus = ""
+	rawBytes, err = ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0.9)
+	require.NoError(t, err)
+	assert.NotContains(t, string(rawBytes.Data), "aws.lambda.metrics.errors")
+}
+
+func Test_processPlatformReportQueueTime(t *testing.T) {
+	timestamp := time.Now()
+	logEvent := LogEvent{
+		Time: timestamp,
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestId: "6f7f0961f83442118a7af6fe80b88d56",
+			Metrics:   PlatformMetrics{DurationMs: 182.43, BilledDurationMs: 183, MemorySizeMB: 128, MaxMemoryUsedMB: 76},
+		},
+	}
+	event := extension.NextEventResponse{
+		Timestamp:  timestamp,
+		EventType:  extension.Invoke,
+		DeadlineMs: timestamp.UnixNano()/1e6 + 4584,
+		RequestID:  "6f7f0961f83442118a7af6fe80b88d56",
+	}
+
+	rawBytes, err := ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0.9)
+	require.NoError(t, err)
+	assert.NotContains(t, string(rawBytes.Data), "aws.lambda.metrics.queue_time")
+
+	event.QueueTime = 1500 * time.Millisecond
+	rawBytes, err = ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0.9)
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"aws.lambda.metrics.queue_time":{"value":1500}`)
+}
+
+func Test_processPlatformReportDoesNotAliasMetadata(t *testing.T) {
+	timestamp := time.Now()
+
+	// Metadata with spare capacity, as when it is extracted from an uncompressed agent payload
+	metadata := make([]byte, 0, 1024)
+	metadata = append(metadata, `{"metadata":{}}`...)
+	mc := extension.NewMetadataContainer(metadata)
+
+	outputs := make([]string, 0, 2)
+	var results [][]byte
+	for i, requestID := range []string{"first-invocation", "second-invocation"} {
+		logEvent := LogEvent{
+			Time: timestamp,
+			Type: "platform.report",
+			Record: LogEventRecord{
+				RequestId: requestID,
+				Metrics:   PlatformMetrics{DurationMs: float32(100 * (i + 1))},
+			},
+		}
+		event := extension.NextEventResponse{
+			Timestamp: timestamp,
+			EventType: extension.Invoke,
+			RequestID: requestID,
+		}
+		agentData, err := ProcessPlatformReport(context.Background(), mc, &event, logEvent, 0.9)
+		require.NoError(t, err)
+		outputs = append(outputs, string(agentData.Data))
+		results = append(results, agentData.Data)
+	}
+
+	assert.Equal(t, `{"metadata":{}}`, string(mc.Get()))
+	for i, data := range results {
+		assert.Equal(t, outputs[i], string(data))
+	}
+	assert.NotEqual(t, string(results[0]), string(results[1]))
+}
+
+func Test_processRuntimeDone(t *testing.T) {
+	timestamp := time.Date(2022, 8, 2, 12, 1, 23, 0, time.UTC)
+	mc := extension.NewMetadataContainer([]byte(`{"metadata":{}}`))
+
+	le := new(LogEvent)
+	runtimeDoneJSON := []byte(`{
+		"time": "2022-08-02T12:01:23Z",
+		"type": "platform.runtimeDone",
+		"record": {
+			"requestId": "6f7f0961f83442118a7af6fe80b88d56",
+			"status": "success",
+			"metrics": {"durationMs": 140.5, "producedBytes": 16},
+			"spans": [
+				{"name": "responseLatency", "start": "2022-08-02T12:01:23.521Z", "durationMs": 23.5},
+				{"name": "responseDuration", "start": "2022-08-02T12:01:23.545Z", "durationMs": 20}
+			]
+		}
+	}`)
+	require.NoError(t, le.UnmarshalJSON(runtimeDoneJSON))
+	assert.True(t, le.Record.hasRuntimeMetrics())
+
+	event := extension.NextEventResponse{
+		RequestID:          "6f7f0961f83442118a7af6fe80b88d56",
+		InvokedFunctionArn: "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime",
+	}
+
+	rawBytes, err := ProcessRuntimeDone(context.Background(), mc, &event, *le, true)
+	require.NoError(t, err)
+
+	desiredOutputMetrics := fmt.Sprintf(`{"metricset":{"samples":{"aws.lambda.metrics.runtime_duration":{"value":140.5},"aws.lambda.metrics.produced_bytes":{"value":16},"aws.lambda.metrics.response_latency":{"value":23.5},"aws.lambda.metrics.response_duration":{"value":20}},"timestamp":%d,"tags":{"outcome":"success","runtime_done_status":"success"},"faas":{"coldstart":true,"execution":"6f7f0961f83442118a7af6fe80b88d56","id":"arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"}}}`, timestamp.UnixNano()/1e3)
+
+	processingResult := strings.Split(string(rawBytes.Data), "\n")
+	require.Len(t, processingResult, 2)
+	assert.JSONEq(t, `{"metadata":{}}`, processingResult[0])
+	assert.JSONEq(t, desiredOutputMetrics, processingResult[1])
+}
+
+func Test_runtimeDoneWithoutMetrics(t *testing.T) {
+	record := LogEventRecord{RequestId: "6f7f0961f83442118a7af6fe80b88d56", Status: "success"}
+	assert.False(t, record.hasRuntimeMetrics())
+}
+
+func Test_processRuntimeDoneOutcome(t *testing.T) {
+	le := LogEvent{
+		Time: time.Now(),
+		Type: "platform.runtimeDone",
+		Record: LogEventRecord{
+			RequestId: "6f7f0961f83442118a7af6fe80b88d56",
+			Status:    "timeout",
+			ErrorType: "Sandbox.Timedout",
+			Metrics:   PlatformMetrics{DurationMs: 3000},
+		},
+	}
+	event := extension.NextEventResponse{RequestID: "6f7f0961f83442118a7af6fe80b88d56"}
+
+	rawBytes, err := ProcessRuntimeDone(context.Background(), &extension.MetadataContainer{}, &event, le, false)
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"tags":{"outcome":"failure","runtime_done_status":"timeout","runtime_error_type":"Sandbox.Timedout"}`)
+
+	assert.Equal(t, "success", runtimeDoneOutcome("success"))
+	assert.Equal(t, "failure", runtimeDoneOutcome("error"))
+	assert.Equal(t, "unknown", runtimeDoneOutcome(""))
+}
+
+func Test_processPlatformReportNearTimeout(t *testing.T) {
+	timestamp := time.Now()
+	logEvent := LogEvent{
+		Time: timestamp,
+		Type: "platform.report",
+		Record: LogEventRecord{
+			RequestId: "6f7f0961f83442118a7af6fe80b88d56",
+			Metrics:   PlatformMetrics{DurationMs: 4600, BilledDurationMs: 4600, MemorySizeMB: 128, MaxMemoryUsedMB: 128},
+		},
+	}
+	event := extension.NextEventResponse{
+		Timestamp:  timestamp,
+		EventType:  extension.Invoke,
+		DeadlineMs: timestamp.UnixNano()/1e6 + 4584,
+		RequestID:  "6f7f0961f83442118a7af6fe80b88d56",
+	}
+
+	rawBytes, err := ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0.9)
+	require.NoError(t, err)
+	out := string(rawBytes.Data)
+	assert.Contains(t, out, `"aws.lambda.metrics.near_timeout":{"value":1}`)
+	assert.Contains(t, out, `"aws.lambda.metrics.memory_utilization":{"value":1}`)
+	assert.Contains(t, out, `"aws.lambda.metrics.memory_headroom_mb":{"value":0}`)
+
+	rawBytes, err = ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0.95)
+	require.NoError(t, err)
+	assert.Contains(t, string(rawBytes.Data), `"aws.lambda.metrics.near_timeout":{"value":0}`)
+
+	// The proximity to the timeout is not reported when disabled
+	rawBytes, err = ProcessPlatformReport(context.Background(), &extension.MetadataContainer{}, &event, logEvent, 0)
+	require.NoError(t, err)
+	assert.NotContains(t, string(rawBytes.Data), "aws.lambda.metrics.near_timeout")
+}
@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"crypto/rand"
+	"time"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// PlatformTracing is the tracing context of the invocation, as reported in platform.start events of the
+// Telemetry API.
+type PlatformTracing struct {
+	SpanId string `json:"spanId"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+}
+
+// ProcessPlatformStart records the hints carried by the platform.start event of the current invocation: the
+// version of the function, reported in the faas fields of the platform metrics, its start time, and the
+// tracing context of the invocation, when the Extensions API did not provide it.
+func ProcessPlatformStart(currentEvent *extension.NextEventResponse, platformStart LogEvent) {
+	record := platformStart.Record
+	if record.RequestId != currentEvent.RequestID {
+		extension.Log.Debug("platform.start event request id didn't match")
+		return
+	}
+	currentEvent.FunctionVersion = record.Version
+	currentEvent.StartTime = platformStart.Time
+	if currentEvent.Tracing.Value == "" && record.Tracing != nil {
+		currentEvent.Tracing = extension.Tracing{Type: record.Tracing.Type, Value: record.Tracing.Value}
+	}
+}
+
+// ProcessPlatformFault converts a platform.fault event, e.g. reporting that the runtime process exited before
+// completing the request, into an unhandled APM error attributed to the current invocation, prefixed by the
+// metadata when available.
+func ProcessPlatformFault(metadataContainer *extension.MetadataContainer, currentEvent *extension.NextEventResponse, platformFault LogEvent) (extension.AgentData, error) {
+	message := platformFault.StringRecord
+	if message == "" {
+		message = platformFault.Record.Status
+	}
+	exceptionType := platformFault.Record.ErrorType
+	if exceptionType == "" {
+		exceptionType = string(Fault)
+	}
+	requestID := platformFault.Record.RequestId
+	if requestID == "" {
+		requestID = currentEvent.RequestID
+	}
+	errorEvent := model.Error{
+		Timestamp: model.Time(platformFault.Time),
+		Culprit:   string(Fault),
+		Exception: model.Exception{
+			Message: truncateRecord(message, maxStringRecordBytes),
+			Type:    exceptionType,
+			Handled: false,
+		},
+		Context: &model.Context{
+			Tags: model.IfaceMap{{Key: "faas_execution", Value: requestID}},
+		},
+	}
+	if _, err := rand.Read(errorEvent.ID[:]); err != nil {
+		return extension.AgentData{}, err
+	}
+
+	var jsonWriter fastjson.Writer
+	jsonWriter.RawString(`{"error":`)
+	if err := errorEvent.MarshalFastJSON(&jsonWriter); err != nil {
+		return extension.AgentData{}, err
+	}
+	jsonWriter.RawString(`}`)
+
+	data := metadataContainer.AppendTo(nil)
+	data = append(data, jsonWriter.Bytes()...)
+	return extension.AgentData{Data: data}, nil
+}
+
+// PlatformInvocation describes the invocation of functionData from its platform.start, platform.runtimeDone and
+// platform.report events, for the transaction reported when no agent data was received during the invocation.
+func PlatformInvocation(functionData *extension.NextEventResponse, platformReport LogEvent) extension.PlatformInvocation {
+	duration := time.Duration(float64(platformReport.Record.Metrics.DurationMs) * float64(time.Millisecond))
+	start := functionData.StartTime
+	if start.IsZero() {
+		// The platform.report event is sent at the end of the invocation
+		start = platformReport.Time.Add(-duration)
+	}
+	return extension.PlatformInvocation{
+		Start:     start,
+		Duration:  duration,
+		Outcome:   runtimeDoneOutcome(functionData.RuntimeDoneStatus),
+		Coldstart: platformReport.Record.Metrics.InitDurationMs > 0,
+	}
+}
@@ -0,0 +1,165 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessPlatformStart(t *testing.T) {
+	le := new(LogEvent)
+	platformStartJSON := []byte(`{
+		"time": "2022-10-12T00:00:00.000Z",
+		"type": "platform.start",
+		"record": {
+			"requestId": "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa",
+			"version": "7",
+			"tracing": {
+				"spanId": "54565fb41ac79632",
+				"type": "X-Amzn-Trace-Id",
+				"value": "Root=1-62e900b2-710d76f009d6e7785905449a;Parent=0efbd19962d95b05;Sampled=1"
+			}
+		}
+	}`)
+	require.NoError(t, le.UnmarshalJSON(platformStartJSON))
+
+	event := extension.NextEventResponse{RequestID: "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa"}
+	ProcessPlatformStart(&event, *le)
+	assert.Equal(t, "7", event.FunctionVersion)
+	assert.Equal(t, time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC), event.StartTime.UTC())
+	assert.Equal(t, extension.Tracing{
+		Type:  "X-Amzn-Trace-Id",
+		Value: "Root=1-62e900b2-710d76f009d6e7785905449a;Parent=0efbd19962d95b05;Sampled=1",
+	}, event.Tracing)
+
+	// The tracing context received from the Extensions API is kept
+	event = extension.NextEventResponse{
+		RequestID: "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa",
+		Tracing:   extension.Tracing{Type: "X-Amzn-Trace-Id", Value: "Root=1-5759e988-bd862e3fe1be46a994272793"},
+	}
+	ProcessPlatformStart(&event, *le)
+	assert.Equal(t, "Root=1-5759e988-bd862e3fe1be46a994272793", event.Tracing.Value)
+
+	// Events of other invocations are ignored
+	event = extension.NextEventResponse{RequestID: "another-request"}
+	ProcessPlatformStart(&event, *le)
+	assert.Equal(t, "", event.FunctionVersion)
+}
+
+func TestPlatformStartVersionReportedInMetrics(t *testing.T) {
+	event := extension.NextEventResponse{RequestID: "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa", FunctionVersion: "7"}
+	runtimeDone := LogEvent{Type: RuntimeDone, Record: LogEventRecord{RequestId: event.RequestID}}
+	agentData, err := ProcessRuntimeDone(context.Background(), &extension.MetadataContainer{}, &event, runtimeDone, false)
+	require.NoError(t, err)
+	assert.Contains(t, string(agentData.Data), `"version":"7"`)
+}
+
+func TestPlatformInvocation(t *testing.T) {
+	start := time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC)
+	report := LogEvent{
+		Time: start.Add(2 * time.Second),
+		Type: Report,
+		Record: LogEventRecord{
+			RequestId: "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa",
+			Metrics:   PlatformMetrics{DurationMs: 182.5, InitDurationMs: 320},
+		},
+	}
+	event := extension.NextEventResponse{RequestID: report.Record.RequestId, StartTime: start, RuntimeDoneStatus: "error"}
+	assert.Equal(t, extension.PlatformInvocation{
+		Start:     start,
+		Duration:  182500 * time.Microsecond,
+		Outcome:   "failure",
+		Coldstart: true,
+	}, PlatformInvocation(&event, report))
+
+	// Without a platform.start event, the invocation is assumed to end when it is reported
+	report.Record.Metrics.InitDurationMs = 0
+	event = extension.NextEventResponse{RequestID: report.Record.RequestId, RuntimeDoneStatus: "success"}
+	assert.Equal(t, extension.PlatformInvocation{
+		Start:    report.Time.Add(-182500 * time.Microsecond),
+		Duration: 182500 * time.Microsecond,
+		Outcome:  "success",
+	}, PlatformInvocation(&event, report))
+}
+
+type platformFaultEvent struct {
+	Error struct {
+		Culprit   string `json:"culprit"`
+		Timestamp int64  `json:"timestamp"`
+		Exception struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Handled bool   `json:"handled"`
+		} `json:"exception"`
+		Context struct {
+			Tags map[string]string `json:"tags"`
+		} `json:"context"`
+	} `json:"error"`
+}
+
+func TestProcessPlatformFault(t *testing.T) {
+	timestamp := time.Date(2021, 2, 4, 20, 0, 5, 123e6, time.UTC)
+	mc := extension.NewMetadataContainer([]byte(`{"metadata":{}}`))
+	event := extension.NextEventResponse{RequestID: "d783b35e-a91d-4251-af17-035953428a2c"}
+	logEvent := LogEvent{
+		Time:         timestamp,
+		Type:         Fault,
+		StringRecord: "RequestId: d783b35e-a91d-4251-af17-035953428a2c Process exited before completing request",
+	}
+
+	agentData, err := ProcessPlatformFault(mc, &event, logEvent)
+	require.NoError(t, err)
+	lines := strings.Split(string(agentData.Data), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"metadata":{}}`, lines[0])
+
+	var errorEvent platformFaultEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &errorEvent))
+	assert.Equal(t, "platform.fault", errorEvent.Error.Culprit)
+	assert.Equal(t, timestamp.UnixNano()/1e3, errorEvent.Error.Timestamp)
+	assert.Equal(t, logEvent.StringRecord, errorEvent.Error.Exception.Message)
+	assert.Equal(t, "platform.fault", errorEvent.Error.Exception.Type)
+	assert.False(t, errorEvent.Error.Exception.Handled)
+	assert.Equal(t, map[string]string{"faas_execution": event.RequestID}, errorEvent.Error.Context.Tags)
+}
+
+func TestProcessPlatformFaultRecord(t *testing.T) {
+	event := extension.NextEventResponse{RequestID: "d783b35e-a91d-4251-af17-035953428a2c"}
+	logEvent := LogEvent{
+		Type:   Fault,
+		Record: LogEventRecord{RequestId: "previous-request", Status: "timeout", ErrorType: "Runtime.ExitError"},
+	}
+
+	agentData, err := ProcessPlatformFault(&extension.MetadataContainer{}, &event, logEvent)
+	require.NoError(t, err)
+
+	var errorEvent platformFaultEvent
+	require.NoError(t, json.Unmarshal(agentData.Data, &errorEvent))
+	assert.Equal(t, "timeout", errorEvent.Error.Exception.Message)
+	assert.Equal(t, "Runtime.ExitError", errorEvent.Error.Exception.Type)
+	assert.Equal(t, map[string]string{"faas_execution": "previous-request"}, errorEvent.Error.Context.Tags)
+}
@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"crypto/rand"
+	"strings"
+	"unicode/utf8"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"go.elastic.co/apm/v2/model"
+	"go.elastic.co/fastjson"
+)
+
+// maxStringRecordBytes is the maximum size of a platform string record forwarded to the APM server.
+const maxStringRecordBytes = 1024
+
+// truncationSuffix is appended to string records exceeding maxStringRecordBytes.
+const truncationSuffix = "..."
+
+// IsNotableStringRecord returns true if a log event carrying a plain string record is worth forwarding
+// to the APM server, e.g. faults reported by the platform or errors reported at the end of the runtime.
+func IsNotableStringRecord(logEvent LogEvent) bool {
+	if logEvent.StringRecord == "" {
+		return false
+	}
+	switch logEvent.Type {
+	case Fault, RuntimeDone:
+		return true
+	}
+	return strings.Contains(strings.ToLower(logEvent.StringRecord), "error")
+}
+
+// ProcessStringRecord converts a platform log event carrying a plain string record into an APM error
+// holding the (truncated) record as its log message, prefixed by the metadata when available.
+func ProcessStringRecord(metadataContainer *extension.MetadataContainer, logEvent LogEvent) (extension.AgentData, error) {
+	errorEvent := model.Error{
+		Timestamp: model.Time(logEvent.Time),
+		Culprit:   string(logEvent.Type),
+		Log: model.Log{
+			Message:    truncateRecord(logEvent.StringRecord, maxStringRecordBytes),
+			Level:      "error",
+			LoggerName: string(logEvent.Type),
+		},
+	}
+	if _, err := rand.Read(errorEvent.ID[:]); err != nil {
+		return extension.AgentData{}, err
+	}
+
+	var jsonWriter fastjson.Writer
+	jsonWriter.RawString(`{"error":`)
+	if err := errorEvent.MarshalFastJSON(&jsonWriter); err != nil {
+		return extension.AgentData{}, err
+	}
+	jsonWriter.RawString(`}`)
+
+	data := metadataContainer.AppendTo(nil)
+	data = append(data, jsonWriter.Bytes()...)
+	return extension.AgentData{Data: data}, nil
+}
+
+// truncateRecord shortens record to at most maxBytes bytes, suffix included, without splitting a UTF-8 character.
+func truncateRecord(record string, maxBytes int) string {
+	if len(record) <= maxBytes {
+		return record
+	}
+	cut := maxBytes - len(truncationSuffix)
+	for cut > 0 && !utf8.RuneStart(record[cut]) {
+		cut--
+	}
+	return record[:cut] + truncationSuffix
+}
@@ -0,0 +1,93 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"elastic/apm-lambda-extension/extension"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsNotableStringRecord(t *testing.T) {
+	assert.True(t, IsNotableStringRecord(LogEvent{Type: Fault, StringRecord: "Process exited before completing request"}))
+	assert.True(t, IsNotableStringRecord(LogEvent{Type: RuntimeDone, StringRecord: "Unknown application error occurred"}))
+	assert.True(t, IsNotableStringRecord(LogEvent{Type: "platform.extension", StringRecord: "Extension.Crash: extension error"}))
+	assert.False(t, IsNotableStringRecord(LogEvent{Type: Start, StringRecord: "START RequestId: 6f7f0961f83442118a7af6fe80b88d56"}))
+	assert.False(t, IsNotableStringRecord(LogEvent{Type: Fault}))
+}
+
+func TestProcessStringRecord(t *testing.T) {
+	timestamp := time.Date(2021, 2, 4, 20, 0, 5, 123e6, time.UTC)
+	mc := extension.NewMetadataContainer([]byte(`{"metadata":{}}`))
+	logEvent := LogEvent{
+		Time:         timestamp,
+		Type:         Fault,
+		StringRecord: "RequestId: d783b35e-a91d-4251-af17-035953428a2c Process exited before completing request",
+	}
+
+	agentData, err := ProcessStringRecord(mc, logEvent)
+	require.NoError(t, err)
+
+	lines := strings.Split(string(agentData.Data), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"metadata":{}}`, lines[0])
+
+	var errorEvent struct {
+		Error struct {
+			ID        string `json:"id"`
+			Timestamp int64  `json:"timestamp"`
+			Culprit   string `json:"culprit"`
+			Log       struct {
+				Message    string `json:"message"`
+				Level      string `json:"level"`
+				LoggerName string `json:"logger_name"`
+			} `json:"log"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &errorEvent))
+	assert.Len(t, errorEvent.Error.ID, 32)
+	assert.Equal(t, timestamp.UnixNano()/1e3, errorEvent.Error.Timestamp)
+	assert.Equal(t, "platform.fault", errorEvent.Error.Culprit)
+	assert.Equal(t, logEvent.StringRecord, errorEvent.Error.Log.Message)
+	assert.Equal(t, "error", errorEvent.Error.Log.Level)
+	assert.Equal(t, "platform.fault", errorEvent.Error.Log.LoggerName)
+}
+
+func TestProcessStringRecordTruncated(t *testing.T) {
+	logEvent := LogEvent{Type: Fault, StringRecord: strings.Repeat("a", 2*maxStringRecordBytes)}
+	agentData, err := ProcessStringRecord(&extension.MetadataContainer{}, logEvent)
+	require.NoError(t, err)
+	assert.Contains(t, string(agentData.Data), strings.Repeat("a", maxStringRecordBytes-len(truncationSuffix))+truncationSuffix+`"`)
+}
+
+func TestTruncateRecord(t *testing.T) {
+	assert.Equal(t, "short", truncateRecord("short", 10))
+	assert.Equal(t, "abcdefg...", truncateRecord("abcdefghijklmnop", 10))
+
+	// Multi-byte characters are not split
+	truncated := truncateRecord(strings.Repeat("é", 10), 10)
+	assert.True(t, utf8.ValidString(truncated))
+	assert.Equal(t, "ééé...", truncated)
+}
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"elastic/apm-lambda-extension/extension"
+	"elastic/apm-lambda-extension/failpoint"
 
 	"github.com/pkg/errors"
 )
@@ -39,6 +40,8 @@ type LogsTransport struct {
 	listener     net.Listener
 	listenerHost string
 	server       *http.Server
+	subscription *subscription
+	telemetryAPI bool
 }
 
 func InitLogsTransport(listenerHost string) *LogsTransport {
@@ -58,32 +61,96 @@ type LogEvent struct {
 
 // LogEventRecord is a sub-object in a Logs API event
 type LogEventRecord struct {
-	RequestId string          `json:"requestId"`
-	Status    string          `json:"status"`
-	Metrics   PlatformMetrics `json:"metrics"`
+	RequestId string           `json:"requestId"`
+	Status    string           `json:"status"`
+	ErrorType string           `json:"errorType,omitempty"`
+	Version   string           `json:"version,omitempty"`
+	Tracing   *PlatformTracing `json:"tracing,omitempty"`
+	Metrics   PlatformMetrics  `json:"metrics"`
+	Spans     []PlatformSpan   `json:"spans,omitempty"`
 }
 
-// Subscribes to the Logs API
+// maxSubscribeAttempts is the number of subscription attempts for each destination, when the subscription
+// response describes a subscription that does not match the request.
+const maxSubscribeAttempts = 2
+
+// Subscribes to the Telemetry API, falling back to the Logs API when the Telemetry API is unavailable or
+// disabled.
+//
+// The subscription is verified, rather than trusting a successful status: the subscription described by the
+// response, if any, must match the request, and the destination must reach the listener. Otherwise, the
+// subscription is retried, with an alternative destination host name if the listener cannot be reached.
+// Subscribing again with the same parameters is a no-op.
 func subscribe(transport *LogsTransport, extensionID string, eventTypes []EventType) error {
+	if err := failpoint.Inject(failpoint.Subscribe); err != nil {
+		return err
+	}
 
 	extensionsAPIAddress, ok := os.LookupEnv("AWS_LAMBDA_RUNTIME_API")
 	if !ok {
 		return errors.New("AWS_LAMBDA_RUNTIME_API is not set")
 	}
 
-	logsAPIBaseUrl := fmt.Sprintf("http://%s", extensionsAPIAddress)
-	logsAPIClient, err := NewClient(logsAPIBaseUrl)
-	if err != nil {
-		return err
+	apiBaseUrl := fmt.Sprintf("http://%s", extensionsAPIAddress)
+	_, port, _ := net.SplitHostPort(transport.listener.Addr().String())
+
+	var verifyErr error
+	for _, host := range destinationHosts(transport.listenerHost) {
+		destinationURI := URI("http://" + net.JoinHostPort(host, port))
+		if transport.subscription.covers(destinationURI, eventTypes) {
+			return nil
+		}
+		for attempt := 1; attempt <= maxSubscribeAttempts; attempt++ {
+			resp, err := subscribeOnce(apiBaseUrl, destinationURI, extensionID, eventTypes, transport.telemetryAPI)
+			if err != nil {
+				return err
+			}
+			if verifyErr = resp.verify(destinationURI, eventTypes); verifyErr != nil {
+				extension.Log.Warnf("Subscription mismatch, attempt %d/%d: %v", attempt, maxSubscribeAttempts, verifyErr)
+				continue
+			}
+			if verifyErr = probeDestination(destinationURI); verifyErr != nil {
+				extension.Log.Warnf("Subscription destination unreachable: %v", verifyErr)
+				break
+			}
+			transport.subscription = &subscription{destinationURI: destinationURI, eventTypes: eventTypes}
+			return nil
+		}
 	}
+	return errors.WithMessage(verifyErr, "could not verify the subscription")
+}
 
-	_, port, _ := net.SplitHostPort(transport.listener.Addr().String())
-	_, err = logsAPIClient.Subscribe(eventTypes, URI("http://"+transport.listenerHost+":"+port), extensionID)
-	return err
+// subscribeOnce subscribes to the Telemetry API, or to the Logs API when the Telemetry API is unavailable or
+// disabled.
+func subscribeOnce(apiBaseUrl string, destinationURI URI, extensionID string, eventTypes []EventType, telemetryAPI bool) (*SubscribeResponse, error) {
+	if telemetryAPI {
+		telemetryAPIClient, err := NewTelemetryClient(apiBaseUrl)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := telemetryAPIClient.Subscribe(eventTypes, destinationURI, extensionID)
+		if err == nil {
+			extension.Log.Info("Subscribed to the Telemetry API")
+			return resp, nil
+		}
+		extension.Log.Infof("Telemetry API unavailable, falling back to the Logs API : %v", err)
+	}
+
+	logsAPIClient, err := NewClient(apiBaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := logsAPIClient.Subscribe(eventTypes, destinationURI, extensionID)
+	if err != nil {
+		return nil, err
+	}
+	extension.Log.Info("Subscribed to the Logs API")
+	return resp, nil
 }
 
-// Subscribe starts the HTTP server listening for log events and subscribes to the Logs API
-func Subscribe(ctx context.Context, extensionID string, eventTypes []EventType) (transport *LogsTransport, err error) {
+// Subscribe starts the HTTP server listening for log events and subscribes to the Telemetry API, or to the Logs API
+// in environments where the Telemetry API is not available, or when telemetryAPI is false
+func Subscribe(ctx context.Context, extensionID string, eventTypes []EventType, telemetryAPI bool) (transport *LogsTransport, err error) {
 	if checkAWSSamLocal() {
 		return nil, errors.New("Detected sam local environment")
 	}
@@ -95,6 +162,7 @@ func Subscribe(ctx context.Context, extensionID string, eventTypes []EventType)
 	} else {
 		transport = InitLogsTransport("localhost")
 	}
+	transport.telemetryAPI = telemetryAPI
 
 	if err = startHTTPServer(ctx, transport); err != nil {
 		return nil, err
@@ -162,42 +230,24 @@ func checkLambdaFunction() bool {
 // to requestID is received, or ctx is cancelled, and then returns.
 func ProcessLogs(
 	ctx context.Context,
-	requestID string,
+	currentEvent *extension.NextEventResponse,
 	apmServerTransport *extension.ApmServerTransport,
 	logsTransport *LogsTransport,
 	metadataContainer *extension.MetadataContainer,
 	runtimeDoneSignal chan struct{},
 	prevEvent *extension.NextEventResponse,
 ) error {
+	currentEvent.Coldstart = prevEvent == nil
 	for {
 		select {
 		case logEvent := <-logsTransport.logsChannel:
-			extension.Log.Debugf("Received log event %v", logEvent.Type)
-			switch logEvent.Type {
-			// Check the logEvent for runtimeDone and compare the RequestID
-			// to the id that came in via the Next API
-			case RuntimeDone:
-				if logEvent.Record.RequestId == requestID {
-					extension.Log.Info("Received runtimeDone event for this function invocation")
-					runtimeDoneSignal <- struct{}{}
-					return nil
-				} else {
-					extension.Log.Debug("Log API runtimeDone event request id didn't match")
-				}
-			// Check if the logEvent contains metrics and verify that they can be linked to the previous invocation
-			case Report:
-				if prevEvent != nil && logEvent.Record.RequestId == prevEvent.RequestID {
-					extension.Log.Debug("Received platform report for the previous function invocation")
-					processedMetrics, err := ProcessPlatformReport(ctx, metadataContainer, prevEvent, logEvent)
-					if err != nil {
-						extension.Log.Errorf("Error processing Lambda platform metrics : %v", err)
-					} else {
-						apmServerTransport.EnqueueAPMData(processedMetrics)
-					}
-				} else {
-					extension.Log.Warn("report event request id didn't match the previous event id")
-					extension.Log.Debug("Log API runtimeDone event request id didn't match")
+			if processLogEvent(ctx, logEvent, currentEvent, apmServerTransport, metadataContainer, prevEvent) {
+				// The invocation may have ended on the agent done signal already
+				select {
+				case runtimeDoneSignal <- struct{}{}:
+				case <-ctx.Done():
 				}
+				return nil
 			}
 		case <-ctx.Done():
 			extension.Log.Debug("Current invocation over. Interrupting logs processing goroutine")
@@ -205,3 +255,108 @@ func ProcessLogs(
 		}
 	}
 }
+
+// processLogEvent processes a single event received from the Logs API, and returns true if it is the
+// RuntimeDone event of currentEvent.
+func processLogEvent(
+	ctx context.Context,
+	logEvent LogEvent,
+	currentEvent *extension.NextEventResponse,
+	apmServerTransport *extension.ApmServerTransport,
+	metadataContainer *extension.MetadataContainer,
+	prevEvent *extension.NextEventResponse,
+) bool {
+	extension.Log.Debugf("Received log event %v", logEvent.Type)
+	// Function logs are only received when their forwarding is enabled
+	if logEvent.Type == SubEventType(Function) {
+		if logEvent.StringRecord == "" {
+			extension.Log.Debug("Ignoring function log without a string record")
+			return false
+		}
+		agentData, err := ProcessFunctionLog(metadataContainer, currentEvent, logEvent)
+		if err != nil {
+			extension.Log.Errorf("Error processing function log : %v", err)
+		} else {
+			apmServerTransport.EnqueueAPMData(agentData)
+		}
+		return false
+	}
+	if logEvent.Type == Fault {
+		agentData, err := ProcessPlatformFault(metadataContainer, currentEvent, logEvent)
+		if err != nil {
+			extension.Log.Errorf("Error processing Lambda platform fault : %v", err)
+		} else {
+			apmServerTransport.EnqueuePriorityData(agentData)
+		}
+		return false
+	}
+	// Forward the other platform records that are plain strings, if they are notable (e.g. errors)
+	if IsNotableStringRecord(logEvent) {
+		agentData, err := ProcessStringRecord(metadataContainer, logEvent)
+		if err != nil {
+			extension.Log.Errorf("Error processing Lambda %s record : %v", logEvent.Type, err)
+		} else {
+			apmServerTransport.EnqueuePriorityData(agentData)
+		}
+		return false
+	}
+	switch logEvent.Type {
+	case Start:
+		ProcessPlatformStart(currentEvent, logEvent)
+	// Check the logEvent for runtimeDone and compare the RequestID
+	// to the id that came in via the Next API
+	case RuntimeDone:
+		if logEvent.Record.RequestId == currentEvent.RequestID {
+			extension.Log.Info("Received runtimeDone event for this function invocation")
+			processRuntimeDone(ctx, apmServerTransport, metadataContainer, currentEvent, logEvent)
+			return true
+		} else if prevEvent != nil && logEvent.Record.RequestId == prevEvent.RequestID {
+			// The agent signaled the end of the previous invocation before its runtimeDone event was received
+			extension.Log.Debug("Received runtimeDone event for the previous function invocation")
+			processRuntimeDone(ctx, apmServerTransport, metadataContainer, prevEvent, logEvent)
+		} else {
+			extension.Log.Debug("Log API runtimeDone event request id didn't match")
+		}
+	// Check if the logEvent contains metrics and verify that they can be linked to the previous invocation
+	case Report:
+		if prevEvent != nil && logEvent.Record.RequestId == prevEvent.RequestID {
+			extension.Log.Debug("Received platform report for the previous function invocation")
+			if queueTime, ok := apmServerTransport.InvocationQueueTime(prevEvent.RequestID); ok {
+				prevEvent.QueueTime = queueTime
+			}
+			processedMetrics, err := ProcessPlatformReport(ctx, metadataContainer, prevEvent, logEvent, apmServerTransport.NearTimeoutRatio())
+			if err != nil {
+				extension.Log.Errorf("Error processing Lambda platform metrics : %v", err)
+			} else {
+				apmServerTransport.EnqueuePlatformMetrics(processedMetrics)
+			}
+			apmServerTransport.EnqueuePlatformTransaction(metadataContainer, prevEvent, PlatformInvocation(prevEvent, logEvent))
+		} else {
+			extension.Log.Warn("report event request id didn't match the previous event id")
+			extension.Log.Debug("Log API runtimeDone event request id didn't match")
+		}
+	}
+	return false
+}
+
+// processRuntimeDone records the status of the platform.runtimeDone event of the invocation described by
+// functionData, which is reported along with its platform metrics, and forwards the runtime metrics of newer
+// schemas right away.
+func processRuntimeDone(
+	ctx context.Context,
+	apmServerTransport *extension.ApmServerTransport,
+	metadataContainer *extension.MetadataContainer,
+	functionData *extension.NextEventResponse,
+	runtimeDone LogEvent,
+) {
+	functionData.RuntimeDoneStatus = runtimeDone.Record.Status
+	if !runtimeDone.Record.hasRuntimeMetrics() {
+		return
+	}
+	processedMetrics, err := ProcessRuntimeDone(ctx, metadataContainer, functionData, runtimeDone, functionData.Coldstart)
+	if err != nil {
+		extension.Log.Errorf("Error processing Lambda runtime metrics : %v", err)
+	} else {
+		apmServerTransport.EnqueuePlatformMetrics(processedMetrics)
+	}
+}
@@ -21,10 +21,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
+
+	"elastic/apm-lambda-extension/extension"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -40,7 +44,7 @@ func TestSubscribeWithSamLocalEnv(t *testing.T) {
 		}
 	})
 
-	_, err := Subscribe(context.Background(), "testID", []EventType{Platform})
+	_, err := Subscribe(context.Background(), "testID", []EventType{Platform}, true)
 	assert.Error(t, err)
 }
 
@@ -54,7 +58,7 @@ func TestSubscribeWithLambdaFunction(t *testing.T) {
 		}
 	})
 
-	_, err := Subscribe(context.Background(), "testID", []EventType{Platform})
+	_, err := Subscribe(context.Background(), "testID", []EventType{Platform}, true)
 	assert.Error(t, err, "listen tcp: lookup sandbox: no such host")
 }
 
@@ -85,7 +89,7 @@ func TestSubscribeAWSRequest(t *testing.T) {
 	}
 
 	// Subscribe to the logs api and start the http server listening for events
-	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform})
+	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform}, true)
 	if err != nil {
 		t.Logf("Error subscribing, %v", err)
 		t.Fail()
@@ -131,7 +135,7 @@ func TestSubscribeWithBadLogsRequest(t *testing.T) {
 	}
 
 	// Subscribe to the logs api and start the http server listening for events
-	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform})
+	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform}, true)
 	if err != nil {
 		t.Logf("Error subscribing, %v", err)
 		t.Fail()
@@ -154,3 +158,118 @@ func TestSubscribeWithBadLogsRequest(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, resp.StatusCode, 500)
 }
+
+// TestProcessLogsRuntimeDoneUnread checks that ProcessLogs returns once the invocation is over, even if the
+// runtimeDone signal is not read because the invocation ended on the agent done signal.
+func TestProcessLogsRuntimeDoneUnread(t *testing.T) {
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", "bar.example.com/")
+	apmServerTransport := extension.InitApmServerTransport(extension.ProcessEnv(nil))
+	logsTransport := InitLogsTransport("localhost")
+	event := extension.NextEventResponse{EventType: extension.Invoke, RequestID: "8476a536-e9f4-11e8-9739-2dfe598c3fcd"}
+	logsTransport.logsChannel <- LogEvent{Time: time.Now(), Type: RuntimeDone, Record: LogEventRecord{RequestId: event.RequestID, Status: "success"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ProcessLogs(ctx, &event, apmServerTransport, logsTransport, &extension.MetadataContainer{}, make(chan struct{}), nil)
+	}()
+	assert.Eventually(t, func() bool { return len(logsTransport.logsChannel) == 0 }, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ProcessLogs did not return once the invocation was over")
+	}
+}
+
+// newRecordingTransport returns a transport sending the agent data to an APM server which records the uncompressed
+// body of each request.
+func newRecordingTransport(t *testing.T) (*extension.ApmServerTransport, *[]string) {
+	var requests []string
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		data, err := extension.GetUncompressedBytes(body, r.Header.Get("Content-Encoding"))
+		require.NoError(t, err)
+		requests = append(requests, string(data))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(apmServer.Close)
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", apmServer.URL+"/")
+	return extension.InitApmServerTransport(extension.ProcessEnv(nil)), &requests
+}
+
+// TestProcessLogsLateRuntimeDone checks that the runtimeDone event of an invocation which ended on the agent done
+// signal, and is therefore received during the next invocation, is taken into account in its platform metrics.
+func TestProcessLogsLateRuntimeDone(t *testing.T) {
+	apmServerTransport, metrics := newRecordingTransport(t)
+	logsTransport := InitLogsTransport("localhost")
+	timestamp := time.Now()
+	prevEvent := extension.NextEventResponse{
+		Timestamp:  timestamp,
+		EventType:  extension.Invoke,
+		DeadlineMs: timestamp.UnixMilli() + 5000,
+		RequestID:  "8476a536-e9f4-11e8-9739-2dfe598c3fcd",
+	}
+	event := extension.NextEventResponse{EventType: extension.Invoke, RequestID: "b03a29ec-ee63-44cd-8e53-3987a8e8aa8e"}
+
+	// The previous invocation ended on the agent done signal, before its runtimeDone event was received
+	logsTransport.logsChannel <- LogEvent{Time: timestamp, Type: RuntimeDone, Record: LogEventRecord{RequestId: prevEvent.RequestID, Status: "error"}}
+	logsTransport.logsChannel <- LogEvent{
+		Time: timestamp,
+		Type: Report,
+		Record: LogEventRecord{
+			RequestId: prevEvent.RequestID,
+			Metrics:   PlatformMetrics{DurationMs: 182.43, BilledDurationMs: 183, MemorySizeMB: 128, MaxMemoryUsedMB: 76},
+		},
+	}
+	logsTransport.logsChannel <- LogEvent{Time: timestamp, Type: RuntimeDone, Record: LogEventRecord{RequestId: event.RequestID, Status: "success"}}
+
+	runtimeDone := make(chan struct{}, 1)
+	require.NoError(t, ProcessLogs(context.Background(), &event, apmServerTransport, logsTransport, extension.NewMetadataContainer(nil), runtimeDone, &prevEvent))
+	assert.Len(t, runtimeDone, 1)
+	assert.Equal(t, "error", prevEvent.RuntimeDoneStatus)
+	assert.Equal(t, "success", event.RuntimeDoneStatus)
+
+	apmServerTransport.FlushAPMData(context.Background(), extension.FlushInfo{})
+	require.Len(t, *metrics, 1)
+	assert.Contains(t, (*metrics)[0], `"aws.lambda.metrics.errors":{"value":1}`)
+	assert.Contains(t, (*metrics)[0], `"tags":{"runtime_done_status":"error"}`)
+}
+
+// TestProcessLogsLateRuntimeDoneMetrics checks that the runtime metrics and the outcome of an invocation which ended on the agent
+// done signal are forwarded when its runtimeDone event is received during the next invocation.
+func TestProcessLogsLateRuntimeDoneMetrics(t *testing.T) {
+	apmServerTransport, metrics := newRecordingTransport(t)
+	logsTransport := InitLogsTransport("localhost")
+	prevEvent := extension.NextEventResponse{EventType: extension.Invoke, RequestID: "8476a536-e9f4-11e8-9739-2dfe598c3fcd", Coldstart: true}
+	event := extension.NextEventResponse{EventType: extension.Invoke, RequestID: "b03a29ec-ee63-44cd-8e53-3987a8e8aa8e"}
+	logsTransport.logsChannel <- LogEvent{
+		Time: time.Now(),
+		Type: RuntimeDone,
+		Record: LogEventRecord{
+			RequestId: prevEvent.RequestID,
+			Status:    "error",
+			ErrorType: "Runtime.ExitError",
+			Metrics:   PlatformMetrics{DurationMs: 140.5, ProducedBytes: 16},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ProcessLogs(ctx, &event, apmServerTransport, logsTransport, extension.NewMetadataContainer(nil), make(chan struct{}), &prevEvent)
+	}()
+	assert.Eventually(t, func() bool { return apmServerTransport.BufferedDataCount() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	assert.False(t, event.Coldstart)
+
+	apmServerTransport.FlushAPMData(context.Background(), extension.FlushInfo{})
+	require.Len(t, *metrics, 1)
+	assert.Contains(t, (*metrics)[0], `"aws.lambda.metrics.runtime_duration":{"value":140.5}`)
+	assert.Contains(t, (*metrics)[0], `"coldstart":true,"execution":"8476a536-e9f4-11e8-9739-2dfe598c3fcd"`)
+	// The outcome is known even though the agent reported the end of the invocation first
+	assert.Contains(t, (*metrics)[0], `"tags":{"outcome":"failure","runtime_done_status":"error","runtime_error_type":"Runtime.ExitError"}`)
+}
@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// probeTimeout is the maximum time the extension waits for its own listener to answer a probe.
+const probeTimeout = time.Second
+
+// subscription describes the subscription registered for a LogsTransport.
+type subscription struct {
+	destinationURI URI
+	eventTypes     []EventType
+}
+
+// covers returns true if the subscription sends the events of types to destinationURI.
+func (s *subscription) covers(destinationURI URI, types []EventType) bool {
+	return s != nil && s.destinationURI == destinationURI && coversEventTypes(s.eventTypes, types)
+}
+
+func coversEventTypes(subscribed []EventType, expected []EventType) bool {
+	for _, eventType := range expected {
+		found := false
+		for _, subscribedType := range subscribed {
+			if subscribedType == eventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriptionEcho is the subscription described in the body of a subscription response, by the API versions
+// echoing the subscription they registered.
+type subscriptionEcho struct {
+	Types       []EventType `json:"types"`
+	Destination struct {
+		URI URI `json:"URI"`
+	} `json:"destination"`
+}
+
+// verify returns an error if the response describes a subscription that does not send the events of types to
+// destinationURI. Responses that do not describe the subscription, such as "OK", cannot be verified and are
+// accepted.
+func (r *SubscribeResponse) verify(destinationURI URI, types []EventType) error {
+	if r == nil {
+		return nil
+	}
+	var echo subscriptionEcho
+	if err := json.Unmarshal([]byte(r.body), &echo); err != nil {
+		return nil
+	}
+	if echo.Destination.URI != "" && echo.Destination.URI != destinationURI {
+		return fmt.Errorf("events are sent to %s instead of %s", echo.Destination.URI, destinationURI)
+	}
+	if echo.Types != nil && !coversEventTypes(echo.Types, types) {
+		return fmt.Errorf("subscribed to %v instead of %v", echo.Types, types)
+	}
+	return nil
+}
+
+// probeDestination checks that destinationURI reaches the listener of the extension, by sending it an empty
+// batch of events, as the platform would.
+func probeDestination(destinationURI URI) error {
+	client := http.Client{Timeout: probeTimeout}
+	resp, err := client.Post(string(destinationURI), "application/json", bytes.NewReader([]byte("[]")))
+	if err != nil {
+		return fmt.Errorf("%s is not reachable: %v", destinationURI, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered with status %d", destinationURI, resp.StatusCode)
+	}
+	return nil
+}
+
+// destinationHosts returns the host names under which the platform can reach the listener, preferred first.
+func destinationHosts(listenerHost string) []string {
+	if listenerHost == "sandbox" {
+		return []string{"sandbox", "sandbox.localdomain"}
+	}
+	return []string{listenerHost}
+}
@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeResponseVerify(t *testing.T) {
+	destination := URI("http://sandbox:1234")
+	types := []EventType{Platform, Function}
+
+	assert.NoError(t, (*SubscribeResponse)(nil).verify(destination, types))
+	assert.NoError(t, (&SubscribeResponse{"OK"}).verify(destination, types))
+	assert.NoError(t, (&SubscribeResponse{`{"types":["platform","function","extension"],"destination":{"URI":"http://sandbox:1234"}}`}).verify(destination, types))
+	assert.Error(t, (&SubscribeResponse{`{"types":["platform"],"destination":{"URI":"http://sandbox:1234"}}`}).verify(destination, types))
+	assert.Error(t, (&SubscribeResponse{`{"types":["platform","function"],"destination":{"URI":"http://sandbox:4321"}}`}).verify(destination, types))
+}
+
+func TestDestinationHosts(t *testing.T) {
+	assert.Equal(t, []string{"sandbox", "sandbox.localdomain"}, destinationHosts("sandbox"))
+	assert.Equal(t, []string{"localhost"}, destinationHosts("localhost"))
+}
+
+func TestProbeDestination(t *testing.T) {
+	transport := InitLogsTransport("localhost")
+	require.NoError(t, startHTTPServer(context.Background(), transport))
+	defer transport.server.Close()
+	assert.NoError(t, probeDestination(URI("http://"+transport.listener.Addr().String())))
+	// The probe does not forward any event
+	assert.Len(t, transport.logsChannel, 0)
+
+	transport.server.Close()
+	assert.Error(t, probeDestination(URI("http://"+transport.listener.Addr().String())))
+}
+
+func TestSubscribeRetriesMismatch(t *testing.T) {
+	var requests int32
+	awsRuntimeApiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := TelemetrySubscribeRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		types := req.EventTypes
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// The first subscription only covers part of the requested event types
+			types = types[:1]
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"types":       types,
+			"destination": req.Destination,
+		}))
+	}))
+	defer awsRuntimeApiServer.Close()
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", awsRuntimeApiServer.Listener.Addr().String())
+
+	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform, Function}, true)
+	require.NoError(t, err)
+	defer transport.server.Close()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Subscribing again with the same parameters is a no-op
+	require.NoError(t, subscribe(transport, "testID", []EventType{Platform}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestSubscribeMismatchNotResolved(t *testing.T) {
+	awsRuntimeApiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"types":["platform"],"destination":{"URI":"http://elsewhere:1234"}}`))
+	}))
+	defer awsRuntimeApiServer.Close()
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", awsRuntimeApiServer.Listener.Addr().String())
+
+	// The listener is closed when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := Subscribe(ctx, "testID", []EventType{Platform}, true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,103 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+const TelemetrySchemaVersion20220701 SchemaVersion = "2022-07-01"
+
+// TelemetryClient is the client used to subscribe to the Telemetry API, which supersedes the Logs API.
+// The events sent by the Telemetry API share the envelope of the Logs API events ({"time", "type", "record"}),
+// and are therefore received and parsed as LogEvent.
+type TelemetryClient struct {
+	httpClient          *http.Client
+	telemetryAPIBaseUrl string
+}
+
+// NewTelemetryClient returns a new TelemetryClient with the given URL
+func NewTelemetryClient(telemetryAPIBaseUrl string) (*TelemetryClient, error) {
+	return &TelemetryClient{
+		httpClient:          &http.Client{},
+		telemetryAPIBaseUrl: telemetryAPIBaseUrl,
+	}, nil
+}
+
+// TelemetryDestination is the configuration for listeners who would like to receive telemetry with HTTP
+type TelemetryDestination struct {
+	Protocol HttpProtocol `json:"protocol"`
+	URI      URI          `json:"URI"`
+}
+
+// TelemetrySubscribeRequest is the request body that is sent to the Telemetry API on subscribe
+type TelemetrySubscribeRequest struct {
+	SchemaVersion SchemaVersion        `json:"schemaVersion"`
+	EventTypes    []EventType          `json:"types"`
+	BufferingCfg  BufferingCfg         `json:"buffering"`
+	Destination   TelemetryDestination `json:"destination"`
+}
+
+// Subscribe calls the Telemetry API to subscribe for the telemetry events.
+func (c *TelemetryClient) Subscribe(types []EventType, destinationURI URI, extensionId string) (*SubscribeResponse, error) {
+	bufferingCfg := BufferingCfg{
+		MaxItems:  10000,
+		MaxBytes:  262144,
+		TimeoutMS: 25,
+	}
+	data, err := json.Marshal(
+		&TelemetrySubscribeRequest{
+			SchemaVersion: TelemetrySchemaVersion20220701,
+			EventTypes:    types,
+			BufferingCfg:  bufferingCfg,
+			Destination: TelemetryDestination{
+				Protocol: HttpProto,
+				URI:      destinationURI,
+			},
+		})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to marshal TelemetrySubscribeRequest")
+	}
+
+	headers := make(map[string]string)
+	headers[lambdaAgentIdentifierHeaderKey] = extensionId
+	url := fmt.Sprintf("%s/2022-07-01/telemetry", c.telemetryAPIBaseUrl)
+	resp, err := httpPutWithHeaders(c.httpClient, url, data, &headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Errorf("%s failed: %d[%s]", url, resp.StatusCode, resp.Status)
+		}
+
+		return nil, errors.Errorf("%s failed: %d[%s] %s", url, resp.StatusCode, resp.Status, string(body))
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	return &SubscribeResponse{string(body)}, nil
+}
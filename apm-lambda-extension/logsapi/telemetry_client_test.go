@@ -0,0 +1,143 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package logsapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeTelemetryAPI(t *testing.T) {
+	var subscribedPaths []string
+	awsRuntimeApiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscribedPaths = append(subscribedPaths, r.URL.Path)
+		assert.Equal(t, "testID", r.Header.Get(lambdaAgentIdentifierHeaderKey))
+		req := TelemetrySubscribeRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, TelemetrySchemaVersion20220701, req.SchemaVersion)
+		assert.Equal(t, []EventType{Platform}, req.EventTypes)
+		assert.Equal(t, HttpProto, req.Destination.Protocol)
+		assert.NotEmpty(t, req.Destination.URI)
+	}))
+	defer awsRuntimeApiServer.Close()
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", awsRuntimeApiServer.Listener.Addr().String())
+
+	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform}, true)
+	require.NoError(t, err)
+	defer transport.server.Close()
+
+	assert.Equal(t, []string{"/2022-07-01/telemetry"}, subscribedPaths)
+}
+
+func TestSubscribeFallbackToLogsAPI(t *testing.T) {
+	var subscribedPaths []string
+	awsRuntimeApiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscribedPaths = append(subscribedPaths, r.URL.Path)
+		if r.URL.Path == "/2022-07-01/telemetry" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		req := SubscribeRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, SchemaVersion(SchemaVersionLatest), req.SchemaVersion)
+		assert.Equal(t, HttpPost, req.Destination.HttpMethod)
+	}))
+	defer awsRuntimeApiServer.Close()
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", awsRuntimeApiServer.Listener.Addr().String())
+
+	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform}, true)
+	require.NoError(t, err)
+	defer transport.server.Close()
+
+	assert.Equal(t, []string{"/2022-07-01/telemetry", "/2020-08-15/logs"}, subscribedPaths)
+}
+
+func TestSubscribeTelemetryAPIDisabled(t *testing.T) {
+	var subscribedPaths []string
+	awsRuntimeApiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscribedPaths = append(subscribedPaths, r.URL.Path)
+	}))
+	defer awsRuntimeApiServer.Close()
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", awsRuntimeApiServer.Listener.Addr().String())
+
+	transport, err := Subscribe(context.Background(), "testID", []EventType{Platform}, false)
+	require.NoError(t, err)
+	defer transport.server.Close()
+
+	assert.Equal(t, []string{"/2020-08-15/logs"}, subscribedPaths)
+}
+
+func TestSubscribeNoAPIAvailable(t *testing.T) {
+	awsRuntimeApiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer awsRuntimeApiServer.Close()
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", awsRuntimeApiServer.Listener.Addr().String())
+
+	_, err := Subscribe(context.Background(), "testID", []EventType{Platform}, true)
+	assert.Error(t, err)
+}
+
+func TestTelemetryEventParsing(t *testing.T) {
+	transport := InitLogsTransport("localhost")
+	handler := handleLogEventsRequest(transport)
+
+	// Events as sent by the Telemetry API, using the 2022-07-01 schema
+	body := []byte(`[
+		{
+			"time": "2022-10-12T00:03:50.000Z",
+			"type": "platform.runtimeDone",
+			"record": {
+				"requestId": "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa",
+				"status": "success",
+				"metrics": {"durationMs": 140.0, "producedBytes": 16},
+				"spans": [{"name": "responseLatency", "start": "2022-10-12T00:03:50.861Z", "durationMs": 23.02}]
+			}
+		},
+		{
+			"time": "2022-10-12T00:03:51.000Z",
+			"type": "platform.report",
+			"record": {
+				"requestId": "6d68ca91-49c9-448d-89b8-7ca3e6dc66aa",
+				"status": "success",
+				"metrics": {"durationMs": 140.0, "billedDurationMs": 141, "memorySizeMB": 128, "maxMemoryUsedMB": 64}
+			}
+		}
+	]`)
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	runtimeDone := <-transport.logsChannel
+	assert.Equal(t, RuntimeDone, runtimeDone.Type)
+	assert.Equal(t, "success", runtimeDone.Record.Status)
+	assert.Equal(t, int64(16), runtimeDone.Record.Metrics.ProducedBytes)
+	require.Len(t, runtimeDone.Record.Spans, 1)
+	assert.Equal(t, "responseLatency", runtimeDone.Record.Spans[0].Name)
+
+	report := <-transport.logsChannel
+	assert.Equal(t, Report, report.Type)
+	assert.Equal(t, int32(141), report.Record.Metrics.BilledDurationMs)
+}
@@ -19,6 +19,9 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -26,23 +29,44 @@ import (
 	"syscall"
 	"time"
 
+	"elastic/apm-lambda-extension/buildinfo"
 	"elastic/apm-lambda-extension/extension"
 	"elastic/apm-lambda-extension/logsapi"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
 var (
-	extensionName   = filepath.Base(os.Args[0]) // extension name has to match the filename
+	extensionName   = filepath.Base(os.Args[0]) // extension name has to match the filename, unless overridden
 	extensionClient = extension.NewClient(os.Getenv("AWS_LAMBDA_RUNTIME_API"))
 )
 
+// shutdownLogsIdleWait is how long the extension waits for more log events when draining them at shutdown.
+const shutdownLogsIdleWait = 100 * time.Millisecond
+
 /* --- elastic vars  --- */
 
 func main() {
 
+	// Command-line flags are only read when the extension runs as a program, not when tests, which
+	// parse the command line for their own flags, call main.
+	if !flag.Parsed() && len(os.Args) > 1 {
+		if err := applyFlags(os.Args[1:], os.Stderr); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return
+			}
+			extension.Log.Fatalf("Could not parse the command-line flags: %v", err)
+		}
+		extensionClient = extension.NewClient(os.Getenv("AWS_LAMBDA_RUNTIME_API"))
+	}
+
 	// Global context
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -66,8 +90,21 @@ func main() {
 	// pulls ELASTIC_ env variable into globals for easy access
 	config := extension.ProcessEnv(manager)
 	extension.Log.Level.SetLevel(config.LogLevel)
+	extension.SetLogFormat(config.LogFormat)
+	// AWS_LAMBDA_FUNCTION_NAME is automatically set by AWS.
+	extension.SetLogFunctionName(os.Getenv("AWS_LAMBDA_FUNCTION_NAME"))
+	extension.SetLogInvocation("", extension.InitPhase)
+	extension.Log.Infof("Starting APM Lambda extension version %s (commit %s)", buildinfo.Version(), buildinfo.Commit())
+	extension.Log.Debugf("Runtime quirks: %+v", config.RuntimeQuirks)
+
+	// The runtime is initialized once all the extensions registered, so it must be able to reach the proxy by then
+	runtimeAPIProxy, errProxy := extension.StartRuntimeAPIProxy(config, os.Getenv("AWS_LAMBDA_RUNTIME_API"))
+	defer runtimeAPIProxy.Close()
 
 	// register extension with AWS Extension API
+	if config.ExtensionName != "" {
+		extensionName = config.ExtensionName
+	}
 	res, err := extensionClient.Register(ctx, extensionName)
 	if err != nil {
 		status, errRuntime := extensionClient.InitError(ctx, err.Error())
@@ -75,14 +112,44 @@ func main() {
 			panic(errRuntime)
 		}
 		extension.Log.Errorf("Error: %s", err)
+		if diagnostic := extension.DiagnoseRegisterError(err, extensionName, extension.ExtensionsDir); diagnostic != "" {
+			extension.Log.Error(diagnostic)
+		}
 		extension.Log.Infof("Init error signal sent to runtime : %s", status)
 		extension.Log.Infof("Exiting")
 		return
 	}
 	extension.Log.Debugf("Register response: %v", extension.PrettyPrint(res))
+	// The wrapper already pointed the runtime to the proxy, which could not start: the runtime would not be
+	// able to reach the Runtime API, so the initialization fails instead.
+	if errProxy != nil {
+		reportProxyFailure(ctx, errProxy)
+		return
+	}
 
 	// Init APM Server Transport struct and start http server to receive data from agent
 	apmServerTransport := extension.InitApmServerTransport(config)
+	apmServerTransport.SetRuntimeAPIProxy(runtimeAPIProxy)
+	apmServerTransport.SetDeadLetterQueue(extension.NewDeadLetterQueue(config, sqs.New(sess, aws.NewConfig().WithRegion(region))))
+	apmServerTransport.SetRecordOutput(extension.NewRecordOutput(config, kinesis.New(sess, aws.NewConfig().WithRegion(region)), firehose.New(sess, aws.NewConfig().WithRegion(region))))
+	apmServerTransport.RecordConfigSnapshot()
+	apmServerTransport.DetectServerVersion(ctx)
+	apmServerTransport.SetMetadataLabels(extension.LookupTagLabels(config, lambda.New(sess, aws.NewConfig().WithRegion(region))))
+	memoryBudget := extension.NewMemoryBudget(config)
+	syntheticTransactions := extension.NewSyntheticTransactions(config)
+	timeoutDetector := extension.NewTimeoutDetector(config)
+	adaptiveSendStrategy := extension.NewAdaptiveSendStrategy(config)
+	deferredFlush := extension.NewDeferredFlush(config)
+	debugLogSampler := extension.NewDebugLogSampler(config)
+	collectors := extension.NewCollectors(config, apmServerTransport)
+	configWatcher := extension.NewConfigWatcher(config, ssm.New(sess, aws.NewConfig().WithRegion(region)), apmServerTransport)
+	if profiler := extension.NewSlowFlushProfiler(config); profiler != nil {
+		apmServerTransport.AddFlushListener(profiler)
+	}
+	// Lambda sends the output of the extension to CloudWatch Logs, along with the logs of the function
+	if emitter := extension.NewFlushMetricsEmitter(config, os.Stdout); emitter != nil {
+		apmServerTransport.AddFlushListener(emitter)
+	}
 	agentDataServer, err := extension.StartHttpServer(ctx, apmServerTransport)
 	if err != nil {
 		extension.Log.Errorf("Could not start APM data receiver : %v", err)
@@ -92,7 +159,11 @@ func main() {
 	// Use a wait group to ensure the background go routine sending to the APM server
 	// completes before signaling that the extension is ready for the next invocation.
 
-	logsTransport, err := logsapi.Subscribe(ctx, extensionClient.ExtensionID, []logsapi.EventType{logsapi.Platform})
+	eventTypes := []logsapi.EventType{logsapi.Platform}
+	if config.SendFunctionLogs {
+		eventTypes = append(eventTypes, logsapi.Function)
+	}
+	logsTransport, err := logsapi.Subscribe(ctx, extensionClient.ExtensionID, eventTypes, config.Features.Enabled(extension.TelemetryAPIFeature))
 	if err != nil {
 		extension.Log.Warnf("Error while subscribing to the Logs API: %v", err)
 	}
@@ -102,6 +173,7 @@ func main() {
 	// This data structure contains metadata tied to the current Lambda instance. If empty, it is populated once for each
 	// active Lambda environment
 	metadataContainer := extension.MetadataContainer{}
+	apmServerTransport.RestoreState(ctx, &metadataContainer)
 
 	for {
 		select {
@@ -109,13 +181,60 @@ func main() {
 			return
 		default:
 			var backgroundDataSendWg sync.WaitGroup
-			event := processEvent(ctx, cancel, apmServerTransport, logsTransport, &backgroundDataSendWg, prevEvent, &metadataContainer)
+			debugLogSampler.Start()
+			event := processEvent(ctx, config.RuntimeQuirks, config.ShortTimeout, config.SendStrategy, deferredFlush, apmServerTransport, logsTransport, &backgroundDataSendWg, prevEvent, &metadataContainer)
+			sendStrategy := invocationSendStrategy(config.SendStrategy, event)
+			if event != nil && event.EventType == extension.Invoke {
+				extension.SetLogInvocation(event.RequestID, extension.FlushPhase)
+			}
 			extension.Log.Debug("Waiting for background data send to end")
 			backgroundDataSendWg.Wait()
-			if config.SendStrategy == extension.SyncFlush {
+			if event != nil {
+				// Without agent data, the invocation is reported from the platform events, if enabled
+				event.AgentDataSeen = apmServerTransport.TakeAgentDataSeen()
+			}
+			apmServerTransport.ApplyTailSampling()
+			syntheticTransactions.Enqueue(apmServerTransport, event, time.Now())
+			timeoutDetector.Observe(apmServerTransport, &metadataContainer, event)
+			apmServerTransport.ReportBufferDrops(&metadataContainer)
+			apmServerTransport.ReportCertExpiry(&metadataContainer)
+			apmServerTransport.ReportConfigDrift(&metadataContainer)
+			if event != nil && event.EventType == extension.Invoke {
+				apmServerTransport.ReportSelfMetrics(&metadataContainer)
+			}
+			collectors.Collect(ctx, apmServerTransport, &metadataContainer, time.Now())
+			apmServerTransport.RefreshDNSCache()
+			if event != nil && event.EventType == extension.Shutdown {
+				// The data is flushed before the shutdown deadline regardless of the send strategy
+				shutdown(ctx, event, config.RuntimeQuirks.DeadlineMargin, apmServerTransport, logsTransport, prevEvent, &metadataContainer)
+				apmServerTransport.SaveState(&metadataContainer)
+				return
+			}
+			if sendStrategy == extension.Adaptive {
+				sendStrategy = adaptiveSendStrategy.Decide(apmServerTransport, event, time.Now())
+			}
+			if sendStrategy == extension.FlushOnNext {
+				sendStrategy = deferredFlush.End(apmServerTransport, time.Now())
+			}
+			if sendStrategy == extension.SyncFlush {
 				// Flush APM data now that the function invocation has completed
-				apmServerTransport.FlushAPMData(ctx)
+				apmServerTransport.FlushAPMData(ctx, extension.NewFlushInfo(event))
 			}
+			// The configuration is checked and polled once the data of the invocation was flushed, not to delay it
+			configWatcher.Check(time.Now())
+			apmServerTransport.PollCentralConfig(ctx, time.Now())
+			// The memory budget is enforced once the data of the invocation had a chance to be flushed
+			memoryBudget.Enforce(apmServerTransport, &metadataContainer)
+			// In strict delivery mode, failing to deliver the APM data is reported as an extension error,
+			// which makes the invocation fail.
+			if config.StrictDelivery && event != nil && event.EventType == extension.Invoke {
+				if err := checkDelivery(apmServerTransport, sendStrategy); err != nil {
+					reportDeliveryFailure(ctx, err)
+					return
+				}
+			}
+			apmServerTransport.SaveState(&metadataContainer)
+			debugLogSampler.End()
 			prevEvent = event
 		}
 	}
@@ -123,7 +242,10 @@ func main() {
 
 func processEvent(
 	ctx context.Context,
-	cancel context.CancelFunc,
+	quirks extension.RuntimeQuirks,
+	shortTimeout extension.ShortTimeout,
+	sendStrategy extension.SendStrategy,
+	deferredFlush *extension.DeferredFlush,
 	apmServerTransport *extension.ApmServerTransport,
 	logsTransport *logsapi.LogsTransport,
 	backgroundDataSendWg *sync.WaitGroup,
@@ -137,6 +259,7 @@ func processEvent(
 
 	// call Next method of extension API.  This long polling HTTP method
 	// will block until there's an invocation of the function
+	extension.SetLogInvocation("", "")
 	extension.Log.Infof("Waiting for next event...")
 	event, err := extensionClient.NextEvent(ctx)
 	if err != nil {
@@ -156,16 +279,25 @@ func processEvent(
 	extension.Log.Debugf("%v", extension.PrettyPrint(event))
 
 	if event.EventType == extension.Shutdown {
-		cancel()
+		extension.SetLogInvocation("", extension.ShutdownPhase)
 		return event
 	}
 
+	extension.SetLogInvocation(event.RequestID, extension.InvokePhase)
+	apmServerTransport.SetInvokedFunctionArn(event.InvokedFunctionArn)
+	apmServerTransport.SetTraceContext(event.RequestID, event.Tracing)
+	apmServerTransport.SetInvocationDeadline(time.UnixMilli(event.DeadlineMs))
+	apmServerTransport.StartInvocation()
+
 	// APM Data Processing
-	apmServerTransport.AgentDoneSignal = make(chan struct{})
-	defer close(apmServerTransport.AgentDoneSignal)
+	apmServerTransport.ReplaySpilledData()
+	agentDoneSignal := apmServerTransport.StartAgentDoneSignal()
+	defer apmServerTransport.StopAgentDoneSignal()
 	backgroundDataSendWg.Add(1)
 	go func() {
 		defer backgroundDataSendWg.Done()
+		// The agent data deferred by the flushonnext send strategy is flushed first
+		deferredFlush.Start(invocationCtx, apmServerTransport, event)
 		if err := apmServerTransport.ForwardApmData(invocationCtx, metadataContainer); err != nil {
 			extension.Log.Error(err)
 		}
@@ -173,10 +305,15 @@ func processEvent(
 
 	// Lambda Service Logs Processing, also used to extract metrics from APM logs
 	// This goroutine should not be started if subscription failed
+	// The goroutine writes the platform hints of the invocation (e.g. its runtimeDone status) to event, so it is
+	// joined before the event is returned.
 	runtimeDone := make(chan struct{})
+	var logsProcessingWg sync.WaitGroup
 	if logsTransport != nil {
+		logsProcessingWg.Add(1)
 		go func() {
-			if err := logsapi.ProcessLogs(invocationCtx, event.RequestID, apmServerTransport, logsTransport, metadataContainer, runtimeDone, prevEvent); err != nil {
+			defer logsProcessingWg.Done()
+			if err := logsapi.ProcessLogs(invocationCtx, event, apmServerTransport, logsTransport, metadataContainer, runtimeDone, prevEvent); err != nil {
 				extension.Log.Errorf("Error while processing Lambda Logs ; %v", err)
 			} else {
 				close(runtimeDone)
@@ -187,28 +324,141 @@ func processEvent(
 		close(runtimeDone)
 	}
 
-	// Calculate how long to wait for a runtimeDoneSignal or AgentDoneSignal signal
-	flushDeadlineMs := event.DeadlineMs - 100
-	durationUntilFlushDeadline := time.Until(time.Unix(flushDeadlineMs/1000, 0))
-
-	// Create a timer that expires after durationUntilFlushDeadline
-	timer := time.NewTimer(durationUntilFlushDeadline)
+	// Create a timer that expires when the extension should stop waiting for a runtimeDoneSignal or AgentDoneSignal signal
+	// Functions with a short timeout may hand their data off right away rather than flushing it at the end of
+	// the invocation, with a smaller deadline margin
+	deadlineMargin := shortTimeout.Apply(event, sendStrategy, quirks.DeadlineMargin)
+	timer := time.NewTimer(durationUntilFlushDeadline(event.DeadlineMs, deadlineMargin, time.Now()))
 	defer timer.Stop()
 
 	// The extension relies on 3 independent mechanisms to minimize the time interval between the end of the execution of
 	// the lambda function and the end of the execution of processEvent()
 	// 1) AgentDoneSignal is triggered upon reception of a `flushed=true` query from the agent
 	// 2) [Backup 1] RuntimeDone is triggered upon reception of a Lambda log entry certifying the end of the execution of the current function
-	// 3) [Backup 2] If all else fails, the extension relies of the timeout of the Lambda function to interrupt itself 100 ms before the specified deadline.
+	// 3) [Backup 2] If all else fails, the extension relies of the timeout of the Lambda function to interrupt itself shortly before the specified deadline.
 	// This time interval is large enough to attempt a last flush attempt (if SendStrategy == syncFlush) before the environment gets shut down.
 	select {
-	case <-apmServerTransport.AgentDoneSignal:
+	case <-agentDoneSignal:
 		extension.Log.Debug("Received agent done signal")
 	case <-runtimeDone:
 		extension.Log.Debug("Received runtimeDone signal")
+		if !waitForAgentDone(agentDoneSignal, timer.C, quirks.AgentDoneWait) {
+			apmServerTransport.RecordFlushTimeout()
+		}
 	case <-timer.C:
 		extension.Log.Info("Time expired waiting for agent signal or runtimeDone event")
+		apmServerTransport.RecordFlushTimeout()
+		event.FlushDeadlineReached = true
 	}
 
+	invocationCancel()
+	logsProcessingWg.Wait()
 	return event
 }
+
+// shutdown gives the extension a last chance to send its data when the execution environment shuts down. It
+// drains the log events still sent by the Logs API, releases the agent data held by tail sampling, queues a
+// metricset holding the reason of the shutdown and flushes the buffered agent data, before the shutdown deadline.
+func shutdown(
+	ctx context.Context,
+	event *extension.NextEventResponse,
+	deadlineMargin time.Duration,
+	apmServerTransport *extension.ApmServerTransport,
+	logsTransport *logsapi.LogsTransport,
+	prevEvent *extension.NextEventResponse,
+	metadataContainer *extension.MetadataContainer,
+) {
+	shutdownCtx, cancel := context.WithDeadline(ctx, time.UnixMilli(event.DeadlineMs))
+	defer cancel()
+
+	// The drain leaves deadlineMargin for the last flush
+	var drained int
+	if logsTransport != nil {
+		drainCtx, drainCancel := context.WithTimeout(shutdownCtx, durationUntilFlushDeadline(event.DeadlineMs, deadlineMargin, time.Now()))
+		drained = logsapi.DrainLogs(drainCtx, event, apmServerTransport, logsTransport, metadataContainer, prevEvent, shutdownLogsIdleWait)
+		drainCancel()
+	}
+	// The agent data received while draining is not held past the shutdown
+	apmServerTransport.ApplyTailSampling()
+	apmServerTransport.ReportShutdown(metadataContainer, event, drained)
+	apmServerTransport.FlushAPMData(shutdownCtx, extension.NewFlushInfo(event))
+	apmServerTransport.LogDebugVars()
+}
+
+// waitForAgentDone keeps waiting for the agent done signal for at most wait after the end of the invocation was
+// reported by the runtime, for the agents that flush their data after the handler returned. It returns false if
+// the flush deadline was reached first.
+func waitForAgentDone(agentDoneSignal <-chan struct{}, flushDeadline <-chan time.Time, wait time.Duration) bool {
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-agentDoneSignal:
+		extension.Log.Debug("Received agent done signal after runtimeDone")
+	case <-timer.C:
+		extension.Log.Debug("Time expired waiting for agent signal after runtimeDone")
+	case <-flushDeadline:
+		extension.Log.Info("Time expired waiting for agent signal after runtimeDone")
+		return false
+	}
+	return true
+}
+
+// durationUntilFlushDeadline returns how long the extension can wait, as seen from now, for the current invocation
+// to end before attempting a last flush, margin before the deadline. The deadline is expressed in milliseconds since
+// the epoch, as received from the Extensions API. The returned duration is never negative, so that a deadline already
+// in the past (e.g. because of a clock skew between the Lambda service and the execution environment) results in an
+// immediate flush.
+func durationUntilFlushDeadline(deadlineMs int64, margin time.Duration, now time.Time) time.Duration {
+	flushDeadline := time.UnixMilli(deadlineMs).Add(-margin)
+	if remaining := flushDeadline.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// invocationSendStrategy returns the send strategy applied to the invocation described by event, which may differ
+// from the configured one for functions with a short timeout.
+func invocationSendStrategy(configured extension.SendStrategy, event *extension.NextEventResponse) extension.SendStrategy {
+	if event != nil && event.SendStrategy != "" {
+		return event.SendStrategy
+	}
+	return configured
+}
+
+// checkDelivery returns an error if agent data could not be delivered to the APM server during the invocation.
+// With the syncflush strategy, agent data still buffered after the final flush is also considered undelivered.
+func checkDelivery(transport *extension.ApmServerTransport, sendStrategy extension.SendStrategy) error {
+	if failures := transport.TakeDeliveryFailures(); failures > 0 {
+		return fmt.Errorf("%d agent data payloads could not be delivered to the APM server", failures)
+	}
+	if buffered := transport.BufferedDataCount(); sendStrategy == extension.SyncFlush && buffered > 0 {
+		return fmt.Errorf("%d agent data payloads are still buffered after the final flush", buffered)
+	}
+	return nil
+}
+
+// reportProxyFailure signals to the Extensions API that the Runtime API proxy could not start, before the
+// extension exits.
+func reportProxyFailure(ctx context.Context, err error) {
+	extension.Log.Errorf("Could not proxy the Runtime API, exiting: %v", err)
+	status, errRuntime := extensionClient.InitError(ctx, "Extension.RuntimeAPIProxyFailed")
+	if errRuntime != nil {
+		extension.Log.Errorf("Could not report the proxy failure to the Extensions API: %v", errRuntime)
+		return
+	}
+	extension.Log.Infof("Init error signal sent to runtime : %s", status)
+}
+
+// reportDeliveryFailure signals a telemetry delivery failure to the Extensions API, before the extension exits.
+func reportDeliveryFailure(ctx context.Context, err error) {
+	extension.Log.Errorf("Strict delivery mode, exiting: %v", err)
+	status, errRuntime := extensionClient.ExitError(ctx, "Extension.TelemetryDeliveryFailed")
+	if errRuntime != nil {
+		extension.Log.Errorf("Could not report the delivery failure to the Extensions API: %v", errRuntime)
+		return
+	}
+	extension.Log.Infof("Exit signal sent to runtime : %s", status)
+}
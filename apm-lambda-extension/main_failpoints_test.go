@@ -0,0 +1,103 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build failpoints
+// +build failpoints
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"elastic/apm-lambda-extension/failpoint"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFailpointRegister checks that a failed registration is reported to the Extensions API as an
+// initialization error, and that the extension exits.
+func TestFailpointRegister(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t)
+	lambdaServerInternals := newMockLambdaServer(t, eventsChannel)
+	t.Setenv(failpoint.EnvVar, "register=error")
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	assert.NotPanics(t, main)
+	assert.Contains(t, lambdaServerInternals.InitErrorType, "register failpoint")
+	assert.NotContains(t, apmServerInternals.Data, TimelyResponse)
+}
+
+// TestFailpointSubscribe checks that the agent data is still sent to the APM server when the subscription to
+// the Telemetry API fails, and only the platform metrics and the function logs are lost. Without the
+// runtimeDone event, the end of the invocation is only signaled by the agent.
+func TestFailpointSubscribe(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t)
+	newMockLambdaServer(t, eventsChannel)
+	t.Setenv(failpoint.EnvVar, "subscribe=error")
+	t.Setenv("ELASTIC_APM_AGENT_DONE_WAIT", "3s")
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandardFlush, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	assert.NotPanics(t, main)
+	assert.Contains(t, apmServerInternals.Data, TimelyResponse)
+}
+
+// TestFailpointPost checks that the extension neither panics nor blocks the invocations when the APM server is
+// unreachable, and that the function does not report an error.
+func TestFailpointPost(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t)
+	lambdaServerInternals := newMockLambdaServer(t, eventsChannel)
+	t.Setenv(failpoint.EnvVar, "post=error")
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	assert.NotPanics(t, main)
+	assert.NotContains(t, apmServerInternals.Data, TimelyResponse)
+	assert.Empty(t, lambdaServerInternals.ExitErrorType)
+}
+
+// TestFailpointFlush checks that the agent data of a failed flush stays buffered, and is sent by the next flush.
+func TestFailpointFlush(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t)
+	newMockLambdaServer(t, eventsChannel)
+	t.Setenv(failpoint.EnvVar, "flush=1*error")
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	assert.NotPanics(t, main)
+	assert.Equal(t, 2, strings.Count(apmServerInternals.Data, string(TimelyResponse)))
+}
@@ -0,0 +1,166 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build soak
+// +build soak
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"elastic/apm-lambda-extension/datagen"
+)
+
+const (
+	// soakInvocations is the number of invocations simulated during a soak test, i.e. a long-lived warm sandbox.
+	soakInvocations = 10000
+	// soakWarmupInvocations are simulated before the baseline is measured, so that buffers, connection pools and
+	// caches reach their steady state size.
+	soakWarmupInvocations = 1000
+	// soakSampleInterval is the number of invocations between two measurements.
+	soakSampleInterval = 1000
+	// soakMaxGoroutineGrowth absorbs the goroutines of the invocation in flight when a measurement is taken.
+	// A goroutine leaked per invocation would exceed it by several orders of magnitude.
+	soakMaxGoroutineGrowth = 25
+	// soakMaxRSSGrowthBytes is the tolerated growth of the resident set size over the baseline.
+	soakMaxRSSGrowthBytes = 32 * 1024 * 1024
+)
+
+type soakSample struct {
+	invocations int
+	goroutines  int
+	rssBytes    int64
+}
+
+// TestSoak runs the extension against the mock Lambda and APM servers for a large number of invocations, as happens
+// in a warm execution environment, and checks that the number of goroutines and the resident memory stay flat.
+// It is excluded from the default test run and is executed with `make soak-test`.
+func TestSoak(t *testing.T) {
+	initLogLevel(t, "error")
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(func() { apmServer.Close() })
+	t.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", apmServer.URL)
+	t.Setenv("ELASTIC_APM_SECRET_TOKEN", "none")
+
+	// The mock Lambda server sends a shutdown event as soon as the events channel is empty,
+	// so all the invocations are queued before starting the extension.
+	eventsChannel := make(chan MockEvent, soakInvocations)
+	newMockLambdaServer(t, eventsChannel)
+	payload := datagen.Batch(datagen.DefaultConfig())
+	for i := 0; i < soakInvocations; i++ {
+		eventsChannel <- MockEvent{Type: InvokeGeneratedPayload, ExecutionDuration: 0, Timeout: 5, Payload: payload}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		main()
+	}()
+
+	var samples []soakSample
+	nextSample := soakWarmupInvocations
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+			if invocations := soakInvocations - len(eventsChannel); invocations >= nextSample {
+				samples = append(samples, takeSoakSample(t, invocations))
+				nextSample += soakSampleInterval
+			}
+		}
+	}
+
+	if len(samples) < 2 {
+		t.Fatalf("Not enough samples taken during the soak test: %d", len(samples))
+	}
+	baseline := samples[0]
+	for _, sample := range samples {
+		t.Logf("%5d invocations: %4d goroutines, %6d KiB RSS", sample.invocations, sample.goroutines, sample.rssBytes/1024)
+	}
+	for _, sample := range samples[1:] {
+		if growth := sample.goroutines - baseline.goroutines; growth > soakMaxGoroutineGrowth {
+			t.Errorf("Goroutine count grew by %d between %d and %d invocations", growth, baseline.invocations, sample.invocations)
+		}
+		if growth := sample.rssBytes - baseline.rssBytes; growth > soakMaxRSSGrowthBytes {
+			t.Errorf("RSS grew by %d KiB between %d and %d invocations", growth/1024, baseline.invocations, sample.invocations)
+		}
+	}
+}
+
+func takeSoakSample(t *testing.T, invocations int) soakSample {
+	// Return the memory freed by the garbage collector to the OS, so that the RSS reflects live data.
+	debug.FreeOSMemory()
+	return soakSample{
+		invocations: invocations,
+		goroutines:  runtime.NumGoroutine(),
+		rssBytes:    residentSetSize(t),
+	}
+}
+
+// residentSetSize returns the resident set size of the process, as reported by procfs.
+// When procfs is not available, the memory obtained from the OS by the Go runtime is used instead.
+func residentSetSize(t *testing.T) int64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		return int64(memStats.Sys - memStats.HeapReleased)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("VmRSS:")) {
+			continue
+		}
+		// e.g. "VmRSS:	   12345 kB"
+		fields := strings.Fields(string(line))
+		if len(fields) < 2 {
+			break
+		}
+		kiB, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %v", line, err)
+		}
+		return kiB * 1024
+	}
+	t.Fatal("VmRSS not found in /proc/self/status")
+	return 0
+}
@@ -22,6 +22,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -32,12 +33,14 @@ import (
 	"testing"
 	"time"
 
+	"elastic/apm-lambda-extension/datagen"
 	e2eTesting "elastic/apm-lambda-extension/e2e-testing"
 	"elastic/apm-lambda-extension/extension"
 	"elastic/apm-lambda-extension/logsapi"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type MockEventType string
@@ -51,11 +54,15 @@ const (
 	InvokeLateFlush                    MockEventType = "LateFlush"
 	InvokeWaitgroupsRace               MockEventType = "InvokeWaitgroupsRace"
 	InvokeMultipleTransactionsOverload MockEventType = "MultipleTransactionsOverload"
+	InvokeGeneratedPayload             MockEventType = "GeneratedPayload"
+	InvokeLateData                     MockEventType = "LateData"
 	Shutdown                           MockEventType = "Shutdown"
 )
 
 type MockServerInternals struct {
 	Data                string
+	InitErrorType       string
+	ExitErrorType       string
 	WaitForUnlockSignal bool
 	UnlockSignalChannel chan struct{}
 	WaitGroup           sync.WaitGroup
@@ -75,6 +82,7 @@ type MockEvent struct {
 	APMServerBehavior APMServerBehavior
 	ExecutionDuration float64
 	Timeout           float64
+	Payload           []byte
 }
 
 type ApmInfo struct {
@@ -142,7 +150,7 @@ func newMockApmServer(t *testing.T) (*MockServerInternals, *httptest.Server) {
 	return &apmServerInternals, apmServer
 }
 
-func newMockLambdaServer(t *testing.T, eventsChannel chan MockEvent) *MockServerInternals {
+func newMockLambdaServer(t testing.TB, eventsChannel chan MockEvent) *MockServerInternals {
 	var lambdaServerInternals MockServerInternals
 	lambdaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.RequestURI {
@@ -173,9 +181,24 @@ func newMockLambdaServer(t *testing.T, eventsChannel chan MockEvent) *MockServer
 				sendNextEventInfo(w, currId, finalShutDown)
 				go processMockEvent(currId, finalShutDown, os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT"), &lambdaServerInternals)
 			}
+		case "/2020-01-01/extension/init/error":
+			lambdaServerInternals.InitErrorType = r.Header.Get("Lambda-Extension-Function-Error-Type")
+			if err := json.NewEncoder(w).Encode(extension.StatusResponse{Status: "OK"}); err != nil {
+				extension.Log.Fatalf("Could not encode init error response : %v", err)
+				return
+			}
+		case "/2020-01-01/extension/exit/error":
+			lambdaServerInternals.ExitErrorType = r.Header.Get("Lambda-Extension-Function-Error-Type")
+			if err := json.NewEncoder(w).Encode(extension.StatusResponse{Status: "OK"}); err != nil {
+				extension.Log.Fatalf("Could not encode exit error response : %v", err)
+				return
+			}
 		// Logs API subscription request
 		case "/2020-08-15/logs":
 			w.WriteHeader(http.StatusOK)
+		// Telemetry API subscription request
+		case "/2022-07-01/telemetry":
+			w.WriteHeader(http.StatusOK)
 		}
 	}))
 
@@ -192,12 +215,15 @@ func newMockLambdaServer(t *testing.T, eventsChannel chan MockEvent) *MockServer
 	}
 	t.Setenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT", fmt.Sprint(extensionPort))
 
+	// Isolate the data spilled to disk by each test
+	t.Setenv("TMPDIR", t.TempDir())
+
 	t.Cleanup(func() { lambdaServer.Close() })
 	return &lambdaServerInternals
 }
 
 // TODO : Move logger out of extension package and stop using it as a package-level variable
-func initLogLevel(t *testing.T, logLevel string) {
+func initLogLevel(t testing.TB, logLevel string) {
 	t.Setenv("ELASTIC_APM_LOG_LEVEL", logLevel)
 }
 
@@ -271,6 +297,33 @@ func processMockEvent(currId string, event MockEvent, extensionPort string, inte
 			}()
 		}
 		wg.Wait()
+	case InvokeGeneratedPayload:
+		time.Sleep(time.Duration(event.ExecutionDuration) * time.Second)
+		reqData, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/intake/v2/events?flushed=true", extensionPort), bytes.NewBuffer(event.Payload))
+		res, err := client.Do(reqData)
+		if err != nil {
+			extension.Log.Error(err.Error())
+			break
+		}
+		// Close the response body so that the connection is reused across invocations, as agents do.
+		res.Body.Close()
+	case InvokeLateData:
+		time.Sleep(time.Duration(event.ExecutionDuration) * time.Second)
+		reqData, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/intake/v2/events", extensionPort), bytes.NewBuffer([]byte(event.APMServerBehavior)))
+		if _, err := client.Do(reqData); err != nil {
+			extension.Log.Error(err.Error())
+		}
+		// The rest of the data is sent after the end of the invocation was reported. The next event is only
+		// sent to the extension once it is received.
+		internals.WaitGroup.Add(1)
+		go func() {
+			defer internals.WaitGroup.Done()
+			time.Sleep(100 * time.Millisecond)
+			reqLateData, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/intake/v2/events", extensionPort), bytes.NewBuffer(event.Payload))
+			if _, err := client.Do(reqLateData); err != nil {
+				extension.Log.Error(err.Error())
+			}
+		}()
 	case InvokeStandardInfo:
 		time.Sleep(time.Duration(event.ExecutionDuration) * time.Second)
 		req, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%s/", extensionPort), bytes.NewBuffer([]byte(event.APMServerBehavior)))
@@ -305,6 +358,7 @@ func sendNextEventInfo(w http.ResponseWriter, id string, event MockEvent) {
 	}
 	if event.Type == Shutdown {
 		nextEventInfo.EventType = "SHUTDOWN"
+		nextEventInfo.ShutdownReason = "spindown"
 	}
 
 	if err := json.NewEncoder(w).Encode(nextEventInfo); err != nil {
@@ -316,6 +370,9 @@ func sendLogEvent(requestId string, logEventType logsapi.SubEventType) {
 	record := logsapi.LogEventRecord{
 		RequestId: requestId,
 	}
+	if logEventType == logsapi.RuntimeDone {
+		record.Status = "success"
+	}
 	if logEventType == logsapi.Report {
 		record.Metrics = logsapi.PlatformMetrics{
 			BilledDurationMs: 60,
@@ -349,10 +406,12 @@ func sendLogEvent(requestId string, logEventType logsapi.SubEventType) {
 	host, port, _ := net.SplitHostPort(logsapi.TestListenerAddr.String())
 	req, _ := http.NewRequest("POST", "http://"+host+":"+port, bufLogEvent)
 	client := http.Client{}
-	if _, err := client.Do(req); err != nil {
+	res, err := client.Do(req)
+	if err != nil {
 		extension.Log.Errorf("Could not send log event : %v", err)
 		return
 	}
+	res.Body.Close()
 }
 
 func eventQueueGenerator(inputQueue []MockEvent, eventsChannel chan MockEvent) {
@@ -550,6 +609,61 @@ func TestFullChannelSlowAPMServer(t *testing.T) {
 	t.Setenv("ELASTIC_APM_SEND_STRATEGY", "syncflush")
 }
 
+// TestStrictDeliveryAPMServerDown checks that, in strict delivery mode, the extension reports an error to the
+// Extensions API when the APM data cannot be delivered.
+func TestStrictDeliveryAPMServerDown(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	_, apmServer := newMockApmServer(t)
+	lambdaServerInternals := newMockLambdaServer(t, eventsChannel)
+	t.Setenv("ELASTIC_APM_STRICT_DELIVERY", "true")
+
+	apmServer.Close()
+	eventsChain := []MockEvent{
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	assert.NotPanics(t, main)
+	assert.Equal(t, "Extension.TelemetryDeliveryFailed", lambdaServerInternals.ExitErrorType)
+}
+
+// TestStrictDelivery checks that strict delivery mode has no effect when the APM data is delivered.
+func TestStrictDelivery(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t)
+	lambdaServerInternals := newMockLambdaServer(t, eventsChannel)
+	t.Setenv("ELASTIC_APM_STRICT_DELIVERY", "true")
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	assert.NotPanics(t, main)
+	assert.Equal(t, 2, strings.Count(apmServerInternals.Data, string(TimelyResponse)))
+	assert.Empty(t, lambdaServerInternals.ExitErrorType)
+}
+
+// TestRuntimeAPIProxyFailure checks that the extension reports an initialization error to the Extensions API
+// when the Runtime API proxy cannot start, as the runtime would not be able to reach the Runtime API.
+func TestRuntimeAPIProxyFailure(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	newMockApmServer(t)
+	lambdaServerInternals := newMockLambdaServer(t, eventsChannel)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+	t.Setenv("ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY", "true")
+	t.Setenv("ELASTIC_APM_LAMBDA_RUNTIME_API_PROXY_PORT", port)
+
+	assert.NotPanics(t, main)
+	assert.Equal(t, "Extension.RuntimeAPIProxyFailed", lambdaServerInternals.InitErrorType)
+}
+
 // TestInfoRequest checks if the extension is able to retrieve APM server info (/ endpoint) (fast APM server, only one standard event)
 func TestInfoRequest(t *testing.T) {
 	initLogLevel(t, "trace")
@@ -601,6 +715,7 @@ func TestMetricsWithoutMetadata(t *testing.T) {
 	assert.Contains(t, apmServerInternals.Data, `aws.lambda.metrics.coldstart_duration":{"value":500`)
 	assert.Contains(t, apmServerInternals.Data, `aws.lambda.metrics.timeout":{"value":5000}`)
 	assert.Contains(t, apmServerInternals.Data, `system.memory.actual.free":{"value":7.1303168e+07`)
+	assert.Contains(t, apmServerInternals.Data, `aws.lambda.metrics.errors":{"value":0}`)
 	assert.Contains(t, apmServerInternals.Data, `system.memory.total":{"value":1.34217728e+08`)
 	assert.Contains(t, apmServerInternals.Data, `coldstart":true`)
 	assert.Contains(t, apmServerInternals.Data, `execution":`)
@@ -631,3 +746,183 @@ func TestMetricsWithMetadata(t *testing.T) {
 	assert.Contains(t, apmServerInternals.Data, `execution"`)
 	assert.Contains(t, apmServerInternals.Data, `id":"arn:aws:lambda:eu-central-1:627286350134:function:main_unit_test"`)
 }
+
+// TestShutdownFlush checks that the metrics of the last invocation, which are only received once the invocation is
+// over, are sent to the APM server when the execution environment shuts down, along with the shutdown reason.
+func TestShutdownFlush(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t)
+	newMockLambdaServer(t, eventsChannel)
+
+	eventsChain := []MockEvent{
+		{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 1, Timeout: 5},
+		{Type: Shutdown, Timeout: 2},
+	}
+	eventQueueGenerator(eventsChain, eventsChannel)
+	assert.NotPanics(t, main)
+
+	assert.Contains(t, apmServerInternals.Data, `aws.lambda.metrics.billed_duration":{"value":60`)
+	assert.Contains(t, apmServerInternals.Data, `"shutdown_reason":"spindown"`)
+}
+
+// TestShutdownFlushLateData checks that the data sent by the agent after the end of the last invocation was
+// reported is sent to the APM server when the execution environment shuts down, whatever the send strategy.
+func TestShutdownFlushLateData(t *testing.T) {
+	for _, sendStrategy := range []extension.SendStrategy{extension.SyncFlush, extension.Background} {
+		t.Run(string(sendStrategy), func(t *testing.T) {
+			initLogLevel(t, "trace")
+			t.Setenv("ELASTIC_APM_SEND_STRATEGY", string(sendStrategy))
+			eventsChannel := newTestStructs(t)
+			apmServerInternals, _ := newMockApmServer(t)
+			newMockLambdaServer(t, eventsChannel)
+
+			eventsChain := []MockEvent{
+				{Type: InvokeStandard, APMServerBehavior: TimelyResponse, ExecutionDuration: 0, Timeout: 5},
+				{Type: InvokeLateData, APMServerBehavior: TimelyResponse, ExecutionDuration: 0, Timeout: 5, Payload: []byte("LateData")},
+				{Type: Shutdown, Timeout: 2},
+			}
+			eventQueueGenerator(eventsChain, eventsChannel)
+			assert.NotPanics(t, main)
+
+			assert.Equal(t, 2, strings.Count(apmServerInternals.Data, string(TimelyResponse)))
+			assert.Equal(t, 1, strings.Count(apmServerInternals.Data, "LateData"))
+			assert.Equal(t, 2, strings.Count(apmServerInternals.Data, `aws.lambda.metrics.billed_duration"`))
+			assert.Contains(t, apmServerInternals.Data, `"shutdown_reason":"spindown"`)
+		})
+	}
+}
+
+// TestShutdownTailSampling checks that the agent data held by tail sampling, e.g. because it was received
+// while draining the log events at shutdown, is sent to the APM server when the execution environment shuts down.
+func TestShutdownTailSampling(t *testing.T) {
+	initLogLevel(t, "trace")
+	eventsChannel := newTestStructs(t)
+	apmServerInternals, _ := newMockApmServer(t)
+	newMockLambdaServer(t, eventsChannel)
+	t.Setenv("ELASTIC_APM_LAMBDA_TAIL_SAMPLING", "true")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	apmServerTransport := extension.InitApmServerTransport(extension.ProcessEnv(nil))
+	agentDataServer, err := extension.StartHttpServer(ctx, apmServerTransport)
+	require.NoError(t, err)
+	defer agentDataServer.Close()
+	res, err := http.Post(fmt.Sprintf("http://localhost:%s/intake/v2/events", os.Getenv("ELASTIC_APM_DATA_RECEIVER_SERVER_PORT")), "application/x-ndjson", strings.NewReader(string(TimelyResponse)))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Zero(t, apmServerTransport.BufferedDataCount())
+
+	event := &extension.NextEventResponse{
+		EventType:      extension.Shutdown,
+		DeadlineMs:     time.Now().Add(2 * time.Second).UnixMilli(),
+		ShutdownReason: "spindown",
+	}
+	shutdown(ctx, event, 0, apmServerTransport, nil, nil, extension.NewMetadataContainer(nil))
+	assert.Equal(t, 1, strings.Count(apmServerInternals.Data, string(TimelyResponse)))
+}
+
+// BenchmarkFullPipeline measures the overhead of the extension per function invocation : reception of the agent data,
+// processing of the Logs API events and synchronous flush to the APM server. Each benchmark iteration is an invocation.
+func BenchmarkFullPipeline(b *testing.B) {
+	initLogLevel(b, "error")
+
+	apmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	b.Cleanup(func() { apmServer.Close() })
+	b.Setenv("ELASTIC_APM_LAMBDA_APM_SERVER", apmServer.URL)
+	b.Setenv("ELASTIC_APM_SECRET_TOKEN", "none")
+
+	// The mock Lambda server sends a shutdown event as soon as the events channel is empty,
+	// so all the invocations are queued before starting the extension.
+	eventsChannel := make(chan MockEvent, b.N)
+	newMockLambdaServer(b, eventsChannel)
+	payload := datagen.Batch(datagen.DefaultConfig())
+	for i := 0; i < b.N; i++ {
+		eventsChannel <- MockEvent{Type: InvokeGeneratedPayload, ExecutionDuration: 0, Timeout: 5, Payload: payload}
+	}
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	main()
+}
+
+// TestDurationUntilFlushDeadline checks the computation of the time the extension waits for the end of an invocation.
+// The current time is injected, so that the test does not depend on the wall clock.
+func TestDurationUntilFlushDeadline(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	nowMs := now.UnixMilli()
+
+	tests := []struct {
+		name       string
+		deadlineMs int64
+		now        time.Time
+		expected   time.Duration
+	}{
+		{name: "Standard deadline", deadlineMs: nowMs + 5000, now: now, expected: 4900 * time.Millisecond},
+		{name: "Sub-second deadline", deadlineMs: nowMs + 750, now: now, expected: 650 * time.Millisecond},
+		{name: "Sub-200ms remaining time", deadlineMs: nowMs + 150, now: now, expected: 50 * time.Millisecond},
+		{name: "Remaining time within the margin", deadlineMs: nowMs + 80, now: now, expected: 0},
+		{name: "Remaining time equal to the margin", deadlineMs: nowMs + 100, now: now, expected: 0},
+		{name: "Deadline in the past", deadlineMs: nowMs - 2000, now: now, expected: 0},
+		{name: "Local clock behind the Lambda service", deadlineMs: nowMs + 1000, now: now.Add(-300 * time.Millisecond), expected: 1200 * time.Millisecond},
+		{name: "Local clock ahead of the Lambda service", deadlineMs: nowMs + 1000, now: now.Add(300 * time.Millisecond), expected: 600 * time.Millisecond},
+		{name: "Local clock ahead beyond the deadline", deadlineMs: nowMs + 1000, now: now.Add(2 * time.Second), expected: 0},
+		{name: "Millisecond precision", deadlineMs: nowMs + 1999, now: now.Add(500 * time.Microsecond), expected: 1898500 * time.Microsecond},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, durationUntilFlushDeadline(tc.deadlineMs, 100*time.Millisecond, tc.now))
+		})
+	}
+}
+
+// TestDurationUntilFlushDeadlinePrecision checks that the flush deadline keeps the millisecond precision of the
+// deadline received from the Extensions API, which used to be truncated to the second, so that the extension
+// stopped waiting for the invocation up to a second too early.
+func TestDurationUntilFlushDeadlinePrecision(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, offsetMs := range []int64{1001, 1500, 1999} {
+		deadlineMs := now.UnixMilli() + offsetMs
+		truncated := time.Unix((deadlineMs-100)/1000, 0).Sub(now)
+		remaining := durationUntilFlushDeadline(deadlineMs, 100*time.Millisecond, now)
+		assert.Equal(t, time.Duration(offsetMs-100)*time.Millisecond, remaining)
+		assert.Greater(t, remaining, truncated)
+	}
+}
+
+// TestWaitForAgentDone checks that the extension keeps waiting for the agent after runtimeDone, for at most the
+// configured duration.
+func TestWaitForAgentDone(t *testing.T) {
+	agentDone := make(chan struct{}, 1)
+	flushDeadline := make(chan time.Time)
+
+	start := time.Now()
+	waitForAgentDone(agentDone, flushDeadline, 0)
+	waitForAgentDone(agentDone, flushDeadline, 50*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	agentDone <- struct{}{}
+	start = time.Now()
+	assert.True(t, waitForAgentDone(agentDone, flushDeadline, time.Minute))
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(flushDeadline)
+	start = time.Now()
+	assert.False(t, waitForAgentDone(agentDone, flushDeadline, time.Minute))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// TestInvocationSendStrategy checks that the send strategy applied to an invocation takes precedence over the
+// configured one.
+func TestInvocationSendStrategy(t *testing.T) {
+	assert.Equal(t, extension.SyncFlush, invocationSendStrategy(extension.SyncFlush, nil))
+	assert.Equal(t, extension.SyncFlush, invocationSendStrategy(extension.SyncFlush, &extension.NextEventResponse{EventType: extension.Shutdown}))
+	assert.Equal(t, extension.Background, invocationSendStrategy(extension.SyncFlush, &extension.NextEventResponse{SendStrategy: extension.Background}))
+}